@@ -1,25 +1,36 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
+	"pc_cloud/internal/config"
+	"pc_cloud/internal/logging"
 	"pc_cloud/internal/server"
 	"pc_cloud/internal/ui"
 	"pc_cloud/internal/webrtcx"
 )
 
-var logFile *os.File
-
 func main() {
-	setupLogging()
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "config:", err)
+		os.Exit(2)
+	}
+	logFile := setupLogging(cfg)
 	defer logFile.Close()
 
-	go startHTTPServer()
+	go cfg.Watch(context.Background(), 2*time.Second)
+
+	go startHTTPServer(cfg)
 
 	// Start tray
-	ui.StartTray(ui.Callbacks{
+	ui.StartTray(settingsURL(cfg.Get()), ui.Callbacks{
 		OnRestart: func() {
 			log.Println("Restart triggered from tray")
 			// Simple restart: exec new process and exit
@@ -31,16 +42,20 @@ func main() {
 	})
 }
 
-func startHTTPServer() {
-	mgr := webrtcx.New()
-	srv := server.New(mgr)
-	addr := ":8080"
+func startHTTPServer(cfg *config.Store) {
+	mgr := webrtcx.New(cfg)
+	srv := server.New(mgr, cfg)
+	addr := cfg.Get().ListenAddr
 	log.Printf("PCloud server listening on %s", addr)
 	if err := http.ListenAndServe(addr, srv); err != nil {
 		log.Fatal(err)
 	}
 }
 
+func settingsURL(c config.Config) string {
+	return fmt.Sprintf("http://localhost:%d/settings", c.Port())
+}
+
 func restartServer() {
 	exe, err := os.Executable()
 	if err != nil {
@@ -54,12 +69,22 @@ func restartServer() {
 	os.Exit(0)
 }
 
-func setupLogging() {
-	var err error
-	logFile, err = os.OpenFile("pcloud.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+func setupLogging(cfg *config.Store) io.Closer {
+	c := cfg.Get()
+	f, err := logging.Setup(logging.Options{
+		Dir:        c.LogDir,
+		Level:      c.LogLevel,
+		MaxSize:    int64(c.LogMaxSizeMB) << 20,
+		MaxAge:     time.Duration(c.LogMaxAgeDays) * 24 * time.Hour,
+		MaxBackups: c.LogMaxBackups,
+	})
 	if err != nil {
 		panic("Failed to open log file: " + err.Error())
 	}
-	log.SetOutput(logFile)
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	cfg.OnChange(func(prev, next config.Config) {
+		if prev.LogLevel != next.LogLevel {
+			_ = logging.SetLevel(next.LogLevel)
+		}
+	})
+	return f
 }
@@ -0,0 +1,50 @@
+// Package bitstream parses H.264 and H.265 elementary streams (Annex-B
+// framing, access-unit boundaries, emulation prevention), AV1 OBUs and VP9
+// frames, and the fields of the sequence parameter set, sequence header or
+// key frame header the server cares about.
+package bitstream
+
+import "bytes"
+
+var (
+	startCode   = []byte{0, 0, 1}
+	emulation03 = []byte{0, 0, 3}
+)
+
+// Split appends the NAL units in b to dst[:0], without their start codes,
+// and returns it. The slices alias b. Bytes before the first start code are
+// dropped, as are the zero bytes that make a start code 4 bytes long.
+func Split(b []byte, dst [][]byte) [][]byte {
+	dst = dst[:0]
+	i := bytes.Index(b, startCode)
+	if i < 0 {
+		return dst
+	}
+	start := i + 3
+	for {
+		j := bytes.Index(b[start:], startCode)
+		if j < 0 {
+			return append(dst, b[start:])
+		}
+		end := start + j
+		for end > start && b[end-1] == 0 {
+			end--
+		}
+		dst = append(dst, b[start:end])
+		start += j + 3
+	}
+}
+
+// Unescape appends the RBSP of a NAL unit to dst[:0], i.e. src with every
+// emulation prevention byte (the 03 in 00 00 03) removed.
+func Unescape(dst, src []byte) []byte {
+	dst = dst[:0]
+	for {
+		i := bytes.Index(src, emulation03)
+		if i < 0 {
+			return append(dst, src...)
+		}
+		dst = append(dst, src[:i+2]...)
+		src = src[i+3:]
+	}
+}
@@ -0,0 +1,195 @@
+package bitstream
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"reflect"
+	"testing"
+)
+
+// legacySplit is the start-code scanner the webrtcx pumps used before this
+// package, kept as the reference for the fuzz tests and benchmarks.
+func legacySplit(b []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+	for i := 0; i+2 < len(b); i++ {
+		if b[i] != 0 || b[i+1] != 0 || b[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			for end > start && b[end-1] == 0 {
+				end--
+			}
+			nals = append(nals, b[start:end])
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 {
+		nals = append(nals, b[start:])
+	}
+	return nals
+}
+
+// unescapeBytewise is Unescape written the obvious way.
+func unescapeBytewise(src []byte) []byte {
+	out := []byte{}
+	zeros := 0
+	for _, c := range src {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		out = append(out, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// escape inserts emulation prevention bytes, the inverse of Unescape.
+func escape(rbsp []byte) []byte {
+	var out []byte
+	zeros := 0
+	for _, c := range rbsp {
+		if zeros >= 2 && c <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+func annexB(nals ...[]byte) []byte {
+	var b []byte
+	for i, n := range nals {
+		if i == 0 {
+			b = append(b, 0) // 4-byte start code first, as encoders write it
+		}
+		b = append(b, 0, 0, 1)
+		b = append(b, n...)
+	}
+	return b
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want [][]byte
+	}{
+		{"empty", nil, nil},
+		{"no start code", []byte{1, 2, 3}, nil},
+		{"one", []byte{0, 0, 0, 1, 0x65, 1, 2}, [][]byte{{0x65, 1, 2}}},
+		{"leading garbage", []byte{9, 9, 0, 0, 1, 0x41}, [][]byte{{0x41}}},
+		{"mixed start codes", []byte{0, 0, 1, 0x67, 1, 0, 0, 0, 1, 0x68, 2, 0, 0, 1, 0x65}, [][]byte{{0x67, 1}, {0x68, 2}, {0x65}}},
+		{"trailing zeros stripped", []byte{0, 0, 1, 0x06, 5, 0, 0, 0, 0, 0, 1, 0x65}, [][]byte{{0x06, 5}, {0x65}}},
+		{"empty nal", []byte{0, 0, 1, 0, 0, 1, 0x65}, [][]byte{{}, {0x65}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Split(tt.in, nil); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Split = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnescape(t *testing.T) {
+	tests := []struct{ in, want []byte }{
+		{[]byte{1, 2, 3}, []byte{1, 2, 3}},
+		{[]byte{0, 0, 3, 1}, []byte{0, 0, 1}},
+		{[]byte{0, 0, 3, 0, 0, 3, 0}, []byte{0, 0, 0, 0, 0}},
+		{[]byte{0, 3, 0, 0, 3}, []byte{0, 3, 0, 0}},
+		{[]byte{0, 0, 3}, []byte{0, 0}},
+	}
+	for _, tt := range tests {
+		if got := Unescape(nil, tt.in); !bytes.Equal(got, tt.want) {
+			t.Errorf("Unescape(%x) = %x, want %x", tt.in, got, tt.want)
+		}
+	}
+}
+
+func FuzzSplit(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 1, 0x67, 0, 0, 1, 0x68, 0, 0, 0, 0, 1, 0x65})
+	f.Add([]byte{0, 0, 1, 0, 0, 1, 0, 0})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		got := Split(b, nil)
+		want := legacySplit(b)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Split(%x) = %x, legacy %x", b, got, want)
+		}
+	})
+}
+
+func FuzzUnescape(f *testing.F) {
+	f.Add([]byte{0, 0, 3, 0, 0, 3, 1})
+	f.Add([]byte{0, 0, 0, 3, 3})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		got := Unescape(nil, b)
+		if want := unescapeBytewise(b); !bytes.Equal(got, want) {
+			t.Fatalf("Unescape(%x) = %x, want %x", b, got, want)
+		}
+		if rt := Unescape(nil, escape(b)); !bytes.Equal(rt, b) {
+			t.Fatalf("Unescape(escape(%x)) = %x", b, rt)
+		}
+	})
+}
+
+// benchFrame is a 4K-sized access unit: parameter sets, an SEI and eight
+// 96 KiB slices of incompressible data.
+func benchFrame() []byte {
+	rng := rand.New(rand.NewPCG(1, 2))
+	slice := func(hdr byte) []byte {
+		b := make([]byte, 96<<10)
+		for i := range b {
+			b[i] = byte(rng.IntN(255) + 1) // no zeros, so no false start codes
+		}
+		b[0], b[1] = hdr, 0x88
+		return b
+	}
+	nals := [][]byte{{0x67, 0x64, 0, 0x33}, {0x68, 0xee, 0x3c, 0x80}, {0x06, 5, 16}}
+	for i := 0; i < 8; i++ {
+		nals = append(nals, slice(0x65))
+	}
+	return annexB(nals...)
+}
+
+func BenchmarkSplit(b *testing.B) {
+	frame := benchFrame()
+	var dst [][]byte
+	b.SetBytes(int64(len(frame)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dst = Split(frame, dst)
+	}
+}
+
+func BenchmarkSplitLegacy(b *testing.B) {
+	frame := benchFrame()
+	b.SetBytes(int64(len(frame)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		legacySplit(frame)
+	}
+}
+
+func BenchmarkUnescape(b *testing.B) {
+	src := escape(bytes.Repeat([]byte{0, 0, 1, 0x55, 0x21}, 20<<10))
+	var dst []byte
+	b.SetBytes(int64(len(src)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dst = Unescape(dst, src)
+	}
+}
@@ -0,0 +1,215 @@
+package bitstream
+
+// Codec selects the NAL unit syntax.
+type Codec int
+
+const (
+	H264 Codec = iota
+	H265
+)
+
+// H.264 NAL unit types (Table 7-1) used here.
+const (
+	H264Slice = 1
+	H264IDR   = 5
+	H264SEI   = 6
+	H264SPS   = 7
+	H264PPS   = 8
+	H264AUD   = 9
+)
+
+// H.265 NAL unit types (Table 7-1) used here.
+const (
+	H265IDRWRADL  = 19
+	H265IDRNLP    = 20
+	H265CRA       = 21
+	H265VPS       = 32
+	H265SPS       = 33
+	H265PPS       = 34
+	H265AUD       = 35
+	H265PrefixSEI = 39
+)
+
+// NALType returns the nal_unit_type of nal, or -1 if the header is
+// truncated or the forbidden_zero_bit is set.
+func (c Codec) NALType(nal []byte) int {
+	if c == H265 {
+		if len(nal) < 2 || nal[0]&0x80 != 0 {
+			return -1
+		}
+		return int(nal[0]>>1) & 0x3F
+	}
+	if len(nal) < 1 || nal[0]&0x80 != 0 {
+		return -1
+	}
+	return int(nal[0] & 0x1F)
+}
+
+// IsVCL reports whether nal carries slice data.
+func (c Codec) IsVCL(nal []byte) bool {
+	t := c.NALType(nal)
+	if c == H265 {
+		return t >= 0 && t < 32
+	}
+	return t >= 1 && t <= 5
+}
+
+// IsKeyframe reports whether nal is a slice of a picture a decoder can
+// start from: IDR for H.264, IRAP without leading-picture dependencies for
+// H.265.
+func (c Codec) IsKeyframe(nal []byte) bool {
+	t := c.NALType(nal)
+	if c == H265 {
+		return t == H265IDRWRADL || t == H265IDRNLP || t == H265CRA
+	}
+	return t == H264IDR
+}
+
+// seiRecoveryPoint is the payloadType of a recovery point SEI message in
+// both codecs (H.264 D.1.8, H.265 D.2.8).
+const seiRecoveryPoint = 6
+
+// IsRecoveryPoint reports whether nal is an SEI NAL unit with a recovery
+// point message. Encoders doing gradual intra refresh send one with the
+// first picture of every refresh; a decoder can start there and has a
+// clean picture once the refresh is complete.
+func (c Codec) IsRecoveryPoint(nal []byte) bool {
+	hdr, sei := 1, H264SEI
+	if c == H265 {
+		hdr, sei = 2, H265PrefixSEI
+	}
+	if c.NALType(nal) != sei || len(nal) <= hdr {
+		return false
+	}
+	rbsp := Unescape(nil, nal[hdr:])
+	// sei_message()s until the rbsp_trailing_bits
+	for len(rbsp) > 0 && rbsp[0] != 0x80 {
+		typ, n := seiValue(rbsp)
+		if n == 0 {
+			return false
+		}
+		if typ == seiRecoveryPoint {
+			return true
+		}
+		size, m := seiValue(rbsp[n:])
+		if m == 0 || n+m+size > len(rbsp) {
+			return false
+		}
+		rbsp = rbsp[n+m+size:]
+	}
+	return false
+}
+
+// seiValue decodes the payloadType or payloadSize at the start of b: a run
+// of 0xFF bytes adding 255 each, then a final byte. It returns the value and
+// its length in bytes, 0 if b is truncated.
+func seiValue(b []byte) (int, int) {
+	v := 0
+	for i, x := range b {
+		v += int(x)
+		if x != 0xFF {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// Parameter set kinds returned by ParamSet.
+const (
+	ParamVPS = iota
+	ParamSPS
+	ParamPPS
+)
+
+// ParamSet returns ParamVPS, ParamSPS or ParamPPS if nal is that parameter
+// set, and -1 otherwise. H.264 has no VPS.
+func (c Codec) ParamSet(nal []byte) int {
+	t := c.NALType(nal)
+	if c == H265 {
+		switch t {
+		case H265VPS:
+			return ParamVPS
+		case H265SPS:
+			return ParamSPS
+		case H265PPS:
+			return ParamPPS
+		}
+		return -1
+	}
+	switch t {
+	case H264SPS:
+		return ParamSPS
+	case H264PPS:
+		return ParamPPS
+	}
+	return -1
+}
+
+// IsAUD reports whether nal is an access unit delimiter.
+func (c Codec) IsAUD(nal []byte) bool {
+	if c == H265 {
+		return c.NALType(nal) == H265AUD
+	}
+	return c.NALType(nal) == H264AUD
+}
+
+// firstSliceOfPicture reports whether VCL nal starts a new picture:
+// first_mb_in_slice == 0 (H.264) or first_slice_segment_in_pic_flag (H.265).
+// Both are the first bit after the NAL header, as ue(v) codes 0 as "1".
+func (c Codec) firstSliceOfPicture(nal []byte) bool {
+	hdr := 1
+	if c == H265 {
+		hdr = 2
+	}
+	return len(nal) > hdr && nal[hdr]&0x80 != 0
+}
+
+// startsAU reports whether nal, following a VCL NAL, opens the next access
+// unit (H.264 7.4.1.2.3, H.265 7.4.2.4.4).
+func (c Codec) startsAU(nal []byte) bool {
+	if c.IsVCL(nal) {
+		return c.firstSliceOfPicture(nal)
+	}
+	t := c.NALType(nal)
+	if c == H265 {
+		return t >= H265VPS && t <= H265AUD || t == H265PrefixSEI || t >= 41 && t <= 44 || t >= 48 && t <= 55
+	}
+	return t >= H264SEI && t <= H264AUD || t >= 14 && t <= 18
+}
+
+// AUSplitter groups a stream of NAL units into access units, from the slice
+// headers and the NAL types that may only open one, so it works without
+// AUDs.
+type AUSplitter struct {
+	codec Codec
+	cur   [][]byte
+	done  [][]byte
+	vcl   bool // cur has a VCL NAL
+}
+
+func NewAUSplitter(c Codec) *AUSplitter { return &AUSplitter{codec: c} }
+
+// Push adds nal. If nal opens a new access unit, the previous one is
+// returned; it stays valid until the next call. nal is not copied.
+func (s *AUSplitter) Push(nal []byte) [][]byte {
+	var out [][]byte
+	if s.vcl && s.codec.startsAU(nal) {
+		out = s.Flush()
+	}
+	s.cur = append(s.cur, nal)
+	if s.codec.IsVCL(nal) {
+		s.vcl = true
+	}
+	return out
+}
+
+// Flush returns the pending access unit, if any, e.g. at the end of a
+// container packet that is known to end one.
+func (s *AUSplitter) Flush() [][]byte {
+	if len(s.cur) == 0 {
+		return nil
+	}
+	s.done, s.cur = s.cur, s.done[:0]
+	s.vcl = false
+	return s.done
+}
@@ -0,0 +1,108 @@
+package bitstream
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestAUSplitterH264(t *testing.T) {
+	sps := []byte{0x67, 0x64}
+	pps := []byte{0x68, 0xee}
+	sei := []byte{0x06, 0x05}
+	idr0 := []byte{0x65, 0x88} // first_mb_in_slice = 0
+	idr1 := []byte{0x65, 0x40} // first_mb_in_slice = 1
+	p0 := []byte{0x41, 0x9a}
+	p1 := []byte{0x41, 0x20}
+	aud := []byte{0x09, 0xf0}
+
+	s := NewAUSplitter(H264)
+	var aus [][][]byte
+	for _, n := range [][]byte{sps, pps, sei, idr0, idr1, p0, p1, aud, p0, sei, p0} {
+		if au := s.Push(n); au != nil {
+			aus = append(aus, append([][]byte(nil), au...))
+		}
+	}
+	aus = append(aus, s.Flush())
+	want := [][][]byte{{sps, pps, sei, idr0, idr1}, {p0, p1}, {aud, p0}, {sei, p0}}
+	if !reflect.DeepEqual(aus, want) {
+		t.Errorf("got %x\nwant %x", aus, want)
+	}
+}
+
+func TestAUSplitterH265(t *testing.T) {
+	vps := []byte{0x40, 0x01}
+	sps := []byte{0x42, 0x01}
+	pps := []byte{0x44, 0x01}
+	idrFirst := []byte{0x26, 0x01, 0xaf} // IDR_W_RADL, first_slice_segment_in_pic_flag
+	idrNext := []byte{0x26, 0x01, 0x20}
+	trail := []byte{0x02, 0x01, 0xd0}
+	suffixSEI := []byte{0x50, 0x01, 0x05}
+
+	s := NewAUSplitter(H265)
+	var aus [][][]byte
+	for _, n := range [][]byte{vps, sps, pps, idrFirst, idrNext, suffixSEI, trail, trail} {
+		if au := s.Push(n); au != nil {
+			aus = append(aus, append([][]byte(nil), au...))
+		}
+	}
+	aus = append(aus, s.Flush())
+	want := [][][]byte{{vps, sps, pps, idrFirst, idrNext, suffixSEI}, {trail}, {trail}}
+	if !reflect.DeepEqual(aus, want) {
+		t.Errorf("got %x\nwant %x", aus, want)
+	}
+}
+
+func TestIsRecoveryPoint(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec Codec
+		nal   []byte
+		want  bool
+	}{
+		{"h264 recovery point", H264, []byte{0x06, 0x06, 0x01, 0xc4, 0x80}, true},
+		{"h264 after user data", H264, []byte{0x06, 0x05, 0x02, 0xaa, 0xbb, 0x06, 0x01, 0xc4, 0x80}, true},
+		{"h264 escaped payload", H264, []byte{0x06, 0x05, 0x03, 0x00, 0x00, 0x03, 0x01, 0x06, 0x01, 0xc4, 0x80}, true},
+		{"h264 user data only", H264, []byte{0x06, 0x05, 0x01, 0xaa, 0x80}, false},
+		{"h264 type 256", H264, []byte{0x06, 0xff, 0x01, 0x00, 0x80}, false},
+		{"h264 truncated payload", H264, []byte{0x06, 0x05, 0x09, 0xaa}, false},
+		{"h264 truncated type", H264, []byte{0x06, 0xff}, false},
+		{"h264 slice", H264, []byte{0x65, 0x06, 0x01}, false},
+		{"h265 prefix sei", H265, []byte{0x4e, 0x01, 0x06, 0x01, 0xc4, 0x80}, true},
+		{"h265 suffix sei", H265, []byte{0x50, 0x01, 0x06, 0x01, 0xc4, 0x80}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.codec.IsRecoveryPoint(tt.nal); got != tt.want {
+			t.Errorf("%s: IsRecoveryPoint(%x) = %v, want %v", tt.name, tt.nal, got, tt.want)
+		}
+	}
+}
+
+func FuzzAUSplitter(f *testing.F) {
+	f.Add(annexB([]byte{0x67, 0x64}, []byte{0x68, 0xee}, []byte{0x65, 0x88}, []byte{0x41, 0x9a}), false)
+	f.Add(annexB([]byte{0x40, 0x01}, []byte{0x26, 0x01, 0xaf}, []byte{0x02, 0x01, 0xd0}), true)
+	f.Fuzz(func(t *testing.T, b []byte, hevc bool) {
+		c := H264
+		if hevc {
+			c = H265
+		}
+		nals := Split(b, nil)
+		s := NewAUSplitter(c)
+		var got [][]byte
+		for _, n := range nals {
+			for _, au := range s.Push(n) {
+				got = append(got, au)
+			}
+		}
+		got = append(got, s.Flush()...)
+		// every NAL comes out exactly once and in order
+		if len(got) != len(nals) {
+			t.Fatalf("%d NALs in, %d out", len(nals), len(got))
+		}
+		for i := range nals {
+			if !bytes.Equal(got[i], nals[i]) {
+				t.Fatalf("NAL %d changed", i)
+			}
+		}
+	})
+}
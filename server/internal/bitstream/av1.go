@@ -0,0 +1,277 @@
+package bitstream
+
+import (
+	"errors"
+	"fmt"
+)
+
+// AV1 OBU types (Section 6.2.2) used here.
+const (
+	OBUSequenceHeader       = 1
+	OBUTemporalDelimiter    = 2
+	OBUFrameHeader          = 3
+	OBUTileGroup            = 4
+	OBUMetadata             = 5
+	OBUFrame                = 6
+	OBURedundantFrameHeader = 7
+	OBUTileList             = 8
+	OBUPadding              = 15
+)
+
+// OBUHeader is the obu_header of an AV1 OBU plus its size field.
+type OBUHeader struct {
+	Type     int
+	Extended bool // has an extension header, i.e. temporal/spatial layer ids
+	Len      int  // bytes of header and size field
+	Size     int  // payload bytes, -1 if the OBU has no size field
+}
+
+// ParseOBUHeader parses the header at the start of b.
+func ParseOBUHeader(b []byte) (OBUHeader, error) {
+	if len(b) < 1 {
+		return OBUHeader{}, errShort
+	}
+	if b[0]&0x80 != 0 {
+		return OBUHeader{}, errors.New("av1: forbidden bit set")
+	}
+	h := OBUHeader{Type: int(b[0] >> 3 & 0x0F), Extended: b[0]&0x04 != 0, Len: 1, Size: -1}
+	if h.Extended {
+		h.Len++
+	}
+	if len(b) < h.Len {
+		return OBUHeader{}, errShort
+	}
+	if b[0]&0x02 != 0 {
+		v, n, err := leb128(b[h.Len:])
+		if err != nil {
+			return OBUHeader{}, err
+		}
+		h.Len += n
+		h.Size = int(v)
+	}
+	return h, nil
+}
+
+// leb128 decodes an unsigned LEB128 value of at most 8 bytes (Section 4.10.5).
+func leb128(b []byte) (uint64, int, error) {
+	var v uint64
+	for i := 0; i < 8; i++ {
+		if i >= len(b) {
+			return 0, 0, errShort
+		}
+		v |= uint64(b[i]&0x7F) << (7 * i)
+		if b[i]&0x80 == 0 {
+			if v > 1<<32-1 {
+				return 0, 0, errors.New("av1: obu_size out of range")
+			}
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, errors.New("av1: leb128 longer than 8 bytes")
+}
+
+func appendLEB128(dst []byte, v uint64) []byte {
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+// OBU is one OBU of a low-overhead bitstream (Section 5.2).
+type OBU struct {
+	OBUHeader
+	Raw     []byte // header, size field and payload
+	Payload []byte
+}
+
+// SplitOBUs appends the OBUs in b to dst[:0] and returns it. The slices
+// alias b. Only the last OBU may lack a size field; it then runs to the end
+// of b, as in an IVF frame.
+func SplitOBUs(b []byte, dst []OBU) ([]OBU, error) {
+	dst = dst[:0]
+	for len(b) > 0 {
+		h, err := ParseOBUHeader(b)
+		if err != nil {
+			return dst, err
+		}
+		if h.Size < 0 {
+			h.Size = len(b) - h.Len
+		}
+		end := h.Len + h.Size
+		if end > len(b) {
+			return dst, fmt.Errorf("av1: obu_size %d past the end of the buffer", h.Size)
+		}
+		dst = append(dst, OBU{OBUHeader: h, Raw: b[:end], Payload: b[h.Len:end]})
+		b = b[end:]
+	}
+	return dst, nil
+}
+
+// AppendOBU appends o to dst with obu_has_size_field set, so OBUs taken from
+// different buffers can be concatenated.
+func AppendOBU(dst []byte, o OBU) []byte {
+	if o.Raw[0]&0x02 != 0 {
+		return append(dst, o.Raw...)
+	}
+	hdr := 1
+	if o.Extended {
+		hdr = 2
+	}
+	dst = append(dst, o.Raw[0]|0x02)
+	dst = append(dst, o.Raw[1:hdr]...)
+	dst = appendLEB128(dst, uint64(len(o.Payload)))
+	return append(dst, o.Payload...)
+}
+
+// SequenceHeader holds the AV1 sequence header fields the server uses, in
+// the terms of SPS. Level is seq_level_idx of the first operating point;
+// Width and Height are the maximum frame size.
+type SequenceHeader struct {
+	SPS
+	ReducedStillPicture bool
+}
+
+// ParseSequenceHeader parses the payload of an OBU_SEQUENCE_HEADER, up to
+// and including color_config (Section 5.5).
+func ParseSequenceHeader(payload []byte) (SequenceHeader, error) {
+	r := &bitReader{b: payload}
+	var h SequenceHeader
+	h.Profile = int(r.u(3))
+	r.skip(1) // still_picture
+	h.ReducedStillPicture = r.flag()
+	if h.ReducedStillPicture {
+		h.Level = int(r.u(5))
+	} else {
+		decoderModel := false
+		bufferDelayLen := 0
+		if r.flag() { // timing_info_present_flag
+			r.skip(32 + 32) // num_units_in_display_tick, time_scale
+			if r.flag() {   // equal_picture_interval
+				r.uvlc() // num_ticks_per_picture_minus_1
+			}
+			decoderModel = r.flag()
+			if decoderModel {
+				bufferDelayLen = int(r.u(5)) + 1
+				r.skip(32 + 5 + 5) // num_units_in_decoding_tick, removal/presentation time lengths
+			}
+		}
+		initialDelay := r.flag()
+		ops := int(r.u(5)) + 1
+		for i := 0; i < ops && r.err == nil; i++ {
+			r.skip(12) // operating_point_idc
+			level := int(r.u(5))
+			if i == 0 {
+				h.Level = level
+			}
+			if level > 7 {
+				r.skip(1) // seq_tier
+			}
+			if decoderModel && r.flag() {
+				r.skip(2*bufferDelayLen + 1) // decoder/encoder_buffer_delay, low_delay_mode_flag
+			}
+			if initialDelay && r.flag() {
+				r.skip(4) // initial_display_delay_minus_1
+			}
+		}
+	}
+	wBits, hBits := int(r.u(4))+1, int(r.u(4))+1
+	h.Width = int(r.u(wBits)) + 1
+	h.Height = int(r.u(hBits)) + 1
+	if !h.ReducedStillPicture && r.flag() { // frame_id_numbers_present_flag
+		r.skip(4 + 3)
+	}
+	r.skip(3) // use_128x128_superblock, enable_filter_intra, enable_intra_edge_filter
+	if !h.ReducedStillPicture {
+		r.skip(4) // interintra, masked compound, warped motion, dual filter
+		orderHint := r.flag()
+		if orderHint {
+			r.skip(2) // enable_jnt_comp, enable_ref_frame_mvs
+		}
+		forceSCT := 1
+		if !r.flag() { // seq_choose_screen_content_tools
+			forceSCT = int(r.u(1))
+		}
+		if forceSCT > 0 && !r.flag() { // seq_choose_integer_mv
+			r.skip(1) // seq_force_integer_mv
+		}
+		if orderHint {
+			r.skip(3) // order_hint_bits_minus_1
+		}
+	}
+	r.skip(3) // enable_superres, enable_cdef, enable_restoration
+	h.parseColorConfig(r)
+	if r.err != nil {
+		return SequenceHeader{}, fmt.Errorf("av1 sequence header: %w", r.err)
+	}
+	return h, nil
+}
+
+// parseColorConfig reads color_config (Section 5.5.2).
+func (h *SequenceHeader) parseColorConfig(r *bitReader) {
+	h.BitDepthLuma = 8
+	if r.flag() { // high_bitdepth
+		h.BitDepthLuma = 10
+		if h.Profile == 2 && r.flag() { // twelve_bit
+			h.BitDepthLuma = 12
+		}
+	}
+	h.BitDepthChroma = h.BitDepthLuma
+	mono := h.Profile != 1 && r.flag()
+	if r.flag() { // color_description_present_flag
+		h.Color.Primaries, h.Color.Transfer, h.Color.Matrix = int(r.u(8)), int(r.u(8)), int(r.u(8))
+	}
+	switch {
+	case mono:
+		h.ChromaFormat = 0
+		h.Color.FullRange = r.flag()
+		return
+	case h.Color == Color{Primaries: 1, Transfer: 13, Matrix: 0}: // sRGB
+		h.ChromaFormat = 3
+		h.Color.FullRange = true
+		return
+	}
+	h.Color.FullRange = r.flag()
+	ssx, ssy := true, true
+	switch {
+	case h.Profile == 1:
+		ssx, ssy = false, false
+	case h.Profile == 2 && h.BitDepthLuma == 12:
+		ssx = r.flag()
+		ssy = ssx && r.flag()
+	case h.Profile == 2:
+		ssy = false
+	}
+	switch {
+	case ssx && ssy:
+		h.ChromaFormat = 1
+		r.skip(2) // chroma_sample_position
+	case ssx:
+		h.ChromaFormat = 2
+	default:
+		h.ChromaFormat = 3
+	}
+}
+
+// FrameType reads the start of the uncompressed header in the payload of
+// an OBU_FRAME or OBU_FRAME_HEADER: whether the frame is a key frame and
+// whether it is shown, which ends its temporal unit. A shown existing frame
+// is reported as shown but not key.
+func (h SequenceHeader) FrameType(payload []byte) (key, shown bool, err error) {
+	if h.ReducedStillPicture {
+		return true, true, nil
+	}
+	r := &bitReader{b: payload}
+	if r.flag() { // show_existing_frame
+		return false, true, r.err
+	}
+	key = r.u(2) == 0 // KEY_FRAME
+	shown = r.flag()
+	return key, shown, r.err
+}
+
+// ShowsExistingFrame reports whether the frame header in payload only
+// shows an already decoded frame. No tile groups follow such a header.
+func (h SequenceHeader) ShowsExistingFrame(payload []byte) bool {
+	return !h.ReducedStillPicture && len(payload) > 0 && payload[0]&0x80 != 0
+}
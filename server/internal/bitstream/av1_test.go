@@ -0,0 +1,256 @@
+package bitstream
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+type av1Seq struct {
+	profile, level        int
+	highBitDepth, twelve  bool
+	mono                  bool
+	ssx, ssy              bool // profile 2, 12-bit only
+	width, height         int
+	decoderModel, reduced bool
+	color                 Color // not described if zero
+}
+
+// sequenceHeader writes an OBU_SEQUENCE_HEADER payload for s.
+func (s av1Seq) sequenceHeader() []byte {
+	w := &bitWriter{}
+	flag := func(b bool) {
+		if b {
+			w.u(1, 1)
+		} else {
+			w.u(1, 0)
+		}
+	}
+	w.u(3, uint32(s.profile))
+	w.u(1, 0) // still_picture
+	flag(s.reduced)
+	if s.reduced {
+		w.u(5, uint32(s.level))
+	} else {
+		flag(s.decoderModel) // timing_info_present_flag
+		if s.decoderModel {
+			w.u(32, 1001)
+			w.u(32, 60000)
+			w.u(1, 1)  // equal_picture_interval
+			w.u(5, 4)  // uvlc num_ticks_per_picture_minus_1 = 3
+			w.u(1, 1)  // decoder_model_info_present_flag
+			w.u(5, 19) // buffer_delay_length_minus_1
+			w.u(32, 1001)
+			w.u(5, 31)
+			w.u(5, 31)
+		}
+		w.u(1, 1) // initial_display_delay_present_flag
+		w.u(5, 1) // operating_points_cnt_minus_1
+		for _, level := range []int{s.level, 4} {
+			w.u(12, 0)
+			w.u(5, uint32(level))
+			if level > 7 {
+				w.u(1, 1)
+			}
+			if s.decoderModel {
+				w.u(1, 1)
+				w.u(20, 1)
+				w.u(20, 2)
+				w.u(1, 0)
+			}
+			w.u(1, 1)
+			w.u(4, 9)
+		}
+	}
+	w.u(4, 15)
+	w.u(4, 15)
+	w.u(16, uint32(s.width-1))
+	w.u(16, uint32(s.height-1))
+	if !s.reduced {
+		w.u(1, 1) // frame_id_numbers_present_flag
+		w.u(7, 0)
+	}
+	w.u(3, 0)
+	if !s.reduced {
+		w.u(4, 0)
+		w.u(1, 1) // enable_order_hint
+		w.u(2, 0)
+		w.u(1, 0) // seq_choose_screen_content_tools
+		w.u(1, 1) // seq_force_screen_content_tools
+		w.u(1, 0) // seq_choose_integer_mv
+		w.u(1, 0)
+		w.u(3, 6)
+	}
+	w.u(3, 0)
+	flag(s.highBitDepth)
+	if s.profile == 2 && s.highBitDepth {
+		flag(s.twelve)
+	}
+	if s.profile != 1 {
+		flag(s.mono)
+	}
+	described := s.color != Color{FullRange: s.color.FullRange}
+	flag(described) // color_description_present_flag
+	if described {
+		w.u(8, uint32(s.color.Primaries))
+		w.u(8, uint32(s.color.Transfer))
+		w.u(8, uint32(s.color.Matrix))
+	}
+	flag(s.color.FullRange) // color_range
+	if !s.mono && s.profile == 2 && s.twelve {
+		flag(s.ssx)
+		if s.ssx {
+			flag(s.ssy)
+		}
+	}
+	w.u(2, 0) // chroma_sample_position, if 4:2:0
+	w.u(2, 0)
+	return w.b
+}
+
+func TestParseSequenceHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		in   av1Seq
+		want SPS
+	}{
+		{"main 1080p", av1Seq{profile: 0, level: 8, width: 1920, height: 1080, color: bt709},
+			SPS{Profile: 0, Level: 8, ChromaFormat: 1, BitDepthLuma: 8, BitDepthChroma: 8, Width: 1920, Height: 1080, Color: bt709}},
+		{"main 10-bit PQ with decoder model", av1Seq{profile: 0, level: 12, highBitDepth: true, decoderModel: true, width: 3840, height: 2160, color: pq},
+			SPS{Profile: 0, Level: 12, ChromaFormat: 1, BitDepthLuma: 10, BitDepthChroma: 10, Width: 3840, Height: 2160, Color: pq}},
+		{"high 4:4:4 full range", av1Seq{profile: 1, level: 9, width: 2560, height: 1440, color: bt709Full},
+			SPS{Profile: 1, Level: 9, ChromaFormat: 3, BitDepthLuma: 8, BitDepthChroma: 8, Width: 2560, Height: 1440, Color: bt709Full}},
+		{"professional 10-bit 4:2:2", av1Seq{profile: 2, level: 8, highBitDepth: true, width: 1280, height: 720},
+			SPS{Profile: 2, Level: 8, ChromaFormat: 2, BitDepthLuma: 10, BitDepthChroma: 10, Width: 1280, Height: 720}},
+		{"professional 12-bit 4:2:0", av1Seq{profile: 2, level: 8, highBitDepth: true, twelve: true, ssx: true, ssy: true, width: 1280, height: 720},
+			SPS{Profile: 2, Level: 8, ChromaFormat: 1, BitDepthLuma: 12, BitDepthChroma: 12, Width: 1280, Height: 720}},
+		{"monochrome", av1Seq{profile: 0, level: 5, mono: true, width: 640, height: 480},
+			SPS{Profile: 0, Level: 5, ChromaFormat: 0, BitDepthLuma: 8, BitDepthChroma: 8, Width: 640, Height: 480}},
+		{"sRGB", av1Seq{profile: 1, level: 8, width: 1920, height: 1080, color: Color{Primaries: 1, Transfer: 13}},
+			SPS{Profile: 1, Level: 8, ChromaFormat: 3, BitDepthLuma: 8, BitDepthChroma: 8, Width: 1920, Height: 1080,
+				Color: Color{Primaries: 1, Transfer: 13, FullRange: true}}},
+		{"reduced still picture", av1Seq{profile: 0, level: 3, reduced: true, width: 320, height: 240},
+			SPS{Profile: 0, Level: 3, ChromaFormat: 1, BitDepthLuma: 8, BitDepthChroma: 8, Width: 320, Height: 240}},
+	}
+	for _, tt := range tests {
+		got, err := ParseSequenceHeader(tt.in.sequenceHeader())
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got.SPS != tt.want || got.ReducedStillPicture != tt.in.reduced {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+	if _, err := ParseSequenceHeader([]byte{0x00, 0x00}); err == nil {
+		t.Error("truncated sequence header parsed")
+	}
+}
+
+func TestSplitOBUs(t *testing.T) {
+	seq := av1Seq{level: 8, width: 1920, height: 1080}.sequenceHeader()
+	td := []byte{0x12, 0x00}
+	sh := append([]byte{0x0a, byte(len(seq))}, seq...)
+	frame := []byte{0x30, 0x10, 0xaa, 0xbb}     // OBU_FRAME, no size field
+	ext := []byte{0x36, 0x28, 0x02, 0x10, 0xcc} // OBU_FRAME with extension, size 2
+	obus, err := SplitOBUs(append(append(append(append([]byte{}, td...), sh...), ext...), frame...), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []int
+	for _, o := range obus {
+		types = append(types, o.Type)
+	}
+	if !reflect.DeepEqual(types, []int{OBUTemporalDelimiter, OBUSequenceHeader, OBUFrame, OBUFrame}) {
+		t.Fatalf("types = %v", types)
+	}
+	if !bytes.Equal(obus[1].Payload, seq) || !obus[2].Extended || !bytes.Equal(obus[2].Payload, []byte{0x10, 0xcc}) ||
+		obus[3].Size != 3 || !bytes.Equal(obus[3].Payload, frame[1:]) {
+		t.Fatalf("obus = %+v", obus)
+	}
+
+	// AppendOBU adds the size field the last OBU lacked.
+	var b []byte
+	for _, o := range obus[1:] {
+		b = AppendOBU(b, o)
+	}
+	again, err := SplitOBUs(append(b, td...), nil)
+	if err != nil || len(again) != 4 || !bytes.Equal(again[2].Payload, frame[1:]) || again[3].Type != OBUTemporalDelimiter {
+		t.Fatalf("after AppendOBU: %+v, %v", again, err)
+	}
+
+	for _, bad := range [][]byte{{0x92, 0x00}, {0x0a, 0x05, 0x00}, {0x0a, 0x80}, {0x36}} {
+		if _, err := SplitOBUs(bad, nil); err == nil {
+			t.Errorf("SplitOBUs(%x) succeeded", bad)
+		}
+	}
+}
+
+func TestFrameType(t *testing.T) {
+	var h SequenceHeader
+	tests := []struct {
+		payload     []byte
+		key, shown  bool
+		description string
+	}{
+		{[]byte{0x10}, true, true, "shown key frame"},
+		{[]byte{0x30}, false, true, "shown inter frame"},
+		{[]byte{0x20}, false, false, "hidden inter frame"},
+		{[]byte{0x80}, false, true, "show_existing_frame"},
+	}
+	for _, tt := range tests {
+		key, shown, err := h.FrameType(tt.payload)
+		if err != nil || key != tt.key || shown != tt.shown {
+			t.Errorf("%s: key %v shown %v err %v", tt.description, key, shown, err)
+		}
+		if existing := h.ShowsExistingFrame(tt.payload); existing != (tt.payload[0] == 0x80) {
+			t.Errorf("%s: ShowsExistingFrame = %v", tt.description, existing)
+		}
+	}
+	h.ReducedStillPicture = true
+	if key, shown, _ := h.FrameType(nil); !key || !shown {
+		t.Error("reduced still picture frames are shown key frames")
+	}
+	if h.ShowsExistingFrame([]byte{0x80}) {
+		t.Error("reduced still pictures have no show_existing_frame")
+	}
+}
+
+func FuzzSplitOBUs(f *testing.F) {
+	f.Add([]byte{0x12, 0x00, 0x30, 0x10, 0xaa})
+	f.Add([]byte{0x36, 0x28, 0x02, 0x10, 0xcc, 0x0a, 0x80})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		obus, err := SplitOBUs(b, nil)
+		var joined []byte
+		for _, o := range obus {
+			if len(o.Raw) != o.Len+len(o.Payload) {
+				t.Fatalf("obu %+v: Raw is not header + payload", o)
+			}
+			joined = append(joined, o.Raw...)
+		}
+		if !bytes.HasPrefix(b, joined) || err == nil && len(joined) != len(b) {
+			t.Fatalf("OBUs don't tile the input (err %v)", err)
+		}
+		var re []byte
+		for _, o := range obus {
+			re = AppendOBU(re, o)
+		}
+		again, err := SplitOBUs(re, nil)
+		if err != nil || len(again) != len(obus) {
+			t.Fatalf("re-split after AppendOBU: %d OBUs, %v", len(again), err)
+		}
+	})
+}
+
+func FuzzParseSequenceHeader(f *testing.F) {
+	f.Add(av1Seq{level: 8, width: 1920, height: 1080}.sequenceHeader())
+	f.Add(av1Seq{profile: 2, highBitDepth: true, twelve: true, ssx: true, decoderModel: true, width: 64, height: 64}.sequenceHeader())
+	f.Fuzz(func(t *testing.T, b []byte) {
+		h, err := ParseSequenceHeader(b)
+		if err == nil && (h.Width < 1 || h.Height < 1 || h.ChromaFormat < 0 || h.ChromaFormat > 3) {
+			t.Fatalf("implausible sequence header %+v", h)
+		}
+	})
+}
+
+// vp9KeyFrame writes the uncompressed header of a VP9 key frame.
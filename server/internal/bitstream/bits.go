@@ -0,0 +1,75 @@
+package bitstream
+
+import "errors"
+
+var errShort = errors.New("bitstream: truncated")
+
+// bitReader reads big-endian bit fields from an RBSP. Reads past the end
+// return zeros and set err, so parsers can check once at the end.
+type bitReader struct {
+	b   []byte
+	pos int // in bits
+	err error
+}
+
+func (r *bitReader) u(n int) uint32 {
+	var v uint32
+	for ; n > 0; n-- {
+		if r.pos >= len(r.b)*8 {
+			r.err = errShort
+			return 0
+		}
+		bit := r.b[r.pos>>3] >> (7 - r.pos&7) & 1
+		v = v<<1 | uint32(bit)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) flag() bool { return r.u(1) == 1 }
+
+func (r *bitReader) skip(n int) {
+	r.pos += n
+	if r.pos > len(r.b)*8 {
+		r.err = errShort
+	}
+}
+
+// ue reads an Exp-Golomb coded unsigned integer.
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.u(1) == 0 {
+		if r.err != nil {
+			return 0
+		}
+		if zeros++; zeros > 31 {
+			r.err = errors.New("bitstream: bad exp-golomb code")
+			return 0
+		}
+	}
+	return 1<<zeros - 1 + r.u(zeros)
+}
+
+// se reads an Exp-Golomb coded signed integer.
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v&1 == 1 {
+		return int32(v/2 + 1)
+	}
+	return -int32(v / 2)
+}
+
+// uvlc reads a variable length unsigned integer as used by AV1 (Section
+// 4.10.3).
+func (r *bitReader) uvlc() uint32 {
+	zeros := 0
+	for r.u(1) == 0 {
+		if r.err != nil {
+			return 0
+		}
+		if zeros++; zeros >= 32 {
+			return 1<<32 - 1
+		}
+	}
+	return 1<<zeros - 1 + r.u(zeros)
+}
@@ -0,0 +1,35 @@
+package bitstream
+
+// bitWriter builds RBSPs and headers for the parser tests.
+type bitWriter struct {
+	b    []byte
+	nbit int
+}
+
+func (w *bitWriter) u(n int, v uint32) {
+	for i := n - 1; i >= 0; i-- {
+		if w.nbit%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		w.b[len(w.b)-1] |= byte(v>>i&1) << (7 - w.nbit%8)
+		w.nbit++
+	}
+}
+
+func (w *bitWriter) ue(v uint32) {
+	n := 0
+	for (v+1)>>(n+1) != 0 {
+		n++
+	}
+	w.u(n, 0)
+	w.u(n+1, v+1)
+}
+
+// nal appends rbsp_trailing_bits and the escaped payload to header.
+func (w *bitWriter) nal(header ...byte) []byte {
+	w.u(1, 1)
+	for w.nbit%8 != 0 {
+		w.u(1, 0)
+	}
+	return append(header, escape(w.b)...)
+}
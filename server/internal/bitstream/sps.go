@@ -0,0 +1,334 @@
+package bitstream
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SPS holds the sequence parameter set fields the server uses. Width and
+// Height are the displayed size, after the cropping window.
+type SPS struct {
+	Profile        int // profile_idc / general_profile_idc
+	Level          int // level_idc / general_level_idc
+	ChromaFormat   int // 0 = monochrome, 1 = 4:2:0, 2 = 4:2:2, 3 = 4:4:4
+	BitDepthLuma   int
+	BitDepthChroma int
+	Width          int
+	Height         int
+	Color          Color
+}
+
+// Color is the video signal description of a stream: the VUI of an SPS
+// (Annex E of H.264 and H.265), the AV1 color_config or a VP9 key frame.
+// Primaries, Transfer and Matrix are ITU-T H.273 code points, all zero when
+// the stream doesn't describe them.
+type Color struct {
+	Primaries int
+	Transfer  int
+	Matrix    int
+	FullRange bool
+}
+
+// String formats c as primaries/transfer/matrix and range, "1/1/1 limited"
+// for BT.709.
+func (c Color) String() string {
+	rng := "limited"
+	if c.FullRange {
+		rng = "full"
+	}
+	if c == (Color{FullRange: c.FullRange}) {
+		return "unspecified " + rng
+	}
+	return fmt.Sprintf("%d/%d/%d %s", c.Primaries, c.Transfer, c.Matrix, rng)
+}
+
+// parseVUIColor reads the start of vui_parameters, which H.264 and H.265
+// share, up to and including the colour description.
+func parseVUIColor(r *bitReader) Color {
+	var c Color
+	if r.flag() { // aspect_ratio_info_present_flag
+		if r.u(8) == 255 { // Extended_SAR
+			r.skip(16 + 16)
+		}
+	}
+	if r.flag() { // overscan_info_present_flag
+		r.skip(1)
+	}
+	if r.flag() { // video_signal_type_present_flag
+		r.skip(3) // video_format
+		c.FullRange = r.flag()
+		if r.flag() { // colour_description_present_flag
+			c.Primaries, c.Transfer, c.Matrix = int(r.u(8)), int(r.u(8)), int(r.u(8))
+		}
+	}
+	return c
+}
+
+// ParseSPS parses an SPS NAL unit, header included.
+func (c Codec) ParseSPS(nal []byte) (SPS, error) {
+	if c == H265 {
+		return parseH265SPS(nal)
+	}
+	return parseH264SPS(nal)
+}
+
+// subsampling returns SubWidthC and SubHeightC (Table 6-1).
+func subsampling(chromaFormat int, separatePlanes bool) (int, int) {
+	switch {
+	case chromaFormat == 1 && !separatePlanes:
+		return 2, 2
+	case chromaFormat == 2 && !separatePlanes:
+		return 2, 1
+	}
+	return 1, 1
+}
+
+func parseH264SPS(nal []byte) (SPS, error) {
+	if H264.NALType(nal) != H264SPS {
+		return SPS{}, errors.New("h264: not an SPS")
+	}
+	r := &bitReader{b: Unescape(nil, nal[1:])}
+	s := SPS{ChromaFormat: 1, BitDepthLuma: 8, BitDepthChroma: 8}
+	s.Profile = int(r.u(8))
+	r.skip(8) // constraint flags
+	s.Level = int(r.u(8))
+	r.ue() // seq_parameter_set_id
+	separatePlanes := false
+	switch s.Profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		s.ChromaFormat = int(r.ue())
+		if s.ChromaFormat == 3 {
+			separatePlanes = r.flag()
+		}
+		s.BitDepthLuma = int(r.ue()) + 8
+		s.BitDepthChroma = int(r.ue()) + 8
+		r.skip(1) // qpprime_y_zero_transform_bypass_flag
+		// seq_scaling_matrix_present_flag
+		if r.flag() {
+			n := 8
+			if s.ChromaFormat == 3 {
+				n = 12
+			}
+			for i := 0; i < n; i++ {
+				if r.flag() {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					skipScalingList(r, size)
+				}
+			}
+		}
+	}
+	r.ue() // log2_max_frame_num_minus4
+	// pic_order_cnt_type
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.skip(1) // delta_pic_order_always_zero_flag
+		r.se()    // offset_for_non_ref_pic
+		r.se()    // offset_for_top_to_bottom_field
+		n := r.ue()
+		for i := uint32(0); i < n && r.err == nil; i++ {
+			r.se()
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.skip(1) // gaps_in_frame_num_value_allowed_flag
+	widthMbs := int(r.ue()) + 1
+	heightMapUnits := int(r.ue()) + 1
+	frameMbsOnly := r.flag()
+	if !frameMbsOnly {
+		r.skip(1) // mb_adaptive_frame_field_flag
+	}
+	r.skip(1) // direct_8x8_inference_flag
+	var cl, cr, ct, cb int
+	if r.flag() { // frame_cropping_flag
+		cl, cr, ct, cb = int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+	}
+	if r.flag() { // vui_parameters_present_flag
+		s.Color = parseVUIColor(r)
+	}
+	if r.err != nil {
+		return SPS{}, fmt.Errorf("h264 sps: %w", r.err)
+	}
+
+	fieldFactor := 2
+	if frameMbsOnly {
+		fieldFactor = 1
+	}
+	cropX, cropY := 1, fieldFactor
+	if s.ChromaFormat != 0 && !separatePlanes {
+		sw, sh := subsampling(s.ChromaFormat, separatePlanes)
+		cropX, cropY = sw, sh*fieldFactor
+	}
+	s.Width = widthMbs*16 - cropX*(cl+cr)
+	s.Height = heightMapUnits*16*fieldFactor - cropY*(ct+cb)
+	if s.Width <= 0 || s.Height <= 0 {
+		return SPS{}, errors.New("h264 sps: bad cropping window")
+	}
+	return s, nil
+}
+
+func skipScalingList(r *bitReader, size int) {
+	last, next := int32(8), int32(8)
+	for j := 0; j < size && r.err == nil; j++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+func parseH265SPS(nal []byte) (SPS, error) {
+	if H265.NALType(nal) != H265SPS {
+		return SPS{}, errors.New("h265: not an SPS")
+	}
+	r := &bitReader{b: Unescape(nil, nal[2:])}
+	var s SPS
+	r.skip(4) // sps_video_parameter_set_id
+	maxSubLayersMinus1 := int(r.u(3))
+	r.skip(1) // sps_temporal_id_nesting_flag
+
+	// profile_tier_level(1, sps_max_sub_layers_minus1)
+	r.skip(3) // general_profile_space, general_tier_flag
+	s.Profile = int(r.u(5))
+	r.skip(32 + 4 + 43 + 1) // compatibility flags, source flags, reserved
+	s.Level = int(r.u(8))
+	profilePresent := make([]bool, maxSubLayersMinus1)
+	levelPresent := make([]bool, maxSubLayersMinus1)
+	for i := range profilePresent {
+		profilePresent[i] = r.flag()
+		levelPresent[i] = r.flag()
+	}
+	if maxSubLayersMinus1 > 0 {
+		r.skip(2 * (8 - maxSubLayersMinus1)) // reserved_zero_2bits
+	}
+	for i := range profilePresent {
+		if profilePresent[i] {
+			r.skip(88)
+		}
+		if levelPresent[i] {
+			r.skip(8)
+		}
+	}
+
+	r.ue() // sps_seq_parameter_set_id
+	s.ChromaFormat = int(r.ue())
+	separatePlanes := false
+	if s.ChromaFormat == 3 {
+		separatePlanes = r.flag()
+	}
+	width, height := int(r.ue()), int(r.ue())
+	var cl, cr, ct, cb int
+	if r.flag() { // conformance_window_flag
+		cl, cr, ct, cb = int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+	}
+	s.BitDepthLuma = int(r.ue()) + 8
+	s.BitDepthChroma = int(r.ue()) + 8
+	log2MaxPocLsb := int(r.ue()) + 4
+	first := maxSubLayersMinus1
+	if r.flag() { // sps_sub_layer_ordering_info_present_flag
+		first = 0
+	}
+	for i := first; i <= maxSubLayersMinus1; i++ {
+		r.ue() // sps_max_dec_pic_buffering_minus1
+		r.ue() // sps_max_num_reorder_pics
+		r.ue() // sps_max_latency_increase_plus1
+	}
+	for i := 0; i < 6; i++ {
+		r.ue() // coding and transform block sizes, transform hierarchy depths
+	}
+	if r.flag() && r.flag() { // scaling_list_enabled_flag, sps_scaling_list_data_present_flag
+		skipH265ScalingLists(r)
+	}
+	r.skip(2)     // amp_enabled_flag, sample_adaptive_offset_enabled_flag
+	if r.flag() { // pcm_enabled_flag
+		r.skip(4 + 4) // pcm sample bit depths
+		r.ue()        // log2_min_pcm_luma_coding_block_size_minus3
+		r.ue()        // log2_diff_max_min_pcm_luma_coding_block_size
+		r.skip(1)     // pcm_loop_filter_disabled_flag
+	}
+	numRPS := int(r.ue())
+	if numRPS > 64 {
+		return SPS{}, errors.New("h265 sps: too many short-term RPS")
+	}
+	deltaPocs := make([]int, numRPS)
+	for i := 0; i < numRPS && r.err == nil; i++ {
+		deltaPocs[i] = skipShortTermRPS(r, i, deltaPocs)
+	}
+	if r.flag() { // long_term_ref_pics_present_flag
+		n := int(r.ue())
+		if n > 32 {
+			return SPS{}, errors.New("h265 sps: too many long-term pictures")
+		}
+		r.skip(n * (log2MaxPocLsb + 1)) // lt_ref_pic_poc_lsb_sps, used_by_curr_pic_lt_sps_flag
+	}
+	r.skip(2)     // sps_temporal_mvp_enabled_flag, strong_intra_smoothing_enabled_flag
+	if r.flag() { // vui_parameters_present_flag
+		s.Color = parseVUIColor(r)
+	}
+	if r.err != nil {
+		return SPS{}, fmt.Errorf("h265 sps: %w", r.err)
+	}
+
+	sw, sh := subsampling(s.ChromaFormat, separatePlanes)
+	s.Width = width - sw*(cl+cr)
+	s.Height = height - sh*(ct+cb)
+	if s.Width <= 0 || s.Height <= 0 {
+		return SPS{}, errors.New("h265 sps: bad conformance window")
+	}
+	return s, nil
+}
+
+// skipH265ScalingLists reads scaling_list_data (7.3.4).
+func skipH265ScalingLists(r *bitReader) {
+	for sizeID := 0; sizeID < 4; sizeID++ {
+		step := 1
+		if sizeID == 3 {
+			step = 3
+		}
+		for matrixID := 0; matrixID < 6 && r.err == nil; matrixID += step {
+			if !r.flag() { // scaling_list_pred_mode_flag
+				r.ue() // scaling_list_pred_matrix_id_delta
+				continue
+			}
+			if sizeID > 1 {
+				r.se() // scaling_list_dc_coef_minus8
+			}
+			for i := 0; i < min(64, 1<<(4+2*sizeID)) && r.err == nil; i++ {
+				r.se() // scaling_list_delta_coef
+			}
+		}
+	}
+}
+
+// skipShortTermRPS reads st_ref_pic_set(idx) of an SPS (7.3.7) and returns
+// its NumDeltaPocs; deltaPocs holds those of the sets before it, which a
+// set predicted from the previous one needs.
+func skipShortTermRPS(r *bitReader, idx int, deltaPocs []int) int {
+	if idx > 0 && r.flag() { // inter_ref_pic_set_prediction_flag
+		r.skip(1) // delta_rps_sign
+		r.ue()    // abs_delta_rps_minus1
+		n := 0
+		for j := 0; j <= deltaPocs[idx-1] && r.err == nil; j++ {
+			if r.flag() || r.flag() { // used_by_curr_pic_flag, else use_delta_flag
+				n++
+			}
+		}
+		return n
+	}
+	neg, pos := r.ue(), r.ue()
+	if neg > 16 || pos > 16 {
+		r.err = errors.New("bitstream: too many reference pictures")
+		return 0
+	}
+	for j := uint32(0); j < neg+pos && r.err == nil; j++ {
+		r.ue()    // delta_poc_s0/s1_minus1
+		r.skip(1) // used_by_curr_pic_s0/s1_flag
+	}
+	return int(neg + pos)
+}
@@ -0,0 +1,340 @@
+package bitstream
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+var (
+	bt709     = Color{Primaries: 1, Transfer: 1, Matrix: 1}
+	bt709Full = Color{Primaries: 1, Transfer: 1, Matrix: 1, FullRange: true}
+	pq        = Color{Primaries: 9, Transfer: 16, Matrix: 9}
+)
+
+// vuiColor writes the start of vui_parameters with an extended SAR, overscan
+// info and c, leaving out the colour description if c is unspecified.
+func (w *bitWriter) vuiColor(c Color) {
+	w.u(1, 1)   // aspect_ratio_info_present_flag
+	w.u(8, 255) // Extended_SAR
+	w.u(16, 1)
+	w.u(16, 1)
+	w.u(1, 1) // overscan_info_present_flag
+	w.u(1, 0)
+	w.u(1, 1) // video_signal_type_present_flag
+	w.u(3, 5) // video_format: unspecified
+	if c.FullRange {
+		w.u(1, 1)
+	} else {
+		w.u(1, 0)
+	}
+	if c == (Color{FullRange: c.FullRange}) {
+		w.u(1, 0)
+		return
+	}
+	w.u(1, 1)
+	w.u(8, uint32(c.Primaries))
+	w.u(8, uint32(c.Transfer))
+	w.u(8, uint32(c.Matrix))
+	w.u(1, 0) // chroma_loc_info_present_flag, ignored by the parser
+}
+
+// h264SPS writes an SPS for the given layout, with a VUI if vui is given.
+func h264SPS(profile, chroma, bitDepth, widthMbs, heightUnits int, frameMbsOnly bool, crop [4]int, vui ...Color) []byte {
+	w := &bitWriter{}
+	w.u(8, uint32(profile))
+	w.u(8, 0)
+	w.u(8, 51)
+	w.ue(0)
+	if profile >= 100 {
+		w.ue(uint32(chroma))
+		if chroma == 3 {
+			w.u(1, 0)
+		}
+		w.ue(uint32(bitDepth - 8))
+		w.ue(uint32(bitDepth - 8))
+		w.u(1, 0)
+		w.u(1, 0)
+	}
+	w.ue(0) // log2_max_frame_num_minus4
+	w.ue(2) // pic_order_cnt_type
+	w.ue(1)
+	w.u(1, 0)
+	w.ue(uint32(widthMbs - 1))
+	w.ue(uint32(heightUnits - 1))
+	if frameMbsOnly {
+		w.u(1, 1)
+	} else {
+		w.u(1, 0)
+		w.u(1, 0)
+	}
+	w.u(1, 1)
+	if crop != [4]int{} {
+		w.u(1, 1)
+		for _, c := range crop {
+			w.ue(uint32(c))
+		}
+	} else {
+		w.u(1, 0)
+	}
+	if len(vui) > 0 {
+		w.u(1, 1) // vui_parameters_present_flag
+		w.vuiColor(vui[0])
+	} else {
+		w.u(1, 0)
+	}
+	return w.nal(0x67)
+}
+
+// h265SPS writes an SPS with two sub-layers, scaling lists, PCM, short-term
+// reference picture sets both explicit and predicted, and long-term ones,
+// so the parser has to get through all of them to reach the VUI. Width and
+// height are the displayed size.
+func h265SPS(profile, chroma, bitDepth, width, height int, vui ...Color) []byte {
+	w := &bitWriter{}
+	w.u(4, 0) // sps_video_parameter_set_id
+	w.u(3, 1) // sps_max_sub_layers_minus1
+	w.u(1, 1)
+	w.u(3, 0)
+	w.u(5, uint32(profile))
+	w.u(32, 1<<(31-profile))
+	w.u(48, 0)
+	w.u(8, 123)
+	w.u(2, 0b11) // sub_layer_profile/level_present_flag
+	w.u(14, 0)   // reserved_zero_2bits
+	w.u(88, 0)
+	w.u(8, 120)
+	w.ue(0)
+	w.ue(uint32(chroma))
+	if chroma == 3 {
+		w.u(1, 0)
+	}
+	sw, sh := subsampling(chroma, false)
+	codedW, codedH := (width+7)&^7, (height+7)&^7
+	w.ue(uint32(codedW))
+	w.ue(uint32(codedH))
+	if codedW != width || codedH != height {
+		w.u(1, 1) // conformance_window_flag
+		w.ue(0)
+		w.ue(uint32((codedW - width) / sw))
+		w.ue(0)
+		w.ue(uint32((codedH - height) / sh))
+	} else {
+		w.u(1, 0)
+	}
+	w.ue(uint32(bitDepth - 8))
+	w.ue(uint32(bitDepth - 8))
+	w.ue(4)   // log2_max_pic_order_cnt_lsb_minus4
+	w.u(1, 1) // sps_sub_layer_ordering_info_present_flag
+	for i := 0; i < 2; i++ {
+		w.ue(4)
+		w.ue(2)
+		w.ue(0)
+	}
+	for _, v := range []uint32{0, 3, 0, 3, 2, 2} {
+		w.ue(v)
+	}
+	w.u(2, 0b11) // scaling_list_enabled_flag, sps_scaling_list_data_present_flag
+	for sizeID := 0; sizeID < 4; sizeID++ {
+		step := 1
+		if sizeID == 3 {
+			step = 3
+		}
+		for matrixID := 0; matrixID < 6; matrixID += step {
+			if matrixID > 0 {
+				w.u(1, 0) // scaling_list_pred_mode_flag
+				w.ue(1)
+				continue
+			}
+			w.u(1, 1)
+			if sizeID > 1 {
+				w.ue(3) // se(-2)
+			}
+			for i := 0; i < min(64, 1<<(4+2*sizeID)); i++ {
+				w.ue(uint32(i % 3))
+			}
+		}
+	}
+	w.u(2, 0b11) // amp_enabled_flag, sample_adaptive_offset_enabled_flag
+	w.u(1, 1)    // pcm_enabled_flag
+	w.u(8, 0x77)
+	w.ue(0)
+	w.ue(1)
+	w.u(1, 0)
+	w.ue(3) // num_short_term_ref_pic_sets
+	// 0: two negative pictures, one positive
+	w.ue(2)
+	w.ue(1)
+	for i := 0; i < 3; i++ {
+		w.ue(uint32(i))
+		w.u(1, 1)
+	}
+	// 1: predicted from 0, 4 entries; 3 kept
+	w.u(1, 1)
+	w.u(1, 0)
+	w.ue(0)
+	w.u(1, 1)    // used_by_curr_pic_flag
+	w.u(2, 0b00) // unused, use_delta_flag = 0
+	w.u(1, 1)
+	w.u(2, 0b01)
+	// 2: predicted from 1, 4 entries
+	w.u(1, 1)
+	w.u(1, 1)
+	w.ue(2)
+	w.u(4, 0b1111)
+	w.u(1, 1) // long_term_ref_pics_present_flag
+	w.ue(2)
+	w.u(9, 0x101)
+	w.u(9, 0x0fe)
+	w.u(2, 0b11) // sps_temporal_mvp_enabled_flag, strong_intra_smoothing_enabled_flag
+	if len(vui) > 0 {
+		w.u(1, 1) // vui_parameters_present_flag
+		w.vuiColor(vui[0])
+	} else {
+		w.u(1, 0)
+	}
+	w.u(1, 0) // sps_extension_present_flag
+	return w.nal(0x42, 0x01)
+}
+
+func TestParseSPS(t *testing.T) {
+	hexNAL := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	tests := []struct {
+		name  string
+		codec Codec
+		nal   []byte
+		want  SPS
+	}{
+		{
+			"x264 1080p high", H264,
+			hexNAL("6764002aacd940780227e5c044000003000400000300f03c60c658"),
+			SPS{Profile: 100, Level: 42, ChromaFormat: 1, BitDepthLuma: 8, BitDepthChroma: 8, Width: 1920, Height: 1080},
+		},
+		{
+			// x265 2.6, Big Buck Bunny 1080p
+			"x265 1080p main", H265,
+			hexNAL("420101016000000300900000030000030078a003c08010e596566924caf01010000003001000000301e080"),
+			SPS{Profile: 1, Level: 120, ChromaFormat: 1, BitDepthLuma: 8, BitDepthChroma: 8, Width: 1920, Height: 1080},
+		},
+		{
+			// x265 3.5, ultrafast zerolatency, with VUI timing info
+			"x265 720p main", H265,
+			hexNAL("42010101600000030090000003000003005da00280802d165ba4a4c2e01000003e800007530080"),
+			SPS{Profile: 1, Level: 93, ChromaFormat: 1, BitDepthLuma: 8, BitDepthChroma: 8, Width: 1280, Height: 720},
+		},
+		{
+			"baseline no crop", H264,
+			h264SPS(66, 1, 8, 40, 30, true, [4]int{}),
+			SPS{Profile: 66, Level: 51, ChromaFormat: 1, BitDepthLuma: 8, BitDepthChroma: 8, Width: 640, Height: 480},
+		},
+		{
+			"high 4:4:4 10-bit 2160p", H264,
+			h264SPS(244, 3, 10, 240, 135, true, [4]int{0, 0, 0, 0}),
+			SPS{Profile: 244, Level: 51, ChromaFormat: 3, BitDepthLuma: 10, BitDepthChroma: 10, Width: 3840, Height: 2160},
+		},
+		{
+			"interlaced 1080i", H264,
+			h264SPS(100, 1, 8, 120, 34, false, [4]int{0, 0, 0, 2}),
+			SPS{Profile: 100, Level: 51, ChromaFormat: 1, BitDepthLuma: 8, BitDepthChroma: 8, Width: 1920, Height: 1080},
+		},
+		{
+			"4:2:2 cropped", H264,
+			h264SPS(122, 2, 8, 120, 68, true, [4]int{0, 0, 0, 8}),
+			SPS{Profile: 122, Level: 51, ChromaFormat: 2, BitDepthLuma: 8, BitDepthChroma: 8, Width: 1920, Height: 1080},
+		},
+		{
+			"high bt709 limited", H264,
+			h264SPS(100, 1, 8, 120, 68, true, [4]int{0, 0, 0, 4}, bt709),
+			SPS{Profile: 100, Level: 51, ChromaFormat: 1, BitDepthLuma: 8, BitDepthChroma: 8, Width: 1920, Height: 1080, Color: bt709},
+		},
+		{
+			"high 4:4:4 bt709 full", H264,
+			h264SPS(244, 3, 8, 120, 68, true, [4]int{0, 0, 0, 8}, bt709Full),
+			SPS{Profile: 244, Level: 51, ChromaFormat: 3, BitDepthLuma: 8, BitDepthChroma: 8, Width: 1920, Height: 1080, Color: bt709Full},
+		},
+		{
+			"range only", H264,
+			h264SPS(100, 1, 8, 80, 45, true, [4]int{}, Color{FullRange: true}),
+			SPS{Profile: 100, Level: 51, ChromaFormat: 1, BitDepthLuma: 8, BitDepthChroma: 8, Width: 1280, Height: 720, Color: Color{FullRange: true}},
+		},
+		{
+			"hevc main bt709", H265,
+			h265SPS(1, 1, 8, 1920, 1080, bt709),
+			SPS{Profile: 1, Level: 123, ChromaFormat: 1, BitDepthLuma: 8, BitDepthChroma: 8, Width: 1920, Height: 1080, Color: bt709},
+		},
+		{
+			"hevc main10 pq", H265,
+			h265SPS(2, 1, 10, 3840, 2160, pq),
+			SPS{Profile: 2, Level: 123, ChromaFormat: 1, BitDepthLuma: 10, BitDepthChroma: 10, Width: 3840, Height: 2160, Color: pq},
+		},
+		{
+			"hevc rext 4:4:4 full", H265,
+			h265SPS(4, 3, 8, 2560, 1440, bt709Full),
+			SPS{Profile: 4, Level: 123, ChromaFormat: 3, BitDepthLuma: 8, BitDepthChroma: 8, Width: 2560, Height: 1440, Color: bt709Full},
+		},
+		{
+			"hevc no vui", H265,
+			h265SPS(1, 1, 8, 1280, 720),
+			SPS{Profile: 1, Level: 123, ChromaFormat: 1, BitDepthLuma: 8, BitDepthChroma: 8, Width: 1280, Height: 720},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.codec.ParseSPS(tt.nal)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSPSErrors(t *testing.T) {
+	full := h264SPS(100, 1, 8, 120, 68, true, [4]int{0, 0, 0, 4})
+	for n := 0; n < len(full)-2; n++ {
+		if _, err := H264.ParseSPS(full[:n]); err == nil {
+			t.Errorf("truncated to %d bytes: no error", n)
+		}
+	}
+	full = h265SPS(2, 1, 10, 3840, 2160, pq)
+	for n := 0; n < len(full)-2; n++ {
+		if _, err := H265.ParseSPS(full[:n]); err == nil {
+			t.Errorf("hevc truncated to %d bytes: no error", n)
+		}
+	}
+	if _, err := H264.ParseSPS([]byte{0x68, 0xee}); err == nil {
+		t.Error("PPS parsed as SPS")
+	}
+}
+
+func FuzzParseSPS(f *testing.F) {
+	f.Add(h264SPS(100, 1, 8, 120, 68, true, [4]int{0, 0, 0, 4}), false)
+	f.Add(h265SPS(2, 1, 10, 3840, 2160, pq), true)
+	f.Fuzz(func(t *testing.T, nal []byte, hevc bool) {
+		c := H264
+		if hevc {
+			c = H265
+		}
+		s, err := c.ParseSPS(nal)
+		if err == nil && (s.Width <= 0 || s.Height <= 0) {
+			t.Fatalf("accepted %+v", s)
+		}
+	})
+}
+
+func BenchmarkParseSPS(b *testing.B) {
+	nal, _ := hex.DecodeString("6764002aacd940780227e5c044000003000400000300f03c60c658")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := H264.ParseSPS(nal); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package bitstream
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SplitVP9Superframe appends the frames of a VP9 superframe (Annex B) to
+// dst[:0] and returns it. The slices alias b. Anything that is not a valid
+// superframe is returned as a single frame.
+func SplitVP9Superframe(b []byte, dst [][]byte) [][]byte {
+	dst = dst[:0]
+	if len(b) == 0 {
+		return dst
+	}
+	marker := b[len(b)-1]
+	if marker&0xE0 != 0xC0 {
+		return append(dst, b)
+	}
+	frames := int(marker&7) + 1
+	mag := int(marker>>3&3) + 1
+	index := 2 + mag*frames
+	if len(b) < index || b[len(b)-index] != marker {
+		return append(dst, b)
+	}
+	sizes := b[len(b)-index+1 : len(b)-1]
+	data := b[:len(b)-index]
+	off := 0
+	for i := 0; i < frames; i++ {
+		sz := 0
+		for j := mag - 1; j >= 0; j-- {
+			sz = sz<<8 | int(sizes[i*mag+j])
+		}
+		if sz > len(data)-off {
+			return append(dst[:0], b)
+		}
+		dst = append(dst, data[off:off+sz])
+		off += sz
+	}
+	return dst
+}
+
+// VP9Frame holds the start of a VP9 uncompressed header (Section 6.2). The
+// SPS fields other than Profile are only filled for key frames, the only
+// ones that carry the color config and frame size; VP9 codes no level.
+type VP9Frame struct {
+	SPS
+	Key, Shown bool
+}
+
+// vp9Colors maps VP9 color_space to H.273 code points. VP9 only names the
+// matrix; the primaries and transfer are the ones that go with it.
+var vp9Colors = [8]Color{
+	1: {Primaries: 5, Transfer: 6, Matrix: 5},  // CS_BT_601
+	2: {Primaries: 1, Transfer: 1, Matrix: 1},  // CS_BT_709
+	3: {Primaries: 6, Transfer: 6, Matrix: 6},  // CS_SMPTE_170
+	4: {Primaries: 7, Transfer: 7, Matrix: 7},  // CS_SMPTE_240
+	5: {Primaries: 9, Transfer: 14, Matrix: 9}, // CS_BT_2020
+	7: {Primaries: 1, Transfer: 13, Matrix: 0}, // CS_RGB
+}
+
+// ParseVP9Frame parses the uncompressed header at the start of frame.
+func ParseVP9Frame(frame []byte) (VP9Frame, error) {
+	r := &bitReader{b: frame}
+	var f VP9Frame
+	if r.u(2) != 2 {
+		return VP9Frame{}, errors.New("vp9: bad frame marker")
+	}
+	low := r.u(1)
+	f.Profile = int(r.u(1)<<1 | low)
+	if f.Profile == 3 {
+		r.skip(1)
+	}
+	if r.flag() { // show_existing_frame
+		f.Shown = true
+		return f, r.err
+	}
+	f.Key = r.u(1) == 0
+	f.Shown = r.flag()
+	r.skip(1) // error_resilient_mode
+	if !f.Key {
+		return f, r.err
+	}
+	if r.u(24) != 0x498342 {
+		if r.err != nil {
+			return VP9Frame{}, fmt.Errorf("vp9: %w", r.err)
+		}
+		return VP9Frame{}, errors.New("vp9: bad sync code")
+	}
+	f.BitDepthLuma = 8
+	if f.Profile >= 2 {
+		f.BitDepthLuma = 10
+		if r.flag() { // ten_or_twelve_bit
+			f.BitDepthLuma = 12
+		}
+	}
+	f.BitDepthChroma = f.BitDepthLuma
+	f.ChromaFormat = 1
+	if cs := r.u(3); cs != 7 { // color_space != CS_RGB
+		f.Color = vp9Colors[cs]
+		f.Color.FullRange = r.flag()
+		if f.Profile == 1 || f.Profile == 3 {
+			ssx, ssy := r.flag(), r.flag()
+			r.skip(1)
+			switch {
+			case ssx && ssy:
+				f.ChromaFormat = 1
+			case ssx:
+				f.ChromaFormat = 2
+			default:
+				f.ChromaFormat = 3
+			}
+		}
+	} else {
+		f.ChromaFormat = 3
+		f.Color = Color{Primaries: 1, Transfer: 13, Matrix: 0, FullRange: true}
+		if f.Profile == 1 || f.Profile == 3 {
+			r.skip(1)
+		}
+	}
+	f.Width = int(r.u(16)) + 1
+	f.Height = int(r.u(16)) + 1
+	if r.err != nil {
+		return VP9Frame{}, fmt.Errorf("vp9: %w", r.err)
+	}
+	return f, nil
+}
@@ -0,0 +1,100 @@
+package bitstream
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func vp9KeyFrame(profile, bitDepth int, ssx, ssy bool, width, height int) []byte {
+	w := &bitWriter{}
+	w.u(2, 2)
+	w.u(1, uint32(profile&1))
+	w.u(1, uint32(profile>>1))
+	if profile == 3 {
+		w.u(1, 0)
+	}
+	w.u(3, 0b001) // show_existing_frame = 0, KEY_FRAME, show_frame
+	w.u(1, 0)     // error_resilient_mode
+	w.u(24, 0x498342)
+	if profile >= 2 {
+		w.u(1, uint32(bitDepth/12))
+	}
+	w.u(3, 2) // CS_BT_709
+	w.u(1, 0) // color_range
+	if profile == 1 || profile == 3 {
+		for _, b := range []bool{ssx, ssy, false} {
+			if b {
+				w.u(1, 1)
+			} else {
+				w.u(1, 0)
+			}
+		}
+	}
+	w.u(16, uint32(width-1))
+	w.u(16, uint32(height-1))
+	w.u(8, 0)
+	return w.b
+}
+
+func TestParseVP9Frame(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		want  VP9Frame
+	}{
+		{"profile 0 key frame", vp9KeyFrame(0, 8, true, true, 1920, 1080),
+			VP9Frame{SPS{Profile: 0, ChromaFormat: 1, BitDepthLuma: 8, BitDepthChroma: 8, Width: 1920, Height: 1080, Color: bt709}, true, true}},
+		{"profile 1 4:4:4", vp9KeyFrame(1, 8, false, false, 2560, 1440),
+			VP9Frame{SPS{Profile: 1, ChromaFormat: 3, BitDepthLuma: 8, BitDepthChroma: 8, Width: 2560, Height: 1440, Color: bt709}, true, true}},
+		{"profile 2 10-bit", vp9KeyFrame(2, 10, true, true, 3840, 2160),
+			VP9Frame{SPS{Profile: 2, ChromaFormat: 1, BitDepthLuma: 10, BitDepthChroma: 10, Width: 3840, Height: 2160, Color: bt709}, true, true}},
+		{"profile 3 12-bit 4:2:2", vp9KeyFrame(3, 12, true, false, 1280, 720),
+			VP9Frame{SPS{Profile: 3, ChromaFormat: 2, BitDepthLuma: 12, BitDepthChroma: 12, Width: 1280, Height: 720, Color: bt709}, true, true}},
+		{"profile 2 inter frame", []byte{0b10010110}, VP9Frame{SPS{Profile: 2}, false, true}},
+		{"hidden inter frame", []byte{0b10000100}, VP9Frame{Key: false, Shown: false}},
+		{"show existing frame", []byte{0b10001000}, VP9Frame{Shown: true}},
+	}
+	for _, tt := range tests {
+		got, err := ParseVP9Frame(tt.frame)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %+v, %v; want %+v", tt.name, got, err, tt.want)
+		}
+	}
+	for _, bad := range [][]byte{{0x00}, {0x82, 0x49, 0x83, 0x43}, vp9KeyFrame(0, 8, true, true, 64, 64)[:6]} {
+		if _, err := ParseVP9Frame(bad); err == nil {
+			t.Errorf("ParseVP9Frame(%x) succeeded", bad)
+		}
+	}
+}
+
+func TestSplitVP9Superframe(t *testing.T) {
+	hidden := bytes.Repeat([]byte{0x84}, 300)
+	shown := []byte{0x86, 0x01, 0x02}
+	// two frames, 2-byte sizes: marker 0b11001001
+	sf := append(append(append([]byte{}, hidden...), shown...), 0xc9, 0x2c, 0x01, 0x03, 0x00, 0xc9)
+	got := SplitVP9Superframe(sf, nil)
+	if !reflect.DeepEqual(got, [][]byte{hidden, shown}) {
+		t.Fatalf("got %d frames: %x", len(got), got)
+	}
+	for _, single := range [][]byte{shown, append(append([]byte{}, shown...), 0xc0, 0x09, 0xc0)} {
+		if got := SplitVP9Superframe(single, nil); len(got) != 1 || !bytes.Equal(got[0], single) {
+			t.Errorf("SplitVP9Superframe(%x) = %x", single, got)
+		}
+	}
+}
+
+func FuzzSplitVP9Superframe(f *testing.F) {
+	f.Add([]byte{0x84, 0x84, 0x86, 0xc1, 0x02, 0x01, 0xc1})
+	f.Add(vp9KeyFrame(2, 10, true, true, 1920, 1080))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var joined []byte
+		for _, fr := range SplitVP9Superframe(b, nil) {
+			joined = append(joined, fr...)
+			ParseVP9Frame(fr)
+		}
+		if !bytes.HasPrefix(b, joined) {
+			t.Fatal("frames are not a prefix of the input")
+		}
+	})
+}
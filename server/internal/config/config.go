@@ -1,43 +1,465 @@
 package config
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
 	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"pc_cloud/internal/encoder"
 )
 
 type Config struct {
-	ListenAddr       string
-	VideoPort        int
-	AudioPort        int
-	CaptureFramerate int
-	BrowserCmd       string
-	BrowserURL       string
-	DefaultCodec     string // h264|hevc|av1
-	Audio            bool
-}
-
-func Load() Config {
-	c := Config{
-		ListenAddr:       getEnv("LISTEN_ADDR", ":8080"),
-		VideoPort:        getEnvInt("VIDEO_PORT", 5004),
-		AudioPort:        getEnvInt("AUDIO_PORT", 5006),
-		CaptureFramerate: getEnvInt("FRAMERATE", 60),
-		BrowserCmd:       os.Getenv("BROWSER_CMD"),
-		BrowserURL:       getEnv("BROWSER_URL", "http://127.0.0.1:8080/play"),
-		DefaultCodec:     getEnv("DEFAULT_CODEC", "h264"),
-		Audio:            !isTrue(os.Getenv("DISABLE_AUDIO")),
-	}
-	return c
+	ListenAddr       string `yaml:"listen_addr" json:"listen_addr"`
+	Name             string `yaml:"name" json:"name"` // friendly name advertised on the LAN; "" = hostname
+	VideoPort        int    `yaml:"video_port" json:"video_port"`
+	AudioPort        int    `yaml:"audio_port" json:"audio_port"`
+	CaptureFramerate int    `yaml:"framerate" json:"framerate"`
+	BrowserCmd       string `yaml:"browser_cmd" json:"browser_cmd"`
+	BrowserURL       string `yaml:"browser_url" json:"browser_url"`
+	DefaultCodec     string `yaml:"default_codec" json:"default_codec"`     // h264|hevc|av1|vp9|vp8
+	DefaultPreset    string `yaml:"default_preset" json:"default_preset"`   // NVENC p1..p7
+	DefaultBitrate   string `yaml:"default_bitrate" json:"default_bitrate"` // e.g. "20M"
+	DefaultLatency   string `yaml:"default_latency" json:"default_latency"` // ultra-low|balanced|quality
+	Audio            bool   `yaml:"audio" json:"audio"`
+	MicPassthrough   bool   `yaml:"mic_passthrough" json:"mic_passthrough"` // clients may play their mic into a virtual mic
+	AudioDevice      string `yaml:"audio_device" json:"audio_device"`       // id from /api/devices/audio; "" = system default
+	FFmpegPath       string `yaml:"ffmpeg_path" json:"ffmpeg_path"`         // "" = ffmpeg from PATH
+	AV1Container     string `yaml:"av1_container" json:"av1_container"`     // ivf|obu: how FFmpeg hands AV1 to the server
+	LogLevel         string `yaml:"log_level" json:"log_level"`             // debug|info|warn|error
+	LogDir           string `yaml:"log_dir" json:"log_dir"`                 // "" = per-user log directory
+	LogMaxSizeMB     int    `yaml:"log_max_size_mb" json:"log_max_size_mb"`
+	LogMaxAgeDays    int    `yaml:"log_max_age_days" json:"log_max_age_days"`
+	LogMaxBackups    int    `yaml:"log_max_backups" json:"log_max_backups"` // rotated log files kept at most
+
+	// CodecPreference is the order codecs are tried in when the one a
+	// stream asked for is not in the client's offer or not encodable here.
+	CodecPreference []string `yaml:"codec_preference" json:"codec_preference"`
+
+	// HDR says the captured desktop runs in HDR mode (Windows only). It is
+	// then captured as 10-bit PQ and sent as HDR, with HDRTransfer, to
+	// clients that can show it, and tone-mapped to SDR for the others.
+	HDR         bool   `yaml:"hdr" json:"hdr"`
+	HDRTransfer string `yaml:"hdr_transfer" json:"hdr_transfer"` // pq|hlg
+
+	// ColorRange is the quantization range of SDR video, which is always
+	// BT.709: limited (16-235) is what decoders assume when in doubt, full
+	// keeps all 256 levels for clients that honor the flag.
+	ColorRange string `yaml:"color_range" json:"color_range"` // limited|full
+
+	// EncoderMaxRestarts is how many times in a row a crashed FFmpeg is
+	// restarted before the session is ended; 0 disables restarting.
+	EncoderMaxRestarts int `yaml:"encoder_max_restarts" json:"encoder_max_restarts"`
+
+	// Session lifecycle. A session is ended when the PeerConnection stays
+	// disconnected for DisconnectGraceS, when neither input nor RTCP arrived
+	// for IdleTimeoutS, or after MaxSessionMinutes; 0 disables the latter two.
+	DisconnectGraceS  int    `yaml:"disconnect_grace_s" json:"disconnect_grace_s"`
+	IdleTimeoutS      int    `yaml:"idle_timeout_s" json:"idle_timeout_s"`
+	MaxSessionMinutes int    `yaml:"max_session_minutes" json:"max_session_minutes"`
+	WebhookURL        string `yaml:"webhook_url" json:"webhook_url"` // receives session started/ended events
+
+	Profiles       map[string]Profile `yaml:"profiles" json:"profiles"`
+	DefaultProfile string             `yaml:"default_profile" json:"default_profile"` // "" = default_* fields
+	ClientProfiles map[string]string  `yaml:"client_profiles" json:"client_profiles"` // client id -> profile; ids are self-asserted, not authenticated
+	Caps           Caps               `yaml:"caps" json:"caps"`
+}
+
+// Defaults returns the configuration used when neither the config file,
+// the environment nor flags say otherwise.
+func Defaults() Config {
+	return Config{
+		ListenAddr:       ":8080",
+		VideoPort:        5004,
+		AudioPort:        5006,
+		CaptureFramerate: encoder.DefaultFPS,
+		BrowserURL:       "http://127.0.0.1:8080/play",
+		DefaultCodec:     "h264",
+		DefaultPreset:    encoder.DefaultPreset,
+		DefaultBitrate:   encoder.DefaultBitrate,
+		DefaultLatency:   encoder.DefaultLatency,
+		AV1Container:     "ivf",
+		CodecPreference:  []string{"av1", "hevc", "h264", "vp9", "vp8"},
+		HDRTransfer:      "pq",
+		ColorRange:       "limited",
+		Audio:            true,
+		MicPassthrough:   true,
+		LogLevel:         "info",
+		LogMaxSizeMB:     10,
+		LogMaxAgeDays:    7,
+		LogMaxBackups:    10,
+		Profiles:         defaultProfiles(),
+
+		EncoderMaxRestarts: 5,
+		DisconnectGraceS:   15,
+		IdleTimeoutS:       60,
+	}
+}
+
+// Clone returns a copy that shares no maps with c.
+func (c Config) Clone() Config {
+	out := c
+	out.CodecPreference = slices.Clone(c.CodecPreference)
+	out.Profiles = make(map[string]Profile, len(c.Profiles))
+	for k, v := range c.Profiles {
+		out.Profiles[k] = v
+	}
+	out.ClientProfiles = make(map[string]string, len(c.ClientProfiles))
+	for k, v := range c.ClientProfiles {
+		out.ClientProfiles[k] = v
+	}
+	return out
+}
+
+// Dir is the per-machine PCloud data directory (identity.json, config.yaml).
+func Dir() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "PCloud")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "pcloud")
+}
+
+// DefaultPath is where the config file lives unless -config says otherwise.
+func DefaultPath() string { return filepath.Join(Dir(), "config.yaml") }
+
+// Load builds the effective configuration from, in increasing priority:
+// built-in defaults, the config file, environment variables and args
+// (command-line flags, without the program name). A missing config file is
+// created with the defaults so there is something to edit.
+func Load(args []string) (*Store, error) {
+	fs := flag.NewFlagSet("pcloud", flag.ContinueOnError)
+	path := fs.String("config", DefaultPath(), "path to config.yaml")
+	var fl Config
+	fs.StringVar(&fl.ListenAddr, "listen", "", "HTTP listen address, e.g. :8080")
+	fs.StringVar(&fl.Name, "name", "", "friendly name advertised on the LAN")
+	fs.IntVar(&fl.CaptureFramerate, "fps", 0, "default capture framerate")
+	fs.StringVar(&fl.DefaultCodec, "codec", "", "default codec: h264|hevc|av1|vp9|vp8")
+	fs.StringVar(&fl.DefaultPreset, "preset", "", "default NVENC preset p1..p7")
+	fs.StringVar(&fl.DefaultBitrate, "bitrate", "", "default video bitrate, e.g. 20M")
+	fs.StringVar(&fl.DefaultLatency, "latency", "", "default latency mode: ultra-low|balanced|quality")
+	fs.StringVar(&fl.FFmpegPath, "ffmpeg", "", "path to the ffmpeg binary")
+	fs.StringVar(&fl.AudioDevice, "audio-device", "", "audio capture device id, see /api/devices/audio")
+	fs.StringVar(&fl.LogLevel, "log-level", "", "log level: debug|info|warn|error")
+	noAudio := fs.Bool("no-audio", false, "disable audio capture")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	overrides := func(c *Config) {
+		applyEnv(c)
+		if set["listen"] {
+			c.ListenAddr = fl.ListenAddr
+		}
+		if set["name"] {
+			c.Name = fl.Name
+		}
+		if set["fps"] {
+			c.CaptureFramerate = fl.CaptureFramerate
+		}
+		if set["codec"] {
+			c.DefaultCodec = fl.DefaultCodec
+		}
+		if set["preset"] {
+			c.DefaultPreset = fl.DefaultPreset
+		}
+		if set["bitrate"] {
+			c.DefaultBitrate = fl.DefaultBitrate
+		}
+		if set["latency"] {
+			c.DefaultLatency = fl.DefaultLatency
+		}
+		if set["ffmpeg"] {
+			c.FFmpegPath = fl.FFmpegPath
+		}
+		if set["audio-device"] {
+			c.AudioDevice = fl.AudioDevice
+		}
+		if set["log-level"] {
+			c.LogLevel = fl.LogLevel
+		}
+		if *noAudio {
+			c.Audio = false
+		}
+	}
+
+	s := &Store{path: *path, overrides: overrides}
+	if _, err := os.Stat(s.path); errors.Is(err, os.ErrNotExist) {
+		if err := writeFile(s.path, Defaults()); err != nil {
+			return nil, fmt.Errorf("create %s: %w", s.path, err)
+		}
+	}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func applyEnv(c *Config) {
+	c.ListenAddr = getEnv("LISTEN_ADDR", c.ListenAddr)
+	c.Name = getEnv("PCLOUD_NAME", c.Name)
+	c.VideoPort = getEnvInt("VIDEO_PORT", c.VideoPort)
+	c.AudioPort = getEnvInt("AUDIO_PORT", c.AudioPort)
+	c.CaptureFramerate = getEnvInt("FRAMERATE", c.CaptureFramerate)
+	c.BrowserCmd = getEnv("BROWSER_CMD", c.BrowserCmd)
+	c.BrowserURL = getEnv("BROWSER_URL", c.BrowserURL)
+	c.DefaultCodec = getEnv("DEFAULT_CODEC", c.DefaultCodec)
+	c.DefaultPreset = getEnv("DEFAULT_PRESET", c.DefaultPreset)
+	c.DefaultBitrate = getEnv("DEFAULT_BITRATE", c.DefaultBitrate)
+	c.DefaultLatency = getEnv("DEFAULT_LATENCY", c.DefaultLatency)
+	c.FFmpegPath = getEnv("FFMPEG_PATH", c.FFmpegPath)
+	c.AV1Container = getEnv("AV1_CONTAINER", c.AV1Container)
+	c.AudioDevice = getEnv("AUDIO_DEVICE", c.AudioDevice)
+	c.LogLevel = getEnv("LOG_LEVEL", c.LogLevel)
+	if isTrue(os.Getenv("DISABLE_AUDIO")) {
+		c.Audio = false
+	}
+	if isTrue(os.Getenv("HDR")) {
+		c.HDR = true
+	}
+	c.HDRTransfer = getEnv("HDR_TRANSFER", c.HDRTransfer)
+	c.ColorRange = getEnv("COLOR_RANGE", c.ColorRange)
 }
 
+func readFile(path string) (Config, error) {
+	c := Defaults()
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	// a profiles section in the file replaces the built-in set entirely
+	c.Profiles = nil
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("%s: %w", path, err)
+	}
+	if c.Profiles == nil {
+		c.Profiles = defaultProfiles()
+	}
+	return c, nil
+}
+
+func writeFile(path string, c Config) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Normalize lower-cases and trims the enum-like fields.
+func (c *Config) Normalize() {
+	c.Name = strings.TrimSpace(c.Name)
+	c.DefaultCodec = strings.ToLower(strings.TrimSpace(c.DefaultCodec))
+	if c.DefaultCodec == "h265" {
+		c.DefaultCodec = "hevc"
+	}
+	c.DefaultPreset = strings.ToLower(strings.TrimSpace(c.DefaultPreset))
+	c.DefaultBitrate = strings.TrimSpace(c.DefaultBitrate)
+	c.DefaultLatency = strings.ToLower(strings.TrimSpace(c.DefaultLatency))
+	c.FFmpegPath = strings.TrimSpace(c.FFmpegPath)
+	c.AV1Container = strings.ToLower(strings.TrimSpace(c.AV1Container))
+	for i, codec := range c.CodecPreference {
+		c.CodecPreference[i] = strings.ToLower(strings.TrimSpace(codec))
+		if c.CodecPreference[i] == "h265" {
+			c.CodecPreference[i] = "hevc"
+		}
+	}
+	c.HDRTransfer = strings.ToLower(strings.TrimSpace(c.HDRTransfer))
+	c.ColorRange = strings.ToLower(strings.TrimSpace(c.ColorRange))
+	c.AudioDevice = strings.TrimSpace(c.AudioDevice)
+	c.LogLevel = strings.ToLower(strings.TrimSpace(c.LogLevel))
+	c.WebhookURL = strings.TrimSpace(c.WebhookURL)
+	c.DefaultProfile = strings.TrimSpace(c.DefaultProfile)
+	for name, p := range c.Profiles {
+		p.Codec = strings.ToLower(strings.TrimSpace(p.Codec))
+		if p.Codec == "h265" {
+			p.Codec = "hevc"
+		}
+		p.Preset = strings.ToLower(strings.TrimSpace(p.Preset))
+		p.Bitrate = strings.TrimSpace(p.Bitrate)
+		p.Chroma = strings.TrimSpace(p.Chroma)
+		p.Latency = strings.ToLower(strings.TrimSpace(p.Latency))
+		c.Profiles[name] = p
+	}
+}
+
+// Validate reports every invalid field, one per line.
+func (c Config) Validate() error {
+	var errs []error
+	bad := func(field, format string, a ...any) {
+		errs = append(errs, fmt.Errorf("%s: "+format, append([]any{field}, a...)...))
+	}
+	if _, port, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		bad("listen_addr", "must look like \":8080\" or \"0.0.0.0:8080\"")
+	} else if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		bad("listen_addr", "port %q is not between 1 and 65535", port)
+	}
+	for field, p := range map[string]int{"video_port": c.VideoPort, "audio_port": c.AudioPort} {
+		if p < 0 || p > 65535 {
+			bad(field, "%d is not between 0 and 65535", p)
+		}
+	}
+	if c.CaptureFramerate < 1 || c.CaptureFramerate > 240 {
+		bad("framerate", "%d is not between 1 and 240", c.CaptureFramerate)
+	}
+	if !validCodec(c.DefaultCodec) {
+		bad("default_codec", "%q is not one of h264, hevc, av1, vp9, vp8", c.DefaultCodec)
+	}
+	if !validPreset(c.DefaultPreset) {
+		bad("default_preset", "%q is not one of p1..p7", c.DefaultPreset)
+	}
+	if _, err := ParseBitrate(c.DefaultBitrate); err != nil {
+		bad("default_bitrate", "%v", err)
+	}
+	if !slices.Contains(encoder.LatencyModes, c.DefaultLatency) {
+		bad("default_latency", "%q is not one of %s", c.DefaultLatency, strings.Join(encoder.LatencyModes, ", "))
+	}
+	for _, codec := range c.CodecPreference {
+		if !validCodec(codec) {
+			bad("codec_preference", "%q is not one of h264, hevc, av1, vp9, vp8", codec)
+		}
+	}
+	if c.AV1Container != "ivf" && c.AV1Container != "obu" {
+		bad("av1_container", "%q is not one of ivf, obu", c.AV1Container)
+	}
+	if c.HDRTransfer != "pq" && c.HDRTransfer != "hlg" {
+		bad("hdr_transfer", "%q is not one of pq, hlg", c.HDRTransfer)
+	}
+	if c.ColorRange != "limited" && c.ColorRange != "full" {
+		bad("color_range", "%q is not one of limited, full", c.ColorRange)
+	}
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		bad("log_level", "%q is not one of debug, info, warn, error", c.LogLevel)
+	}
+	if c.LogMaxSizeMB < 1 {
+		bad("log_max_size_mb", "must be at least 1")
+	}
+	if c.LogMaxAgeDays < 1 {
+		bad("log_max_age_days", "must be at least 1")
+	}
+	if c.LogMaxBackups < 1 {
+		bad("log_max_backups", "must be at least 1")
+	}
+	for field, v := range map[string]int{
+		"encoder_max_restarts": c.EncoderMaxRestarts,
+		"idle_timeout_s":       c.IdleTimeoutS,
+		"max_session_minutes":  c.MaxSessionMinutes,
+	} {
+		if v < 0 {
+			bad(field, "must not be negative")
+		}
+	}
+	if c.DisconnectGraceS < 1 {
+		bad("disconnect_grace_s", "must be at least 1")
+	}
+	if c.WebhookURL != "" {
+		if u, err := url.Parse(c.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			bad("webhook_url", "%q is not an http(s) URL", c.WebhookURL)
+		}
+	}
+	if err := c.validateProfiles(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Port returns the TCP port from ListenAddr, or 0 if it has none.
+func (c Config) Port() int {
+	_, p, err := net.SplitHostPort(c.ListenAddr)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(p)
+	return n
+}
+
+// RestartRequired lists the settings that differ between prev and next and
+// only take effect after the server restarts. The mDNS instance name is
+// fixed when the responder starts, hence name.
+func RestartRequired(prev, next Config) []string {
+	var out []string
+	if prev.ListenAddr != next.ListenAddr {
+		out = append(out, "listen_addr")
+	}
+	if prev.Name != next.Name {
+		out = append(out, "name")
+	}
+	if prev.LogDir != next.LogDir {
+		out = append(out, "log_dir")
+	}
+	if prev.LogMaxSizeMB != next.LogMaxSizeMB {
+		out = append(out, "log_max_size_mb")
+	}
+	if prev.LogMaxAgeDays != next.LogMaxAgeDays {
+		out = append(out, "log_max_age_days")
+	}
+	if prev.LogMaxBackups != next.LogMaxBackups {
+		out = append(out, "log_max_backups")
+	}
+	return out
+}
+
+// FileOnlyChanges lists the settings that differ between prev and next and
+// may only be set in the config file, the environment or flags: they name
+// a program the server runs, where it writes, or a URL it calls, so the
+// settings API leaves them alone.
+func FileOnlyChanges(prev, next Config) []string {
+	var out []string
+	if prev.FFmpegPath != next.FFmpegPath {
+		out = append(out, "ffmpeg_path")
+	}
+	if prev.LogDir != next.LogDir {
+		out = append(out, "log_dir")
+	}
+	if prev.WebhookURL != next.WebhookURL {
+		out = append(out, "webhook_url")
+	}
+	return out
+}
+
+func validPreset(p string) bool {
+	return len(p) == 2 && p[0] == 'p' && p[1] >= '1' && p[1] <= '7'
+}
+
+// ParseBitrate parses FFmpeg-style rates ("20M", "800k", "2500000") into
+// bits per second.
+func ParseBitrate(s string) (int64, error) { return encoder.ParseBitrate(s) }
+
 func getEnv(key, def string) string {
-	if v := os.Getenv(key); v != "" { return v }
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
 	return def
 }
 
 func getEnvInt(key string, def int) int {
 	if v := os.Getenv(key); v != "" {
-		if n, err := strconv.Atoi(v); err == nil { return n }
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
 	}
 	return def
 }
@@ -0,0 +1,327 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// load writes file (if not empty) to a temporary config path and loads it
+// with args.
+func load(t *testing.T, file string, args ...string) (*Store, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if file != "" {
+		if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return Load(append([]string{"-config", path}, args...))
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want func(c Config) bool
+	}{
+		{"defaults", "", nil, nil,
+			func(c Config) bool { return c.ListenAddr == ":8080" && c.DefaultCodec == "h264" && c.Audio }},
+		{"file over defaults", "listen_addr: \":9000\"\ndefault_codec: av1\n", nil, nil,
+			func(c Config) bool { return c.ListenAddr == ":9000" && c.DefaultCodec == "av1" }},
+		{"env over file", "listen_addr: \":9000\"\n", map[string]string{"LISTEN_ADDR": ":9100", "DISABLE_AUDIO": "1"}, nil,
+			func(c Config) bool { return c.ListenAddr == ":9100" && !c.Audio }},
+		{"flags over env", "ffmpeg_path: /opt/a/ffmpeg\n", map[string]string{"FFMPEG_PATH": "/opt/b/ffmpeg", "DEFAULT_CODEC": "vp9"},
+			[]string{"-ffmpeg", "/opt/c/ffmpeg", "-codec", "hevc"},
+			func(c Config) bool { return c.FFmpegPath == "/opt/c/ffmpeg" && c.DefaultCodec == "hevc" }},
+		{"flag set to empty still wins", "name: den\n", nil, []string{"-name", ""},
+			func(c Config) bool { return c.Name == "" }},
+		{"no-audio", "audio: true\n", nil, []string{"-no-audio"},
+			func(c Config) bool { return !c.Audio }},
+		{"normalized", "default_codec: \" H265 \"\ndefault_latency: Ultra-Low\ncodec_preference: [AV1, h265]\n", nil, nil,
+			func(c Config) bool {
+				return c.DefaultCodec == "hevc" && c.DefaultLatency == "ultra-low" && slices.Equal(c.CodecPreference, []string{"av1", "hevc"})
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			s, err := load(t, tt.file, tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c := s.Get(); !tt.want(c) {
+				t.Errorf("got %+v", c)
+			}
+		})
+	}
+}
+
+func TestLoadKeepsOverridesOutOfFile(t *testing.T) {
+	t.Setenv("LISTEN_ADDR", ":9100")
+	s, err := load(t, "listen_addr: \":9000\"\n", "-bitrate", "30M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := s.File(); f.ListenAddr != ":9000" || f.DefaultBitrate != Defaults().DefaultBitrate {
+		t.Errorf("File() = %+v, want the file without env and flags", f)
+	}
+	if c := s.Get(); c.ListenAddr != ":9100" || c.DefaultBitrate != "30M" {
+		t.Errorf("Get() = %+v, want the overrides applied", c)
+	}
+}
+
+func TestLoadCreatesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "config.yaml")
+	if _, err := Load([]string{"-config", path}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := readFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ListenAddr != Defaults().ListenAddr || len(c.Profiles) != len(defaultProfiles()) {
+		t.Errorf("created file holds %+v, want the defaults", c)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		args []string
+		want string
+	}{
+		{"invalid value", "framerate: 500\n", nil, "framerate: 500 is not between 1 and 240"},
+		{"invalid flag value", "", []string{"-codec", "mpeg2"}, `default_codec: "mpeg2" is not one of`},
+		{"bad yaml", "listen_addr: [\n", nil, "config.yaml"},
+		{"unknown flag", "", []string{"-nope"}, "not defined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := load(t, tt.file, tt.args...)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Defaults().Validate(); err != nil {
+		t.Fatalf("defaults: %v", err)
+	}
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   []string // one line of the error each
+	}{
+		{"listen_addr", func(c *Config) { c.ListenAddr = "8080" }, []string{`listen_addr: must look like ":8080" or "0.0.0.0:8080"`}},
+		{"listen port", func(c *Config) { c.ListenAddr = ":70000" }, []string{`listen_addr: port "70000" is not between 1 and 65535`}},
+		{"video_port", func(c *Config) { c.VideoPort = -1 }, []string{"video_port: -1 is not between 0 and 65535"}},
+		{"preset", func(c *Config) { c.DefaultPreset = "p8" }, []string{`default_preset: "p8" is not one of p1..p7`}},
+		{"bitrate", func(c *Config) { c.DefaultBitrate = "fast" }, []string{`default_bitrate: "fast" is not a bitrate like 20M or 800k`}},
+		{"latency", func(c *Config) { c.DefaultLatency = "instant" }, []string{`default_latency: "instant" is not one of ultra-low, balanced, quality`}},
+		{"codec_preference", func(c *Config) { c.CodecPreference = []string{"h264", "theora"} },
+			[]string{`codec_preference: "theora" is not one of h264, hevc, av1, vp9, vp8`}},
+		{"av1_container", func(c *Config) { c.AV1Container = "mp4" }, []string{`av1_container: "mp4" is not one of ivf, obu`}},
+		{"hdr_transfer", func(c *Config) { c.HDRTransfer = "sdr" }, []string{`hdr_transfer: "sdr" is not one of pq, hlg`}},
+		{"color_range", func(c *Config) { c.ColorRange = "pc" }, []string{`color_range: "pc" is not one of limited, full`}},
+		{"log_level", func(c *Config) { c.LogLevel = "trace" }, []string{`log_level: "trace" is not one of debug, info, warn, error`}},
+		{"log limits", func(c *Config) { c.LogMaxSizeMB, c.LogMaxAgeDays, c.LogMaxBackups = 0, 0, 0 },
+			[]string{"log_max_size_mb: must be at least 1", "log_max_age_days: must be at least 1", "log_max_backups: must be at least 1"}},
+		{"negative timeouts", func(c *Config) { c.IdleTimeoutS = -1 }, []string{"idle_timeout_s: must not be negative"}},
+		{"disconnect grace", func(c *Config) { c.DisconnectGraceS = 0 }, []string{"disconnect_grace_s: must be at least 1"}},
+		{"webhook", func(c *Config) { c.WebhookURL = "ftp://example.com/hook" }, []string{`webhook_url: "ftp://example.com/hook" is not an http(s) URL`}},
+		{"profile", func(c *Config) {
+			c.Profiles["tv"] = Profile{Codec: "h264", FPS: 0, Width: 1920, Preset: "p4", Bitrate: "10M", Chroma: "422"}
+		},
+			[]string{"profiles.tv.fps: 0 is not between 1 and 240", "profiles.tv.width: width and height must both be 0 (native) or both positive",
+				`profiles.tv.chroma: "422" is not one of 420, 444`}},
+		{"profile references", func(c *Config) { c.DefaultProfile, c.ClientProfiles = "gone", map[string]string{"tv": "missing"} },
+			[]string{`default_profile: "gone" is not a configured profile`, `client_profiles.tv: "missing" is not a configured profile`}},
+		{"caps", func(c *Config) { c.Caps = Caps{MaxBitrate: "lots", MaxFPS: -1} },
+			[]string{`caps.max_bitrate: "lots" is not a bitrate like 20M or 800k`, "caps: limits must be 0 (none) or positive"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Defaults()
+			tt.change(&c)
+			err := c.Validate()
+			if err == nil {
+				t.Fatal("no error")
+			}
+			lines := strings.Split(err.Error(), "\n")
+			slices.Sort(lines)
+			want := slices.Sorted(slices.Values(tt.want))
+			if !slices.Equal(lines, want) {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+			}
+		})
+	}
+}
+
+func TestProfilesFromFile(t *testing.T) {
+	s, err := load(t, "profiles:\n  tv:\n    codec: hevc\n    fps: 60\n    preset: p5\n    bitrate: 40M\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := s.Get().ProfileNames(); !slices.Equal(names, []string{"tv"}) {
+		t.Errorf("profiles %v, want the file's to replace the built-in set", names)
+	}
+
+	s, err = load(t, "default_profile: wifi-1080p\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Get(); len(got.Profiles) != len(defaultProfiles()) || got.DefaultProfile != "wifi-1080p" {
+		t.Errorf("got %v, want the built-in profiles without a profiles section", got.ProfileNames())
+	}
+}
+
+func TestStoreUpdate(t *testing.T) {
+	t.Setenv("DEFAULT_CODEC", "vp9")
+	s, err := load(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls []string
+	s.OnChange(func(prev, next Config) { calls = append(calls, prev.ListenAddr+">"+next.ListenAddr) })
+
+	c := s.File()
+	c.ListenAddr = ":9000"
+	c.DefaultBitrate = "50M"
+	c.DefaultCodec = "av1"
+	res, err := s.Update(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(res.RestartRequired, []string{"listen_addr"}) || !slices.Equal(res.Overridden, []string{"default_codec"}) {
+		t.Errorf("restart %v, overridden %v, want [listen_addr] and [default_codec]", res.RestartRequired, res.Overridden)
+	}
+	if res.Config.DefaultCodec != "vp9" || s.Get().DefaultBitrate != "50M" {
+		t.Errorf("got %+v, want the update with env still winning", res.Config)
+	}
+	if !slices.Equal(calls, []string{":8080>:9000"}) {
+		t.Errorf("OnChange calls %v", calls)
+	}
+	onDisk, err := readFile(s.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if onDisk.ListenAddr != ":9000" || onDisk.DefaultCodec != "av1" {
+		t.Errorf("file has %+v, want the update without the env override", onDisk)
+	}
+
+	c.DefaultPreset = "fast"
+	if _, err := s.Update(c); err == nil || !strings.Contains(err.Error(), "default_preset") {
+		t.Errorf("got %v, want a default_preset error", err)
+	}
+	if s.Get().DefaultPreset != Defaults().DefaultPreset || len(calls) != 1 {
+		t.Error("an invalid update changed the config")
+	}
+	if onDisk, _ := readFile(s.Path()); onDisk.DefaultPreset != Defaults().DefaultPreset {
+		t.Error("an invalid update was written")
+	}
+}
+
+func TestStoreWatch(t *testing.T) {
+	s, err := load(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Watch(ctx, 5*time.Millisecond)
+
+	// explicit mtimes, as the file system may not tell writes apart
+	edit := func(content string, mt time.Time) {
+		if err := os.WriteFile(s.Path(), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(s.Path(), mt, mt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor := func(what string, ok func(Config) bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !ok(s.Get()) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: got %+v", what, s.Get())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	now := time.Now()
+	edit("default_bitrate: 12M\n", now.Add(time.Second))
+	waitFor("edit not picked up", func(c Config) bool { return c.DefaultBitrate == "12M" })
+
+	edit("default_bitrate: 12M\nframerate: 0\n", now.Add(2*time.Second))
+	time.Sleep(50 * time.Millisecond)
+	if c := s.Get(); c.CaptureFramerate != Defaults().CaptureFramerate {
+		t.Errorf("an invalid edit was applied: %+v", c)
+	}
+	edit("default_bitrate: 14M\n", now.Add(3*time.Second))
+	waitFor("edit after an invalid one not picked up", func(c Config) bool { return c.DefaultBitrate == "14M" })
+}
+
+func TestRestartRequired(t *testing.T) {
+	tests := []struct {
+		change func(c *Config)
+		want   []string
+	}{
+		{func(c *Config) {}, nil},
+		{func(c *Config) { c.DefaultBitrate, c.FFmpegPath = "5M", "/opt/ffmpeg" }, nil},
+		{func(c *Config) { c.ListenAddr, c.Name = ":9000", "den" }, []string{"listen_addr", "name"}},
+		{func(c *Config) {
+			c.LogDir, c.LogMaxSizeMB, c.LogMaxAgeDays, c.LogMaxBackups = "/var/log/pcloud", 20, 30, 3
+		},
+			[]string{"log_dir", "log_max_size_mb", "log_max_age_days", "log_max_backups"}},
+	}
+	for _, tt := range tests {
+		next := Defaults()
+		tt.change(&next)
+		if got := RestartRequired(Defaults(), next); !slices.Equal(got, tt.want) {
+			t.Errorf("got %v, want %v", got, tt.want)
+		}
+	}
+}
+
+func TestFileOnlyChanges(t *testing.T) {
+	tests := []struct {
+		change func(c *Config)
+		want   []string
+	}{
+		{func(c *Config) { c.Name, c.DefaultCodec = "den", "av1" }, nil},
+		{func(c *Config) { c.FFmpegPath = "/tmp/x" }, []string{"ffmpeg_path"}},
+		{func(c *Config) { c.LogDir, c.WebhookURL = "/tmp", "http://10.0.0.1/" }, []string{"log_dir", "webhook_url"}},
+	}
+	for _, tt := range tests {
+		next := Defaults()
+		tt.change(&next)
+		if got := FileOnlyChanges(Defaults(), next); !slices.Equal(got, tt.want) {
+			t.Errorf("got %v, want %v", got, tt.want)
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	c := Defaults()
+	c.ClientProfiles = map[string]string{"tv": "lan-4k60"}
+	d := c.Clone()
+	d.CodecPreference[0] = "vp8"
+	d.Profiles["new"] = Profile{}
+	d.ClientProfiles["tv"] = "mobile-720p"
+	if c.CodecPreference[0] != "av1" || len(c.Profiles) != len(defaultProfiles()) || c.ClientProfiles["tv"] != "lan-4k60" {
+		t.Errorf("changing the clone changed the original: %+v", c)
+	}
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"pc_cloud/internal/encoder"
+)
+
+// Profile is a named set of stream settings a client can ask for instead of
+// sending every parameter in its offer.
+type Profile struct {
+	Codec   string `yaml:"codec" json:"codec"` // h264|hevc|av1|vp9|vp8
+	FPS     int    `yaml:"fps" json:"fps"`
+	Width   int    `yaml:"width" json:"width"`   // 0 = native
+	Height  int    `yaml:"height" json:"height"` // 0 = native
+	Preset  string `yaml:"preset" json:"preset"`
+	Bitrate string `yaml:"bitrate" json:"bitrate"`
+	Chroma  string `yaml:"chroma,omitempty" json:"chroma,omitempty"`   // 420 (default) or 444, sharper text where the encoder and client have it
+	Latency string `yaml:"latency,omitempty" json:"latency,omitempty"` // ultra-low|balanced|quality; "" = default_latency
+	// IntraRefresh refreshes the picture gradually instead of with periodic
+	// keyframes, where the encoder can (NVENC H.264/HEVC, libx264); unset
+	// means on for ultra-low latency only, false turns it off there too
+	IntraRefresh *bool `yaml:"intra_refresh,omitempty" json:"intra_refresh,omitempty"`
+}
+
+// Caps are hard limits applied to every stream after profile and client
+// settings are merged. Zero values mean "no limit".
+type Caps struct {
+	MaxBitrate string `yaml:"max_bitrate" json:"max_bitrate"`
+	MaxWidth   int    `yaml:"max_width" json:"max_width"`
+	MaxHeight  int    `yaml:"max_height" json:"max_height"`
+	MaxFPS     int    `yaml:"max_fps" json:"max_fps"`
+}
+
+func defaultProfiles() map[string]Profile {
+	return map[string]Profile{
+		"lan-4k60":    {Codec: "hevc", FPS: 60, Width: 3840, Height: 2160, Preset: encoder.DefaultPreset, Bitrate: "80M"},
+		"wifi-1080p":  {Codec: "h264", FPS: 60, Width: 1920, Height: 1080, Preset: encoder.DefaultPreset, Bitrate: encoder.DefaultBitrate},
+		"mobile-720p": {Codec: "h264", FPS: 30, Width: 1280, Height: 720, Preset: encoder.DefaultPreset, Bitrate: "6M"},
+		// native resolution and full chroma, for text and UI over motion
+		"desktop-text": {Codec: "h264", FPS: 60, Preset: encoder.DefaultPreset, Bitrate: "30M", Chroma: "444"},
+	}
+}
+
+// DefaultStream is the profile built from the default_* fields; it applies
+// when neither the offer, the client nor default_profile name one.
+func (c Config) DefaultStream() Profile {
+	return Profile{
+		Codec:   c.DefaultCodec,
+		FPS:     c.CaptureFramerate,
+		Preset:  c.DefaultPreset,
+		Bitrate: c.DefaultBitrate,
+		Latency: c.DefaultLatency,
+	}
+}
+
+// ProfileFor resolves the profile for an offer: the one it names, else the
+// client's default, else default_profile, else DefaultStream. Naming a
+// profile that doesn't exist is an error.
+func (c Config) ProfileFor(name, clientID string) (Profile, string, error) {
+	if name != "" {
+		p, ok := c.Profiles[name]
+		if !ok {
+			return Profile{}, "", fmt.Errorf("unknown profile %q (have %v)", name, c.ProfileNames())
+		}
+		return p, name, nil
+	}
+	if n := c.ClientProfiles[clientID]; clientID != "" && n != "" {
+		if p, ok := c.Profiles[n]; ok {
+			return p, n, nil
+		}
+	}
+	if p, ok := c.Profiles[c.DefaultProfile]; ok {
+		return p, c.DefaultProfile, nil
+	}
+	return c.DefaultStream(), "", nil
+}
+
+// ProfileNames returns the configured profile names, sorted.
+func (c Config) ProfileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for n := range c.Profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func validCodec(codec string) bool {
+	switch codec {
+	case "h264", "hevc", "av1", "vp9", "vp8":
+		return true
+	}
+	return false
+}
+
+func (p Profile) validate(field string) []error {
+	var errs []error
+	bad := func(sub, format string, a ...any) {
+		errs = append(errs, fmt.Errorf("%s.%s: "+format, append([]any{field, sub}, a...)...))
+	}
+	if !validCodec(p.Codec) {
+		bad("codec", "%q is not one of h264, hevc, av1, vp9, vp8", p.Codec)
+	}
+	if p.FPS < 1 || p.FPS > 240 {
+		bad("fps", "%d is not between 1 and 240", p.FPS)
+	}
+	if p.Width < 0 || p.Height < 0 || (p.Width == 0) != (p.Height == 0) {
+		bad("width", "width and height must both be 0 (native) or both positive")
+	}
+	if !validPreset(p.Preset) {
+		bad("preset", "%q is not one of p1..p7", p.Preset)
+	}
+	if _, err := ParseBitrate(p.Bitrate); err != nil {
+		bad("bitrate", "%v", err)
+	}
+	if p.Chroma != "" && p.Chroma != "420" && p.Chroma != "444" {
+		bad("chroma", "%q is not one of 420, 444", p.Chroma)
+	}
+	if p.Latency != "" && !slices.Contains(encoder.LatencyModes, p.Latency) {
+		bad("latency", "%q is not one of %s", p.Latency, strings.Join(encoder.LatencyModes, ", "))
+	}
+	return errs
+}
+
+func (c Config) validateProfiles() error {
+	var errs []error
+	for _, name := range c.ProfileNames() {
+		errs = append(errs, c.Profiles[name].validate("profiles."+name)...)
+	}
+	if c.DefaultProfile != "" {
+		if _, ok := c.Profiles[c.DefaultProfile]; !ok {
+			errs = append(errs, fmt.Errorf("default_profile: %q is not a configured profile", c.DefaultProfile))
+		}
+	}
+	for client, name := range c.ClientProfiles {
+		if _, ok := c.Profiles[name]; !ok {
+			errs = append(errs, fmt.Errorf("client_profiles.%s: %q is not a configured profile", client, name))
+		}
+	}
+	if c.Caps.MaxBitrate != "" {
+		if _, err := ParseBitrate(c.Caps.MaxBitrate); err != nil {
+			errs = append(errs, fmt.Errorf("caps.max_bitrate: %v", err))
+		}
+	}
+	if c.Caps.MaxWidth < 0 || c.Caps.MaxHeight < 0 || c.Caps.MaxFPS < 0 {
+		errs = append(errs, errors.New("caps: limits must be 0 (none) or positive"))
+	}
+	return errors.Join(errs...)
+}
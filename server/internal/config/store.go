@@ -0,0 +1,171 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"pc_cloud/internal/logging"
+)
+
+var log = logging.For("config")
+
+// Store holds the live configuration. Readers call Get on every use, so
+// settings that don't need a restart take effect as soon as they change,
+// whether through Update or an edit of the file on disk.
+type Store struct {
+	path      string
+	overrides func(*Config) // env + flags, re-applied on every load
+
+	mu      sync.RWMutex
+	cur     Config
+	file    Config // cur without the overrides, as the file has it
+	modTime time.Time
+	subs    []func(prev, next Config)
+}
+
+// Get returns a copy of the current config; callers may modify it freely.
+func (s *Store) Get() Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cur.Clone()
+}
+
+// File returns a copy of the config as the file has it, without the env
+// and flag overrides. Changes meant to be saved start from this.
+func (s *Store) File() Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.file.Clone()
+}
+
+// Path is the config file backing the store.
+func (s *Store) Path() string { return s.path }
+
+// OnChange registers fn to be called after every successful change.
+func (s *Store) OnChange(fn func(prev, next Config)) {
+	s.mu.Lock()
+	s.subs = append(s.subs, fn)
+	s.mu.Unlock()
+}
+
+// UpdateResult tells the caller how an Update landed.
+type UpdateResult struct {
+	Config          Config   `json:"config"`           // effective config after the update
+	RestartRequired []string `json:"restart_required"` // changed fields that need a restart
+	Overridden      []string `json:"overridden"`       // fields pinned by env vars or flags
+}
+
+// Update validates c, a file-level config as File returns it, writes it to
+// the config file and makes it current with the overrides applied again.
+func (s *Store) Update(c Config) (UpdateResult, error) {
+	c = c.Clone()
+	c.Normalize()
+	if err := c.Validate(); err != nil {
+		return UpdateResult{}, err
+	}
+	if err := writeFile(s.path, c); err != nil {
+		return UpdateResult{}, err
+	}
+	eff := c.Clone()
+	s.overrides(&eff)
+	eff.Normalize()
+
+	old := s.set(c, eff, fileModTime(s.path))
+	return UpdateResult{
+		Config:          eff.Clone(),
+		RestartRequired: RestartRequired(old, eff),
+		Overridden:      diffFields(c, eff),
+	}, nil
+}
+
+// Watch polls the config file and reloads it when it changes on disk.
+// Invalid edits are logged and ignored; the previous config stays active.
+func (s *Store) Watch(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		mt := fileModTime(s.path)
+		s.mu.RLock()
+		same := mt.Equal(s.modTime)
+		s.mu.RUnlock()
+		if same {
+			continue
+		}
+		old := s.Get()
+		if err := s.reload(); err != nil {
+			log.Error("ignoring invalid config file", "path", s.path, "err", err)
+			s.mu.Lock()
+			s.modTime = mt
+			s.mu.Unlock()
+			continue
+		}
+		log.Info("config reloaded", "path", s.path)
+		if r := RestartRequired(old, s.Get()); len(r) > 0 {
+			log.Warn("some changes take effect after restart", "fields", r)
+		}
+	}
+}
+
+func (s *Store) reload() error {
+	mt := fileModTime(s.path)
+	c, err := readFile(s.path)
+	if err != nil {
+		return err
+	}
+	file := c.Clone()
+	file.Normalize()
+	s.overrides(&c)
+	c.Normalize()
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	s.set(file, c, mt)
+	return nil
+}
+
+// set makes c, built from file, the current config.
+func (s *Store) set(file, c Config, mt time.Time) (old Config) {
+	s.mu.Lock()
+	old, s.cur, s.file, s.modTime = s.cur, c, file, mt
+	subs := append([]func(prev, next Config){}, s.subs...)
+	s.mu.Unlock()
+	for _, fn := range subs {
+		fn(old.Clone(), c.Clone())
+	}
+	return old
+}
+
+func fileModTime(path string) time.Time {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// diffFields returns the JSON names of fields whose values differ.
+func diffFields(a, b Config) []string {
+	var ma, mb map[string]json.RawMessage
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	_ = json.Unmarshal(ja, &ma)
+	_ = json.Unmarshal(jb, &mb)
+	var out []string
+	for k, v := range ma {
+		if !bytes.Equal(v, mb[k]) {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,196 @@
+package devices
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AudioApp is an application stream currently playing (a Pulse sink input).
+type AudioApp struct {
+	ID      string `json:"id"`      // sink input index
+	Name    string `json:"name"`    // application.name, e.g. "Firefox"
+	Process string `json:"process"` // executable, e.g. "firefox"
+	PID     int    `json:"pid,omitempty"`
+	Sink    string `json:"sink"`   // index of the sink it plays to
+	Corked  bool   `json:"corked"` // paused
+}
+
+// ListAudioApps returns the application streams playing right now.
+func ListAudioApps(ctx context.Context) ([]AudioApp, error) {
+	if runtime.GOOS == "windows" {
+		return nil, fmt.Errorf("per-application audio: %w", errors.ErrUnsupported)
+	}
+	out, err := command(ctx, "pactl", "list", "sink-inputs")
+	if err != nil {
+		return nil, err
+	}
+	return parsePactlSinkInputs(out), nil
+}
+
+// parsePactlSinkInputs reads `pactl list sink-inputs`.
+func parsePactlSinkInputs(out string) []AudioApp {
+	var apps []AudioApp
+	var cur *AudioApp
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		line := sc.Text()
+		if idx, ok := strings.CutPrefix(line, "Sink Input #"); ok {
+			apps = append(apps, AudioApp{ID: strings.TrimSpace(idx)})
+			cur = &apps[len(apps)-1]
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		if strings.HasPrefix(line, "\t\t") {
+			key, val, ok := strings.Cut(strings.TrimSpace(line), " = ")
+			if !ok {
+				continue
+			}
+			val = strings.Trim(val, `"`)
+			switch key {
+			case "application.name":
+				cur.Name = val
+			case "application.process.binary":
+				cur.Process = val
+			case "application.process.id":
+				cur.PID, _ = strconv.Atoi(val)
+			}
+			continue
+		}
+		key, val, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		switch val = strings.TrimSpace(val); key {
+		case "Sink":
+			cur.Sink = val
+		case "Corked":
+			cur.Corked = val == "yes"
+		}
+	}
+	return apps
+}
+
+// matches reports whether the stream belongs to target: a PID, or a process
+// or application name compared case-insensitively, ".exe" optional.
+func (a AudioApp) matches(target string) bool {
+	target = strings.TrimSpace(target)
+	if pid, err := strconv.Atoi(target); err == nil {
+		return a.PID == pid
+	}
+	norm := func(s string) string { return strings.TrimSuffix(strings.ToLower(s), ".exe") }
+	t := norm(target)
+	return t != "" && (norm(a.Process) == t || norm(a.Name) == t)
+}
+
+const (
+	appCaptureSink = "pcloud_app"
+	appPollEvery   = 2 * time.Second
+)
+
+// AppCapture routes one application's streams into a dedicated null sink
+// whose monitor is then captured instead of the whole desktop. A loopback
+// plays the sink on the default output, so the host still hears the app.
+// Streams the app opens later are picked up by polling.
+type AppCapture struct {
+	target  string
+	modules []string
+
+	mu    sync.Mutex
+	moved map[string]string // sink input -> the sink it came from
+}
+
+// NewAppCapture sets up the sink for target, a process name or PID, and
+// moves its current streams. It succeeds even when the app is not playing
+// yet.
+func NewAppCapture(ctx context.Context, target string) (*AppCapture, error) {
+	if runtime.GOOS == "windows" {
+		return nil, fmt.Errorf("per-application audio: %w", errors.ErrUnsupported)
+	}
+	if strings.TrimSpace(target) == "" {
+		return nil, errors.New("per-application audio: no application given")
+	}
+	unloadStale(ctx, "sink_name="+appCaptureSink, "source="+appCaptureSink+".monitor")
+	c := &AppCapture{target: target, moved: map[string]string{}}
+	for _, args := range [][]string{
+		{"module-null-sink", "sink_name=" + appCaptureSink, "sink_properties=device.description=PCloud-App-Capture"},
+		{"module-loopback", "source=" + appCaptureSink + ".monitor", "source_dont_move=true", "latency_msec=30"},
+	} {
+		out, err := command(ctx, "pactl", append([]string{"load-module"}, args...)...)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("per-application audio: %w", err)
+		}
+		c.modules = append(c.modules, strings.TrimSpace(out))
+	}
+	if err := c.sync(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Source is the Pulse source to capture: the dedicated sink's monitor.
+func (c *AppCapture) Source() string { return appCaptureSink + ".monitor" }
+
+// Run keeps moving new streams of the app until ctx ends.
+func (c *AppCapture) Run(ctx context.Context) {
+	t := time.NewTicker(appPollEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			_ = c.sync(ctx)
+		}
+	}
+}
+
+func (c *AppCapture) sync(ctx context.Context) error {
+	apps, err := ListAudioApps(ctx)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, a := range apps {
+		if _, done := c.moved[a.ID]; done || !a.matches(c.target) {
+			continue
+		}
+		if _, err := command(ctx, "pactl", "move-sink-input", a.ID, appCaptureSink); err != nil {
+			continue
+		}
+		c.moved[a.ID] = a.Sink
+	}
+	return nil
+}
+
+// Close moves the app's streams back where they were and removes the sink.
+func (c *AppCapture) Close() error {
+	ctx := context.Background()
+	c.mu.Lock()
+	for id, sink := range c.moved {
+		// fails harmlessly for streams that have ended
+		_, _ = command(ctx, "pactl", "move-sink-input", id, sink)
+	}
+	c.moved = map[string]string{}
+	c.mu.Unlock()
+
+	var errs []error
+	for i := len(c.modules) - 1; i >= 0; i-- {
+		if _, err := command(ctx, "pactl", "unload-module", c.modules[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	c.modules = nil
+	return errors.Join(errs...)
+}
@@ -1,101 +1,55 @@
-// devices.go
+// Package devices enumerates the host's audio capture devices: DirectShow
+// on Windows (through FFmpeg), PulseAudio or PipeWire elsewhere.
 package devices
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"errors"
-	"net/http"
-	"os/exec"
-	"regexp"
-	"strings"
+	"runtime"
+	"sync"
 	"time"
 )
 
-var (
-	reHdrAudio   = regexp.MustCompile(`(?i)DirectShow audio devices`)
-	reHdrVideo   = regexp.MustCompile(`(?i)DirectShow video devices`)
-	reName       = regexp.MustCompile(`^\s*"([^"]+)"\s*$`)
-	reAlt        = regexp.MustCompile(`^\s*Alternative name\s+"([^"]+)"\s*$`)
-	lastDevCache []DShowDevice
-	lastDevTS    time.Time
-)
-
-type DShowDevice struct {
-	Name string `json:"name"` // friendly name shown in FFmpeg, e.g. Microphone (Realtek...)
-	Alt  string `json:"alt"`  // Alternative name, e.g. @device_pnp_...
+// AudioDevice is a capture device. ID is what goes into the audio_device
+// setting and on to FFmpeg: the dshow friendly name, or the Pulse source
+// name (which PipeWire's pulse server accepts too).
+type AudioDevice struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`              // human-readable description
+	Alt     string `json:"alt,omitempty"`     // dshow alternative name, e.g. @device_cm_...
+	Backend string `json:"backend"`           // dshow|pulse|pipewire
+	Monitor bool   `json:"monitor,omitempty"` // captures what a sink plays (system audio)
+	Default bool   `json:"default,omitempty"` // what an empty audio_device captures
 }
 
-func listDShowAudioDevices(ctx context.Context, ffmpegPath string) ([]DShowDevice, error) {
-	// simple 2s cache to avoid spamming
-	if time.Since(lastDevTS) < 2*time.Second && len(lastDevCache) > 0 {
-		return lastDevCache, nil
-	}
-
-	if ffmpegPath == "" {
-		ffmpegPath = "ffmpeg"
-	}
-	// FFmpeg prints device list to STDERR
-	cmd := exec.CommandContext(ctx, ffmpegPath, "-hide_banner", "-list_devices", "true", "-f", "dshow", "-i", "dummy")
-	var stderr bytes.Buffer
-	cmd.Stdout = &bytes.Buffer{} // discard
-	cmd.Stderr = &stderr
-	_ = cmd.Run() // non-zero exit is normal for this probe
+const cacheTTL = 2 * time.Second
 
-	lines := strings.Split(stderr.String(), "\n")
-	inAudio := false
-	var out []DShowDevice
-	var cur *DShowDevice
+var cache struct {
+	mu   sync.Mutex
+	devs []AudioDevice
+	at   time.Time
+}
 
-	for _, ln := range lines {
-		l := strings.TrimRight(ln, "\r")
-		if reHdrAudio.MatchString(l) {
-			inAudio = true
-			continue
-		}
-		if reHdrVideo.MatchString(l) {
-			// audio section ended
-			if cur != nil {
-				out = append(out, *cur)
-				cur = nil
-			}
-			inAudio = false
-		}
-		if !inAudio {
-			continue
-		}
-		if m := reName.FindStringSubmatch(l); m != nil {
-			// flush previous
-			if cur != nil {
-				out = append(out, *cur)
-			}
-			cur = &DShowDevice{Name: m[1]}
-			continue
-		}
-		if m := reAlt.FindStringSubmatch(l); m != nil && cur != nil {
-			cur.Alt = m[1]
-			continue
-		}
-	}
-	if cur != nil {
-		out = append(out, *cur)
-	}
-	if len(out) == 0 {
-		return nil, errors.New("no DirectShow audio devices found")
+// ListAudio returns the capture devices of this platform's backend.
+// ffmpegPath is only used on Windows; "" means ffmpeg from PATH. Results are
+// cached briefly so a settings page polling it doesn't spawn a process per
+// request.
+func ListAudio(ctx context.Context, ffmpegPath string) ([]AudioDevice, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if time.Since(cache.at) < cacheTTL && len(cache.devs) > 0 {
+		return cache.devs, nil
 	}
-	lastDevCache, lastDevTS = out, time.Now()
-	return out, nil
-}
 
-func handleListAudioDevices(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
-	defer cancel()
-	devs, err := listDShowAudioDevices(ctx, "") // "" -> use PATH ffmpeg
+	var devs []AudioDevice
+	var err error
+	if runtime.GOOS == "windows" {
+		devs, err = listDShow(ctx, ffmpegPath)
+	} else {
+		devs, err = listPulse(ctx)
+	}
 	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+		return nil, err
 	}
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(devs)
+	cache.devs, cache.at = devs, time.Now()
+	return devs, nil
 }
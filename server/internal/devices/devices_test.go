@@ -0,0 +1,149 @@
+package devices
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func readTestdata(t *testing.T, name string) string {
+	t.Helper()
+	b, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestParseDShow(t *testing.T) {
+	tests := []struct {
+		file string
+		want []AudioDevice
+	}{
+		{"dshow_sections.txt", []AudioDevice{
+			{
+				ID: "Microphone (Realtek High Definition Audio)", Name: "Microphone (Realtek High Definition Audio)",
+				Alt: `@device_cm_{33D9A762-90C8-11D0-BD43-00A0C911CE86}\wave_{5B2A5C3D-7E1F-4C4A-9E4B-2D0F3C6A1B11}`, Backend: "dshow",
+			},
+			{
+				ID: "Stereo Mix (Realtek High Definition Audio)", Name: "Stereo Mix (Realtek High Definition Audio)",
+				Alt: `@device_cm_{33D9A762-90C8-11D0-BD43-00A0C911CE86}\wave_{8C1E0F7A-1D2B-4E3C-A5F6-7B8C9D0E1F22}`, Backend: "dshow",
+			},
+		}},
+		{"dshow_tagged.txt", []AudioDevice{
+			{
+				ID: "Microphone (USB Audio Device)", Name: "Microphone (USB Audio Device)",
+				Alt: `@device_cm_{33D9A762-90C8-11D0-BD43-00A0C911CE86}\wave_{D1B7E3A0-2C4F-4B6E-8A9D-0F1E2D3C4B55}`, Backend: "dshow",
+			},
+			{
+				ID: "CABLE Output (VB-Audio Virtual Cable)", Name: "CABLE Output (VB-Audio Virtual Cable)",
+				Alt: `@device_cm_{33D9A762-90C8-11D0-BD43-00A0C911CE86}\wave_{E4F5A6B7-C8D9-4E0F-A1B2-C3D4E5F60718}`, Backend: "dshow",
+			},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			got := parseDShow(readTestdata(t, tt.file))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDShow:\n got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDShowCRLF(t *testing.T) {
+	out := "[dshow @ 01] \"Mic\" (audio)\r\n[dshow @ 01]   Alternative name \"@device_cm_x\"\r\n"
+	want := []AudioDevice{{ID: "Mic", Name: "Mic", Alt: "@device_cm_x", Backend: "dshow"}}
+	if got := parseDShow(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParsePactl(t *testing.T) {
+	devs := parsePactlSources(readTestdata(t, "pactl_sources.txt"))
+	markDefault(devs, parsePactlDefaultSource(readTestdata(t, "pactl_info.txt")))
+	want := []AudioDevice{
+		{
+			ID: "alsa_output.pci-0000_00_1f.3.analog-stereo.monitor", Name: "Monitor of Built-in Audio Analog Stereo",
+			Backend: "pulse", Monitor: true,
+		},
+		{
+			ID: "alsa_input.pci-0000_00_1f.3.analog-stereo", Name: "Built-in Audio Analog Stereo",
+			Backend: "pulse", Default: true,
+		},
+	}
+	if !reflect.DeepEqual(devs, want) {
+		t.Errorf("got %+v\nwant %+v", devs, want)
+	}
+}
+
+func TestParsePactlTruncated(t *testing.T) {
+	if got := parsePactlSources("Source #1\n\tState: RUNNING\n"); len(got) != 0 {
+		t.Errorf("got %+v, want none", got)
+	}
+}
+
+func TestParsePWDump(t *testing.T) {
+	devs, err := parsePWDump([]byte(readTestdata(t, "pw-dump.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []AudioDevice{
+		{
+			ID: "alsa_output.usb-Generic_USB_Audio-00.analog-stereo.monitor", Name: "Monitor of USB Audio Analog Stereo",
+			Backend: "pipewire", Monitor: true,
+		},
+		{
+			ID: "alsa_input.usb-Generic_USB_Audio-00.mono-fallback", Name: "USB Audio Mono",
+			Backend: "pipewire", Default: true,
+		},
+	}
+	if !reflect.DeepEqual(devs, want) {
+		t.Errorf("got %+v\nwant %+v", devs, want)
+	}
+}
+
+func TestParsePWDumpInvalid(t *testing.T) {
+	if _, err := parsePWDump([]byte("{not json")); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestParseModulesWith(t *testing.T) {
+	out := "536870912\tmodule-always-sink\t\n" +
+		"536870913\tmodule-null-sink\tsink_name=pcloud_mic sink_properties=device.description=PCloud-Client-Mic\n" +
+		"536870914\tmodule-remap-source\tmaster=pcloud_mic.monitor source_name=pcloud_mic_source\n" +
+		"536870915\tmodule-null-sink\tsink_name=pcloud_mic_other\n"
+	want := []string{"536870913", "536870914"}
+	if got := parseModulesWith(out, "sink_name=pcloud_mic", "source_name=pcloud_mic_source"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestParsePactlSinkInputs(t *testing.T) {
+	got := parsePactlSinkInputs(readTestdata(t, "pactl_sink_inputs.txt"))
+	want := []AudioApp{
+		{ID: "87", Name: "Firefox", Process: "firefox", PID: 4242, Sink: "56"},
+		{ID: "91", Name: "WEBRTC VoiceEngine", Process: "Discord", PID: 5150, Sink: "56", Corked: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestAudioAppMatches(t *testing.T) {
+	app := AudioApp{Name: "WEBRTC VoiceEngine", Process: "Discord", PID: 5150}
+	for target, want := range map[string]bool{
+		"discord":            true,
+		"Discord.exe":        true,
+		"5150":               true,
+		"webrtc voiceengine": true,
+		"515":                false,
+		"firefox":            false,
+		"":                   false,
+	} {
+		if got := app.matches(target); got != want {
+			t.Errorf("matches(%q) = %v, want %v", target, got, want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package devices
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+var (
+	reDShowPrefix = regexp.MustCompile(`^\[dshow @ [^\]]*\]\s?`)
+	reHdrAudio    = regexp.MustCompile(`(?i)DirectShow audio devices`)
+	reHdrVideo    = regexp.MustCompile(`(?i)DirectShow video devices`)
+	// FFmpeg >= 4.4 tags each device instead of printing sections
+	reTagged = regexp.MustCompile(`^\s*"([^"]+)"\s+\((audio|video|audio, video|none)\)\s*$`)
+	reName   = regexp.MustCompile(`^\s*"([^"]+)"\s*$`)
+	reAlt    = regexp.MustCompile(`^\s*Alternative name\s+"([^"]+)"\s*$`)
+)
+
+func listDShow(ctx context.Context, ffmpegPath string) ([]AudioDevice, error) {
+	if ffmpegPath == "" {
+		ffmpegPath = "ffmpeg"
+	}
+	// FFmpeg prints the device list to stderr and exits non-zero
+	cmd := exec.CommandContext(ctx, ffmpegPath, "-hide_banner", "-list_devices", "true", "-f", "dshow", "-i", "dummy")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	_ = cmd.Run()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	devs := parseDShow(stderr.String())
+	if len(devs) == 0 {
+		return nil, errors.New("no DirectShow audio devices found")
+	}
+	return devs, nil
+}
+
+// parseDShow reads the audio devices from `ffmpeg -list_devices true -f
+// dshow` output, in both the sectioned (FFmpeg < 4.4) and the tagged
+// format. DirectShow has no notion of a default device.
+func parseDShow(out string) []AudioDevice {
+	var devs []AudioDevice
+	inAudio := false
+	// whether the last name line was an audio device, so its alternative
+	// name belongs to it
+	lastAudio := false
+	for _, ln := range strings.Split(out, "\n") {
+		l := reDShowPrefix.ReplaceAllString(strings.TrimRight(ln, "\r"), "")
+		switch {
+		case reHdrAudio.MatchString(l):
+			inAudio = true
+			continue
+		case reHdrVideo.MatchString(l):
+			inAudio = false
+			continue
+		}
+		if m := reTagged.FindStringSubmatch(l); m != nil {
+			lastAudio = strings.Contains(m[2], "audio")
+			if lastAudio {
+				devs = append(devs, AudioDevice{ID: m[1], Name: m[1], Backend: "dshow"})
+			}
+			continue
+		}
+		if m := reName.FindStringSubmatch(l); m != nil {
+			lastAudio = inAudio
+			if lastAudio {
+				devs = append(devs, AudioDevice{ID: m[1], Name: m[1], Backend: "dshow"})
+			}
+			continue
+		}
+		if m := reAlt.FindStringSubmatch(l); m != nil && lastAudio {
+			devs[len(devs)-1].Alt = m[1]
+		}
+	}
+	return devs
+}
@@ -0,0 +1,184 @@
+package devices
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// listPulse asks pactl for the sources, which covers PipeWire too when
+// pipewire-pulse runs. Without pactl it falls back to pw-dump.
+func listPulse(ctx context.Context) ([]AudioDevice, error) {
+	if _, err := exec.LookPath("pactl"); err == nil {
+		sources, err := command(ctx, "pactl", "list", "sources")
+		if err != nil {
+			return nil, err
+		}
+		devs := parsePactlSources(sources)
+		// the default only decorates the list
+		if info, err := command(ctx, "pactl", "info"); err == nil {
+			markDefault(devs, parsePactlDefaultSource(info))
+		}
+		if len(devs) == 0 {
+			return nil, errors.New("pactl reported no sources")
+		}
+		return devs, nil
+	}
+	if _, err := exec.LookPath("pw-dump"); err != nil {
+		return nil, errors.New("neither pactl nor pw-dump is installed")
+	}
+	dump, err := command(ctx, "pw-dump")
+	if err != nil {
+		return nil, err
+	}
+	devs, err := parsePWDump([]byte(dump))
+	if err != nil {
+		return nil, err
+	}
+	if len(devs) == 0 {
+		return nil, errors.New("pw-dump reported no audio nodes")
+	}
+	return devs, nil
+}
+
+// command runs a tool with its output in English, since the parsers match
+// on field names.
+func command(ctx context.Context, name string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return string(out), nil
+}
+
+// parsePactlSources reads `pactl list sources`. Monitor sources are the ones
+// whose "Monitor of Sink" is not n/a.
+func parsePactlSources(out string) []AudioDevice {
+	var devs []AudioDevice
+	var cur *AudioDevice
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "Source #") {
+			devs = append(devs, AudioDevice{Backend: "pulse"})
+			cur = &devs[len(devs)-1]
+			continue
+		}
+		// properties are indented twice; only the top-level fields matter
+		if cur == nil || !strings.HasPrefix(line, "\t") || strings.HasPrefix(line, "\t\t") {
+			continue
+		}
+		key, val, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		val = strings.TrimSpace(val)
+		switch key {
+		case "Name":
+			cur.ID = val
+		case "Description":
+			cur.Name = val
+		case "Monitor of Sink":
+			cur.Monitor = val != "n/a"
+		}
+	}
+	// drop entries a truncated listing left without a name
+	named := devs[:0]
+	for _, d := range devs {
+		if d.ID == "" {
+			continue
+		}
+		if d.Name == "" {
+			d.Name = d.ID
+		}
+		named = append(named, d)
+	}
+	return named
+}
+
+// parsePactlDefaultSource reads the "Default Source" line of `pactl info`.
+func parsePactlDefaultSource(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(line), "Default Source:"); ok {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+func markDefault(devs []AudioDevice, id string) {
+	for i := range devs {
+		devs[i].Default = id != "" && devs[i].ID == id
+	}
+}
+
+type pwObject struct {
+	Type string `json:"type"`
+	Info *struct {
+		Props map[string]any `json:"props"`
+	} `json:"info"`
+	Props    map[string]any `json:"props"`
+	Metadata []struct {
+		Key   string          `json:"key"`
+		Value json.RawMessage `json:"value"`
+	} `json:"metadata"`
+}
+
+// parsePWDump reads the audio nodes from `pw-dump`. Sinks are listed as
+// their monitor, named the way pipewire-pulse exposes it ("<sink>.monitor"),
+// so the IDs work with FFmpeg's pulse input either way.
+func parsePWDump(b []byte) ([]AudioDevice, error) {
+	var objs []pwObject
+	if err := json.Unmarshal(b, &objs); err != nil {
+		return nil, fmt.Errorf("pw-dump: %w", err)
+	}
+	var devs []AudioDevice
+	var defSource string
+	for _, o := range objs {
+		switch o.Type {
+		case "PipeWire:Interface:Node":
+			if o.Info == nil {
+				continue
+			}
+			name, _ := o.Info.Props["node.name"].(string)
+			desc, _ := o.Info.Props["node.description"].(string)
+			class, _ := o.Info.Props["media.class"].(string)
+			if name == "" {
+				continue
+			}
+			if desc == "" {
+				desc = name
+			}
+			switch class {
+			case "Audio/Source", "Audio/Source/Virtual":
+				devs = append(devs, AudioDevice{ID: name, Name: desc, Backend: "pipewire"})
+			case "Audio/Sink":
+				devs = append(devs, AudioDevice{ID: name + ".monitor", Name: "Monitor of " + desc, Backend: "pipewire", Monitor: true})
+			}
+		case "PipeWire:Interface:Metadata":
+			if n, _ := o.Props["metadata.name"].(string); n != "default" {
+				continue
+			}
+			for _, m := range o.Metadata {
+				if m.Key != "default.audio.source" {
+					continue
+				}
+				var v struct {
+					Name string `json:"name"`
+				}
+				if json.Unmarshal(m.Value, &v) == nil {
+					defSource = v.Name
+				}
+			}
+		}
+	}
+	markDefault(devs, defSource)
+	return devs, nil
+}
@@ -0,0 +1,123 @@
+package devices
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Names of the virtual microphone's Pulse objects. Applications see the
+// source as "PCloud Microphone" and remember it by name, so the names are
+// fixed rather than per session: there is one streaming session at a time,
+// the previous one is ended before the next creates its microphone, and
+// NewVirtualMic removes whatever else still goes by these names.
+const (
+	VirtualMicSink   = "pcloud_mic"
+	virtualMicSource = "pcloud_mic_source"
+)
+
+// pactlTimeout bounds the pactl calls made outside of NewVirtualMic, which
+// have no caller context; a wedged Pulse server must not hang the API.
+const pactlTimeout = 5 * time.Second
+
+// VirtualMic is a Pulse null sink whose monitor is remapped into a regular
+// source, so whatever plays into the sink shows up as a microphone. It works
+// the same on PipeWire through pipewire-pulse. Windows has no built-in way
+// to create one; use a virtual cable driver there.
+type VirtualMic struct {
+	modules []string // pactl module indices, unloaded by Close
+}
+
+// NewVirtualMic creates the sink and source, replacing ones a previous run
+// left behind.
+func NewVirtualMic(ctx context.Context) (*VirtualMic, error) {
+	if runtime.GOOS == "windows" {
+		return nil, fmt.Errorf("virtual microphone: %w", errors.ErrUnsupported)
+	}
+	unloadStale(ctx, "sink_name="+VirtualMicSink, "source_name="+virtualMicSource)
+
+	v := &VirtualMic{}
+	for _, args := range [][]string{
+		{"module-null-sink", "sink_name=" + VirtualMicSink, "sink_properties=device.description=PCloud-Client-Mic"},
+		{"module-remap-source", "master=" + VirtualMicSink + ".monitor", "source_name=" + virtualMicSource,
+			"source_properties=device.description=PCloud-Microphone"},
+	} {
+		out, err := command(ctx, "pactl", append([]string{"load-module"}, args...)...)
+		if err != nil {
+			v.Close()
+			return nil, fmt.Errorf("virtual microphone: %w", err)
+		}
+		v.modules = append(v.modules, strings.TrimSpace(out))
+	}
+	return v, nil
+}
+
+// SetGain sets the sink volume; 1 is unity, values above 1 amplify.
+func (v *VirtualMic) SetGain(gain float64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pactlTimeout)
+	defer cancel()
+	_, err := command(ctx, "pactl", "set-sink-volume", VirtualMicSink, fmt.Sprintf("%d%%", int(gain*100+0.5)))
+	return err
+}
+
+// SetMuted silences the microphone without tearing it down.
+func (v *VirtualMic) SetMuted(muted bool) error {
+	m := "0"
+	if muted {
+		m = "1"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pactlTimeout)
+	defer cancel()
+	_, err := command(ctx, "pactl", "set-sink-mute", VirtualMicSink, m)
+	return err
+}
+
+// Close unloads the modules, source first so nothing records from a
+// vanishing sink.
+func (v *VirtualMic) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pactlTimeout)
+	defer cancel()
+	var errs []error
+	for i := len(v.modules) - 1; i >= 0; i-- {
+		if _, err := command(ctx, "pactl", "unload-module", v.modules[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	v.modules = nil
+	return errors.Join(errs...)
+}
+
+// unloadStale unloads modules a crashed run left behind, recognised by any
+// of the given module arguments.
+func unloadStale(ctx context.Context, args ...string) {
+	mods, err := command(ctx, "pactl", "list", "short", "modules")
+	if err != nil {
+		return
+	}
+	for _, idx := range parseModulesWith(mods, args...) {
+		_, _ = command(ctx, "pactl", "unload-module", idx)
+	}
+}
+
+// parseModulesWith returns the indices of the modules in `pactl list short
+// modules` that were loaded with any of args.
+func parseModulesWith(out string, args ...string) []string {
+	var idx []string
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.SplitN(line, "\t", 3)
+		if len(f) < 3 {
+			continue
+		}
+		for _, arg := range strings.Fields(f[2]) {
+			if slices.Contains(args, arg) {
+				idx = append(idx, f[0])
+				break
+			}
+		}
+	}
+	return idx
+}
@@ -0,0 +1,88 @@
+package encoder
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// DefaultAudioBitrate is the Opus bitrate when Params.AudioBitrate is empty.
+const DefaultAudioBitrate = "128k"
+
+// BuildAudioPipeCmd captures system audio and writes Opus in Ogg to stdout,
+// one page per packet so the reader sees every frame as soon as it is
+// encoded. Without an audio device on Windows it encodes silence.
+func BuildAudioPipeCmd(ctx context.Context, p Params) *exec.Cmd {
+	if p.AudioBitrate == "" {
+		p.AudioBitrate = DefaultAudioBitrate
+	}
+	channels := p.AudioChannels
+	switch channels {
+	case 1, 2, 6:
+	default:
+		channels = 2
+	}
+
+	args := []string{"-hide_banner", "-loglevel", "error", "-y"}
+	if runtime.GOOS == "windows" {
+		if p.AudioDevice != "" {
+			args = append(args, "-f", "dshow", "-audio_buffer_size", "20", "-i", "audio="+p.AudioDevice)
+		} else {
+			args = append(args, "-f", "lavfi", "-i", "anullsrc=channel_layout=stereo:sample_rate=48000")
+		}
+	} else {
+		src := p.AudioDevice
+		if src == "" {
+			src = "default"
+		}
+		args = append(args, "-f", "pulse", "-fragment_size", "3840", "-i", src)
+	}
+
+	args = append(args,
+		"-vn",
+		"-c:a", "libopus",
+		"-b:a", p.AudioBitrate,
+		"-ar", "48000",
+		"-ac", fmt.Sprint(channels),
+		"-application", "lowdelay",
+		"-frame_duration", "20",
+		"-fec", boolFlag(p.AudioFEC),
+		"-dtx", boolFlag(p.AudioDTX),
+	)
+	if p.AudioFEC {
+		// FEC only kicks in when the encoder expects loss
+		args = append(args, "-packet_loss", "10")
+	}
+	if channels == 6 {
+		// Vorbis channel order, 4 streams of which 2 coupled: what browsers
+		// expect for multiopus 5.1
+		args = append(args, "-mapping_family", "1")
+	}
+	args = append(args, "-f", "ogg", "-page_duration", "20000", "-flush_packets", "1", "-")
+
+	cmd := exec.CommandContext(ctx, ffmpegBinary(p.FFmpegPath), args...)
+	hideWindow(cmd)
+	return cmd
+}
+
+func boolFlag(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// BuildMicPlaybackCmd decodes Ogg Opus from stdin and plays it into the Pulse
+// sink, with as little buffering as FFmpeg allows: the client's voice
+// should reach the host's virtual microphone within a frame or two.
+func BuildMicPlaybackCmd(ctx context.Context, ffmpegPath, sink string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, ffmpegBinary(ffmpegPath),
+		"-hide_banner", "-loglevel", "error",
+		"-fflags", "nobuffer", "-probesize", "32", "-analyzeduration", "0",
+		"-f", "ogg", "-i", "-",
+		"-f", "pulse", "-buffer_duration", "40", "-device", sink, "PCloud client microphone",
+	)
+	hideWindow(cmd)
+	return cmd
+}
@@ -0,0 +1,145 @@
+package encoder
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Capabilities describes what the local FFmpeg build can produce.
+type Capabilities struct {
+	Codecs   []string `json:"codecs"`   // h264|hevc|av1|vp9|vp8, in preference order
+	Encoders []string `json:"encoders"` // FFmpeg encoder names, e.g. "h264_nvenc"
+}
+
+// codecEncoders lists the encoders we drive, per codec, best first. H.264
+// falls back to libx264 without NVENC, VP8 and VP9 to libvpx where there is
+// no VAAPI hardware encoder.
+var codecEncoders = []struct {
+	codec    string
+	encoders []string
+}{
+	{"h264", []string{"h264_nvenc", "libx264"}},
+	{"hevc", []string{"hevc_nvenc"}},
+	{"av1", []string{"av1_nvenc"}},
+	{"vp9", []string{"vp9_vaapi", "libvpx-vp9"}},
+	{"vp8", []string{"vp8_vaapi", "libvpx"}},
+}
+
+// chroma444Encoders can encode 4:4:4: H.264 High 4:4:4 Predictive, HEVC
+// Range Extensions and VP9 profile 1.
+var chroma444Encoders = []string{"h264_nvenc", "hevc_nvenc", "libvpx-vp9"}
+
+// Chroma444 reports whether the encoder used for codec can produce 4:4:4.
+func Chroma444(caps Capabilities, codec string) bool {
+	return slices.Contains(chroma444Encoders, EncoderFor(caps, codec))
+}
+
+// vaapiDevice is the DRM render node the VAAPI encoders run on.
+const vaapiDevice = "/dev/dri/renderD128"
+
+var (
+	capsMu    sync.Mutex // held while probing, so a binary is probed once
+	capsCache = map[string]Capabilities{}
+)
+
+// ProbeCapabilities asks the FFmpeg at ffmpegPath which of our encoders it
+// was built with. VAAPI encoders are only counted if a short test encode
+// works, as being built in says nothing about the GPU. The result is cached
+// per path, so a changed ffmpeg_path is probed anew. If FFmpeg cannot be
+// run at all, every codec is reported so clients can still try, and the
+// next call tries again.
+func ProbeCapabilities(ffmpegPath string) Capabilities {
+	capsMu.Lock()
+	defer capsMu.Unlock()
+	if c, ok := capsCache[ffmpegPath]; ok {
+		return c
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpegBinary(ffmpegPath), "-hide_banner", "-encoders")
+	cmd.Stdout = &stdout
+	hideWindow(cmd)
+	if err := cmd.Run(); err != nil {
+		var all Capabilities
+		for _, ce := range codecEncoders {
+			all.Codecs = append(all.Codecs, ce.codec)
+			all.Encoders = append(all.Encoders, ce.encoders...)
+		}
+		return all
+	}
+	c := parseEncoderList(stdout.String(), func(enc string) bool {
+		return !strings.HasSuffix(enc, "_vaapi") || vaapiWorks(ffmpegPath, enc)
+	})
+	capsCache[ffmpegPath] = c
+	return c
+}
+
+// EncoderFor returns the FFmpeg encoder to use for codec: the first one in
+// our preference order that caps has, or the last resort if none.
+func EncoderFor(caps Capabilities, codec string) string {
+	for _, ce := range codecEncoders {
+		if ce.codec != codec {
+			continue
+		}
+		for _, enc := range ce.encoders {
+			if slices.Contains(caps.Encoders, enc) {
+				return enc
+			}
+		}
+		return ce.encoders[len(ce.encoders)-1]
+	}
+	return "h264_nvenc"
+}
+
+// vaapiWorks encodes a few frames with enc on vaapiDevice.
+func vaapiWorks(ffmpegPath, enc string) bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+	if _, err := os.Stat(vaapiDevice); err != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, ffmpegBinary(ffmpegPath), "-hide_banner", "-loglevel", "error",
+		"-init_hw_device", "vaapi=va:"+vaapiDevice, "-filter_hw_device", "va",
+		"-f", "lavfi", "-i", "testsrc2=size=256x256:rate=30", "-frames:v", "3",
+		"-vf", "format=nv12,hwupload", "-c:v", enc, "-f", "null", "-")
+	return cmd.Run() == nil
+}
+
+// parseEncoderList picks our encoders out of `ffmpeg -encoders` output, whose
+// lines look like " V....D h264_nvenc  NVIDIA NVENC H.264 encoder", keeping
+// those usable accepts.
+func parseEncoderList(out string, usable func(encoder string) bool) Capabilities {
+	have := map[string]bool{}
+	for _, ln := range strings.Split(out, "\n") {
+		f := strings.Fields(ln)
+		if len(f) >= 2 && strings.HasPrefix(f[0], "V") {
+			have[f[1]] = true
+		}
+	}
+	var c Capabilities
+	for _, ce := range codecEncoders {
+		found := false
+		for _, enc := range ce.encoders {
+			if have[enc] && usable(enc) {
+				c.Encoders = append(c.Encoders, enc)
+				found = true
+			}
+		}
+		if found {
+			c.Codecs = append(c.Codecs, ce.codec)
+		}
+	}
+	return c
+}
@@ -0,0 +1,56 @@
+package encoder
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+// fakeFFmpeg writes a script to dir/name that lists encoders the way
+// `ffmpeg -encoders` does.
+func fakeFFmpeg(t *testing.T, dir, name string, encoders ...string) string {
+	script := "#!/bin/sh\n"
+	for _, enc := range encoders {
+		script += "echo ' V....D " + enc + "  test encoder'\n"
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestProbeCapabilities(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script for FFmpeg")
+	}
+	dir := t.TempDir()
+	x264 := fakeFFmpeg(t, dir, "x264", "libx264", "libvpx")
+	nvenc := fakeFFmpeg(t, dir, "nvenc", "h264_nvenc", "hevc_nvenc", "av1_nvenc")
+
+	if got, want := ProbeCapabilities(x264), (Capabilities{Codecs: []string{"h264", "vp8"}, Encoders: []string{"libx264", "libvpx"}}); !slices.Equal(got.Codecs, want.Codecs) || !slices.Equal(got.Encoders, want.Encoders) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	// a different ffmpeg_path is probed, not served from the first result
+	if got := ProbeCapabilities(nvenc); !slices.Equal(got.Codecs, []string{"h264", "hevc", "av1"}) {
+		t.Errorf("second binary: got %+v", got)
+	}
+	if err := os.WriteFile(x264, []byte("#!/bin/sh\nexit 1\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if got := ProbeCapabilities(x264); !slices.Equal(got.Encoders, []string{"libx264", "libvpx"}) {
+		t.Errorf("a probed binary is probed again: got %+v", got)
+	}
+
+	// a binary that can't be run reports every codec, until it can be
+	missing := filepath.Join(dir, "later")
+	if got := ProbeCapabilities(missing); len(got.Codecs) != len(codecEncoders) {
+		t.Errorf("missing binary: got %+v, want every codec", got)
+	}
+	fakeFFmpeg(t, dir, "later", "libx264")
+	if got := ProbeCapabilities(missing); !slices.Equal(got.Codecs, []string{"h264"}) {
+		t.Errorf("after it appeared: got %+v, want the failure not cached", got)
+	}
+}
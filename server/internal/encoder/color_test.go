@@ -0,0 +1,204 @@
+package encoder
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+
+	"pc_cloud/internal/bitstream"
+)
+
+// pipeArgs returns the arguments BuildFFmpegPipeCmd runs FFmpeg with for
+// p, the program name left out.
+func pipeArgs(p Params) []string {
+	cmd, _ := BuildFFmpegPipeCmd(context.Background(), p)
+	return cmd.Args[1:]
+}
+
+// argValue returns the value that follows flag in args, or "" if flag is
+// not there.
+func argValue(args []string, flag string) string {
+	if i := slices.Index(args, flag); i >= 0 && i+1 < len(args) {
+		return args[i+1]
+	}
+	return ""
+}
+
+var colorFlags = []string{"-color_primaries", "-color_trc", "-colorspace", "-color_range"}
+
+func TestPipeCmdColorArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       Params
+		want    map[string]string
+		filters string // in -filter_complex, if set
+	}{
+		{"h264 default", Params{Codec: "h264"},
+			map[string]string{"-color_primaries": "bt709", "-color_trc": "bt709", "-colorspace": "bt709", "-color_range": "tv", "-profile:v": "high"}, ""},
+		{"h264 full range", Params{Codec: "h264", ColorRange: "full"},
+			map[string]string{"-colorspace": "bt709", "-color_range": "pc"}, ""},
+		{"h264 4:4:4", Params{Codec: "h264", Chroma: "444", Profile: "high444p"},
+			map[string]string{"-colorspace": "bt709", "-color_range": "tv", "-profile:v": "high444p"},
+			"scale=out_color_matrix=bt709:out_range=tv,format=yuv444p"},
+		{"hevc 4:4:4 full range", Params{Codec: "hevc", Chroma: "444", ColorRange: "full"},
+			map[string]string{"-colorspace": "bt709", "-color_range": "pc", "-profile:v": "rext"},
+			"scale=out_color_matrix=bt709:out_range=pc,format=yuv444p"},
+		{"hevc main10 pq", Params{Codec: "hevc", BitDepth: 10, HDR: "pq"},
+			map[string]string{"-color_primaries": "bt2020", "-color_trc": "smpte2084", "-colorspace": "bt2020nc", "-color_range": "tv", "-profile:v": "main10"}, ""},
+		{"hevc main10 hlg ignores full range", Params{Codec: "hevc", BitDepth: 10, HDR: "hlg", ColorRange: "full"},
+			map[string]string{"-color_primaries": "bt2020", "-color_trc": "arib-std-b67", "-colorspace": "bt2020nc", "-color_range": "tv"}, ""},
+		{"av1 10-bit sdr", Params{Codec: "av1", BitDepth: 10},
+			map[string]string{"-color_primaries": "bt709", "-color_trc": "bt709", "-colorspace": "bt709", "-color_range": "tv"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := pipeArgs(tt.p)
+			for flag, want := range tt.want {
+				if got := argValue(args, flag); got != want {
+					t.Errorf("%s = %q, want %q", flag, got, want)
+				}
+			}
+			if fc := argValue(args, "-filter_complex"); !strings.Contains(fc, tt.filters) {
+				t.Errorf("-filter_complex %q has no %q", fc, tt.filters)
+			}
+			// options for the encoder, after its -c:v
+			enc := slices.Index(args, "-c:v")
+			for _, flag := range colorFlags {
+				if i := slices.Index(args, flag); i < enc {
+					t.Errorf("%s at %d, before -c:v at %d", flag, i, enc)
+				}
+			}
+		})
+	}
+}
+
+// encodeSPS encodes a frame of an RGB test pattern with the software
+// encoder enc and the -color_* arguments BuildFFmpegPipeCmd emits for p,
+// and parses the SPS enc wrote. NVENC takes the same generic options; the
+// software encoders stand in for it where there is no GPU. The test is
+// skipped if FFmpeg or enc is missing.
+func encodeSPS(t *testing.T, enc string, codec bitstream.Codec, p Params) bitstream.SPS {
+	t.Helper()
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("no ffmpeg on PATH")
+	}
+	out, err := exec.Command(ffmpeg, "-hide_banner", "-encoders").Output()
+	if err != nil || !bytes.Contains(out, []byte(" "+enc+" ")) {
+		t.Skipf("ffmpeg has no %s", enc)
+	}
+
+	chroma444 := p.Chroma == "444"
+	pixFmt := pixelFormat(true, p.BitDepth == 10, chroma444)
+	args := []string{"-hide_banner", "-loglevel", "error",
+		"-f", "lavfi", "-i", "testsrc2=size=320x240:rate=30",
+		"-frames:v", "1", "-vf", "format=rgb24," + rgbToYUV(p) + ",format=" + pixFmt,
+		"-c:v", enc, "-pix_fmt", pixFmt}
+	pipe := pipeArgs(p)
+	for _, flag := range colorFlags {
+		args = append(args, flag, argValue(pipe, flag))
+	}
+	args = append(args, "-f", map[bitstream.Codec]string{bitstream.H264: "h264", bitstream.H265: "hevc"}[codec], "-")
+	var stderr bytes.Buffer
+	cmd := exec.Command(ffmpeg, args...)
+	cmd.Stderr = &stderr
+	out, err = cmd.Output()
+	if err != nil {
+		t.Fatalf("ffmpeg %s: %v\n%s", strings.Join(args, " "), err, stderr.String())
+	}
+	for _, nal := range bitstream.Split(out, nil) {
+		if codec.ParamSet(nal) == bitstream.ParamSPS {
+			sps, err := codec.ParseSPS(nal)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return sps
+		}
+	}
+	t.Fatalf("no SPS in %d bytes of output", len(out))
+	return bitstream.SPS{}
+}
+
+// TestColorSignalledInSPS checks that encoders write what the arguments
+// ask for into the SPS. It needs FFmpeg with libx264 and libx265.
+func TestColorSignalledInSPS(t *testing.T) {
+	bt709 := bitstream.Color{Primaries: 1, Transfer: 1, Matrix: 1}
+	bt709Full := bitstream.Color{Primaries: 1, Transfer: 1, Matrix: 1, FullRange: true}
+	tests := []struct {
+		name       string
+		enc        string
+		codec      bitstream.Codec
+		p          Params
+		color      bitstream.Color
+		chroma     int
+		bitDepth   int
+		minProfile int
+	}{
+		{"h264 default", "libx264", bitstream.H264, Params{Codec: "h264"}, bt709, 1, 8, 0},
+		{"h264 full range", "libx264", bitstream.H264, Params{Codec: "h264", ColorRange: "full"}, bt709Full, 1, 8, 0},
+		{"h264 4:4:4", "libx264", bitstream.H264, Params{Codec: "h264", Chroma: "444"}, bt709, 3, 8, 244},
+		{"hevc default", "libx265", bitstream.H265, Params{Codec: "hevc"}, bt709, 1, 8, 1},
+		{"hevc 4:4:4 full range", "libx265", bitstream.H265, Params{Codec: "hevc", Chroma: "444", ColorRange: "full"}, bt709Full, 3, 8, 4},
+		{"hevc main10 pq", "libx265", bitstream.H265, Params{Codec: "hevc", BitDepth: 10, HDR: "pq"},
+			bitstream.Color{Primaries: 9, Transfer: 16, Matrix: 9}, 1, 10, 2},
+		{"hevc main10 hlg", "libx265", bitstream.H265, Params{Codec: "hevc", BitDepth: 10, HDR: "hlg", ColorRange: "full"},
+			bitstream.Color{Primaries: 9, Transfer: 18, Matrix: 9}, 1, 10, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sps := encodeSPS(t, tt.enc, tt.codec, tt.p)
+			if sps.Color != tt.color {
+				t.Errorf("color %v, want %v", sps.Color, tt.color)
+			}
+			if sps.ChromaFormat != tt.chroma || sps.BitDepthLuma != tt.bitDepth || sps.Profile < tt.minProfile {
+				t.Errorf("got %+v, want chroma format %d, %d-bit, profile >= %d", sps, tt.chroma, tt.bitDepth, tt.minProfile)
+			}
+		})
+	}
+}
+
+func TestColorConversion(t *testing.T) {
+	tests := []struct {
+		name   string
+		p      Params
+		pixFmt string
+		want   []string // in order
+	}{
+		{"sdr capture", Params{}, "nv12", nil},
+		{"pq to nvenc", Params{HDRCapture: true, HDR: "pq", BitDepth: 10}, "p010",
+			[]string{"hwdownload,format=x2bgr10", "tin=smpte2084:pin=bt2020:min=gbr:rin=full",
+				":t=smpte2084:p=bt2020:m=bt2020nc:r=limited", "format=p010"}},
+		{"pq to a software encoder", Params{HDRCapture: true, HDR: "pq", BitDepth: 10}, "yuv420p10le",
+			[]string{":m=bt2020nc:r=limited", "format=yuv420p10le"}},
+		{"hlg", Params{HDRCapture: true, HDR: "hlg", BitDepth: 10}, "p010",
+			[]string{":t=arib-std-b67:p=bt2020:m=bt2020nc:r=limited", "format=p010"}},
+		{"hlg to a software encoder", Params{HDRCapture: true, HDR: "hlg", BitDepth: 10}, "yuv444p10le",
+			[]string{":t=arib-std-b67", "npl=1000,format=yuv444p10le"}},
+		{"tone-mapped sdr", Params{HDRCapture: true}, "nv12",
+			[]string{"t=linear:npl=203", "tonemap=hable", "zscale=t=bt709:m=bt709:r=limited", "format=nv12"}},
+		{"tone-mapped full range", Params{HDRCapture: true, ColorRange: "full"}, "yuv444p",
+			[]string{"zscale=t=bt709:m=bt709:r=full", "format=yuv444p"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := colorConversion(tt.p, tt.pixFmt)
+			if tt.want == nil {
+				if got != "" {
+					t.Errorf("got %q, want none", got)
+				}
+				return
+			}
+			rest := got
+			for _, w := range tt.want {
+				i := strings.Index(rest, w)
+				if i < 0 {
+					t.Fatalf("%q: no %q in order", got, w)
+				}
+				rest = rest[i+len(w):]
+			}
+		})
+	}
+}
@@ -4,92 +4,122 @@ import (
 	"context"
 	_ "embed"
 	"fmt"
-	"os"
 	"os/exec"
 	"runtime"
-	"strconv"
+	"slices"
 	"strings"
-	"syscall"
+)
+
+// Fallbacks for Params fields left empty. The config package builds its
+// defaults from these so the server has a single set.
+const (
+	DefaultFPS     = 60
+	DefaultPreset  = "p4"
+	DefaultBitrate = "20M"
 )
 
 type Params struct {
-	Codec       string // h264|hevc|av1
+	Codec       string // h264|hevc|av1|vp9|vp8
 	FPS         int
 	Width       int    // 0 = native
 	Height      int    // 0 = native
 	Preset      string // NVENC p1..p7 (e.g. "p3","p4")
 	Bitrate     string // e.g. "25M"
 	WithAudio   bool
-	AudioPort   int    // RTP port for Opus (0 = off)
 	Display     string // ":0.0" on Linux
-	AudioDevice string // Windows dshow device name
+	AudioDevice string // dshow device name on Windows, Pulse source elsewhere; "" = default
 	Capture     string // This is now handled automatically for Windows
+	FFmpegPath  string // "" = ffmpeg from PATH
+
+	AV1Container string // "ivf" (default) or "obu" for a raw low-overhead bitstream
+	BitDepth     int    // 10 for HEVC Main10, 10-bit AV1 or VP9 profile 2; otherwise 8
+	Profile      string // H.264 profile: high (default), main or baseline
+	HDR          string // transfer of an HDR stream: "pq" or "hlg"; "" = SDR
+	HDRCapture   bool   // the desktop is in HDR (Windows only): capture 10-bit PQ, tone-mapped to SDR unless HDR is set
+	ColorRange   string // of SDR streams: "limited" (default) or "full"; HDR is always limited
+	Chroma       string // "444" for full chroma resolution (8-bit only, see Chroma444); otherwise 4:2:0
+	Latency      string // one of LatencyModes; "" = DefaultLatency
+	IntraRefresh *bool  // refresh gradually with an infinite GOP where the encoder can (see UsesIntraRefresh); nil = in ultra-low latency
+
+	// Opus settings for BuildAudioPipeCmd
+	AudioChannels int    // 1, 2 or 6 (5.1); 0 = 2
+	AudioBitrate  string // e.g. "128k"; "" = DefaultAudioBitrate
+	AudioFEC      bool   // in-band forward error correction
+	AudioDTX      bool   // discontinuous transmission during silence
+}
+
+func ffmpegBinary(path string) string {
+	if path != "" {
+		return path
+	}
+	return "ffmpeg"
 }
 
 // ... (extract and Run functions remain the same) ...
 
+// BuildFFmpegPipeCmd returns the encoder command and what it writes to
+// stdout: "h264" or "hevc" in MPEG-TS, "ivf" or "obu" for AV1, or "vp8" or
+// "vp9" in IVF. All but the raw OBU stream carry a PTS per frame.
 func BuildFFmpegPipeCmd(ctx context.Context, p Params) (*exec.Cmd, string /*videoFmt*/) {
 	vf := strings.ToLower(p.Codec)
 	if vf == "" {
 		vf = "h264"
 	}
 
-	var vcodec, vfmt string
+	var vcodec, vfmt, muxer string
 	var vbsf []string
 	var extraCodecOptions []string // To hold profile option
 	switch vf {
 	case "hevc", "h265":
-		vcodec, vfmt = "hevc_nvenc", "hevc"
-		vbsf = []string{"-bsf:v", "dump_extra=all,hevc_metadata=aud=insert"}
+		vcodec, vfmt, muxer = "hevc_nvenc", "hevc", "mpegts"
+		vbsf = []string{"-bsf:v", "dump_extra=all"}
 	case "av1":
-		vcodec, vfmt = "av1_nvenc", "ivf"
+		vcodec, vfmt, muxer = "av1_nvenc", "ivf", "ivf"
+		if p.AV1Container == "obu" {
+			vfmt, muxer = "obu", "obu"
+		}
+	case "vp8", "vp9":
+		vcodec, vfmt, muxer = EncoderFor(ProbeCapabilities(p.FFmpegPath), vf), vf, "ivf"
 	default:
-		vcodec, vfmt = "h264_nvenc", "h264"
-		vbsf = []string{"-bsf:v", "dump_extra=all,h264_metadata=aud=insert"}
-		extraCodecOptions = []string{"-profile:v", "high"}
+		vcodec, vfmt, muxer = EncoderFor(ProbeCapabilities(p.FFmpegPath), "h264"), "h264", "mpegts"
+		vbsf = []string{"-bsf:v", "dump_extra=all"}
+		profile := p.Profile
+		if profile == "" {
+			profile = "high"
+		}
+		extraCodecOptions = []string{"-profile:v", profile}
 	}
+	vaapi := strings.HasSuffix(vcodec, "_vaapi")
+	software := strings.HasPrefix(vcodec, "lib")
+	tenBit := p.BitDepth == 10 && vf != "h264" && vf != "vp8"
+	chroma444 := p.Chroma == "444" && !tenBit && slices.Contains(chroma444Encoders, vcodec)
+	pixFmt := pixelFormat(software, tenBit, chroma444)
 
 	if p.FPS <= 0 {
-		p.FPS = 60
+		p.FPS = DefaultFPS
 	}
 	if p.Preset == "" {
-		p.Preset = "p1"
+		p.Preset = DefaultPreset
 	}
 	if p.Bitrate == "" {
-		p.Bitrate = "25M"
+		p.Bitrate = DefaultBitrate
 	}
 
 	args := []string{"-hide_banner", "-loglevel", "error", "-y"}
 
-	// --- INPUTS ---
+	// --- INPUTS --- (audio runs in its own process, see BuildAudioPipeCmd)
 	if runtime.GOOS == "windows" {
 		args = append(args, "-init_hw_device", "d3d11va")
-
-		if p.WithAudio {
-			audioDeviceName := p.AudioDevice
-			if audioDeviceName == "" {
-				audioDeviceName = os.Getenv("AUDIO_DEVICE")
-			}
-			if audioDeviceName != "" {
-				args = append(args, "-f", "dshow", "-i", fmt.Sprintf("audio=%s", audioDeviceName))
-			} else {
-				args = append(args, "-f", "lavfi", "-i", "anullsrc=channel_layout=stereo:sample_rate=48000")
-			}
-		} else {
-			args = append(args, "-f", "lavfi", "-i", "anullsrc=channel_layout=stereo:sample_rate=48000")
-		}
 	} else {
 		// Linux/X11
 		disp := p.Display
 		if disp == "" {
 			disp = ":0.0"
 		}
-		args = append(args, "-f", "x11grab", "-framerate", fmt.Sprintf("%d", p.FPS), "-i", disp)
-		if p.WithAudio {
-			args = append(args, "-f", "pulse", "-i", "default")
-		} else {
-			args = append(args, "-f", "lavfi", "-i", "anullsrc=channel_layout=stereo:sample_rate=48000")
+		if vaapi {
+			args = append(args, "-init_hw_device", "vaapi=va:"+vaapiDevice, "-filter_hw_device", "va")
 		}
+		args = append(args, "-f", "x11grab", "-framerate", fmt.Sprintf("%d", p.FPS), "-i", disp)
 	}
 
 	// --- VIDEO FILTERGRAPH ---
@@ -108,52 +138,145 @@ func BuildFFmpegPipeCmd(ctx context.Context, p Params) (*exec.Cmd, string /*vide
 		// filterComplex = "[0:v]hwdownload,hwupload_cuda,scale_cuda=w=-2:h=-2:format=nv12[vout]"
 		filterComplex = fmt.Sprintf("ddagrab=framerate=%d:draw_mouse=1", p.FPS)
 	}
+	if p.HDRCapture || tenBit {
+		// R10G10B10A2: PQ/BT.2020 on an HDR desktop, else 10-bit sRGB
+		filterComplex += ":output_fmt=x2bgr10"
+	}
+	convert := colorConversion(p, pixFmt)
+	switch {
+	case vaapi:
+		// x11grab frames are in system memory
+		filterComplex = "[0:v]" + rgbToYUV(p) + ",format=" + pixFmt + ",hwupload"
+	case convert != "":
+		filterComplex += convert
+	case (software || chroma444) && runtime.GOOS == "windows":
+		// ddagrab hands out D3D11 textures; NVENC would subsample their RGB
+		// to 4:2:0 itself
+		captured := "bgra"
+		if tenBit {
+			captured = "x2bgr10"
+		}
+		filterComplex += ",hwdownload,format=" + captured + "," + rgbToYUV(p) + ",format=" + pixFmt
+	case software || chroma444:
+		filterComplex = "[0:v]" + rgbToYUV(p) + ",format=" + pixFmt
+	}
 
 	args = append(args, "-filter_complex", filterComplex)
 
-	// bufsize, _ := strconv.ParseInt(strings.TrimSuffix(p.Bitrate, "M"), 10, 0)
-	bufsize, _ := strconv.Atoi(strings.TrimSuffix(p.Bitrate, "M"))
-	bufsize_f := float64(bufsize) * 1.2
-	bufsize = int(bufsize_f)
-
-	// --- VIDEO to stdout (elementary stream) ---
-	args = append(args,
-		// "-map", "[vout]",
-		"-c:v", vcodec,
-		"-preset", p.Preset,
-		"-tune", "ll",
-		"-cq", "25",
-		"-b:v", p.Bitrate,
-		"-rc", "vbr",
-		"-maxrate", p.Bitrate,
-		"-g", fmt.Sprintf("%d", p.FPS/2),
-		"-keyint_min", fmt.Sprintf("%d", p.FPS/2),
-		"-minrate", p.Bitrate,
-		"-bufsize", fmt.Sprintf("%dM", bufsize),
-		"-bf", "2",
-		"-zerolatency", "1",
-		"-no-scenecut", "1",
-	)
+	// --- VIDEO to stdout (timestamped container) ---
+	args = append(args, "-c:v", vcodec)
+	switch {
+	case vaapi:
+		args = append(args, vaapiArgs(p)...)
+	case vcodec == "libx264":
+		args = append(args, x264Args(p)...)
+		args = append(args, "-pix_fmt", pixFmt)
+	case software:
+		args = append(args, vpxArgs(p)...)
+		if vf == "vp9" {
+			args = append(args, "-row-mt", "1", "-tile-columns", "2", "-frame-parallel", "0")
+		}
+		args = append(args, "-pix_fmt", pixFmt)
+		switch {
+		case tenBit:
+			args = append(args, "-profile:v", "2")
+		case chroma444:
+			args = append(args, "-profile:v", "1")
+		}
+	default:
+		args = append(args, nvencArgs(p, vcodec)...)
+		switch {
+		case vf == "hevc" && tenBit:
+			args = append(args, "-profile:v", "main10")
+		case vf == "hevc" && chroma444:
+			args = append(args, "-profile:v", "rext")
+		}
+	}
+	args = append(args, colorArgs(p)...)
 	args = append(args, extraCodecOptions...)
 	args = append(args, vbsf...)
-	args = append(args, "-an", "-f", vfmt, "-")
-
-	// --- AUDIO RTP (optional) ---
-	if p.WithAudio && p.AudioPort > 0 {
-		audioOut := fmt.Sprintf("rtp://127.0.0.1:%d?pkt_size=1200&ttl=1", p.AudioPort)
-		args = append(args,
-			// "-map", "1:a",
-			"-c:a", "libopus",
-			"-b:a", "128k",
-			"-ar", "48000",
-			"-ac", "2",
-			"-application", "lowdelay",
-			"-f", "rtp", audioOut,
-		)
-	}
-	cmd := exec.CommandContext(ctx, "ffmpeg.exe", args...)
-	if runtime.GOOS == "windows" {
-		cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	args = append(args, "-an", "-f", muxer)
+	if muxer == "mpegts" {
+		// one PES per frame, with its length set where it fits (under
+		// 64 KB) so the reader can hand a frame on as soon as its last
+		// packet arrives; longer ones end at the stuffed last packet
+		args = append(args, "-muxdelay", "0", "-muxpreload", "0", "-flush_packets", "1",
+			"-omit_video_pes_length", "0")
+	} else {
+		args = append(args, "-flush_packets", "1")
 	}
+	args = append(args, "-")
+
+	cmd := exec.CommandContext(ctx, ffmpegBinary(p.FFmpegPath), args...)
+	hideWindow(cmd)
 	return cmd, vfmt
 }
+
+// colorConversion returns the filters that take HDR captures through system
+// memory into YUV for the encoder: PQ kept as it is, re-encoded as HLG, or
+// tone-mapped to SDR BT.709 for clients without HDR. It returns "" for SDR
+// captures.
+//
+// PQ is converted here too rather than handed to NVENC as RGB: NVENC would
+// pick the matrix for its RGB to YUV conversion itself, and nothing makes
+// it the BT.2020 non-constant luminance that colorArgs signals.
+func colorConversion(p Params, pixFmt string) string {
+	if !p.HDRCapture {
+		return ""
+	}
+	const pq = ",hwdownload,format=x2bgr10,zscale=tin=smpte2084:pin=bt2020:min=gbr:rin=full"
+	switch p.HDR {
+	case "pq":
+		return pq + ":t=smpte2084:p=bt2020:m=bt2020nc:r=limited,format=" + pixFmt
+	case "hlg":
+		return pq + ":t=arib-std-b67:p=bt2020:m=bt2020nc:r=limited:npl=1000,format=" + pixFmt
+	}
+	// 203 nits is the reference white of BT.2408, so SDR content on the HDR
+	// desktop comes out at its usual brightness
+	return pq + ":t=linear:npl=203,format=gbrpf32le,zscale=p=bt709,tonemap=hable:desat=0," +
+		"zscale=t=bt709:m=bt709:r=" + p.colorRange("limited", "full") + ",format=" + pixFmt
+}
+
+// pixelFormat is what the encoder gets when frames go through system memory.
+func pixelFormat(software, tenBit, chroma444 bool) string {
+	switch {
+	case chroma444:
+		return "yuv444p"
+	case tenBit && software:
+		return "yuv420p10le"
+	case tenBit:
+		return "p010"
+	case software:
+		return "yuv420p"
+	}
+	return "nv12"
+}
+
+// rgbToYUV converts captured RGB with the BT.709 matrix. Left to itself,
+// swscale would use BT.601 and the colors would shift against the BT.709
+// that colorArgs signals.
+func rgbToYUV(p Params) string {
+	return "scale=out_color_matrix=bt709:out_range=" + p.colorRange("tv", "pc")
+}
+
+// colorArgs describes the stream to the encoder, which writes it into the
+// H.264/HEVC VUI, the AV1 color config or the VP9 frame header: BT.709 for
+// SDR, BT.2020 with the HDR transfer otherwise. Without it decoders guess,
+// and guess differently.
+func colorArgs(p Params) []string {
+	trc := map[string]string{"pq": "smpte2084", "hlg": "arib-std-b67"}[p.HDR]
+	if trc == "" {
+		return []string{"-color_primaries", "bt709", "-color_trc", "bt709", "-colorspace", "bt709",
+			"-color_range", p.colorRange("tv", "pc")}
+	}
+	return []string{"-color_primaries", "bt2020", "-color_trc", trc, "-colorspace", "bt2020nc", "-color_range", "tv"}
+}
+
+// colorRange returns limited or full, spelled as the caller needs, for the
+// SDR range p asks for.
+func (p Params) colorRange(limited, full string) string {
+	if p.ColorRange == "full" {
+		return full
+	}
+	return limited
+}
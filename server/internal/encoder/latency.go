@@ -0,0 +1,238 @@
+package encoder
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Latency modes trade delay for picture quality. None of them uses
+// B-frames or lookahead: both hold frames back inside the encoder, and
+// WebRTC decoders don't expect frames out of order anyway.
+const (
+	LatencyUltraLow = "ultra-low"
+	LatencyBalanced = "balanced"
+	LatencyQuality  = "quality"
+
+	DefaultLatency = LatencyBalanced
+)
+
+// LatencyModes lists the valid modes, lowest latency first.
+var LatencyModes = []string{LatencyUltraLow, LatencyBalanced, LatencyQuality}
+
+// latencyMode is what a mode asks of every backend.
+type latencyMode struct {
+	// vbvFrames sizes the rate control buffer in frames at the target
+	// bitrate. A frame can't take longer than this many frame intervals
+	// to go out at the link rate, so it bounds the queuing delay.
+	vbvFrames float64
+	// peak is the maxrate of VBR as a multiple of the bitrate; 0 means CBR.
+	peak float64
+	// gopSeconds is the keyframe interval, or the length of one intra
+	// refresh sweep.
+	gopSeconds float64
+	// intraRefresh is the default of Params.IntraRefresh.
+	intraRefresh bool
+
+	nvencTune      string
+	nvencMultipass string
+	vpxCPUUsed     int
+}
+
+var latencyModes = map[string]latencyMode{
+	LatencyUltraLow: {vbvFrames: 1, gopSeconds: 0.5, intraRefresh: true,
+		nvencTune: "ull", nvencMultipass: "disabled", vpxCPUUsed: 8},
+	LatencyBalanced: {vbvFrames: 3, gopSeconds: 1,
+		nvencTune: "ll", nvencMultipass: "qres", vpxCPUUsed: 7},
+	LatencyQuality: {vbvFrames: 15, peak: 1.5, gopSeconds: 2,
+		nvencTune: "hq", nvencMultipass: "fullres", vpxCPUUsed: 5},
+}
+
+// intraRefreshEncoders can refresh gradually instead of sending keyframes.
+var intraRefreshEncoders = []string{"h264_nvenc", "hevc_nvenc", "libx264"}
+
+// intraRefresh reports whether vcodec encodes p with intra refresh: as
+// p.IntraRefresh says, or else as its latency mode does.
+func intraRefresh(p Params, vcodec string) bool {
+	on := modeFor(p).intraRefresh
+	if p.IntraRefresh != nil {
+		on = *p.IntraRefresh
+	}
+	return on && slices.Contains(intraRefreshEncoders, vcodec)
+}
+
+// UsesIntraRefresh reports whether the stream BuildFFmpegPipeCmd makes for
+// p refreshes gradually, and so has no keyframes after the first: the
+// client's keyframe requests then have to be answered by restarting it.
+func UsesIntraRefresh(caps Capabilities, p Params) bool {
+	codec := strings.ToLower(p.Codec)
+	switch codec {
+	case "":
+		codec = "h264"
+	case "h265":
+		codec = "hevc"
+	}
+	return intraRefresh(p, EncoderFor(caps, codec))
+}
+
+// modeFor returns the settings of p.Latency, or of DefaultLatency if unset.
+func modeFor(p Params) latencyMode {
+	if m, ok := latencyModes[p.Latency]; ok {
+		return m
+	}
+	return latencyModes[DefaultLatency]
+}
+
+// rateControl holds the numbers every backend derives from the mode.
+type rateControl struct {
+	bitrate, maxrate, bufsize string
+	cbr                       bool
+	gop                       string // in frames
+}
+
+func (m latencyMode) rateControl(p Params) rateControl {
+	rc := rateControl{bitrate: p.Bitrate, maxrate: p.Bitrate, cbr: m.peak == 0}
+	bps, err := ParseBitrate(p.Bitrate)
+	if err != nil {
+		bps, _ = ParseBitrate(DefaultBitrate)
+		rc.bitrate, rc.maxrate = DefaultBitrate, DefaultBitrate
+	}
+	if !rc.cbr {
+		rc.maxrate = strconv.FormatInt(int64(float64(bps)*m.peak), 10)
+	}
+	rc.bufsize = strconv.FormatInt(int64(float64(bps)*m.vbvFrames/float64(p.FPS)), 10)
+	rc.gop = strconv.Itoa(max(1, int(m.gopSeconds*float64(p.FPS))))
+	return rc
+}
+
+// nvencArgs are the rate control and latency options of the NVENC encoders.
+func nvencArgs(p Params, vcodec string) []string {
+	m := modeFor(p)
+	rc := m.rateControl(p)
+	args := []string{
+		"-preset", p.Preset,
+		"-tune", m.nvencTune,
+		"-multipass", m.nvencMultipass,
+		"-b:v", rc.bitrate,
+		"-maxrate", rc.maxrate,
+		"-bufsize", rc.bufsize,
+		"-bf", "0",
+		"-rc-lookahead", "0",
+		"-zerolatency", "1",
+		"-delay", "0", // hand each frame out as soon as it is encoded
+		"-no-scenecut", "1",
+		"-g", rc.gop,
+	}
+	if rc.cbr {
+		args = append(args, "-rc", "cbr")
+	} else {
+		args = append(args, "-rc", "vbr")
+	}
+	if intraRefresh(p, vcodec) {
+		// -g becomes the refresh period and the GOP infinite
+		args = append(args, "-intra-refresh", "1")
+	} else {
+		args = append(args, "-keyint_min", rc.gop)
+	}
+	return args
+}
+
+// x264Presets maps the NVENC presets onto libx264's, fastest first.
+var x264Presets = map[string]string{
+	"p1": "ultrafast", "p2": "superfast", "p3": "veryfast", "p4": "faster",
+	"p5": "fast", "p6": "medium", "p7": "slow",
+}
+
+// x264Args are the rate control and latency options of libx264. Its
+// zerolatency tune already leaves out B-frames, lookahead and frame
+// threading.
+func x264Args(p Params) []string {
+	m := modeFor(p)
+	rc := m.rateControl(p)
+	preset, ok := x264Presets[p.Preset]
+	if !ok {
+		preset = x264Presets[DefaultPreset]
+	}
+	args := []string{
+		"-preset", preset,
+		"-tune", "zerolatency",
+		"-b:v", rc.bitrate,
+		"-maxrate", rc.maxrate,
+		"-bufsize", rc.bufsize,
+		"-bf", "0",
+		"-sc_threshold", "0",
+		"-g", rc.gop,
+	}
+	if intraRefresh(p, "libx264") {
+		// as with NVENC, keyint is the refresh period and only the first
+		// frame is an IDR
+		args = append(args, "-intra-refresh", "1")
+	} else {
+		args = append(args, "-keyint_min", rc.gop)
+	}
+	return args
+}
+
+// vpxArgs are the rate control and latency options of libvpx, in realtime
+// mode without alt-ref frames, so no superframes and no frames held back.
+func vpxArgs(p Params) []string {
+	m := modeFor(p)
+	rc := m.rateControl(p)
+	args := []string{
+		"-deadline", "realtime",
+		"-cpu-used", strconv.Itoa(m.vpxCPUUsed),
+		"-lag-in-frames", "0",
+		"-auto-alt-ref", "0",
+		"-error-resilient", "1",
+		"-b:v", rc.bitrate,
+		"-maxrate", rc.maxrate,
+		"-bufsize", rc.bufsize,
+		"-g", rc.gop,
+		"-keyint_min", rc.gop,
+	}
+	if rc.cbr {
+		args = append(args, "-minrate", rc.bitrate)
+	}
+	return args
+}
+
+// vaapiArgs are the rate control and latency options of the VAAPI
+// encoders, which have no intra refresh.
+func vaapiArgs(p Params) []string {
+	rc := modeFor(p).rateControl(p)
+	mode := "VBR"
+	if rc.cbr {
+		mode = "CBR"
+	}
+	return []string{
+		"-rc_mode", mode,
+		"-b:v", rc.bitrate,
+		"-maxrate", rc.maxrate,
+		"-bufsize", rc.bufsize,
+		"-bf", "0",
+		"-g", rc.gop,
+	}
+}
+
+// ParseBitrate parses FFmpeg-style rates ("20M", "800k", "2500000") into
+// bits per second.
+func ParseBitrate(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, errors.New("bitrate is empty")
+	}
+	num, mult := s, int64(1)
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		num, mult = s[:len(s)-1], 1_000
+	case 'm', 'M':
+		num, mult = s[:len(s)-1], 1_000_000
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("%q is not a bitrate like 20M or 800k", s)
+	}
+	return int64(v * float64(mult)), nil
+}
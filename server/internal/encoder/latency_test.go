@@ -0,0 +1,101 @@
+package encoder
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRateControl(t *testing.T) {
+	tests := []struct {
+		name string
+		p    Params
+		want rateControl
+	}{
+		// one frame of 20 Mbit/s at 60 fps, half a second of frames
+		{"ultra-low", Params{Latency: LatencyUltraLow, Bitrate: "20M", FPS: 60},
+			rateControl{bitrate: "20M", maxrate: "20M", bufsize: "333333", cbr: true, gop: "30"}},
+		{"balanced", Params{Latency: LatencyBalanced, Bitrate: "20M", FPS: 60},
+			rateControl{bitrate: "20M", maxrate: "20M", bufsize: "1000000", cbr: true, gop: "60"}},
+		{"quality", Params{Latency: LatencyQuality, Bitrate: "20M", FPS: 60},
+			rateControl{bitrate: "20M", maxrate: "30000000", bufsize: "5000000", gop: "120"}},
+		{"unset is balanced", Params{Bitrate: "6000k", FPS: 30},
+			rateControl{bitrate: "6000k", maxrate: "6000k", bufsize: "600000", cbr: true, gop: "30"}},
+		{"unknown is balanced", Params{Latency: "instant", Bitrate: "6M", FPS: 30},
+			rateControl{bitrate: "6M", maxrate: "6M", bufsize: "600000", cbr: true, gop: "30"}},
+		{"bad bitrate", Params{Latency: LatencyQuality, Bitrate: "fast", FPS: 30},
+			rateControl{bitrate: DefaultBitrate, maxrate: "30000000", bufsize: "10000000", gop: "60"}},
+		{"gop of at least a frame", Params{Latency: LatencyUltraLow, Bitrate: "1M", FPS: 1},
+			rateControl{bitrate: "1M", maxrate: "1M", bufsize: "1000000", cbr: true, gop: "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := modeFor(tt.p).rateControl(tt.p); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseBitrate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"20M", 20_000_000},
+		{"20m", 20_000_000},
+		{"800k", 800_000},
+		{"800K", 800_000},
+		{"2.5M", 2_500_000},
+		{"2500000", 2_500_000},
+		{" 6M ", 6_000_000},
+	}
+	for _, tt := range tests {
+		got, err := ParseBitrate(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseBitrate(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "  ", "M", "0", "-5M", "0k", "20G", "fast"} {
+		if got, err := ParseBitrate(in); err == nil {
+			t.Errorf("ParseBitrate(%q) = %d, want an error", in, got)
+		}
+	}
+}
+
+func TestIntraRefreshArgs(t *testing.T) {
+	on, off := true, false
+	tests := []struct {
+		name    string
+		p       Params
+		args    func(Params) []string
+		refresh bool
+	}{
+		{"nvenc", Params{IntraRefresh: &on}, func(p Params) []string { return nvencArgs(p, "h264_nvenc") }, true},
+		{"nvenc hevc", Params{IntraRefresh: &on}, func(p Params) []string { return nvencArgs(p, "hevc_nvenc") }, true},
+		// AV1 NVENC has no intra refresh
+		{"nvenc av1", Params{IntraRefresh: &on}, func(p Params) []string { return nvencArgs(p, "av1_nvenc") }, false},
+		{"nvenc av1 ultra-low", Params{Latency: LatencyUltraLow}, func(p Params) []string { return nvencArgs(p, "av1_nvenc") }, false},
+		{"nvenc unset", Params{}, func(p Params) []string { return nvencArgs(p, "h264_nvenc") }, false},
+		{"nvenc quality", Params{Latency: LatencyQuality}, func(p Params) []string { return nvencArgs(p, "h264_nvenc") }, false},
+		// ultra-low latency turns it on unless asked not to
+		{"nvenc ultra-low", Params{Latency: LatencyUltraLow}, func(p Params) []string { return nvencArgs(p, "h264_nvenc") }, true},
+		{"nvenc ultra-low opt-out", Params{Latency: LatencyUltraLow, IntraRefresh: &off}, func(p Params) []string { return nvencArgs(p, "hevc_nvenc") }, false},
+		{"x264", Params{IntraRefresh: &on}, x264Args, true},
+		{"x264 ultra-low", Params{Latency: LatencyUltraLow}, x264Args, true},
+		{"x264 off", Params{Latency: LatencyUltraLow, IntraRefresh: &off}, x264Args, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.p.Bitrate, tt.p.FPS = "10M", 60
+			args := tt.args(tt.p)
+			if got := argValue(args, "-g"); got != modeFor(tt.p).rateControl(tt.p).gop {
+				t.Errorf("-g %s, want the mode's GOP", got)
+			}
+			refresh := argValue(args, "-intra-refresh") == "1"
+			keyintMin := slices.Contains(args, "-keyint_min")
+			if refresh != tt.refresh || keyintMin == tt.refresh {
+				t.Errorf("intra refresh %v, -keyint_min %v, want intra refresh %v in %q", refresh, keyintMin, tt.refresh, args)
+			}
+		})
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !windows
+
+package encoder
+
+import "os/exec"
+
+func hideWindow(cmd *exec.Cmd) {}
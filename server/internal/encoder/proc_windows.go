@@ -0,0 +1,13 @@
+//go:build windows
+
+package encoder
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// hideWindow keeps FFmpeg from flashing a console window on the desktop.
+func hideWindow(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+}
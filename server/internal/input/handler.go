@@ -2,12 +2,17 @@ package input
 
 import (
 	"encoding/json"
-	"log"
 	"strings"
+	"time"
 
 	"github.com/go-vgo/robotgo"
+
+	"pc_cloud/internal/logging"
+	"pc_cloud/internal/metrics"
 )
 
+var log = logging.For("input")
+
 // Matches the structure sent from webrtc.js
 type InputEvent struct {
 	T      string  `json:"t"` // Type: "mmoveAbs", "mdown", "mup", "kdown", "kup", "mwheel", "gp"
@@ -33,8 +38,11 @@ type Handler struct {
 	screenHeight int
 }
 
+// ScreenSize returns the size of the primary display in pixels.
+func ScreenSize() (int, int) { return robotgo.GetScreenSize() }
+
 func NewHandler() *Handler {
-	w, h := robotgo.GetScreenSize()
+	w, h := ScreenSize()
 	return &Handler{
 		screenWidth:  w,
 		screenHeight: h,
@@ -44,9 +52,14 @@ func NewHandler() *Handler {
 func (h *Handler) Process(data []byte) {
 	var e InputEvent
 	if err := json.Unmarshal(data, &e); err != nil {
-		log.Printf("Failed to unmarshal input event: %v", err)
+		log.Warn("failed to unmarshal input event", "err", err)
 		return
 	}
+	typ := metricType(e.T)
+	metrics.InputEvents.WithLabelValues(typ).Inc()
+	defer func(start time.Time) {
+		metrics.InputInjection.WithLabelValues(typ).Observe(time.Since(start).Seconds())
+	}(time.Now())
 
 	switch e.T {
 	case "mmoveAbs":
@@ -99,6 +112,22 @@ func (h *Handler) Process(data []byte) {
 	}
 }
 
+// eventTypes are the event types Process knows.
+var eventTypes = map[string]bool{
+	"mmoveAbs": true, "mdown": true, "mup": true, "mwheel": true,
+	"kdown": true, "kup": true, "gp": true,
+}
+
+// metricType is the metrics label for event type t. The type comes from
+// the client, so anything unknown is counted as "other" rather than
+// becoming a label of its own.
+func metricType(t string) string {
+	if eventTypes[t] {
+		return t
+	}
+	return "other"
+}
+
 // normalizeKeyCode converts JavaScript key codes to a format robotgo understands.
 // This is a simplified mapping and might need expansion.
 func normalizeKeyCode(jsKey string) string {
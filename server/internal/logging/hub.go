@@ -0,0 +1,214 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Entry is one log record as delivered to live subscribers.
+type Entry struct {
+	Time      time.Time         `json:"time"`
+	Level     string            `json:"level"`
+	Subsystem string            `json:"subsystem,omitempty"`
+	Msg       string            `json:"msg"`
+	Attrs     map[string]string `json:"attrs,omitempty"`
+}
+
+// Filter selects entries for a subscriber. Zero value passes everything
+// that is logged.
+type Filter struct {
+	MinLevel slog.Level
+	// BelowGlobal has records from MinLevel up logged for the subscriber
+	// even where the global level drops them
+	BelowGlobal bool
+	Subsystems  map[string]bool // nil = all
+}
+
+func (f Filter) match(e Entry, lvl slog.Level) bool {
+	if lvl < f.MinLevel {
+		return false
+	}
+	return f.Subsystems == nil || f.Subsystems[e.Subsystem]
+}
+
+type subscriber struct {
+	ch     chan Entry
+	filter Filter
+}
+
+// hubEntry keeps the numeric level next to the entry for filtering.
+type hubEntry struct {
+	e   Entry
+	lvl slog.Level
+}
+
+type logHub struct {
+	mu      sync.Mutex
+	backlog []hubEntry // ring of the most recent entries
+	next    int
+	full    bool
+	subs    map[*subscriber]struct{}
+	// lowest MinLevel of the subscribers, so records below the global
+	// level still reach one that asked for them
+	subLevel atomic.Int64
+}
+
+func newHub(n int) *logHub {
+	h := &logHub{backlog: make([]hubEntry, n), subs: map[*subscriber]struct{}{}}
+	h.subLevel.Store(math.MaxInt64)
+	return h
+}
+
+// enabled reports whether records at l are wanted, either at the global
+// level or by a subscriber.
+func (h *logHub) enabled(l slog.Level) bool {
+	return l >= level.Level() || int64(l) >= h.subLevel.Load()
+}
+
+// updateSubLevel recomputes subLevel; call with mu held.
+func (h *logHub) updateSubLevel() {
+	lowest := int64(math.MaxInt64)
+	for s := range h.subs {
+		if s.filter.BelowGlobal {
+			lowest = min(lowest, int64(s.filter.MinLevel))
+		}
+	}
+	h.subLevel.Store(lowest)
+}
+
+func (h *logHub) publish(he hubEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if he.lvl < level.Level() {
+		// only here for a subscriber: the backlog stays at the global level
+		h.deliver(he)
+		return
+	}
+	h.backlog[h.next] = he
+	h.next = (h.next + 1) % len(h.backlog)
+	if h.next == 0 {
+		h.full = true
+	}
+	h.deliver(he)
+}
+
+// deliver sends he to the subscribers it matches; call with mu held.
+func (h *logHub) deliver(he hubEntry) {
+	for s := range h.subs {
+		if !s.filter.match(he.e, he.lvl) {
+			continue
+		}
+		select {
+		case s.ch <- he.e:
+		default: // slow reader: drop rather than stall logging
+		}
+	}
+}
+
+// Subscribe returns recent entries matching f followed by a channel of new
+// ones. Call cancel when done; the channel is closed.
+func Subscribe(f Filter) (recent []Entry, ch <-chan Entry, cancel func()) {
+	s := &subscriber{ch: make(chan Entry, 256), filter: f}
+	hub.mu.Lock()
+	start, n := 0, hub.next
+	if hub.full {
+		start, n = hub.next, len(hub.backlog)
+	}
+	for i := 0; i < n; i++ {
+		he := hub.backlog[(start+i)%len(hub.backlog)]
+		if f.match(he.e, he.lvl) {
+			recent = append(recent, he.e)
+		}
+	}
+	hub.subs[s] = struct{}{}
+	hub.updateSubLevel()
+	hub.mu.Unlock()
+
+	var once sync.Once
+	return recent, s.ch, func() {
+		once.Do(func() {
+			hub.mu.Lock()
+			delete(hub.subs, s)
+			hub.updateSubLevel()
+			hub.mu.Unlock()
+			close(s.ch)
+		})
+	}
+}
+
+// ParseFilter builds a Filter from query-style values: a minimum level name
+// and a comma-separated subsystem list, either of which may be empty. A
+// level below the global one is honoured: such records are logged, to the
+// hub only, for as long as the subscriber is attached.
+func ParseFilter(levelName, subsystems string) (Filter, error) {
+	var f Filter
+	f.MinLevel = slog.LevelDebug
+	if levelName != "" {
+		if err := f.MinLevel.UnmarshalText([]byte(levelName)); err != nil {
+			return f, err
+		}
+		f.BelowGlobal = true
+	}
+	if subsystems != "" {
+		f.Subsystems = map[string]bool{}
+		for _, s := range strings.Split(subsystems, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				f.Subsystems[s] = true
+			}
+		}
+	}
+	return f, nil
+}
+
+// hubHandler turns slog records into Entries for the hub.
+type hubHandler struct {
+	hub    *logHub
+	attrs  []slog.Attr
+	prefix string // group prefix, "a.b."
+}
+
+func (h *hubHandler) Enabled(_ context.Context, l slog.Level) bool { return h.hub.enabled(l) }
+
+func (h *hubHandler) Handle(_ context.Context, r slog.Record) error {
+	e := Entry{Time: r.Time, Level: r.Level.String(), Msg: r.Message}
+	add := func(prefix string, a slog.Attr) {
+		if a.Key == SubsystemKey && prefix == "" {
+			e.Subsystem = a.Value.String()
+			return
+		}
+		if e.Attrs == nil {
+			e.Attrs = map[string]string{}
+		}
+		e.Attrs[prefix+a.Key] = a.Value.Resolve().String()
+	}
+	for _, a := range h.attrs {
+		add("", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		add(h.prefix, a)
+		return true
+	})
+	h.hub.publish(hubEntry{e: e, lvl: r.Level})
+	return nil
+}
+
+func (h *hubHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	nh := *h
+	nh.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, a := range attrs {
+		a.Key = h.prefix + a.Key
+		nh.attrs = append(nh.attrs, a)
+	}
+	return &nh
+}
+
+func (h *hubHandler) WithGroup(name string) slog.Handler {
+	nh := *h
+	nh.prefix = h.prefix + name + "."
+	return &nh
+}
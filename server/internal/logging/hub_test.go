@@ -0,0 +1,154 @@
+package logging
+
+import (
+	"log/slog"
+	"maps"
+	"math"
+	"slices"
+	"testing"
+)
+
+// testHub swaps in a hub holding n entries for the test.
+func testHub(t *testing.T, n int) *logHub {
+	prev := hub
+	hub = newHub(n)
+	t.Cleanup(func() { hub = prev })
+	return hub
+}
+
+func entry(msg, subsystem string, lvl slog.Level) hubEntry {
+	return hubEntry{e: Entry{Msg: msg, Subsystem: subsystem, Level: lvl.String()}, lvl: lvl}
+}
+
+func msgs(es []Entry) []string {
+	var out []string
+	for _, e := range es {
+		out = append(out, e.Msg)
+	}
+	return out
+}
+
+func TestHubBacklog(t *testing.T) {
+	tests := []struct {
+		name    string
+		publish []string
+		want    []string
+	}{
+		{"empty", nil, nil},
+		{"partial", []string{"a", "b"}, []string{"a", "b"}},
+		{"exactly full", []string{"a", "b", "c"}, []string{"a", "b", "c"}},
+		{"wrapped", []string{"a", "b", "c", "d", "e"}, []string{"c", "d", "e"}},
+		{"wrapped twice", []string{"a", "b", "c", "d", "e", "f", "g"}, []string{"e", "f", "g"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := testHub(t, 3)
+			for _, m := range tt.publish {
+				h.publish(entry(m, "main", slog.LevelInfo))
+			}
+			recent, _, cancel := Subscribe(Filter{})
+			defer cancel()
+			if got := msgs(recent); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHubBelowGlobalNotKept(t *testing.T) {
+	h := testHub(t, 3)
+	_, ch, cancel := Subscribe(Filter{MinLevel: slog.LevelDebug, BelowGlobal: true})
+	defer cancel()
+	h.publish(entry("debug", "main", slog.LevelDebug))
+	if e := <-ch; e.Msg != "debug" {
+		t.Errorf("subscriber got %q", e.Msg)
+	}
+	if recent, _, cancel := Subscribe(Filter{MinLevel: slog.LevelDebug}); len(recent) != 0 {
+		t.Errorf("backlog %v, want records below the global level left out", msgs(recent))
+		cancel()
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	tests := []struct {
+		name string
+		f    Filter
+		e    hubEntry
+		want bool
+	}{
+		{"zero passes all", Filter{}, entry("m", "encoder", slog.LevelInfo), true},
+		{"below level", Filter{MinLevel: slog.LevelWarn}, entry("m", "encoder", slog.LevelInfo), false},
+		{"at level", Filter{MinLevel: slog.LevelWarn}, entry("m", "encoder", slog.LevelWarn), true},
+		{"subsystem in", Filter{Subsystems: map[string]bool{"encoder": true}}, entry("m", "encoder", slog.LevelInfo), true},
+		{"subsystem out", Filter{Subsystems: map[string]bool{"encoder": true}}, entry("m", "webrtc", slog.LevelInfo), false},
+		{"no subsystem", Filter{Subsystems: map[string]bool{"encoder": true}}, entry("m", "", slog.LevelInfo), false},
+	}
+	for _, tt := range tests {
+		if got := tt.f.match(tt.e.e, tt.e.lvl); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		level, subsystems string
+		want              Filter
+		err               bool
+	}{
+		{"", "", Filter{MinLevel: slog.LevelDebug}, false},
+		{"warn", "", Filter{MinLevel: slog.LevelWarn, BelowGlobal: true}, false},
+		{"DEBUG", "encoder, webrtc,,", Filter{MinLevel: slog.LevelDebug, BelowGlobal: true,
+			Subsystems: map[string]bool{"encoder": true, "webrtc": true}}, false},
+		{"", " , ", Filter{MinLevel: slog.LevelDebug, Subsystems: map[string]bool{}}, false},
+		{"loud", "", Filter{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseFilter(tt.level, tt.subsystems)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseFilter(%q, %q): no error", tt.level, tt.subsystems)
+			}
+			continue
+		}
+		if err != nil || got.MinLevel != tt.want.MinLevel || got.BelowGlobal != tt.want.BelowGlobal ||
+			(got.Subsystems == nil) != (tt.want.Subsystems == nil) || !maps.Equal(got.Subsystems, tt.want.Subsystems) {
+			t.Errorf("ParseFilter(%q, %q) = %+v, %v, want %+v", tt.level, tt.subsystems, got, err, tt.want)
+		}
+	}
+}
+
+func TestSubLevel(t *testing.T) {
+	h := testHub(t, 3)
+	defer func(l slog.Level) { level.Set(l) }(level.Level())
+	level.Set(slog.LevelWarn)
+
+	check := func(when string, want int64, debugEnabled, infoEnabled bool) {
+		t.Helper()
+		if got := h.subLevel.Load(); got != want {
+			t.Errorf("%s: subLevel %d, want %d", when, got, want)
+		}
+		if h.enabled(slog.LevelDebug) != debugEnabled || h.enabled(slog.LevelInfo) != infoEnabled {
+			t.Errorf("%s: enabled(debug) %v, enabled(info) %v, want %v, %v", when,
+				h.enabled(slog.LevelDebug), h.enabled(slog.LevelInfo), debugEnabled, infoEnabled)
+		}
+	}
+	check("no subscribers", math.MaxInt64, false, false)
+
+	_, _, cancelAll := Subscribe(Filter{MinLevel: slog.LevelDebug}) // not BelowGlobal
+	check("plain subscriber", math.MaxInt64, false, false)
+	_, _, cancelInfo := Subscribe(Filter{MinLevel: slog.LevelInfo, BelowGlobal: true})
+	check("info subscriber", int64(slog.LevelInfo), false, true)
+	_, _, cancelDebug := Subscribe(Filter{MinLevel: slog.LevelDebug, BelowGlobal: true})
+	check("debug subscriber", int64(slog.LevelDebug), true, true)
+
+	cancelDebug()
+	check("debug cancelled", int64(slog.LevelInfo), false, true)
+	cancelDebug() // twice is fine
+	cancelInfo()
+	check("all below-global cancelled", math.MaxInt64, false, false)
+	cancelAll()
+	if !h.enabled(slog.LevelWarn) {
+		t.Error("the global level is no longer enabled")
+	}
+}
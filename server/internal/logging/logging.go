@@ -0,0 +1,204 @@
+// Package logging sets up the process-wide slog logger: leveled text lines in
+// a rotated file under the per-user log directory, plus an in-memory hub that
+// /logs/stream tails. Subsystems get their own logger via For.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SubsystemKey is the attribute that tags every record with its origin.
+const SubsystemKey = "subsystem"
+
+var (
+	level slog.LevelVar
+	out   = &switchWriter{w: os.Stderr}
+	hub   = newHub(500)
+	root  = slog.New(fanout{
+		slog.NewTextHandler(out, &slog.HandlerOptions{Level: &level}),
+		&hubHandler{hub: hub},
+	})
+)
+
+// For returns the logger for a subsystem ("encoder", "webrtc", ...). It may
+// be called before Setup; output follows whatever Setup configures later.
+func For(subsystem string) *slog.Logger {
+	return root.With(SubsystemKey, subsystem)
+}
+
+// Options configures Setup.
+type Options struct {
+	Dir        string        // "" = Dir()
+	Level      string        // debug|info|warn|error
+	MaxSize    int64         // bytes per file before rotating
+	MaxAge     time.Duration // rotate files older than this and prune backups past it
+	MaxBackups int           // rotated files kept at most
+}
+
+// Setup routes all logging, including the std log package, to a rotating
+// file in opts.Dir. Close the returned writer on exit.
+func Setup(opts Options) (io.Closer, error) {
+	if opts.Dir == "" {
+		opts.Dir = Dir()
+	}
+	if err := SetLevel(opts.Level); err != nil {
+		return nil, err
+	}
+	f, err := OpenRotating(filepath.Join(opts.Dir, "pcloud.log"), opts.MaxSize, opts.MaxAge, opts.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	out.set(f)
+	pathMu.Lock()
+	path = f.path
+	pathMu.Unlock()
+	slog.SetDefault(root.With(SubsystemKey, "main"))
+	return f, nil
+}
+
+var (
+	pathMu sync.Mutex
+	path   string
+)
+
+// Path is the active log file, or "" before Setup.
+func Path() string {
+	pathMu.Lock()
+	defer pathMu.Unlock()
+	return path
+}
+
+// SetLevel changes the minimum level of every logger at once.
+func SetLevel(s string) error {
+	if s == "" {
+		s = "info"
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return err
+	}
+	level.Set(l)
+	return nil
+}
+
+// Dir is the per-user log directory.
+func Dir() string {
+	switch runtime.GOOS {
+	case "windows":
+		if d := os.Getenv("LOCALAPPDATA"); d != "" {
+			return filepath.Join(d, "PCloud", "logs")
+		}
+	case "darwin":
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, "Library", "Logs", "PCloud")
+		}
+	default:
+		if d := os.Getenv("XDG_STATE_HOME"); d != "" {
+			return filepath.Join(d, "pcloud", "logs")
+		}
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, ".local", "state", "pcloud", "logs")
+		}
+	}
+	return filepath.Join(os.TempDir(), "pcloud-logs")
+}
+
+// LineWriter returns an io.Writer that logs each line written to it, e.g.
+// for a child process's stderr.
+func LineWriter(l *slog.Logger, lvl slog.Level) io.Writer {
+	return &lineWriter{l: l, lvl: lvl}
+}
+
+type lineWriter struct {
+	mu  sync.Mutex
+	l   *slog.Logger
+	lvl slog.Level
+	buf []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexAny(w.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+		if ln := strings.TrimSpace(string(w.buf[:i])); ln != "" {
+			w.l.Log(context.Background(), w.lvl, ln)
+		}
+		w.buf = w.buf[i+1:]
+	}
+	if len(w.buf) > 64<<10 { // runaway line without a newline
+		w.l.Log(context.Background(), w.lvl, string(w.buf))
+		w.buf = w.buf[:0]
+	}
+	return len(p), nil
+}
+
+// switchWriter lets Setup redirect the text handler after loggers exist.
+type switchWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *switchWriter) set(w io.Writer) {
+	s.mu.Lock()
+	s.w = w
+	s.mu.Unlock()
+}
+
+func (s *switchWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// fanout sends each record to every handler that is enabled for it: the
+// file gets the global level, the hub also whatever a /logs/stream
+// subscriber asked for below it.
+type fanout []slog.Handler
+
+func (f fanout) Enabled(ctx context.Context, l slog.Level) bool {
+	for _, h := range f {
+		if h.Enabled(ctx, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f fanout) Handle(ctx context.Context, r slog.Record) error {
+	for _, h := range f {
+		if h.Enabled(ctx, r.Level) {
+			_ = h.Handle(ctx, r.Clone())
+		}
+	}
+	return nil
+}
+
+func (f fanout) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(fanout, len(f))
+	for i, h := range f {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (f fanout) WithGroup(name string) slog.Handler {
+	out := make(fanout, len(f))
+	for i, h := range f {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
@@ -0,0 +1,185 @@
+package logging
+
+import (
+	"cmp"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxSize = 10 << 20
+	defaultMaxAge  = 7 * 24 * time.Hour
+	defaultBackups = 10
+	backupLayout   = "20060102-150405"
+)
+
+// RotatingFile is an append-only log file that is renamed to
+// "<name>-<timestamp><ext>" once it grows past maxSize or gets older than
+// maxAge; a second rotation within the same second gets "-1", "-2", ...
+// after the timestamp. On each rotation backups older than maxAge are
+// deleted, and then the oldest ones past maxBackups.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// OpenRotating opens (or creates) path for appending. Zero limits pick the
+// defaults: 10 MiB, 7 days and 10 backups.
+func OpenRotating(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*RotatingFile, error) {
+	if maxSize <= 0 {
+		maxSize = defaultMaxSize
+	}
+	if maxAge <= 0 {
+		maxAge = defaultMaxAge
+	}
+	if maxBackups <= 0 {
+		maxBackups = defaultBackups
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	r := &RotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.opened = f, fi.Size(), fi.ModTime()
+	if r.size == 0 {
+		r.opened = time.Now()
+	}
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.size > 0 && (r.size+int64(len(p)) > r.maxSize || time.Since(r.opened) > r.maxAge) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(r.path, r.backupName(time.Now())); err != nil {
+		// keep logging into the old file rather than losing lines
+		_ = r.open()
+		return nil
+	}
+	r.prune()
+	return r.open()
+}
+
+// backupName is the first unused backup path for a rotation at t.
+func (r *RotatingFile) backupName(t time.Time) string {
+	ext := filepath.Ext(r.path)
+	base := strings.TrimSuffix(r.path, ext) + "-" + t.Format(backupLayout)
+	name := base + ext
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(name); os.IsNotExist(err) {
+			return name
+		}
+		name = base + "-" + strconv.Itoa(n) + ext
+	}
+}
+
+// backup is a rotated file as named by backupName.
+type backup struct {
+	name string
+	ts   time.Time
+	n    int // same-second counter
+}
+
+// backups lists the rotated files next to the log, oldest first.
+func (r *RotatingFile) backups() []backup {
+	ext := filepath.Ext(r.path)
+	prefix := strings.TrimSuffix(filepath.Base(r.path), ext) + "-"
+	entries, err := os.ReadDir(filepath.Dir(r.path))
+	if err != nil {
+		return nil
+	}
+	var out []backup
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		stem := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+		if len(stem) < len(backupLayout) {
+			continue
+		}
+		ts, err := time.ParseInLocation(backupLayout, stem[:len(backupLayout)], time.Local)
+		if err != nil {
+			continue
+		}
+		b := backup{name: name, ts: ts}
+		if rest := stem[len(backupLayout):]; rest != "" {
+			n, err := strconv.Atoi(strings.TrimPrefix(rest, "-"))
+			if !strings.HasPrefix(rest, "-") || err != nil || n < 1 {
+				continue
+			}
+			b.n = n
+		}
+		out = append(out, b)
+	}
+	slices.SortFunc(out, func(a, b backup) int {
+		return cmp.Or(a.ts.Compare(b.ts), cmp.Compare(a.n, b.n))
+	})
+	return out
+}
+
+// prune removes backups whose timestamp is older than maxAge, then the
+// oldest of the rest until at most maxBackups are left.
+func (r *RotatingFile) prune() {
+	dir := filepath.Dir(r.path)
+	bs := r.backups()
+	for len(bs) > 0 && (len(bs) > r.maxBackups || time.Since(bs[0].ts) > r.maxAge) {
+		_ = os.Remove(filepath.Join(dir, bs[0].name))
+		bs = bs[1:]
+	}
+}
+
+// Close closes the current file. Further writes fail with os.ErrClosed.
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
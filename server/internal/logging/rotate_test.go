@@ -0,0 +1,139 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// logFiles lists the files in dir.
+func logFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, e := range entries {
+		out = append(out, e.Name())
+	}
+	return out
+}
+
+func TestRotateBySize(t *testing.T) {
+	dir := t.TempDir()
+	r, err := OpenRotating(filepath.Join(dir, "pcloud.log"), 12, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, line := range []string{"12345\n", "6789\n", "abcdef\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := logFiles(t, dir)
+	if len(files) != 2 || !slices.Contains(files, "pcloud.log") {
+		t.Fatalf("files %v, want the log and one backup", files)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "pcloud.log")); string(b) != "abcdef\n" {
+		t.Errorf("current file holds %q", b)
+	}
+}
+
+// TestRotateSameSecond rotates several times in a row: each backup gets
+// its own name instead of replacing the one before.
+func TestRotateSameSecond(t *testing.T) {
+	dir := t.TempDir()
+	r, err := OpenRotating(filepath.Join(dir, "pcloud.log"), 1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, line := range []string{"a\n", "b\n", "c\n", "d\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var kept []string
+	for _, b := range r.backups() {
+		data, _ := os.ReadFile(filepath.Join(dir, b.name))
+		kept = append(kept, string(data))
+	}
+	if want := []string{"a\n", "b\n", "c\n"}; !slices.Equal(kept, want) {
+		t.Errorf("backups hold %q, want %q in order", kept, want)
+	}
+}
+
+func TestBackupName(t *testing.T) {
+	dir := t.TempDir()
+	r := &RotatingFile{path: filepath.Join(dir, "pcloud.log")}
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.Local)
+	var got []string
+	for range 3 {
+		name := r.backupName(at)
+		got = append(got, filepath.Base(name))
+		if err := os.WriteFile(name, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"pcloud-20260301-120000.log", "pcloud-20260301-120000-1.log", "pcloud-20260301-120000-2.log"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Now()
+	stamp := func(d time.Duration) string { return now.Add(-d).Format(backupLayout) }
+	tests := []struct {
+		name       string
+		files      []string
+		maxBackups int
+		want       []string
+	}{
+		{"age", []string{"pcloud-" + stamp(10*24*time.Hour) + ".log", "pcloud-" + stamp(time.Hour) + ".log"}, 10,
+			[]string{"pcloud-" + stamp(time.Hour) + ".log"}},
+		{"count keeps the newest", []string{
+			"pcloud-" + stamp(3*time.Hour) + ".log",
+			"pcloud-" + stamp(2*time.Hour) + ".log",
+			"pcloud-" + stamp(2*time.Hour) + "-1.log",
+			"pcloud-" + stamp(time.Hour) + ".log",
+		}, 2, []string{"pcloud-" + stamp(2*time.Hour) + "-1.log", "pcloud-" + stamp(time.Hour) + ".log"}},
+		{"counter after ten", []string{
+			"pcloud-" + stamp(time.Hour) + "-2.log",
+			"pcloud-" + stamp(time.Hour) + "-10.log",
+		}, 1, []string{"pcloud-" + stamp(time.Hour) + "-10.log"}},
+		{"other files left alone", []string{
+			"pcloud-" + stamp(30*24*time.Hour) + ".txt",
+			"pcloud-notes.log",
+			"pcloud-" + stamp(30*24*time.Hour) + "-x.log",
+			"other-" + stamp(30*24*time.Hour) + ".log",
+		}, 1, []string{
+			"other-" + stamp(30*24*time.Hour) + ".log",
+			"pcloud-" + stamp(30*24*time.Hour) + "-x.log",
+			"pcloud-" + stamp(30*24*time.Hour) + ".txt",
+			"pcloud-notes.log",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, f := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, f), nil, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r := &RotatingFile{path: filepath.Join(dir, "pcloud.log"), maxAge: 7 * 24 * time.Hour, maxBackups: tt.maxBackups}
+			r.prune()
+			got := logFiles(t, dir)
+			want := slices.Sorted(slices.Values(tt.want))
+			if !slices.Equal(got, want) {
+				t.Errorf("left\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+// Package metrics exposes streaming health as Prometheus metrics on
+// /metrics. Per-stream series are labelled by session id and are removed
+// when the session ends, so scrapes only show live sessions. The codec a
+// session sends is on pcloud_stream_info, which follows it through
+// reconfigurations; join on session to break the others down by codec.
+package metrics
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const ns = "pcloud"
+
+var streamLabels = []string{"session"}
+
+var (
+	registry = prometheus.NewRegistry()
+
+	encoderFrames = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns, Name: "encoder_frames_total",
+		Help: "Encoded video frames (access units) read from the encoder; rate() gives the frame rate.",
+	}, streamLabels)
+	encoderFrameBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns, Name: "encoder_frame_bytes",
+		Help:    "Size of encoded video frames.",
+		Buckets: prometheus.ExponentialBuckets(1024, 2, 12), // 1 KiB .. 2 MiB
+	}, streamLabels)
+	parseErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns, Name: "bitstream_parse_errors_total",
+		Help: "Malformed NAL units/frames and forced access-unit flushes in the encoder output.",
+	}, streamLabels)
+	samplesWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns, Name: "samples_written_total",
+		Help: "Media samples/packets written to WebRTC tracks.",
+	}, append(streamLabels, "track"))
+	rtcpFractionLost = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns, Name: "rtcp_fraction_lost",
+		Help: "Fraction of packets lost as reported by the client's last RTCP receiver report.",
+	}, append(streamLabels, "track"))
+	rtcpJitter = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns, Name: "rtcp_jitter_seconds",
+		Help: "Interarrival jitter from the client's last RTCP receiver report.",
+	}, append(streamLabels, "track"))
+	rtcpRTT = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns, Name: "rtcp_rtt_seconds",
+		Help: "Round-trip time computed from RTCP sender/receiver reports.",
+	}, append(streamLabels, "track"))
+	keyframeRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns, Name: "keyframe_restarts_total",
+		Help: "Times the encoder was restarted to answer a keyframe request on an intra refresh stream.",
+	}, streamLabels)
+	encoderToScreenLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns, Name: "encoder_to_screen_latency_seconds",
+		Help:    "Time from a frame leaving the encoder to the client's screen, from the client's echoes; capture and encoding are not included.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 1.5, 12), // 5ms .. ~430ms
+	}, streamLabels)
+	ffmpegRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns, Name: "ffmpeg_restarts_total",
+		Help: "Times the encoder process was restarted after exiting unexpectedly.",
+	}, streamLabels)
+	streamInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns, Name: "stream_info",
+		Help: "Always 1; labels the session with the video codec it sends now.",
+	}, append(streamLabels, "codec"))
+
+	// ActiveSessions is the number of streaming sessions currently running.
+	ActiveSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns, Name: "active_sessions",
+		Help: "Streaming sessions currently running.",
+	})
+	// InputEvents counts input events received from clients, by type.
+	InputEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns, Name: "input_events_total",
+		Help: "Input events received from clients.",
+	}, []string{"type"})
+	// InputInjection is how long injecting one event into the OS took.
+	InputInjection = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns, Name: "input_injection_seconds",
+		Help:    "Time spent injecting an input event into the OS.",
+		Buckets: prometheus.ExponentialBuckets(0.00005, 2, 12), // 50µs .. ~100ms
+	}, []string{"type"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		encoderFrames, encoderFrameBytes, parseErrors, samplesWritten,
+		rtcpFractionLost, rtcpJitter, rtcpRTT, encoderToScreenLatency, ffmpegRestarts, keyframeRestarts,
+		streamInfo, ActiveSessions, InputEvents, InputInjection,
+	)
+}
+
+// Handler serves the registry in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Stream holds the series of one session, bound to its labels.
+type Stream struct {
+	session string
+
+	Frames           prometheus.Counter
+	FrameBytes       prometheus.Observer
+	ParseErrors      prometheus.Counter
+	FFmpegRestarts   prometheus.Counter
+	KeyframeRestarts prometheus.Counter
+	// EncoderToScreenLatency is fed by the latency probe, see webrtcx.
+	EncoderToScreenLatency prometheus.Observer
+
+	videoSamples, audioSamples prometheus.Counter
+
+	mu     sync.Mutex // orders SetCodec and Close
+	closed bool
+}
+
+// NewStream creates the series for a session sending codec.
+func NewStream(session, codec string) *Stream {
+	s := &Stream{
+		session:                session,
+		Frames:                 encoderFrames.WithLabelValues(session),
+		FrameBytes:             encoderFrameBytes.WithLabelValues(session),
+		ParseErrors:            parseErrors.WithLabelValues(session),
+		FFmpegRestarts:         ffmpegRestarts.WithLabelValues(session),
+		KeyframeRestarts:       keyframeRestarts.WithLabelValues(session),
+		EncoderToScreenLatency: encoderToScreenLatency.WithLabelValues(session),
+		videoSamples:           samplesWritten.WithLabelValues(session, "video"),
+		audioSamples:           samplesWritten.WithLabelValues(session, "audio"),
+	}
+	s.SetCodec(codec)
+	return s
+}
+
+// SetCodec records that the session sends codec from now on.
+func (s *Stream) SetCodec(codec string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	streamInfo.DeletePartialMatch(prometheus.Labels{"session": s.session})
+	streamInfo.WithLabelValues(s.session, codec).Set(1)
+}
+
+// SampleWritten counts one sample written to track ("video"|"audio"). The
+// two series are bound up front, so this stays off the label lookup on
+// every frame.
+func (s *Stream) SampleWritten(track string) {
+	if track == "audio" {
+		s.audioSamples.Inc()
+		return
+	}
+	s.videoSamples.Inc()
+}
+
+// ReceiverReport records an RTCP report block for track. rtt < 0 means the
+// report carried no usable timing.
+func (s *Stream) ReceiverReport(track string, fractionLost, jitterSec, rttSec float64) {
+	rtcpFractionLost.WithLabelValues(s.session, track).Set(fractionLost)
+	rtcpJitter.WithLabelValues(s.session, track).Set(jitterSec)
+	if rttSec >= 0 {
+		rtcpRTT.WithLabelValues(s.session, track).Set(rttSec)
+	}
+}
+
+// Close removes every series of the session.
+func (s *Stream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	l := prometheus.Labels{"session": s.session}
+	for _, v := range []interface{ DeletePartialMatch(prometheus.Labels) int }{
+		encoderFrames, encoderFrameBytes, parseErrors, samplesWritten,
+		rtcpFractionLost, rtcpJitter, rtcpRTT, encoderToScreenLatency, ffmpegRestarts, keyframeRestarts,
+		streamInfo,
+	} {
+		v.DeletePartialMatch(l)
+	}
+}
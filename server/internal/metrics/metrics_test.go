@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"slices"
+	"testing"
+)
+
+// series returns the label sets of metric name in the registry, as
+// "label=value,..." strings.
+func series(t *testing.T, name string) []string {
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			var s string
+			for i, l := range m.GetLabel() {
+				if i > 0 {
+					s += ","
+				}
+				s += l.GetName() + "=" + l.GetValue()
+			}
+			out = append(out, s)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+func TestStreamCodec(t *testing.T) {
+	s := NewStream("s1", "h264")
+	s.Frames.Inc()
+	s.ReceiverReport("video", 0, 0, 0.02)
+	if got, want := series(t, "pcloud_stream_info"), []string{"codec=h264,session=s1"}; !slices.Equal(got, want) {
+		t.Errorf("stream_info %v, want %v", got, want)
+	}
+
+	s.SetCodec("av1")
+	s.Frames.Inc()
+	if got, want := series(t, "pcloud_stream_info"), []string{"codec=av1,session=s1"}; !slices.Equal(got, want) {
+		t.Errorf("after SetCodec, stream_info %v, want %v", got, want)
+	}
+	if got, want := series(t, "pcloud_encoder_frames_total"), []string{"session=s1"}; !slices.Equal(got, want) {
+		t.Errorf("encoder_frames_total %v, want one series across the switch", got)
+	}
+
+	s.Close()
+	s.SetCodec("vp9") // a reconfiguration finishing as the session ends
+	for _, name := range []string{"pcloud_stream_info", "pcloud_encoder_frames_total", "pcloud_rtcp_rtt_seconds"} {
+		if got := series(t, name); len(got) != 0 {
+			t.Errorf("after Close, %s has %v", name, got)
+		}
+	}
+}
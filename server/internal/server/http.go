@@ -4,27 +4,34 @@ import (
 	"embed"
 	"encoding/json"
 	"fmt"
-	"io"
-	"log"
 	"net/http"
-	"os"
 	"os/exec"
 	"runtime"
 	"time"
 
+	"pc_cloud/internal/config"
+	"pc_cloud/internal/logging"
+	"pc_cloud/internal/metrics"
 	"pc_cloud/internal/webrtcx"
-	// "pc_cloud/internal/devices"
+
 	"github.com/gorilla/websocket"
 )
 
 //go:embed assets/*.html
 var assets embed.FS
 
-// TODO: add devices, something wrong with imports?
+var (
+	log          = logging.For("http")
+	inputLog     = logging.For("input")
+	discoveryLog = logging.For("discovery")
+)
 
 type Server struct {
-	mux *http.ServeMux
-	mgr *webrtcx.Manager
+	mux  *http.ServeMux
+	mgr  *webrtcx.Manager
+	cfg  *config.Store
+	name string    // friendly name advertised to LAN clients
+	id   *identity // nil if identity.json could not be created
 }
 
 type PadButton struct {
@@ -61,7 +68,7 @@ func InputWS(w http.ResponseWriter, r *http.Request) {
 		}
 		if msg.Type == "pad" {
 			// TODO: mapuj do akcji lub wstrzykuj do OS (ViGEm/uinput)
-			log.Printf("pad[%d] axes=%v buttons=%d", msg.Index, shortAxes(msg.Axes), len(msg.Buttons))
+			inputLog.Debug("pad", "index", msg.Index, "axes", shortAxes(msg.Axes), "buttons", len(msg.Buttons))
 		}
 	}
 }
@@ -88,10 +95,10 @@ func handleSuspend(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Println("Executing suspend command for", runtime.GOOS)
+	log.Info("executing suspend command", "os", runtime.GOOS)
 	err := cmd.Run()
 	if err != nil {
-		log.Printf("Failed to suspend system: %v", err)
+		log.Error("failed to suspend system", "err", err)
 		http.Error(w, "Failed to suspend system", http.StatusInternalServerError)
 		return
 	}
@@ -100,13 +107,23 @@ func handleSuspend(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "System is going to sleep.")
 }
 
-func New(mgr *webrtcx.Manager) *Server {
+func New(mgr *webrtcx.Manager, cfg *config.Store) *Server {
 	s := &Server{
-		mux: http.NewServeMux(),
-		mgr: mgr,
+		mux:  http.NewServeMux(),
+		mgr:  mgr,
+		cfg:  cfg,
+		name: cfg.Get().Name,
+	}
+	if s.name == "" {
+		s.name = shortHostname()
+	}
+	id, err := loadOrCreateIdentity()
+	if err != nil {
+		log.Error("identity unavailable", "err", err)
 	}
-	// id, _ := loadOrCreateIdentity()
-	StartLANDiscoveryResponder()
+	s.id = id
+	s.StartLANDiscoveryResponder()
+	s.StartMDNSResponder()
 	// s.RegisterPairingExportRoute("wss://broker.example.com/ws", 8080)
 	s.routes()
 	return s
@@ -126,9 +143,16 @@ func (s *Server) routes() {
 
 	// --- API ---
 	s.mux.HandleFunc("/api/session/offer", s.mgr.HandleOffer)
-	// s.mux.HandleFunc("/api/devices/audio", devices.handleListAudioDevices)
+	s.mux.HandleFunc("GET /api/devices/audio", s.handleAudioDevices)
+	s.mux.HandleFunc("GET /api/devices/audio/apps", s.handleAudioApps)
 	s.mux.HandleFunc("/api/session/end", s.mgr.End)
+	s.mux.HandleFunc("GET /api/session/{id}/stats", s.mgr.HandleStats)
+	s.mux.HandleFunc("POST /api/session/{id}/resume", s.mgr.HandleResume)
+	s.mux.HandleFunc("POST /api/session/{id}/mic", s.mgr.HandleMic)
+	s.mux.HandleFunc("POST /api/session/{id}/config", s.mgr.HandleConfig)
 	s.mux.HandleFunc("/api/system/suspend", handleSuspend)
+	s.mux.HandleFunc("/api/settings", s.handleSettings)
+	s.mux.HandleFunc("/api/profiles", s.handleProfiles)
 
 	// --- WebSocket endpoints ---
 	// input (gamepad, keyboard, mouse) -> webrtc
@@ -144,17 +168,10 @@ func (s *Server) routes() {
 		}
 	})
 
-	s.mux.HandleFunc("/logs/raw", func(w http.ResponseWriter, r *http.Request) {
-		logFile := "pcloud.log"
-		f, err := os.Open(logFile)
-		if err != nil {
-			http.Error(w, "cannot open log file", http.StatusInternalServerError)
-			return
-		}
-		defer f.Close()
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		io.Copy(w, f)
-	})
+	s.mux.HandleFunc("/logs/raw", handleLogsRaw)
+	s.mux.HandleFunc("/logs/stream", handleLogsStream)
+
+	s.mux.Handle("/metrics", metrics.Handler())
 
 	s.mux.HandleFunc("/logs", func(w http.ResponseWriter, r *http.Request) {
 		data, err := assets.ReadFile("assets/logs.html")
@@ -180,6 +197,7 @@ func (s *Server) routes() {
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Global CORS (dla kiosku odpalonego z innego hosta/portu)
 	w.Header().Set("Access-Control-Allow-Origin", "*")
+	// no PUT: /api/settings is changed from the host's own settings page
 	w.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS,HEAD")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Accept,Authorization")
 
@@ -2,63 +2,168 @@ package server
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
 	"net"
 	"strings"
+
+	"golang.org/x/net/ipv4"
+
+	"pc_cloud/internal/encoder"
 )
 
-const lanPort = ":9876"
+const (
+	lanPort     = ":9876"
+	discoverMsg = "DISCOVER_PCCLOUD"
+)
 
-func getLocalIP() string {
-	addrs, err := net.InterfaceAddrs()
-	if err != nil {
-		return ""
+// discoveryInfo is what a host tells LAN clients about itself, both in
+// replies to DISCOVER_PCCLOUD broadcasts and in the mDNS TXT record.
+type discoveryInfo struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Status   string   `json:"status"` // always "online" when we answer
+	Busy     bool     `json:"busy"`   // a streaming session is running
+	Address  string   `json:"address"`
+	Port     int      `json:"port"`
+	Codecs   []string `json:"codecs"`
+	Encoders []string `json:"encoders"`
+	FP       string   `json:"fp"` // identity fingerprint, same as in .pcloud-pair
+}
+
+func (s *Server) discoveryInfo(local net.IP) discoveryInfo {
+	cfg := s.cfg.Get()
+	caps := encoder.ProbeCapabilities(cfg.FFmpegPath)
+	info := discoveryInfo{
+		Name:     s.name,
+		Status:   "online",
+		Busy:     s.mgr.Busy(),
+		Port:     cfg.Port(),
+		Codecs:   caps.Codecs,
+		Encoders: caps.Encoders,
 	}
-	for _, addr := range addrs {
-		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				return ipnet.IP.String()
-			}
-		}
+	if s.id != nil {
+		info.ID = s.id.DeviceID
+		info.FP = s.id.DeviceID
+	}
+	if local != nil {
+		info.Address = local.String()
 	}
-	return ""
+	return info
 }
 
-func StartLANDiscoveryResponder() {
-	addr, err := net.ResolveUDPAddr("udp", lanPort)
+// StartLANDiscoveryResponder answers DISCOVER_PCCLOUD probes on lanPort. The
+// reply carries the address of the interface the probe arrived on, so
+// multi-homed hosts hand out an address the client can actually reach.
+func (s *Server) StartLANDiscoveryResponder() {
+	addr, err := net.ResolveUDPAddr("udp4", lanPort)
 	if err != nil {
-		log.Println("LAN discovery resolve error:", err)
+		discoveryLog.Error("LAN discovery resolve failed", "err", err)
 		return
 	}
 
-	conn, err := net.ListenUDP("udp", addr)
+	conn, err := net.ListenUDP("udp4", addr)
 	if err != nil {
-		log.Println("LAN discovery listen error:", err)
+		discoveryLog.Error("LAN discovery listen failed", "err", err)
 		return
 	}
 
+	pc := ipv4.NewPacketConn(conn)
+	// Not implemented on Windows; we fall back to matching subnets there.
+	haveCM := pc.SetControlMessage(ipv4.FlagDst|ipv4.FlagInterface, true) == nil
+
 	go func() {
 		defer conn.Close()
 		buf := make([]byte, 1024)
 
 		for {
-			n, remoteAddr, err := conn.ReadFromUDP(buf)
+			n, cm, src, err := pc.ReadFrom(buf)
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			raddr, ok := src.(*net.UDPAddr)
+			if !ok || strings.TrimSpace(string(buf[:n])) != discoverMsg {
 				continue
 			}
 
-			msg := strings.TrimSpace(string(buf[:n]))
-			if msg == "DISCOVER_PCCLOUD" {
-				resp := map[string]interface{}{
-					"id":      "steam-pc",
-					"name":    "Gaming PC",
-					"status":  "online",
-					"address": getLocalIP(), // your function
-				}
+			local, ifIndex := localAddrFor(cm, raddr.IP)
+			jsonData, _ := json.Marshal(s.discoveryInfo(local))
 
-				jsonData, _ := json.Marshal(resp)
-				conn.WriteToUDP(jsonData, remoteAddr)
+			var wcm *ipv4.ControlMessage
+			if haveCM && ifIndex > 0 {
+				wcm = &ipv4.ControlMessage{IfIndex: ifIndex, Src: local}
+			}
+			if _, err := pc.WriteTo(jsonData, wcm, raddr); err != nil {
+				discoveryLog.Warn("LAN discovery reply failed", "to", raddr, "err", err)
 			}
 		}
 	}()
 }
+
+// localAddrFor picks the local IPv4 address a peer at remote should use to
+// reach us. cm, when available, names the interface the packet came in on.
+func localAddrFor(cm *ipv4.ControlMessage, remote net.IP) (net.IP, int) {
+	if remote.IsLoopback() {
+		return net.IPv4(127, 0, 0, 1), 0
+	}
+	if cm != nil && cm.IfIndex > 0 {
+		if ifi, err := net.InterfaceByIndex(cm.IfIndex); err == nil {
+			if ip := ifaceIPv4(ifi, remote); ip != nil {
+				return ip, ifi.Index
+			}
+		}
+	}
+	ifs, _ := net.Interfaces()
+	for i := range ifs {
+		ifi := &ifs[i]
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil && ipnet.Contains(remote) {
+				return ipnet.IP.To4(), ifi.Index
+			}
+		}
+	}
+	return getLocalIP(), 0
+}
+
+// ifaceIPv4 returns the address of ifi on remote's subnet, or its first IPv4.
+func ifaceIPv4(ifi *net.Interface, remote net.IP) net.IP {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+	var first net.IP
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil {
+			continue
+		}
+		if remote != nil && ipnet.Contains(remote) {
+			return ipnet.IP.To4()
+		}
+		if first == nil {
+			first = ipnet.IP.To4()
+		}
+	}
+	return first
+}
+
+func getLocalIP() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+			if ip := ipnet.IP.To4(); ip != nil {
+				return ip
+			}
+		}
+	}
+	return nil
+}
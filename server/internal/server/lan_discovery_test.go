@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+
+	"pc_cloud/internal/encoder"
+)
+
+func TestDiscoveryInfo(t *testing.T) {
+	s := testServer(t, "Living Room")
+	got := s.discoveryInfo(net.IPv4(192, 168, 1, 20))
+	caps := encoder.ProbeCapabilities(s.cfg.Get().FFmpegPath)
+	if got.Name != "Living Room" || got.Status != "online" || got.Busy || got.Address != "192.168.1.20" ||
+		got.Port != s.cfg.Get().Port() || got.ID != "dev-1" || got.FP != "dev-1" {
+		t.Errorf("got %+v", got)
+	}
+	if !slices.Equal(got.Codecs, caps.Codecs) || !slices.Equal(got.Encoders, caps.Encoders) {
+		t.Errorf("codecs %v, encoders %v, want %+v", got.Codecs, got.Encoders, caps)
+	}
+
+	s.id = nil
+	if got := s.discoveryInfo(nil); got.ID != "" || got.FP != "" || got.Address != "" {
+		t.Errorf("without identity or address: got %+v", got)
+	}
+}
+
+// hostIPv4 returns an up, non-loopback interface and an IPv4 network on
+// it, or skips the test.
+func hostIPv4(t *testing.T) (net.Interface, *net.IPNet) {
+	ifs, _ := net.Interfaces()
+	for _, ifi := range ifs {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				return ifi, ipnet
+			}
+		}
+	}
+	t.Skip("no IPv4 interface")
+	return net.Interface{}, nil
+}
+
+func TestLocalAddrFor(t *testing.T) {
+	if ip, idx := localAddrFor(nil, net.IPv4(127, 0, 0, 1)); !ip.Equal(net.IPv4(127, 0, 0, 1)) || idx != 0 {
+		t.Errorf("loopback peer: got %v, %d", ip, idx)
+	}
+
+	ifi, ipnet := hostIPv4(t)
+	// a peer on the same subnet, with and without the arrival interface
+	peer := slices.Clone(ipnet.IP.To4())
+	peer[3] ^= 1
+	for _, cm := range []*ipv4.ControlMessage{nil, {IfIndex: ifi.Index}} {
+		ip, idx := localAddrFor(cm, peer)
+		if !ip.Equal(ipnet.IP) || idx != ifi.Index {
+			t.Errorf("cm %+v: got %v on %d, want %v on %d", cm, ip, idx, ipnet.IP, ifi.Index)
+		}
+	}
+	// off-subnet, the interface it came in on still decides
+	if ip, idx := localAddrFor(&ipv4.ControlMessage{IfIndex: ifi.Index}, net.IPv4(203, 0, 113, 9)); ip == nil || idx != ifi.Index {
+		t.Errorf("off-subnet peer: got %v on %d, want an address on %d", ip, idx, ifi.Index)
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"pc_cloud/internal/logging"
+)
+
+const defaultRawTail = 256 << 10
+
+// handleLogsRaw returns the tail of the current log file; ?bytes=N sets how
+// much (default 256 KiB).
+func handleLogsRaw(w http.ResponseWriter, r *http.Request) {
+	f, err := os.Open(logging.Path())
+	if err != nil {
+		http.Error(w, "cannot open log file", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	tail := int64(defaultRawTail)
+	if v, err := strconv.ParseInt(r.URL.Query().Get("bytes"), 10, 64); err == nil && v > 0 {
+		tail = v
+	}
+	if fi, err := f.Stat(); err == nil && fi.Size() > tail {
+		_, _ = f.Seek(fi.Size()-tail, io.SeekStart)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = io.Copy(w, f)
+}
+
+// handleLogsStream is a Server-Sent Events feed of log entries as JSON,
+// starting with the recent backlog. Filters: ?level=warn&subsystem=encoder,webrtc
+// A level below the configured one (?level=debug) turns those records on
+// while the stream is open; the backlog only has what the log file has.
+func handleLogsStream(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter, err := logging.ParseFilter(q.Get("level"), q.Get("subsystem"))
+	if err != nil {
+		http.Error(w, "bad level: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	recent, ch, cancel := logging.Subscribe(filter)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	send := func(e logging.Entry) bool {
+		b, _ := json.Marshal(e)
+		_, err := fmt.Fprintf(w, "data: %s\n\n", b)
+		return err == nil
+	}
+	for _, e := range recent {
+		if !send(e) {
+			return
+		}
+	}
+	fl.Flush()
+
+	ping := time.NewTicker(15 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			if !send(e) {
+				return
+			}
+			fl.Flush()
+		case <-ping.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+			fl.Flush()
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+// DNS-SD advertisement of _pcloud._tcp over multicast DNS (RFC 6762/6763),
+// so clients can find hosts without DISCOVER_PCCLOUD broadcasts.
+
+const (
+	mdnsService  = "_pcloud._tcp.local."
+	mdnsServices = "_services._dns-sd._udp.local."
+	mdnsTTL      = 120
+	mdnsCacheBit = 0x8000 // cache-flush on answers, unicast-response on questions
+	// TTL of replies to legacy resolvers, which cache like unicast DNS
+	// and never see the goodbyes (RFC 6762 §6.7)
+	mdnsLegacyTTL = 10
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+type mdnsResponder struct {
+	s        *Server
+	pc       *ipv4.PacketConn
+	haveCM   bool
+	instance string // "<name>._pcloud._tcp.local."
+	host     string // "<hostname>.local."
+}
+
+// StartMDNSResponder joins the mDNS group on every multicast-capable
+// interface, announces the service and answers PTR/SRV/TXT/A queries for it.
+func (s *Server) StartMDNSResponder() {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		discoveryLog.Error("mDNS listen failed", "err", err)
+		return
+	}
+	pc := ipv4.NewPacketConn(conn)
+	ifs := multicastInterfaces()
+	for i := range ifs {
+		if err := pc.JoinGroup(&ifs[i], mdnsGroup); err != nil {
+			discoveryLog.Warn("mDNS join failed", "iface", ifs[i].Name, "err", err)
+		}
+	}
+	_ = pc.SetMulticastTTL(255)
+	_ = pc.SetMulticastLoopback(true)
+
+	r := &mdnsResponder{
+		s:        s,
+		pc:       pc,
+		haveCM:   pc.SetControlMessage(ipv4.FlagInterface, true) == nil,
+		instance: dnsLabel(s.name) + "." + mdnsService,
+		host:     dnsLabel(shortHostname()) + ".local.",
+	}
+	go r.serve()
+	go r.announce(ifs)
+}
+
+func (r *mdnsResponder) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, cm, src, err := r.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		raddr, ok := src.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(buf[:n])
+		if err != nil || h.Response {
+			continue
+		}
+		qs, err := p.AllQuestions()
+		if err != nil {
+			continue
+		}
+
+		local, ifIndex := localAddrFor(cm, raddr.IP)
+		unicast := false
+		var want []dnsmessage.Question
+		for _, q := range qs {
+			if r.answers(q) {
+				want = append(want, q)
+				unicast = unicast || q.Class&mdnsCacheBit != 0
+			}
+		}
+		if len(want) == 0 || local == nil {
+			continue
+		}
+		// a query from another port than 5353 is a legacy/one-shot resolver,
+		// which expects a direct reply that looks like unicast DNS
+		var legacy *legacyQuery
+		if raddr.Port != mdnsGroup.Port {
+			legacy = &legacyQuery{id: h.ID, questions: qs}
+		}
+		msg, err := r.response(want, local, legacy)
+		if err != nil {
+			discoveryLog.Error("mDNS build response failed", "err", err)
+			continue
+		}
+		dst := mdnsGroup
+		if unicast || legacy != nil {
+			dst = raddr
+		}
+		var wcm *ipv4.ControlMessage
+		if r.haveCM && ifIndex > 0 {
+			wcm = &ipv4.ControlMessage{IfIndex: ifIndex}
+		}
+		_, _ = r.pc.WriteTo(msg, wcm, dst)
+	}
+}
+
+// announce sends unsolicited responses on every interface, twice, as the
+// RFC asks, so browsers that are already listening pick us up immediately.
+func (r *mdnsResponder) announce(ifs []net.Interface) {
+	for round := 0; round < 2; round++ {
+		for i := range ifs {
+			local := ifaceIPv4(&ifs[i], nil)
+			if local == nil {
+				continue
+			}
+			msg, err := r.response([]dnsmessage.Question{{
+				Name:  dnsmessage.MustNewName(mdnsService),
+				Type:  dnsmessage.TypePTR,
+				Class: dnsmessage.ClassINET,
+			}}, local, nil)
+			if err != nil {
+				discoveryLog.Error("mDNS build announcement failed", "err", err)
+				return
+			}
+			if err := r.pc.SetMulticastInterface(&ifs[i]); err != nil {
+				continue
+			}
+			_, _ = r.pc.WriteTo(msg, nil, mdnsGroup)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (r *mdnsResponder) answers(q dnsmessage.Question) bool {
+	name := strings.ToLower(q.Name.String())
+	switch name {
+	case mdnsServices, mdnsService:
+		return q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL
+	case strings.ToLower(r.instance):
+		return q.Type == dnsmessage.TypeSRV || q.Type == dnsmessage.TypeTXT || q.Type == dnsmessage.TypeALL
+	case strings.ToLower(r.host):
+		return q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeALL
+	}
+	return false
+}
+
+// legacyQuery is what a reply to a legacy resolver has to repeat.
+type legacyQuery struct {
+	id        uint16
+	questions []dnsmessage.Question
+}
+
+// response builds an answer for qs. Records the question did not ask for
+// directly (SRV/TXT/A after a PTR) go into the additional section. mDNS
+// responses carry ID 0 (RFC 6762 §18.1); replies to a legacy query echo its
+// ID and questions instead and have no cache-flush bits (§6.7).
+func (r *mdnsResponder) response(qs []dnsmessage.Question, local net.IP, legacy *legacyQuery) ([]byte, error) {
+	service := dnsmessage.MustNewName(mdnsService)
+	instance, err := dnsmessage.NewName(r.instance)
+	if err != nil {
+		return nil, err
+	}
+	host, err := dnsmessage.NewName(r.host)
+	if err != nil {
+		return nil, err
+	}
+	info := r.s.discoveryInfo(local)
+
+	ttl := uint32(mdnsTTL)
+	if legacy != nil {
+		ttl = mdnsLegacyTTL
+	}
+	hdr := func(name dnsmessage.Name, unique bool) dnsmessage.ResourceHeader {
+		class := dnsmessage.ClassINET
+		if unique && legacy == nil {
+			class |= mdnsCacheBit
+		}
+		return dnsmessage.ResourceHeader{Name: name, Class: class, TTL: ttl}
+	}
+	var a4 [4]byte
+	copy(a4[:], local.To4())
+	txt := txtRecord(info)
+
+	var id uint16
+	if legacy != nil {
+		id = legacy.id
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, Authoritative: true})
+	b.EnableCompression()
+	if legacy != nil {
+		if err := b.StartQuestions(); err != nil {
+			return nil, err
+		}
+		for _, q := range legacy.questions {
+			if err := b.Question(q); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	var needSRV, needTXT, needA bool
+	for _, q := range qs {
+		switch strings.ToLower(q.Name.String()) {
+		case mdnsServices:
+			err = b.PTRResource(hdr(q.Name, false), dnsmessage.PTRResource{PTR: service})
+		case mdnsService:
+			err = b.PTRResource(hdr(service, false), dnsmessage.PTRResource{PTR: instance})
+			needSRV, needTXT, needA = true, true, true
+		case strings.ToLower(r.instance):
+			if q.Type == dnsmessage.TypeSRV || q.Type == dnsmessage.TypeALL {
+				err = b.SRVResource(hdr(instance, true), dnsmessage.SRVResource{Port: uint16(info.Port), Target: host})
+				needA = true
+			}
+			if err == nil && (q.Type == dnsmessage.TypeTXT || q.Type == dnsmessage.TypeALL) {
+				err = b.TXTResource(hdr(instance, true), dnsmessage.TXTResource{TXT: txt})
+			}
+		case strings.ToLower(r.host):
+			err = b.AResource(hdr(host, true), dnsmessage.AResource{A: a4})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	if needSRV {
+		if err := b.SRVResource(hdr(instance, true), dnsmessage.SRVResource{Port: uint16(info.Port), Target: host}); err != nil {
+			return nil, err
+		}
+	}
+	if needTXT {
+		if err := b.TXTResource(hdr(instance, true), dnsmessage.TXTResource{TXT: txt}); err != nil {
+			return nil, err
+		}
+	}
+	if needA {
+		if err := b.AResource(hdr(host, true), dnsmessage.AResource{A: a4}); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// maxTXTString is the most a TXT character-string can hold (RFC 1035
+// §3.3); the message can't be built with a longer one.
+const maxTXTString = 255
+
+// txtRecord is info as DNS-SD key=value strings. A name too long for one
+// string is cut short, and lists keep as many whole entries as fit.
+func txtRecord(info discoveryInfo) []string {
+	return []string{
+		"id=" + info.ID,
+		txtValue("name", info.Name),
+		"port=" + strconv.Itoa(info.Port),
+		txtList("codecs", info.Codecs),
+		txtList("encoders", info.Encoders),
+		"busy=" + strconv.FormatBool(info.Busy),
+		"fp=" + info.FP,
+	}
+}
+
+// txtValue is key=value, cut at a rune boundary to fit a TXT string.
+func txtValue(key, value string) string {
+	s := key + "=" + value
+	for len(s) > maxTXTString {
+		_, size := utf8.DecodeLastRuneInString(s)
+		s = s[:len(s)-size]
+	}
+	return s
+}
+
+// txtList is key=a,b,c with the entries that fit a TXT string.
+func txtList(key string, values []string) string {
+	s := key + "="
+	for i, v := range values {
+		if i > 0 {
+			v = "," + v
+		}
+		if len(s)+len(v) > maxTXTString {
+			break
+		}
+		s += v
+	}
+	return s
+}
+
+func multicastInterfaces() []net.Interface {
+	ifs, _ := net.Interfaces()
+	var out []net.Interface
+	for _, ifi := range ifs {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		out = append(out, ifi)
+	}
+	return out
+}
+
+func shortHostname() string {
+	hn, err := os.Hostname()
+	if err != nil || hn == "" {
+		return "pcloud"
+	}
+	if i := strings.IndexByte(hn, '.'); i > 0 {
+		hn = hn[:i]
+	}
+	return hn
+}
+
+// dnsLabel turns a friendly name into a single DNS label: no dots, at most
+// 63 bytes.
+func dnsLabel(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '.' || r == '\\' {
+			return '-'
+		}
+		return r
+	}, strings.TrimSpace(s))
+	for len(s) > 63 {
+		_, size := utf8.DecodeLastRuneInString(s)
+		s = s[:len(s)-size]
+	}
+	if s == "" {
+		s = "pcloud"
+	}
+	return s
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"pc_cloud/internal/config"
+	"pc_cloud/internal/webrtcx"
+)
+
+// testServer is a Server for the discovery code, with no responders or
+// routes started.
+func testServer(t *testing.T, name string) *Server {
+	st, err := config.Load([]string{"-config", filepath.Join(t.TempDir(), "config.yaml")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Server{mgr: webrtcx.New(st), cfg: st, name: name, id: &identity{DeviceID: "dev-1"}}
+}
+
+func testResponder(t *testing.T, name string) *mdnsResponder {
+	return &mdnsResponder{
+		s:        testServer(t, name),
+		instance: dnsLabel(name) + "." + mdnsService,
+		host:     "box.local.",
+	}
+}
+
+func question(name string, typ dnsmessage.Type) dnsmessage.Question {
+	return dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}
+}
+
+// parsedResponse is a response as dnsmessage.Parser reads it back.
+type parsedResponse struct {
+	hdr         dnsmessage.Header
+	questions   []dnsmessage.Question
+	answers     []dnsmessage.Resource
+	additionals []dnsmessage.Resource
+}
+
+func parseResponse(t *testing.T, msg []byte) parsedResponse {
+	t.Helper()
+	var p dnsmessage.Parser
+	var r parsedResponse
+	var err error
+	if r.hdr, err = p.Start(msg); err != nil {
+		t.Fatal(err)
+	}
+	if r.questions, err = p.AllQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	if r.answers, err = p.AllAnswers(); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.SkipAllAuthorities(); err != nil {
+		t.Fatal(err)
+	}
+	if r.additionals, err = p.AllAdditionals(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// types lists the record types of rs, e.g. "TypeSRV".
+func types(rs []dnsmessage.Resource) []string {
+	var out []string
+	for _, r := range rs {
+		out = append(out, r.Header.Type.String())
+	}
+	return out
+}
+
+func TestMDNSResponse(t *testing.T) {
+	r := testResponder(t, "Living Room")
+	local := net.IPv4(192, 168, 1, 20)
+	tests := []struct {
+		name        string
+		qs          []dnsmessage.Question
+		answers     []string
+		additionals []string
+	}{
+		{"browse", []dnsmessage.Question{question(mdnsService, dnsmessage.TypePTR)},
+			[]string{"TypePTR"}, []string{"TypeSRV", "TypeTXT", "TypeA"}},
+		{"service enumeration", []dnsmessage.Question{question(mdnsServices, dnsmessage.TypePTR)},
+			[]string{"TypePTR"}, nil},
+		{"resolve", []dnsmessage.Question{question(r.instance, dnsmessage.TypeSRV)},
+			[]string{"TypeSRV"}, []string{"TypeA"}},
+		{"txt", []dnsmessage.Question{question(r.instance, dnsmessage.TypeTXT)},
+			[]string{"TypeTXT"}, nil},
+		{"any instance", []dnsmessage.Question{question(r.instance, dnsmessage.TypeALL)},
+			[]string{"TypeSRV", "TypeTXT"}, []string{"TypeA"}},
+		{"host", []dnsmessage.Question{question(r.host, dnsmessage.TypeA)},
+			[]string{"TypeA"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := r.response(tt.qs, local, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := parseResponse(t, msg)
+			if got.hdr.ID != 0 || !got.hdr.Response || !got.hdr.Authoritative || len(got.questions) != 0 {
+				t.Errorf("header %+v with %d questions, want an mDNS response: ID 0, no questions", got.hdr, len(got.questions))
+			}
+			if a := types(got.answers); !slices.Equal(a, tt.answers) {
+				t.Errorf("answers %v, want %v", a, tt.answers)
+			}
+			if a := types(got.additionals); !slices.Equal(a, tt.additionals) {
+				t.Errorf("additionals %v, want %v", a, tt.additionals)
+			}
+			for _, rr := range append(got.answers, got.additionals...) {
+				shared := rr.Header.Type == dnsmessage.TypePTR
+				if flush := rr.Header.Class&mdnsCacheBit != 0; flush == shared {
+					t.Errorf("%v: cache-flush %v, want it on unique records only", rr.Header.Type, flush)
+				}
+				if rr.Header.TTL != mdnsTTL {
+					t.Errorf("%v: TTL %d, want %d", rr.Header.Type, rr.Header.TTL, mdnsTTL)
+				}
+			}
+		})
+	}
+}
+
+func TestMDNSResponseRecords(t *testing.T) {
+	r := testResponder(t, "Living Room")
+	msg, err := r.response([]dnsmessage.Question{question(mdnsService, dnsmessage.TypePTR)}, net.IPv4(192, 168, 1, 20), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := parseResponse(t, msg)
+	for _, rr := range append(got.answers, got.additionals...) {
+		switch b := rr.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if b.PTR.String() != r.instance {
+				t.Errorf("PTR to %s, want %s", b.PTR, r.instance)
+			}
+		case *dnsmessage.SRVResource:
+			if b.Target.String() != r.host || int(b.Port) != r.s.cfg.Get().Port() {
+				t.Errorf("SRV %s:%d, want %s:%d", b.Target, b.Port, r.host, r.s.cfg.Get().Port())
+			}
+		case *dnsmessage.AResource:
+			if b.A != [4]byte{192, 168, 1, 20} {
+				t.Errorf("A %v, want the local address", b.A)
+			}
+		case *dnsmessage.TXTResource:
+			want := txtRecord(r.s.discoveryInfo(net.IPv4(192, 168, 1, 20)))
+			if !slices.Equal(b.TXT, want) {
+				t.Errorf("TXT %q, want %q", b.TXT, want)
+			}
+			if !slices.ContainsFunc(b.TXT, func(s string) bool { return strings.HasPrefix(s, "encoders=") && len(s) > len("encoders=") }) {
+				t.Errorf("TXT %q has no encoders", b.TXT)
+			}
+		}
+	}
+}
+
+func TestMDNSLegacyResponse(t *testing.T) {
+	r := testResponder(t, "Living Room")
+	qs := []dnsmessage.Question{question(mdnsService, dnsmessage.TypePTR)}
+	msg, err := r.response(qs, net.IPv4(192, 168, 1, 20), &legacyQuery{id: 0x1234, questions: qs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := parseResponse(t, msg)
+	if got.hdr.ID != 0x1234 || !slices.Equal(got.questions, qs) {
+		t.Errorf("ID %#x, questions %v, want the query's echoed", got.hdr.ID, got.questions)
+	}
+	if len(got.answers) != 1 || len(got.additionals) != 3 {
+		t.Fatalf("%d answers, %d additionals, want 1 and 3", len(got.answers), len(got.additionals))
+	}
+	for _, rr := range append(got.answers, got.additionals...) {
+		if rr.Header.Class&mdnsCacheBit != 0 {
+			t.Errorf("%v has the cache-flush bit in a legacy reply", rr.Header.Type)
+		}
+		if rr.Header.TTL != mdnsLegacyTTL {
+			t.Errorf("%v: TTL %d, want %d", rr.Header.Type, rr.Header.TTL, mdnsLegacyTTL)
+		}
+	}
+}
+
+func TestMDNSLongName(t *testing.T) {
+	name := strings.Repeat("ż", 200) // 400 bytes, cut to one label for the instance
+	r := testResponder(t, name)
+	msg, err := r.response([]dnsmessage.Question{question(mdnsService, dnsmessage.TypePTR)}, net.IPv4(10, 0, 0, 2), nil)
+	if err != nil {
+		t.Fatalf("no announcement for a long name: %v", err)
+	}
+	for _, rr := range parseResponse(t, msg).additionals {
+		if txt, ok := rr.Body.(*dnsmessage.TXTResource); ok {
+			for _, s := range txt.TXT {
+				if len(s) > maxTXTString {
+					t.Errorf("TXT string of %d bytes", len(s))
+				}
+			}
+			if i := slices.IndexFunc(txt.TXT, func(s string) bool { return strings.HasPrefix(s, "name=") }); i < 0 || !strings.HasPrefix(name, txt.TXT[i][len("name="):]) {
+				t.Errorf("TXT %q, want the name cut short", txt.TXT)
+			}
+		}
+	}
+}
+
+func TestTXTList(t *testing.T) {
+	many := slices.Repeat([]string{"h264_nvenc"}, 30) // 329 bytes joined
+	got := txtList("encoders", many)
+	if len(got) > maxTXTString || strings.HasSuffix(got, ",") || !strings.HasSuffix(got, "h264_nvenc") {
+		t.Errorf("got %q (%d bytes), want whole entries within %d bytes", got, len(got), maxTXTString)
+	}
+	if got := txtList("codecs", nil); got != "codecs=" {
+		t.Errorf("got %q, want an empty list", got)
+	}
+}
+
+func TestMDNSAnswers(t *testing.T) {
+	r := testResponder(t, "Living Room")
+	tests := []struct {
+		q    dnsmessage.Question
+		want bool
+	}{
+		{question(mdnsService, dnsmessage.TypePTR), true},
+		{question("_PCLOUD._tcp.local.", dnsmessage.TypePTR), true},
+		{question(mdnsService, dnsmessage.TypeALL), true},
+		{question(mdnsService, dnsmessage.TypeA), false},
+		{question(mdnsServices, dnsmessage.TypePTR), true},
+		{question(r.instance, dnsmessage.TypeSRV), true},
+		{question(strings.ToUpper(r.instance), dnsmessage.TypeTXT), true},
+		{question(r.instance, dnsmessage.TypeA), false},
+		{question(r.host, dnsmessage.TypeA), true},
+		{question(r.host, dnsmessage.TypeAAAA), false},
+		{question("_http._tcp.local.", dnsmessage.TypePTR), false},
+	}
+	for _, tt := range tests {
+		if got := r.answers(tt.q); got != tt.want {
+			t.Errorf("answers(%s %v) = %v, want %v", tt.q.Name, tt.q.Type, got, tt.want)
+		}
+	}
+}
@@ -13,9 +13,10 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
+
+	"pc_cloud/internal/config"
 )
 
 type pairFile struct {
@@ -37,13 +38,7 @@ type identity struct {
 	LanToken   string `json:"lan_token,omitempty"`
 }
 
-func idPath() string {
-	if runtime.GOOS == "windows" {
-		return filepath.Join(os.Getenv("ProgramData"), "PCloud", "identity.json")
-	}
-	home, _ := os.UserHomeDir()
-	return filepath.Join(home, ".config", "pcloud", "identity.json")
-}
+func idPath() string { return filepath.Join(config.Dir(), "identity.json") }
 
 func ensureDir(p string) error { return os.MkdirAll(filepath.Dir(p), 0o755) }
 
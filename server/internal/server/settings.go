@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"pc_cloud/internal/config"
+	"pc_cloud/internal/devices"
+)
+
+// handleSettings serves GET/PUT /api/settings. PUT accepts any subset of the
+// config fields; invalid values are rejected with 422 and one message per
+// field. GET returns the effective config; PUT merges onto the file's, so
+// env and flag overrides are never written back, and they still win after
+// the update (the response lists the fields they pin). PUT is only taken
+// from this machine (see localRequest) and can't change the settings
+// config.FileOnlyChanges names.
+func (s *Server) handleSettings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"config": s.cfg.Get(),
+			"path":   s.cfg.Path(),
+		})
+	case http.MethodPut:
+		if !localRequest(r) {
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(map[string]any{"errors": []string{"settings can only be changed on the host itself"}})
+			return
+		}
+		cur := s.cfg.File()
+		// maps are replaced, not merged, so profiles can be removed
+		c := cur.Clone()
+		c.Profiles, c.ClientProfiles = nil, nil
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&c); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]any{"errors": []string{"bad json: " + err.Error()}})
+			return
+		}
+		if c.Profiles == nil {
+			c.Profiles = cur.Profiles
+		}
+		if c.ClientProfiles == nil {
+			c.ClientProfiles = cur.ClientProfiles
+		}
+		if fields := config.FileOnlyChanges(cur, c); len(fields) > 0 {
+			var errs []string
+			for _, f := range fields {
+				errs = append(errs, f+": can only be set in "+s.cfg.Path()+", the environment or flags")
+			}
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(map[string]any{"errors": errs})
+			return
+		}
+		res, err := s.cfg.Update(c)
+		if err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			_ = json.NewEncoder(w).Encode(map[string]any{"errors": strings.Split(err.Error(), "\n")})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// localRequest reports whether r comes from this machine and names it by
+// a loopback address or localhost. Pages from other sites can't send a
+// PUT here, since CORS doesn't allow it, and the Host and Origin checks
+// keep them out through DNS rebinding too.
+func localRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !isLoopback(host) {
+		return false
+	}
+	host = r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !isLoopback(host) {
+		return false
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != r.Host {
+			return false
+		}
+	}
+	return true
+}
+
+func isLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// handleProfiles lists the stream profiles a client may name in its offer.
+func (s *Server) handleProfiles(w http.ResponseWriter, r *http.Request) {
+	cfg := s.cfg.Get()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"profiles": cfg.Profiles,
+		"default":  cfg.DefaultProfile,
+		"caps":     cfg.Caps,
+	})
+}
+
+// handleAudioDevices lists the audio capture devices; the id of one goes
+// into the audio_device setting.
+func (s *Server) handleAudioDevices(w http.ResponseWriter, r *http.Request) {
+	cfg := s.cfg.Get()
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+	devs, err := devices.ListAudio(ctx, cfg.FFmpegPath)
+	if err != nil {
+		log.Warn("listing audio devices failed", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"devices":  devs,
+		"selected": cfg.AudioDevice,
+	})
+}
+
+// handleAudioApps lists the applications playing audio; an offer can name
+// one (process or PID) in audio_app to stream only its sound.
+func (s *Server) handleAudioApps(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+	apps, err := devices.ListAudioApps(ctx)
+	if errors.Is(err, errors.ErrUnsupported) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		log.Warn("listing audio applications failed", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"apps": apps})
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type settingsReply struct {
+	Config struct {
+		DefaultBitrate string              `json:"default_bitrate"`
+		DefaultCodec   string              `json:"default_codec"`
+		FFmpegPath     string              `json:"ffmpeg_path"`
+		Profiles       map[string]struct{} `json:"profiles"`
+	} `json:"config"`
+	Path   string   `json:"path"`
+	Errors []string `json:"errors"`
+}
+
+// settingsRequest sends method /api/settings with body, from this machine
+// unless the request is changed by setup.
+func settingsRequest(t *testing.T, s *Server, method, body string, setup func(r *http.Request)) (int, settingsReply) {
+	t.Helper()
+	r := httptest.NewRequest(method, "http://localhost:8080/api/settings", strings.NewReader(body))
+	r.RemoteAddr = "127.0.0.1:50000"
+	if setup != nil {
+		setup(r)
+	}
+	w := httptest.NewRecorder()
+	s.handleSettings(w, r)
+	var reply settingsReply
+	if w.Code != http.StatusMethodNotAllowed {
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+			t.Fatalf("%d %q: %v", w.Code, w.Body, err)
+		}
+	}
+	return w.Code, reply
+}
+
+func TestSettingsPut(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		setup  func(r *http.Request)
+		code   int
+		errors []string // substrings, one per error
+	}{
+		{"partial", `{"default_bitrate":"30M"}`, nil, http.StatusOK, nil},
+		{"same-origin page", `{"default_bitrate":"30M"}`, func(r *http.Request) { r.Header.Set("Origin", "http://localhost:8080") }, http.StatusOK, nil},
+		{"ffmpeg_path unchanged", `{"ffmpeg_path":"","default_bitrate":"30M"}`, nil, http.StatusOK, nil},
+		{"from the LAN", `{"default_bitrate":"30M"}`, func(r *http.Request) { r.RemoteAddr = "192.168.1.50:50000" }, http.StatusForbidden,
+			[]string{"only be changed on the host"}},
+		{"rebound name", `{"default_bitrate":"30M"}`, func(r *http.Request) { r.Host = "attacker.example:8080" }, http.StatusForbidden,
+			[]string{"only be changed on the host"}},
+		{"other origin", `{"default_bitrate":"30M"}`, func(r *http.Request) { r.Header.Set("Origin", "http://attacker.example") }, http.StatusForbidden,
+			[]string{"only be changed on the host"}},
+		{"ffmpeg_path", `{"ffmpeg_path":"/tmp/evil"}`, nil, http.StatusForbidden, []string{"ffmpeg_path: can only be set in"}},
+		{"file-only fields", `{"log_dir":"/tmp","webhook_url":"http://10.0.0.1/"}`, nil, http.StatusForbidden,
+			[]string{"log_dir: can only be set in", "webhook_url: can only be set in"}},
+		{"unknown field", `{"default_bitrat":"30M"}`, nil, http.StatusBadRequest, []string{"bad json", "default_bitrat"}},
+		{"invalid", `{"default_bitrate":"fast","framerate":0}`, nil, http.StatusUnprocessableEntity,
+			[]string{"default_bitrate:", "framerate:"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer(t, "den")
+			code, reply := settingsRequest(t, s, http.MethodPut, tt.body, tt.setup)
+			if code != tt.code {
+				t.Fatalf("status %d, want %d (errors %q)", code, tt.code, reply.Errors)
+			}
+			if len(tt.errors) > 0 && len(reply.Errors) != len(tt.errors) && tt.code != http.StatusBadRequest {
+				t.Errorf("errors %q, want %d", reply.Errors, len(tt.errors))
+			}
+			for _, want := range tt.errors {
+				if !slices.ContainsFunc(reply.Errors, func(e string) bool { return strings.Contains(e, want) }) {
+					t.Errorf("errors %q, want one containing %q", reply.Errors, want)
+				}
+			}
+			if code == http.StatusOK {
+				if reply.Config.DefaultBitrate != "30M" || reply.Config.DefaultCodec != "h264" {
+					t.Errorf("config %+v, want the bitrate merged onto the rest", reply.Config)
+				}
+				return
+			}
+			if got := s.cfg.Get(); got.DefaultBitrate != "20M" || got.FFmpegPath != "" || got.WebhookURL != "" {
+				t.Errorf("a rejected PUT changed the config: %+v", got)
+			}
+		})
+	}
+}
+
+func TestSettingsProfilesReplaced(t *testing.T) {
+	s := testServer(t, "den")
+	code, reply := settingsRequest(t, s, http.MethodPut,
+		`{"profiles":{"tv":{"codec":"hevc","fps":60,"preset":"p4","bitrate":"40M"}}}`, nil)
+	if code != http.StatusOK || len(reply.Config.Profiles) != 1 {
+		t.Fatalf("%d, profiles %v, want only tv", code, reply.Config.Profiles)
+	}
+	// without profiles in the body they stay as they are
+	code, reply = settingsRequest(t, s, http.MethodPut, `{"default_codec":"av1"}`, nil)
+	if _, ok := reply.Config.Profiles["tv"]; code != http.StatusOK || !ok || len(reply.Config.Profiles) != 1 {
+		t.Errorf("%d, profiles %v, want tv kept", code, reply.Config.Profiles)
+	}
+}
+
+func TestSettingsGet(t *testing.T) {
+	s := testServer(t, "den")
+	// reading is allowed from anywhere
+	code, reply := settingsRequest(t, s, http.MethodGet, "", func(r *http.Request) { r.RemoteAddr = "192.168.1.50:50000" })
+	if code != http.StatusOK || reply.Path != s.cfg.Path() || reply.Config.DefaultCodec != "h264" {
+		t.Errorf("%d %+v", code, reply)
+	}
+	if code, _ := settingsRequest(t, s, http.MethodDelete, "", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE: %d", code)
+	}
+}
+
+func TestCORSMethods(t *testing.T) {
+	s := testServer(t, "den")
+	s.mux = http.NewServeMux()
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, "/api/settings", nil))
+	if m := w.Header().Get("Access-Control-Allow-Methods"); strings.Contains(m, "PUT") {
+		t.Errorf("preflight allows %s", m)
+	}
+}
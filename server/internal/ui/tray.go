@@ -7,6 +7,8 @@ import (
 	"runtime"
 
 	"github.com/getlantern/systray"
+
+	"pc_cloud/internal/logging"
 )
 
 //go:embed pcloud.ico
@@ -17,15 +19,15 @@ type Callbacks struct {
 	OnExit    func()
 }
 
-func StartTray(cb Callbacks) {
+func StartTray(settingsURL string, cb Callbacks) {
 	systray.Run(func() {
-		onReady(cb)
+		onReady(settingsURL, cb)
 	}, func() {
 		cb.OnExit()
 	})
 }
 
-func onReady(cb Callbacks) {
+func onReady(settingsURL string, cb Callbacks) {
 	systray.SetTitle("PCloud")
 	systray.SetTooltip("PCloud Server")
 	systray.SetIcon(iconData)
@@ -43,9 +45,9 @@ func onReady(cb Callbacks) {
 		for {
 			select {
 			case <-openUI.ClickedCh:
-				openBrowser("http://localhost:8080/settings")
+				openBrowser(settingsURL)
 			case <-showLogs.ClickedCh:
-				openLogFile("pcloud.log")
+				openLogFile(logging.Path())
 			case <-restart.ClickedCh:
 				cb.OnRestart()
 			case <-exit.ClickedCh:
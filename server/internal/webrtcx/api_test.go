@@ -0,0 +1,110 @@
+package webrtcx
+
+import (
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestAddCodecIfMissing(t *testing.T) {
+	defaults, err := defaultCodecs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if defaults[102] != (registeredCodec{"video/h264", "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f"}) {
+		t.Fatalf("pion's default codecs moved: 102 is %+v", defaults[102])
+	}
+	me := &webrtc.MediaEngine{}
+	if err := me.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	registered := maps.Clone(defaults)
+	add := func(c webrtc.RTPCodecCapability) {
+		t.Helper()
+		if err := addCodecIfMissing(me, registered, c, webrtc.RTPCodecTypeVideo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add(h264Track("64001f")) // one of the defaults
+	if len(registered) != len(defaults) {
+		t.Errorf("a default codec was registered again")
+	}
+	add(h264Track("640c1f"))
+	add(h264Track("640c1f"))
+	add(videoCodec("vp9", 8))
+	add(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: videoClockRate, SDPFmtpLine: "profile-id=1"})
+	added := map[webrtc.PayloadType]registeredCodec{}
+	for pt, c := range registered {
+		if _, ok := defaults[pt]; !ok {
+			added[pt] = c
+		}
+	}
+	if len(added) != 2 {
+		t.Fatalf("added %+v, want constrained high and vp9 profile 1", added)
+	}
+	for pt := range added {
+		if pt < 96 {
+			t.Errorf("payload type %d is not dynamic", pt)
+		}
+	}
+}
+
+// The answer has to carry the client's payload type for every track the
+// session may send, even where pion's defaults have no matching codec.
+func TestBuildAPIForCodecsAnswer(t *testing.T) {
+	offered := []struct {
+		rtpmap, fmtp string
+		track        webrtc.RTPCodecCapability
+	}{
+		{"H264/90000", "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=640c1f", h264Track("640c1f")},
+		{"H264/90000", "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=f4001f", h264Track("f4001f")},
+		{"H265/90000", "profile-id=4", webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH265, ClockRate: videoClockRate, SDPFmtpLine: "profile-id=4"}},
+		{"VP9/90000", "profile-id=1", webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: videoClockRate, SDPFmtpLine: "profile-id=1"}},
+	}
+	var pts, attrs []string
+	var tracks []webrtc.RTPCodecCapability
+	for i, o := range offered {
+		pt := []string{"120", "121", "122", "123"}[i]
+		pts = append(pts, pt)
+		attrs = append(attrs, "a=rtpmap:"+pt+" "+o.rtpmap, "a=fmtp:"+pt+" "+o.fmtp)
+		tracks = append(tracks, o.track)
+	}
+	sdp := strings.Join(append([]string{
+		"v=0", "o=- 1 2 IN IP4 127.0.0.1", "s=-", "t=0 0", "a=group:BUNDLE 0",
+		"m=video 9 UDP/TLS/RTP/SAVPF " + strings.Join(pts, " "), "c=IN IP4 0.0.0.0",
+		"a=ice-ufrag:abcd", "a=ice-pwd:abcdefghijklmnopqrstuvwx",
+		"a=fingerprint:sha-256 00:11:22:33:44:55:66:77:88:99:AA:BB:CC:DD:EE:FF:00:11:22:33:44:55:66:77:88:99:AA:BB:CC:DD:EE:FF",
+		"a=setup:actpass", "a=mid:0", "a=recvonly", "a=rtcp-mux",
+	}, attrs...), "\r\n") + "\r\n"
+
+	api, err := buildAPIForCodecs(tracks, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	track, err := webrtc.NewTrackLocalStaticRTP(tracks[0], "video", "pccloud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, o := range offered {
+		if want := "a=rtpmap:" + pts[i] + " " + o.rtpmap; !strings.Contains(answer.SDP, want) {
+			t.Errorf("answer has no %q:\n%s", want, answer.SDP)
+		}
+	}
+}
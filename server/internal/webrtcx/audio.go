@@ -0,0 +1,150 @@
+package webrtcx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+
+	"pc_cloud/internal/metrics"
+)
+
+const (
+	opusClockRate = 48000
+	mimeMultiOpus = "audio/multiopus"
+)
+
+// audioCodec is the RTP codec for an Opus channel count. Browsers only
+// decode 5.1 as "multiopus", with the stream layout FFmpeg's
+// -mapping_family 1 produces.
+func audioCodec(channels int) webrtc.RTPCodecCapability {
+	if channels == 6 {
+		return webrtc.RTPCodecCapability{
+			MimeType: mimeMultiOpus, ClockRate: opusClockRate, Channels: 6,
+			SDPFmtpLine: "channel_mapping=0,4,1,2,3,5;num_streams=4;coupled_streams=2",
+		}
+	}
+	c := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: opusClockRate, Channels: 2,
+		SDPFmtpLine: "minptime=10;useinbandfec=1"}
+	if channels == 2 {
+		c.SDPFmtpLine += ";stereo=1;sprop-stereo=1"
+	}
+	return c
+}
+
+// audioChannels picks the channel count for an offer: 1, 2 or 6, falling
+// back to stereo when 5.1 was asked for but the browser didn't offer
+// multiopus.
+func audioChannels(req OfferRequest) int {
+	switch req.AudioChannels {
+	case 1:
+		return 1
+	case 6:
+		if strings.Contains(strings.ToLower(req.SDP), "multiopus/48000/6") {
+			return 6
+		}
+		log.Warn("5.1 audio requested but the client did not offer multiopus, using stereo")
+	}
+	return 2
+}
+
+// audioSink writes Opus packets to the audio track on the session's media
+// clock, the same way videoSink does for frames.
+type audioSink struct {
+	track *webrtc.TrackLocalStaticRTP
+	pk    rtp.Packetizer
+	clock *trackClock
+	ms    *metrics.Stream
+}
+
+func newAudioSink(track *webrtc.TrackLocalStaticRTP, clock *trackClock, ms *metrics.Stream) *audioSink {
+	return &audioSink{
+		track: track,
+		pk:    rtp.NewPacketizer(rtpOutboundMTU, 0, 0, &codecs.OpusPayloader{}, rtp.NewRandomSequencer(), opusClockRate),
+		clock: clock,
+		ms:    ms,
+	}
+}
+
+// pump reads Ogg Opus from FFmpeg's stdout. Each packet's PTS is the number
+// of samples before it, so gaps the encoder leaves (DTX) stay gaps.
+func (a *audioSink) pump(ctx context.Context, r io.Reader, _ string) {
+	or := newOggReader(r)
+	var pts int64
+	headers := 0
+	for {
+		pkt, arrival, err := or.next()
+		if err != nil {
+			if errors.Is(err, errOggCapture) {
+				a.ms.ParseErrors.Inc()
+			}
+			return
+		}
+		if headers < 2 && (bytes.HasPrefix(pkt, []byte("OpusHead")) || bytes.HasPrefix(pkt, []byte("OpusTags"))) {
+			headers++
+			continue
+		}
+		n, err := opusSamples(pkt)
+		if err != nil {
+			a.ms.ParseErrors.Inc()
+			continue
+		}
+		a.write(pkt, pts, arrival)
+		pts += int64(n)
+	}
+}
+
+func (a *audioSink) write(pkt []byte, pts int64, arrival time.Time) {
+	ts := a.clock.stamp(pts, opusClockRate, arrival)
+	for _, p := range a.pk.Packetize(pkt, 0) {
+		p.Timestamp = ts
+		if err := a.track.WriteRTP(p); err != nil {
+			log.Warn("writing RTP packet", "err", err)
+			return
+		}
+		a.clock.sent(len(p.Payload))
+	}
+	a.ms.SampleWritten("audio")
+}
+
+// opusSamples is the duration of an Opus packet at 48 kHz, from its TOC
+// byte (RFC 6716 3.1). For multistream packets this reads the first
+// stream, which has the same duration as the others.
+func opusSamples(pkt []byte) (int, error) {
+	if len(pkt) == 0 {
+		return 0, errors.New("opus: empty packet")
+	}
+	toc := pkt[0]
+	cfg := int(toc >> 3)
+	var frame int // in 1/400 s (2.5 ms) units
+	switch {
+	case cfg < 12: // SILK: 10, 20, 40, 60 ms
+		frame = []int{4, 8, 16, 24}[cfg&3]
+	case cfg < 16: // hybrid: 10, 20 ms
+		frame = []int{4, 8}[cfg&1]
+	default: // CELT: 2.5, 5, 10, 20 ms
+		frame = []int{1, 2, 4, 8}[cfg&3]
+	}
+	frames := 1
+	switch toc & 3 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(pkt) < 2 {
+			return 0, errors.New("opus: truncated code 3 packet")
+		}
+		frames = int(pkt[1] & 0x3F)
+	}
+	n := frames * frame * opusClockRate / 400
+	if n == 0 || n > 120*opusClockRate/1000 {
+		return 0, fmt.Errorf("opus: bad packet duration %d samples", n)
+	}
+	return n, nil
+}
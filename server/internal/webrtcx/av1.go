@@ -0,0 +1,193 @@
+package webrtcx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"time"
+
+	"pc_cloud/internal/bitstream"
+	"pc_cloud/internal/metrics"
+)
+
+// pumpAV1IVFToTrack reads AV1 in IVF from r. Frame PTS are in the time base
+// from the file header and are rescaled to the 90 kHz RTP clock.
+func pumpAV1IVFToTrack(ctx context.Context, r io.Reader, out sampleWriter, ms *metrics.Stream) {
+	iv, err := newIVFReader(r)
+	if err != nil {
+		if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			ms.ParseErrors.Inc()
+			log.Warn("unusable IVF stream", "err", err)
+		}
+		return
+	}
+	if iv.fourcc != "AV01" {
+		ms.ParseErrors.Inc()
+		log.Warn("IVF stream is not AV1", "fourcc", iv.fourcc)
+		return
+	}
+	f := &obuFramer{ms: ms}
+	var obus []bitstream.OBU
+	for {
+		frame, pts, start, err := iv.next()
+		if errors.Is(err, errIVFFrame) {
+			ms.ParseErrors.Inc()
+			continue
+		}
+		if err != nil {
+			return
+		}
+		// on error, still send the OBUs before the broken one
+		if obus, err = bitstream.SplitOBUs(frame, obus); err != nil {
+			ms.ParseErrors.Inc()
+		}
+		for _, o := range obus {
+			f.push(o)
+		}
+		f.write(out, pts, start)
+	}
+}
+
+// pumpAV1OBUToTrack reads a low-overhead AV1 bitstream (Section 5 of the
+// spec) from r, as FFmpeg's obu muxer writes it. It has no timestamps, so
+// frames are stamped when they arrive; a temporal unit is sent as soon as
+// its shown frame is complete rather than at the next temporal delimiter.
+// That is an OBU_FRAME: a shown frame split into a frame header and tile
+// groups can only be known complete at the next temporal delimiter.
+func pumpAV1OBUToTrack(ctx context.Context, r io.Reader, out sampleWriter, ms *metrics.Stream) {
+	br := bufio.NewReaderSize(r, 1<<20)
+	f := &obuFramer{ms: ms}
+	var buf []byte // reused, the framer copies
+	var start time.Time
+	for {
+		h, err := peekOBUHeader(br)
+		if err != nil || h.Size < 0 || h.Len+h.Size > maxIVFFrame {
+			// without sizes there is no next OBU to resync on
+			if err == nil || !errors.Is(err, io.EOF) {
+				ms.ParseErrors.Inc()
+			}
+			return
+		}
+		if f.empty() {
+			start = time.Now()
+		}
+		buf = slices.Grow(buf[:0], h.Len+h.Size)[:h.Len+h.Size]
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return
+		}
+		o := bitstream.OBU{OBUHeader: h, Raw: buf, Payload: buf[h.Len:]}
+		if o.Type == bitstream.OBUTemporalDelimiter {
+			f.write(out, -1, start)
+			continue
+		}
+		if f.push(o) {
+			f.write(out, -1, start)
+		}
+	}
+}
+
+// peekOBUHeader returns the header of the next OBU in br without consuming
+// it, peeking no further than the header so it never waits on the payload.
+func peekOBUHeader(br *bufio.Reader) (bitstream.OBUHeader, error) {
+	b, err := br.Peek(1)
+	if err != nil {
+		return bitstream.OBUHeader{}, err
+	}
+	n := 1
+	if b[0]&0x04 != 0 { // obu_extension_flag
+		n++
+	}
+	if b[0]&0x02 != 0 { // obu_has_size_field: leb128 bytes up to the last
+		for i := 0; i < 8; i++ {
+			if b, err = br.Peek(n + 1); err != nil {
+				return bitstream.OBUHeader{}, err
+			}
+			n++
+			if b[n-1]&0x80 == 0 {
+				break
+			}
+		}
+	}
+	if b, err = br.Peek(n); err != nil {
+		return bitstream.OBUHeader{}, err
+	}
+	return bitstream.ParseOBUHeader(b)
+}
+
+// obuFramer turns temporal units into samples: temporal delimiters, tile
+// lists and padding are dropped, and the last sequence header is put back
+// in front of key frames that come without one, like the parameter sets
+// for H.264. Every OBU is given a size field so they can be concatenated.
+type obuFramer struct {
+	ms       *metrics.Stream
+	seqOBU   []byte // last sequence header, as an OBU with size field
+	seq      bitstream.SequenceHeader
+	tu       []byte // the pending temporal unit
+	hasSeq   bool   // tu has a sequence header
+	keyframe bool
+	buf      []byte
+}
+
+func (f *obuFramer) empty() bool { return len(f.tu) == 0 }
+
+// push adds o to the pending temporal unit and reports whether it ended
+// it, i.e. o is a shown frame of a single-layer stream that needs no more
+// OBUs: an OBU_FRAME, or a frame header that shows an existing frame. The
+// tile groups of any other shown frame header still have to follow.
+func (f *obuFramer) push(o bitstream.OBU) bool {
+	var shown bool
+	switch o.Type {
+	case bitstream.OBUTemporalDelimiter, bitstream.OBUTileList, bitstream.OBUPadding:
+		return false
+	case bitstream.OBUSequenceHeader:
+		f.setSequenceHeader(o)
+		f.hasSeq = true
+	case bitstream.OBUFrame, bitstream.OBUFrameHeader:
+		key, sh, err := f.seq.FrameType(o.Payload)
+		if err != nil {
+			f.ms.ParseErrors.Inc()
+		}
+		f.keyframe = f.keyframe || key
+		shown = sh && !o.Extended && (o.Type == bitstream.OBUFrame || f.seq.ShowsExistingFrame(o.Payload))
+	}
+	f.tu = bitstream.AppendOBU(f.tu, o)
+	return shown
+}
+
+// write sends the pending temporal unit, if any.
+func (f *obuFramer) write(out sampleWriter, pts int64, start time.Time) {
+	if len(f.tu) == 0 {
+		return
+	}
+	sample := f.tu
+	if f.keyframe && !f.hasSeq && f.seqOBU != nil {
+		f.buf = append(append(f.buf[:0], f.seqOBU...), f.tu...)
+		sample = f.buf
+	}
+	out.write(sample, pts, start)
+	f.tu, f.hasSeq, f.keyframe = f.tu[:0], false, false
+}
+
+func (f *obuFramer) setSequenceHeader(o bitstream.OBU) {
+	seqOBU := bitstream.AppendOBU(f.buf[:0], o)
+	f.buf = seqOBU[:0]
+	if bytes.Equal(f.seqOBU, seqOBU) {
+		return
+	}
+	f.seqOBU = append(f.seqOBU[:0], seqOBU...)
+	seq, err := bitstream.ParseSequenceHeader(o.Payload)
+	if err != nil {
+		f.ms.ParseErrors.Inc()
+		log.Warn("unparsable AV1 sequence header", "err", err)
+		return
+	}
+	if seq.SPS != f.seq.SPS {
+		log.Info("video stream parameters", "width", seq.Width, "height", seq.Height,
+			"profile", seq.Profile, "level", seq.Level, "chroma_format", seq.ChromaFormat, "bit_depth", seq.BitDepthLuma,
+			"color", seq.Color.String())
+	}
+	f.seq = seq
+}
@@ -0,0 +1,159 @@
+package webrtcx
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"pc_cloud/internal/metrics"
+)
+
+// sampleRecorder is a sampleWriter that keeps copies of what it was given.
+type sampleRecorder struct {
+	samples [][]byte
+	pts     []int64
+}
+
+func (r *sampleRecorder) write(payload []byte, pts int64, _ time.Time) {
+	r.samples = append(r.samples, bytes.Clone(payload))
+	r.pts = append(r.pts, pts)
+}
+
+// obu returns an OBU of type typ with a size field.
+func obu(typ byte, payload ...byte) []byte {
+	return append([]byte{typ<<3 | 0x02, byte(len(payload))}, payload...)
+}
+
+func TestAV1OBUFraming(t *testing.T) {
+	seqPayload, _ := hex.DecodeString("0210004720004cff83bf821bc000898000") // main 1080p
+	var (
+		td         = obu(2)
+		seq        = obu(1, seqPayload...)
+		keyHeader  = obu(3, 0x10, 0xaa)
+		tile1      = obu(4, 0x01, 0x02)
+		tile2      = obu(4, 0x03, 0x04)
+		interFrame = obu(6, 0x30, 0xbb)
+		keyFrame   = obu(6, 0x10, 0xcc)
+		hidden     = obu(6, 0x20, 0xdd)
+		existing   = obu(3, 0x80)
+		padding    = obu(15, 0, 0)
+	)
+	join := func(obus ...[]byte) []byte { return bytes.Join(obus, nil) }
+	stream := join(
+		td, seq, keyHeader, tile1, padding, tile2, // tile groups after a shown frame header
+		td, interFrame,
+		td, keyFrame, // without a sequence header of its own
+		td, hidden, existing,
+	)
+	want := [][]byte{
+		join(seq, keyHeader, tile1, tile2),
+		interFrame,
+		join(seq, keyFrame),
+		join(hidden, existing),
+	}
+
+	ms := metrics.NewStream("test", "av1")
+	defer ms.Close()
+	rec := &sampleRecorder{}
+	pumpAV1OBUToTrack(context.Background(), bytes.NewReader(stream), rec, ms)
+	if len(rec.samples) != len(want) {
+		t.Fatalf("got %d samples, want %d: %x", len(rec.samples), len(want), rec.samples)
+	}
+	for i := range want {
+		if !bytes.Equal(rec.samples[i], want[i]) {
+			t.Errorf("sample %d = %x, want %x", i, rec.samples[i], want[i])
+		}
+	}
+}
+
+// ivfHeader returns an IVF file header of n bytes with time base 1/60.
+func ivfHeader(n int) []byte {
+	h := make([]byte, n)
+	copy(h, "DKIF")
+	binary.LittleEndian.PutUint16(h[6:], uint16(n))
+	copy(h[8:], "AV01")
+	binary.LittleEndian.PutUint32(h[16:], 60)
+	binary.LittleEndian.PutUint32(h[20:], 1)
+	return h
+}
+
+func appendIVFFrame(dst []byte, size uint32, pts uint64, data []byte) []byte {
+	dst = binary.LittleEndian.AppendUint32(dst, size)
+	dst = binary.LittleEndian.AppendUint64(dst, pts)
+	return append(dst, data...)
+}
+
+func TestNewIVFReaderErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(h []byte)
+		want   string
+	}{
+		{"bad signature", func(h []byte) { copy(h, "RIFF") }, "bad signature"},
+		{"bad version", func(h []byte) { h[4] = 1 }, "unsupported version 1"},
+		{"header too short", func(h []byte) { h[6] = 16 }, "header length 16"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := ivfHeader(32)
+			tt.modify(h)
+			_, err := newIVFReader(bytes.NewReader(h))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+	if _, err := newIVFReader(bytes.NewReader(ivfHeader(32)[:20])); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated header: err = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestIVFReaderFrames(t *testing.T) {
+	// a longer header than the usual 32 bytes is skipped
+	var body []byte
+	body = appendIVFFrame(body, 3, 1, []byte{1, 2, 3})
+	body = appendIVFFrame(body, 0, 2, nil) // empty
+	body = appendIVFFrame(body, maxIVFFrame+1, 3, nil)
+	tail := appendIVFFrame(nil, 2, 4, []byte{4, 5})
+	r := io.MultiReader(bytes.NewReader(ivfHeader(40)), bytes.NewReader(body),
+		io.LimitReader(zeroReader{}, maxIVFFrame+1), bytes.NewReader(tail))
+
+	iv, err := newIVFReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iv.fourcc != "AV01" {
+		t.Errorf("fourcc = %q", iv.fourcc)
+	}
+	type frame struct {
+		data string
+		pts  int64
+		err  error
+	}
+	want := []frame{
+		{"\x01\x02\x03", 1500, nil},
+		{"", 0, errIVFFrame},
+		{"", 0, errIVFFrame},
+		{"\x04\x05", 6000, nil},
+		{"", 0, io.EOF},
+	}
+	for i, w := range want {
+		data, pts, _, err := iv.next()
+		if !errors.Is(err, w.err) || string(data) != w.data || err == nil && pts != w.pts {
+			t.Errorf("frame %d: got %x, pts %d, err %v, want %x, pts %d, err %v", i, data, pts, err, w.data, w.pts, w.err)
+		}
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
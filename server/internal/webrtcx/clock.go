@@ -0,0 +1,151 @@
+package webrtcx
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	senderReportInterval = time.Second
+	// a unit whose mapped capture time is this far from its arrival means the
+	// source timeline jumped (encoder restart) and the track is re-anchored
+	reanchorAfter = time.Second
+	lagSmoothing  = 0.05
+)
+
+// mediaClock is the session-wide timeline both tracks are stamped from:
+// RTP time = per-track random offset + (capture time - epoch) * clock rate.
+// The sender reports are derived from the same formula, so the browser can
+// put audio and video on one wall clock and lip-sync them.
+type mediaClock struct {
+	epoch time.Time
+}
+
+func newMediaClock() *mediaClock { return &mediaClock{epoch: time.Now()} }
+
+// trackClock stamps one track. Source timestamps (encoder PTS, or the
+// Opus sample count for audio) are anchored to the arrival time of
+// the first unit, so steady-state gaps in the source survive into RTP.
+type trackClock struct {
+	media  *mediaClock
+	rate   uint32
+	offset uint32
+	ssrc   uint32
+
+	// written by the track's writer only
+	anchored    bool
+	anchorWall  time.Time
+	anchorSrc   int64
+	lastSrc     int64
+	lastCapture time.Time
+
+	packets atomic.Uint32
+	octets  atomic.Uint32
+
+	mu  sync.Mutex
+	lag time.Duration // smoothed arrival - capture
+}
+
+func (c *mediaClock) track(rate uint32) *trackClock {
+	return &trackClock{media: c, rate: rate, offset: rand.Uint32()}
+}
+
+// stamp returns the RTP timestamp for a unit with source timestamp src,
+// counted at srcRate per second (src < 0 when unknown), that arrived at
+// arrival.
+func (t *trackClock) stamp(src, srcRate int64, arrival time.Time) uint32 {
+	capture := arrival
+	if src >= 0 && srcRate > 0 {
+		if t.anchored && src > t.lastSrc {
+			capture = t.anchorWall.Add(time.Duration((src - t.anchorSrc) * int64(time.Second) / srcRate))
+		}
+		if !t.anchored || src <= t.lastSrc || absDur(arrival.Sub(capture)) > reanchorAfter {
+			t.anchored, t.anchorWall, t.anchorSrc, capture = true, arrival, src, arrival
+		}
+		t.lastSrc = src
+	}
+	if !capture.After(t.lastCapture) {
+		capture = t.lastCapture.Add(time.Second / time.Duration(t.rate))
+	}
+	t.lastCapture = capture
+
+	t.mu.Lock()
+	t.lag += time.Duration(lagSmoothing * float64(arrival.Sub(capture)-t.lag))
+	t.mu.Unlock()
+	return t.rtpAt(capture)
+}
+
+func (t *trackClock) rtpAt(at time.Time) uint32 {
+	return t.offset + uint32(at.Sub(t.media.epoch).Seconds()*float64(t.rate))
+}
+
+// sent counts an RTP packet for the sender reports.
+func (t *trackClock) sent(payloadBytes int) {
+	t.packets.Add(1)
+	t.octets.Add(uint32(payloadBytes))
+}
+
+func (t *trackClock) smoothedLag() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lag
+}
+
+func (t *trackClock) senderReport(now time.Time) *rtcp.SenderReport {
+	return &rtcp.SenderReport{
+		SSRC:        t.ssrc,
+		NTPTime:     ntpTime(now),
+		RTPTime:     t.rtpAt(now),
+		PacketCount: t.packets.Load(),
+		OctetCount:  t.octets.Load(),
+	}
+}
+
+// sendReports writes an RTCP sender report for every track each
+// senderReportInterval until ctx ends. pion's own sender report interceptor
+// is not registered: it maps RTP time to the time packets were sent, which
+// differs between audio and video by their pipeline latency.
+func sendReports(ctx context.Context, pc *webrtc.PeerConnection, tracks ...*trackClock) {
+	t := time.NewTicker(senderReportInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			var pkts []rtcp.Packet
+			for _, tc := range tracks {
+				if tc != nil && tc.ssrc != 0 && tc.packets.Load() > 0 {
+					pkts = append(pkts, tc.senderReport(now))
+				}
+			}
+			if len(pkts) == 0 {
+				continue
+			}
+			if err := pc.WriteRTCP(pkts); err != nil {
+				log.Debug("sender report failed", "err", err)
+			}
+		}
+	}
+}
+
+// ntpTime is the 64-bit NTP timestamp of t.
+func ntpTime(t time.Time) uint64 {
+	const ntpEpochOffset = 2208988800 // 1900 -> 1970
+	secs := uint64(t.Unix()) + ntpEpochOffset
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return secs<<32 | frac
+}
+
+func absDur(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,48 @@
+package webrtcx
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// controlMsg is a host-to-client message on the "control" DataChannel.
+type controlMsg struct {
+	Type    string       `json:"type"`              // "encoder"|"stream"|"configured"
+	Track   string       `json:"track,omitempty"`   // video|audio
+	State   string       `json:"state,omitempty"`   // restarting|restarted|failed
+	Attempt int          `json:"attempt,omitempty"` // restart attempt, 1-based
+	ID      int          `json:"id,omitempty"`      // of the "configure" request answered
+	Stream  *StreamState `json:"stream,omitempty"`  // the video sent after a reconfiguration
+	Error   string       `json:"error,omitempty"`
+}
+
+// controlChannel holds the client's "control" DataChannel once it opens.
+// Messages sent before that are dropped.
+type controlChannel struct {
+	mu sync.Mutex
+	dc *webrtc.DataChannel
+}
+
+func (c *controlChannel) set(d *webrtc.DataChannel) {
+	c.mu.Lock()
+	c.dc = d
+	c.mu.Unlock()
+}
+
+func (c *controlChannel) send(m controlMsg) {
+	c.mu.Lock()
+	dc := c.dc
+	c.mu.Unlock()
+	if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	if err := dc.SendText(string(b)); err != nil {
+		log.Debug("control send failed", "type", m.Type, "err", err)
+	}
+}
@@ -0,0 +1,83 @@
+package webrtcx
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+// maxIVFFrame bounds the frame size taken from a frame header, so a corrupt
+// one can't make the pump allocate gigabytes.
+const maxIVFFrame = 50 << 20
+
+// errIVFFrame is returned when a frame was skipped (empty or over
+// maxIVFFrame); the reader stays aligned, so callers may keep reading.
+var errIVFFrame = errors.New("ivf: frame skipped")
+
+// ivfReader reads the frames of an IVF stream, as written by FFmpeg's ivf
+// muxer.
+type ivfReader struct {
+	r        *bufio.Reader
+	fourcc   string
+	den, num int64 // time base num/den seconds, from the file header
+	hdr      [12]byte
+	frame    []byte
+}
+
+// newIVFReader reads and checks the file header.
+func newIVFReader(r io.Reader) (*ivfReader, error) {
+	br := bufio.NewReaderSize(r, 1<<20)
+	var h [32]byte
+	if _, err := io.ReadFull(br, h[:]); err != nil {
+		return nil, err
+	}
+	if string(h[:4]) != "DKIF" {
+		return nil, fmt.Errorf("ivf: bad signature %q", h[:4])
+	}
+	if v := binary.LittleEndian.Uint16(h[4:6]); v != 0 {
+		return nil, fmt.Errorf("ivf: unsupported version %d", v)
+	}
+	n := int(binary.LittleEndian.Uint16(h[6:8]))
+	if n < len(h) {
+		return nil, fmt.Errorf("ivf: header length %d", n)
+	}
+	if _, err := br.Discard(n - len(h)); err != nil {
+		return nil, err
+	}
+	return &ivfReader{
+		r:      br,
+		fourcc: string(h[8:12]),
+		den:    int64(binary.LittleEndian.Uint32(h[16:20])),
+		num:    int64(binary.LittleEndian.Uint32(h[20:24])),
+	}, nil
+}
+
+// next returns the next frame, its PTS in 90 kHz ticks (-1 if the file
+// header has no usable time base) and when its header was read. The frame
+// is only valid until the following call.
+func (v *ivfReader) next() ([]byte, int64, time.Time, error) {
+	if _, err := io.ReadFull(v.r, v.hdr[:]); err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	start := time.Now()
+	sz := binary.LittleEndian.Uint32(v.hdr[:4])
+	if sz == 0 || sz > maxIVFFrame {
+		if _, err := v.r.Discard(int(sz)); err != nil {
+			return nil, 0, time.Time{}, err
+		}
+		return nil, 0, time.Time{}, errIVFFrame
+	}
+	v.frame = slices.Grow(v.frame[:0], int(sz))[:sz]
+	if _, err := io.ReadFull(v.r, v.frame); err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	pts := int64(-1)
+	if v.den > 0 && v.num > 0 {
+		pts = int64(binary.LittleEndian.Uint64(v.hdr[4:12])) * v.num * videoClockRate / v.den
+	}
+	return v.frame, pts, start, nil
+}
@@ -0,0 +1,93 @@
+package webrtcx
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"pc_cloud/internal/metrics"
+)
+
+const (
+	latencySmoothing = 0.1
+	// echoes of frames older than this are left over from before an
+	// encoder restart re-anchored the clock
+	maxProbeAge = 5 * time.Second
+)
+
+// LatencyStats is the latency measured from the client's echoes.
+type LatencyStats struct {
+	// EncoderToScreenMs is how long frames take from leaving the encoder
+	// to the client's screen, smoothed over the last few echoes. Capture,
+	// colour conversion and encoding come before and are not included.
+	EncoderToScreenMs float64 `json:"encoder_to_screen_ms"`
+	// DecodeMs is the client's own figure for decoding a frame, from
+	// requestVideoFrameCallback.
+	DecodeMs float64 `json:"decode_ms"`
+	Samples  uint64  `json:"samples"`
+}
+
+// latencyEcho is what the client sends on its "latency" DataChannel for
+// some of the frames it presents.
+type latencyEcho struct {
+	RTP         uint32  `json:"rtp"`           // RTP timestamp of the frame
+	DecodeMs    float64 `json:"decode_ms"`     // time the decoder spent on it
+	DisplayInMs float64 `json:"display_in_ms"` // until it is expected on screen, from when the echo was sent
+}
+
+// latencyProbe turns echoes into LatencyStats. The marker the client
+// echoes is the frame's RTP timestamp: the media clock derives those from
+// the capture time of each frame, so the age of the marker when its echo
+// arrives, less the trip back, is how long ago the frame was captured.
+// Capture times are anchored to when the first frame left the encoder, so
+// the age is really that of the frame's output: the figure runs from the
+// encoder to the screen. FFmpeg's timestamps give no wallclock to go
+// further back by.
+type latencyProbe struct {
+	clock *trackClock
+	rtt   func() time.Duration // of the peer connection; halved for the trip back
+	ms    *metrics.Stream
+
+	mu    sync.Mutex
+	stats LatencyStats
+}
+
+// echo handles one message from the "latency" DataChannel, received at now.
+func (p *latencyProbe) echo(data []byte, now time.Time) {
+	var e latencyEcho
+	if err := json.Unmarshal(data, &e); err != nil {
+		return
+	}
+	ticks := int32(p.clock.rtpAt(now) - e.RTP)
+	age := time.Duration(int64(ticks) * int64(time.Second) / int64(p.clock.rate))
+	if ticks < 0 || age > maxProbeAge {
+		return
+	}
+	toScreen := age - p.rtt()/2 + time.Duration(e.DisplayInMs*float64(time.Millisecond))
+	if toScreen < 0 {
+		toScreen = 0
+	}
+	p.ms.EncoderToScreenLatency.Observe(toScreen.Seconds())
+
+	ms := float64(toScreen) / float64(time.Millisecond)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stats.Samples == 0 {
+		p.stats.EncoderToScreenMs, p.stats.DecodeMs = ms, e.DecodeMs
+	} else {
+		p.stats.EncoderToScreenMs += latencySmoothing * (ms - p.stats.EncoderToScreenMs)
+		p.stats.DecodeMs += latencySmoothing * (e.DecodeMs - p.stats.DecodeMs)
+	}
+	p.stats.Samples++
+}
+
+// snapshot returns the stats so far, or nil before the first echo.
+func (p *latencyProbe) snapshot() *LatencyStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stats.Samples == 0 {
+		return nil
+	}
+	s := p.stats
+	return &s
+}
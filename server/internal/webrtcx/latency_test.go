@@ -0,0 +1,82 @@
+package webrtcx
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"pc_cloud/internal/metrics"
+)
+
+func TestLatencyProbeEcho(t *testing.T) {
+	epoch := time.Now()
+	at := func(d time.Duration) time.Time { return epoch.Add(d) }
+	echo := func(rtp uint32, displayInMs float64) []byte {
+		return fmt.Appendf(nil, `{"rtp":%d,"decode_ms":2,"display_in_ms":%g}`, rtp, displayInMs)
+	}
+	tests := []struct {
+		name   string
+		offset uint32
+		sent   time.Duration // capture time of the echoed frame
+		now    time.Duration
+		rtt    time.Duration
+		msg    func(c *trackClock, sent time.Duration) []byte
+		want   float64 // ms; < 0 when the echo is to be dropped
+	}{
+		{"half the rtt off, display on", 1000, time.Second, 1100 * time.Millisecond, 40 * time.Millisecond,
+			func(c *trackClock, sent time.Duration) []byte { return echo(c.rtpAt(at(sent)), 16) }, 96},
+		// the clock wraps between the frame and its echo
+		{"rtp wrap-around", math.MaxUint32 - 37_000, 400 * time.Millisecond, time.Second, 0,
+			func(c *trackClock, sent time.Duration) []byte { return echo(c.rtpAt(at(sent)), 0) }, 600},
+		{"trip back longer than the age", 1000, time.Second, 1010 * time.Millisecond, 100 * time.Millisecond,
+			func(c *trackClock, sent time.Duration) []byte { return echo(c.rtpAt(at(sent)), 0) }, 0},
+		// a marker ahead of the clock comes from before a re-anchor
+		{"negative age", 1000, 1050 * time.Millisecond, time.Second, 0,
+			func(c *trackClock, sent time.Duration) []byte { return echo(c.rtpAt(at(sent)), 0) }, -1},
+		{"stale", 1000, time.Second, time.Second + maxProbeAge + time.Millisecond, 0,
+			func(c *trackClock, sent time.Duration) []byte { return echo(c.rtpAt(at(sent)), 0) }, -1},
+		{"not json", 1000, time.Second, 1100 * time.Millisecond, 0,
+			func(*trackClock, time.Duration) []byte { return []byte("rtp=1") }, -1},
+	}
+	ms := metrics.NewStream("test", "h264")
+	defer ms.Close()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &trackClock{media: &mediaClock{epoch: epoch}, rate: 90000, offset: tt.offset}
+			p := &latencyProbe{clock: clock, ms: ms, rtt: func() time.Duration { return tt.rtt }}
+			p.echo(tt.msg(clock, tt.sent), at(tt.now))
+			got := p.snapshot()
+			if tt.want < 0 {
+				if got != nil {
+					t.Errorf("got %+v, want the echo dropped", *got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatal("echo dropped")
+			}
+			// the clock truncates to whole ticks
+			if math.Abs(got.EncoderToScreenMs-tt.want) > 0.1 || got.DecodeMs != 2 || got.Samples != 1 {
+				t.Errorf("got %+v, want %v ms", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLatencyProbeSmoothing(t *testing.T) {
+	epoch := time.Now()
+	clock := &trackClock{media: &mediaClock{epoch: epoch}, rate: 90000}
+	ms := metrics.NewStream("test", "h264")
+	defer ms.Close()
+	p := &latencyProbe{clock: clock, ms: ms, rtt: func() time.Duration { return 0 }}
+
+	now := epoch.Add(10 * time.Second)
+	marker := clock.rtpAt(now)
+	p.echo(fmt.Appendf(nil, `{"rtp":%d,"decode_ms":4,"display_in_ms":100}`, marker), now)
+	p.echo(fmt.Appendf(nil, `{"rtp":%d,"decode_ms":8,"display_in_ms":200}`, marker), now)
+	got := p.snapshot()
+	if got == nil || math.Abs(got.EncoderToScreenMs-110) > 1e-9 || math.Abs(got.DecodeMs-4.4) > 1e-9 || got.Samples != 2 {
+		t.Errorf("got %+v, want 110 ms, 4.4 ms decode over 2 samples", got)
+	}
+}
@@ -0,0 +1,112 @@
+package webrtcx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Reasons a session ends, as reported in logs and webhook events.
+const (
+	reasonClientEnded      = "client_ended" // POST /api/session/end
+	reasonReplaced         = "replaced"     // a new offer took over
+	reasonShutdown         = "shutdown"
+	reasonConnectionFailed = "connection_failed"
+	reasonDisconnected     = "disconnected" // not reconnected within the grace period
+	reasonIdle             = "idle"
+	reasonMaxDuration      = "max_duration"
+	reasonEncoderFailed    = "encoder_failed"
+)
+
+const watchInterval = 5 * time.Second
+
+// lifecycleEvent is logged and POSTed as JSON to the configured webhook.
+type lifecycleEvent struct {
+	Event     string    `json:"event"` // session.started|session.ended
+	SessionID string    `json:"session_id"`
+	Codec     string    `json:"codec"`
+	Profile   string    `json:"profile,omitempty"`
+	ClientID  string    `json:"client_id,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	DurationS float64   `json:"duration_s,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+var webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+func (m *Manager) emit(ev lifecycleEvent) {
+	log.Info(ev.Event, "session", ev.SessionID, "codec", ev.Codec, "profile", ev.Profile,
+		"client", ev.ClientID, "reason", ev.Reason, "duration_s", ev.DurationS)
+	if url := m.cfg.Get().WebhookURL; url != "" {
+		go postWebhook(url, ev)
+	}
+}
+
+func postWebhook(url string, ev lifecycleEvent) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Warn("webhook failed", "event", ev.Event, "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Warn("webhook rejected", "event", ev.Event, "status", resp.Status)
+	}
+}
+
+// touch records activity from the client: an input message or RTCP.
+func (s *Session) touch() { s.lastActivity.Store(time.Now().UnixNano()) }
+
+// watch ends sess when its PeerConnection stays failed or disconnected
+// past the grace period (long enough for the client to resume with an ICE
+// restart), goes idle, or runs past the maximum duration.
+func (m *Manager) watch(ctx context.Context, sess *Session) {
+	var grace *time.Timer
+	sess.pc.OnConnectionStateChange(func(st webrtc.PeerConnectionState) {
+		log.Debug("connection state", "session", sess.id, "state", st)
+		sess.mu.Lock()
+		defer sess.mu.Unlock()
+		if grace != nil {
+			grace.Stop()
+			grace = nil
+		}
+		reason := reasonDisconnected
+		switch st {
+		case webrtc.PeerConnectionStateFailed:
+			reason = reasonConnectionFailed
+			fallthrough
+		case webrtc.PeerConnectionStateDisconnected:
+			d := time.Duration(m.cfg.Get().DisconnectGraceS) * time.Second
+			grace = time.AfterFunc(d, func() { m.endSession(sess, reason) })
+		}
+	})
+
+	sess.touch()
+	t := time.NewTicker(watchInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			cfg := m.cfg.Get()
+			idle := now.Sub(time.Unix(0, sess.lastActivity.Load()))
+			switch {
+			case cfg.IdleTimeoutS > 0 && idle > time.Duration(cfg.IdleTimeoutS)*time.Second:
+				m.endSession(sess, reasonIdle)
+				return
+			case cfg.MaxSessionMinutes > 0 && now.Sub(sess.stats.started) > time.Duration(cfg.MaxSessionMinutes)*time.Minute:
+				m.endSession(sess, reasonMaxDuration)
+				return
+			}
+		}
+	}
+}
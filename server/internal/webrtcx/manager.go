@@ -4,72 +4,159 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"encoding/binary"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"net"
+	"maps"
 	"net/http"
-	"os"
 	"os/exec"
+	"pc_cloud/internal/bitstream"
+	"pc_cloud/internal/config"
+	"pc_cloud/internal/devices"
 	"pc_cloud/internal/encoder"
 	"pc_cloud/internal/input"
+	"pc_cloud/internal/logging"
+	"pc_cloud/internal/metrics"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pion/interceptor"
-	"github.com/pion/rtp"
+	"github.com/pion/interceptor/pkg/report"
+	"github.com/pion/interceptor/pkg/stats"
 	"github.com/pion/webrtc/v4"
-	wmedia "github.com/pion/webrtc/v4/pkg/media"
+)
+
+var (
+	log        = logging.For("webrtc")
+	encoderLog = logging.For("encoder")
 )
 
 type OfferRequest struct {
-	SDP     string `json:"sdp"`
-	Type    string `json:"type"`
-	Codec   string `json:"codec"`   // h264|hevc|av1
-	Audio   bool   `json:"audio"`   // enable audio
-	FPS     int    `json:"fps"`     // e.g. 60
-	Width   int    `json:"width"`   // 0 = native
-	Height  int    `json:"height"`  // 0 = native
-	Preset  string `json:"preset"`  // NVENC p1..p7 (lower=slower/better)
-	Bitrate string `json:"bitrate"` // e.g. "25M"
-	Capture string `json:"capture"` // "ddagrab"|"gdigrab"
+	SDP      string `json:"sdp"`
+	Type     string `json:"type"`
+	Codec    string `json:"codec"`               // h264|hevc|av1|vp9|vp8
+	BitDepth int    `json:"bit_depth,omitempty"` // 10 for HEVC Main10, AV1 or VP9 profile 2; 0 = 8
+	HDR      bool   `json:"hdr,omitempty"`       // the client can decode and show HDR (BT.2020 PQ/HLG)
+	Chroma   string `json:"chroma,omitempty"`    // 420|444: 4:4:4 for sharp text, if the codec and client have it
+	Audio    bool   `json:"audio"`               // enable audio
+	FPS      int    `json:"fps"`                 // e.g. 60
+	Width    int    `json:"width"`               // 0 = native
+	Height   int    `json:"height"`              // 0 = native
+	Preset   string `json:"preset"`              // NVENC p1..p7 (lower=slower/better)
+	Bitrate  string `json:"bitrate"`             // e.g. "25M"
+	Latency  string `json:"latency,omitempty"`   // ultra-low|balanced|quality; "" = from the profile
+	// IntraRefresh asks for gradual intra refresh instead of periodic
+	// keyframes, without their bandwidth spikes; absent = from the profile,
+	// or on for ultra-low latency. false opts out.
+	IntraRefresh *bool  `json:"intra_refresh,omitempty"`
+	Capture      string `json:"capture"`           // "ddagrab"|"gdigrab"
+	Profile      string `json:"profile,omitempty"` // server-side profile name, e.g. "wifi-1080p"
+	// ClientID is the paired client's id, which selects its default
+	// profile. The client asserts it itself: it is not authentication and
+	// must not gate anything but stream defaults.
+	ClientID string `json:"client_id,omitempty"`
+
+	AudioChannels int    `json:"audio_channels,omitempty"` // 1, 2 or 6 (5.1, needs multiopus); 0 = 2
+	AudioBitrate  string `json:"audio_bitrate,omitempty"`  // Opus bitrate, e.g. "128k"
+	AudioFEC      bool   `json:"audio_fec,omitempty"`      // Opus in-band FEC
+	AudioDTX      bool   `json:"audio_dtx,omitempty"`      // Opus DTX: send almost nothing during silence
+	AudioApp      string `json:"audio_app,omitempty"`      // capture only this process name or PID, see /api/devices/audio/apps
+
+	Mic     bool    `json:"mic,omitempty"`      // the offer carries a sendrecv audio track with the client's microphone
+	MicGain float64 `json:"mic_gain,omitempty"` // 1 = unity (default), up to 4
 }
 
 type Answer struct {
-	SDP  string `json:"sdp"`
-	Type string `json:"type"`
+	SDP       string `json:"sdp"`
+	Type      string `json:"type"`
+	SessionID string `json:"session_id"`
+	Codec     string `json:"codec,omitempty"`     // the video codec negotiated from the offer
+	BitDepth  int    `json:"bit_depth,omitempty"` // of the video, 8 or 10
+	HDR       string `json:"hdr,omitempty"`       // transfer of HDR video, "pq" or "hlg"; "" = SDR
+	Chroma    string `json:"chroma,omitempty"`    // of the video, 420 or 444
+	Latency   string `json:"latency,omitempty"`   // the latency mode the encoder runs in
+	// IntraRefresh is set when the encoder refreshes gradually: there are
+	// no keyframes after the first, and PLIs restart the encoder
+	IntraRefresh bool `json:"intra_refresh,omitempty"`
 }
 
 type Session struct {
+	id           string
+	profile      string
+	clientID     string
+	closeOnce    sync.Once
+	onEnd        func(reason string)
+	mu           sync.Mutex   // guards the disconnect grace timer
+	negotiate    sync.Mutex   // serializes resume renegotiations
+	lastActivity atomic.Int64 // unix nanos of the last input message or RTCP packet
+	metrics      *metrics.Stream
 	pc           *webrtc.PeerConnection
+	ctx          context.Context // ends with the session
 	cancel       context.CancelFunc
-	codec        string
-	audioConn    *net.UDPConn
-	audioPT      uint8
-	ffmpeg       *exec.Cmd
+	videoOut     *videoOutput
+	videoMu      sync.Mutex
+	video        *videoEncoder      // guarded by videoMu, replaced by reconfigure
+	audio        *encoderSupervisor // nil without audio
+	reconfig     sync.Mutex         // serializes reconfigurations
+	want         OfferRequest       // the stream asked for, before negotiation; guarded by reconfig
+	offered      []offeredCodec     // video codecs in the client's offer
+	caps         encoder.Capabilities
 	inputHandler *input.Handler
+	stats        statsState
+	control      controlChannel
+	latency      latencyProbe
+	clock        *mediaClock
+	videoClock   *trackClock
+	audioClock   *trackClock         // nil without audio
+	mic          *micPassthrough     // nil without microphone passthrough
+	appCapture   *devices.AppCapture // nil unless audio is captured from one application
 }
 
 type Manager struct {
+	cfg    *config.Store
 	mu     sync.Mutex
 	active *Session
 }
 
-func New() *Manager { return &Manager{} }
+func New(cfg *config.Store) *Manager { return &Manager{cfg: cfg} }
 
-func (m *Manager) CloseActive() {
+// Busy reports whether a streaming session is currently running.
+func (m *Manager) Busy() bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if m.active != nil {
-		if err := m.active.Close(); err != nil {
-			log.Printf("error closing active session: %v", err)
-		}
+	return m.active != nil
+}
+
+// CloseActive ends the running session, if any, e.g. on shutdown.
+func (m *Manager) CloseActive() { m.closeActive(reasonShutdown) }
+
+// closeActive forgets the running session and ends it. Ending waits for
+// the encoders to exit, so it happens outside m.mu.
+func (m *Manager) closeActive(reason string) {
+	m.mu.Lock()
+	sess := m.active
+	m.active = nil
+	m.mu.Unlock()
+	if sess != nil {
+		sess.end(reason)
+	}
+}
+
+// endSession ends sess and forgets it if it is still the active one.
+func (m *Manager) endSession(sess *Session, reason string) {
+	m.mu.Lock()
+	if m.active == sess {
 		m.active = nil
 	}
+	m.mu.Unlock()
+	sess.end(reason)
 }
 
 func (m *Manager) End(w http.ResponseWriter, r *http.Request) {
@@ -82,7 +169,7 @@ func (m *Manager) End(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	if sess != nil {
-		go sess.Close() // async if long-running
+		go sess.end(reasonClientEnded) // async if long-running
 		w.Write([]byte(`{"status":"ended"}`))
 		return
 	}
@@ -94,24 +181,68 @@ func writeJSONError(w http.ResponseWriter, code int, msg string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
 	if _, err := w.Write([]byte(`{"error":` + strconv.Quote(msg) + `}`)); err != nil {
-		log.Printf("error writing JSON error: %v", err)
+		log.Error("writing JSON error", "err", err)
 	}
 }
 
-func (s *Session) Close() error {
-	if s.audioConn != nil {
-		_ = s.audioConn.Close()
+// requestKeyframe answers a PLI or FIR from the client. With periodic
+// keyframes the next one comes soon enough; with intra refresh there is
+// none, so the encoder has to start over.
+func (s *Session) requestKeyframe() {
+	if v := s.currentVideo(); v != nil && v.intraRefresh {
+		v.sup.keyframe()
 	}
+}
+
+func (s *Session) Close() error {
+	s.end(reasonShutdown)
+	return nil
+}
+
+// end tears the session down and reports why; only the first call counts.
+func (s *Session) end(reason string) {
+	s.closeOnce.Do(func() {
+		s.close()
+		if s.onEnd != nil {
+			s.onEnd(reason)
+		}
+	})
+}
+
+func (s *Session) close() {
 	if s.pc != nil {
 		_ = s.pc.Close()
 	}
-	if s.ffmpeg != nil && s.ffmpeg.Process != nil {
-		_ = s.ffmpeg.Process.Kill()
-	}
 	if s.cancel != nil {
 		s.cancel()
 	}
-	return nil
+	var video *encoderSupervisor
+	if v := s.currentVideo(); v != nil {
+		video = v.sup
+	}
+	for _, e := range []*encoderSupervisor{video, s.audio} {
+		if e != nil {
+			e.wait()
+		}
+	}
+	if s.mic != nil {
+		s.mic.close()
+	}
+	if s.appCapture != nil {
+		if err := s.appCapture.Close(); err != nil {
+			log.Warn("removing application capture sink failed", "err", err)
+		}
+	}
+	if s.metrics != nil {
+		s.metrics.Close()
+		metrics.ActiveSessions.Dec()
+	}
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
 func (m *Manager) HandleOffer(w http.ResponseWriter, r *http.Request) {
@@ -120,89 +251,188 @@ func (m *Manager) HandleOffer(w http.ResponseWriter, r *http.Request) {
 		writeJSONError(w, http.StatusBadRequest, "bad json: "+err.Error())
 		return
 	}
-	req.Codec = strings.ToLower(strings.TrimSpace(req.Codec))
-	if req.Codec == "" {
-		req.Codec = "h264"
+	cfg := m.cfg.Get()
+	profile, err := resolveStream(cfg, &req)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
 	}
-	if req.FPS <= 0 {
-		req.FPS = 60
+	if !cfg.Audio {
+		req.Audio = false
 	}
-	req.Preset = strings.ToLower(strings.TrimSpace(req.Preset))
-	if req.Preset == "" {
-		req.Preset = "p4"
+	req.AudioChannels = audioChannels(req)
+
+	offered, err := offeredVideo(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: req.SDP})
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad sdp: "+err.Error())
+		return
+	}
+	want := req
+	want.SDP = ""
+	caps := encoder.ProbeCapabilities(cfg.FFmpegPath)
+	var full []string // codecs to try in 4:4:4 first
+	if req.Chroma == "444" {
+		for _, c := range caps.Codecs {
+			if encoder.Chroma444(caps, c) {
+				full = append(full, c)
+			}
+		}
+	}
+	choice, err := negotiateCodec(offered, codecOrder(req.Codec, cfg.CodecPreference), caps.Codecs, req.BitDepth, full)
+	if err != nil {
+		log.Warn("codec negotiation failed", "err", err)
+		writeJSONError(w, http.StatusNotAcceptable, err.Error())
+		return
 	}
-	if req.Bitrate == "" {
-		req.Bitrate = "20M"
+	if choice.codec != req.Codec || choice.bitDepth != req.BitDepth || choice.chroma != req.Chroma {
+		log.Info("codec negotiated", "requested", req.Codec, "requested_bit_depth", req.BitDepth, "requested_chroma", req.Chroma,
+			"codec", choice.codec, "bit_depth", choice.bitDepth, "chroma", choice.chroma)
 	}
+	req.Codec, req.BitDepth, req.Chroma = choice.codec, choice.bitDepth, choice.chroma
+	// reconfigure starts from what was asked for, but in the codec running
+	want.Codec = choice.codec
+	hdr := hdrTransfer(cfg, req)
 
-	log.Printf("OFFER codec=%s fps=%d %dx%d preset=%s br=%s audio=%v",
-		req.Codec, req.FPS, req.Width, req.Height, req.Preset, req.Bitrate, req.Audio)
+	log.Info("offer", "profile", profile, "codec", req.Codec, "codec_profile", choice.profile, "bit_depth", req.BitDepth, "hdr", hdr, "chroma", req.Chroma, "fps", req.FPS,
+		"width", req.Width, "height", req.Height, "preset", req.Preset, "bitrate", req.Bitrate, "latency", req.Latency,
+		"intra_refresh", encoder.UsesIntraRefresh(caps, encoder.Params{Codec: req.Codec, Latency: req.Latency, IntraRefresh: req.IntraRefresh}), "audio", req.Audio,
+		"audio_channels", req.AudioChannels, "audio_app", req.AudioApp)
 
-	api, err := buildAPIForCodec(req.Codec)
+	var getter stats.Getter
+	tracks := negotiableTracks(choice, offered, caps.Codecs, want.BitDepth, full)
+	api, err := buildAPIForCodecs(tracks, req.AudioChannels, func(_ string, g stats.Getter) { getter = g })
 	if err != nil {
-		log.Printf("api build failed: %v", err)
+		log.Error("api build failed", "err", err)
 		writeJSONError(w, http.StatusInternalServerError, "api: "+err.Error())
 		return
 	}
 	pc, err := api.NewPeerConnection(webrtc.Configuration{})
 	if err != nil {
-		log.Printf("pc create failed: %v", err)
+		log.Error("pc create failed", "err", err)
 		writeJSONError(w, http.StatusInternalServerError, "pc: "+err.Error())
 		return
 	}
 
-	m.CloseActive()
-
 	ctx, cancel := context.WithCancel(context.Background())
-	sess := &Session{
+	var (
+		appCapture *devices.AppCapture
+		sess       *Session
+		started    bool
+	)
+	// until the session is active, every failure undoes what was set up
+	defer func() {
+		if started {
+			return
+		}
+		cancel()
+		_ = pc.Close()
+		if sess != nil {
+			if sess.mic != nil {
+				sess.mic.close()
+			}
+			sess.metrics.Close()
+		}
+		if appCapture != nil {
+			if err := appCapture.Close(); err != nil {
+				log.Warn("removing application capture sink failed", "err", err)
+			}
+		}
+	}()
+
+	m.closeActive(reasonReplaced)
+
+	if req.Audio && req.AudioApp != "" {
+		appCapture, err = devices.NewAppCapture(r.Context(), req.AudioApp)
+		if err != nil {
+			writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+	}
+
+	id := newSessionID()
+	sess = &Session{
+		id:           id,
+		metrics:      metrics.NewStream(id, req.Codec),
 		pc:           pc,
+		ctx:          ctx,
 		cancel:       cancel,
-		codec:        req.Codec,
+		want:         want,
+		offered:      offered,
+		caps:         caps,
+		profile:      profile,
+		clientID:     req.ClientID,
 		inputHandler: input.NewHandler(),
+		appCapture:   appCapture,
 	}
+	sess.stats.started = time.Now()
+	sess.stats.getter = getter
 
 	pc.OnDataChannel(func(d *webrtc.DataChannel) {
-		if d.Label() == "input" {
-			log.Println("Input DataChannel created")
+		sess.stats.addDataChannel(d)
+		switch d.Label() {
+		case "input":
+			log.Info("input DataChannel created")
 			d.OnMessage(func(msg webrtc.DataChannelMessage) {
+				sess.touch()
 				sess.inputHandler.Process(msg.Data)
 			})
+		case "control":
+			sess.control.set(d)
+			d.OnMessage(func(msg webrtc.DataChannelMessage) {
+				// a reconfiguration blocks until the new encoder is live
+				go m.handleControl(sess, msg.Data)
+			})
+		case "latency":
+			d.OnMessage(func(msg webrtc.DataChannelMessage) { sess.latency.echo(msg.Data, time.Now()) })
 		}
 	})
 
-	mime := webrtc.MimeTypeH264
-	switch strings.ToLower(req.Codec) {
-	case "hevc", "h265":
-		mime = webrtc.MimeTypeH265
-	case "av1":
-		mime = webrtc.MimeTypeAV1
+	if req.Mic && cfg.MicPassthrough {
+		mic, err := newMicPassthrough(ctx, cfg.FFmpegPath, req.MicGain)
+		if err != nil {
+			log.Warn("microphone passthrough unavailable", "err", err)
+		} else {
+			sess.mic = mic
+		}
 	}
-	videoTrack, err := webrtc.NewTrackLocalStaticSample(
-		webrtc.RTPCodecCapability{MimeType: mime, ClockRate: 90000},
-		"video", "pccloud",
-	)
+	// set before the offer is applied, which is when OnTrack may fire
+	pc.OnTrack(func(t *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if t.Kind() == webrtc.RTPCodecTypeAudio && sess.mic != nil {
+			sess.mic.run(ctx, t)
+		}
+	})
+
+	videoTrack, err := webrtc.NewTrackLocalStaticRTP(choice.track, "video", "pccloud")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	_, err = pc.AddTrack(videoTrack)
+	vSender, err := pc.AddTrack(videoTrack)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	sess.stats.vSSRC = senderSSRC(vSender)
+	sess.clock = newMediaClock()
+	sess.videoClock = sess.clock.track(videoClockRate)
+	sess.videoClock.ssrc = sess.stats.vSSRC
+	sess.latency = latencyProbe{clock: sess.videoClock, ms: sess.metrics, rtt: sess.stats.videoRTT}
 
 	var audioTrack *webrtc.TrackLocalStaticRTP
 	var aSender *webrtc.RTPSender
 	if req.Audio {
-		audioTrack, err = webrtc.NewTrackLocalStaticRTP(
-			webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
-			"audio", "pccloud",
-		)
+		audioTrack, err = webrtc.NewTrackLocalStaticRTP(audioCodec(req.AudioChannels), "audio", "pccloud")
 		if err == nil {
 			aSender, _ = pc.AddTrack(audioTrack)
 		}
+		if aSender != nil {
+			go readRTCP(aSender, "audio", opusClockRate, sess.metrics, sess.touch, nil)
+			sess.stats.aSSRC = senderSSRC(aSender)
+			sess.audioClock = sess.clock.track(opusClockRate)
+			sess.audioClock.ssrc = sess.stats.aSSRC
+		}
 	} else {
-		log.Println("audio disabled")
+		log.Info("audio disabled")
 	}
 
 	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: req.SDP}
@@ -222,328 +452,205 @@ func (m *Manager) HandleOffer(w http.ResponseWriter, r *http.Request) {
 	}
 	<-g
 
-	var audioPort int
-	if req.Audio && audioTrack != nil && aSender != nil {
-		aconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
-		if err == nil {
-			aaddr := aconn.LocalAddr().(*net.UDPAddr)
-			audioPort = aaddr.Port
-			if params := aSender.GetParameters(); len(params.Codecs) > 0 {
-				sess.audioPT = uint8(params.Codecs[0].PayloadType)
-			}
-			sess.audioConn = aconn
-			go forwardRTP(ctx, aconn, audioTrack, sess.audioPT)
-		} else {
-			log.Println("audio UDP bind failed:", err)
-			log.Println("audio disabled")
-		}
-	}
-
-	cmd, vfmt := encoder.BuildFFmpegPipeCmd(ctx, encoder.Params{
-		Codec:       req.Codec,
-		FPS:         req.FPS,
-		Width:       req.Width,
-		Height:      req.Height,
-		Preset:      req.Preset,
-		Bitrate:     req.Bitrate,
-		WithAudio:   req.Audio,
-		AudioPort:   audioPort,
-		AudioDevice: os.Getenv("AUDIO_DEVICE"),
-		Capture:     req.Capture,
-	})
-	stdout, err := cmd.StdoutPipe()
+	params := encoder.Params{
+		Codec:         req.Codec,
+		FPS:           req.FPS,
+		Width:         req.Width,
+		Height:        req.Height,
+		Preset:        req.Preset,
+		Bitrate:       req.Bitrate,
+		WithAudio:     req.Audio,
+		AudioDevice:   cfg.AudioDevice,
+		AudioChannels: req.AudioChannels,
+		AudioBitrate:  req.AudioBitrate,
+		AudioFEC:      req.AudioFEC,
+		AudioDTX:      req.AudioDTX,
+		Capture:       req.Capture,
+		FFmpegPath:    cfg.FFmpegPath,
+		AV1Container:  cfg.AV1Container,
+		BitDepth:      req.BitDepth,
+		Profile:       choice.profile,
+		HDR:           hdr,
+		HDRCapture:    hostHDR(cfg),
+		ColorRange:    cfg.ColorRange,
+		Chroma:        req.Chroma,
+		Latency:       req.Latency,
+		IntraRefresh:  req.IntraRefresh,
+	}
+	if sess.appCapture != nil {
+		params.AudioDevice = sess.appCapture.Source()
+		go sess.appCapture.Run(ctx)
+	}
+	sess.videoOut = newVideoOutput(sess.videoClock, sess.metrics, &sess.stats.counts, vSender.ReplaceTrack)
+	video, err := m.startVideo(sess, cfg, params, videoTrack)
 	if err != nil {
-		pc.Close()
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	cmd.Stderr = os.Stderr
-	if err := cmd.Start(); err != nil {
-		pc.Close()
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	sess.videoMu.Lock()
+	sess.video = video
+	sess.videoMu.Unlock()
+	// started once sess.video is set, so the first PLI finds the encoder
+	go readRTCP(vSender, "video", videoClockRate, sess.metrics, sess.touch, sess.requestKeyframe)
+	if aSender != nil {
+		asink := newAudioSink(audioTrack, sess.audioClock, sess.metrics)
+		sess.audio = &encoderSupervisor{
+			track: "audio",
+			build: func(ctx context.Context) (*exec.Cmd, string) {
+				return encoder.BuildAudioPipeCmd(ctx, params), "ogg"
+			},
+			pump:        asink.pump,
+			ms:          sess.metrics,
+			maxRestarts: cfg.EncoderMaxRestarts,
+			log:         encoderLog.With("codec", "opus", "session", id),
+			notify:      sess.control.send,
+			// losing audio is not worth ending the stream over
+			onGiveUp: func() {},
+		}
+		if err := sess.audio.start(ctx); err != nil {
+			log.Error("audio encoder failed to start, audio disabled", "err", err)
+		}
 	}
-	sess.ffmpeg = cmd
-
-	switch vfmt {
-	case "h264":
-		go pumpH264AnnexBToTrack(ctx, stdout, videoTrack, 60)
-	case "hevc":
-		go pumpH265AnnexBToTrack(ctx, stdout, videoTrack, 60)
-	case "ivf":
-		go pumpAV1IVFToTrack(ctx, stdout, videoTrack, 60)
-	default:
-		go pumpH264AnnexBToTrack(ctx, stdout, videoTrack, 60)
+	sess.onEnd = func(reason string) {
+		m.emit(lifecycleEvent{Event: "session.ended", SessionID: sess.id, Codec: sess.currentVideo().params.Codec, Profile: sess.profile,
+			ClientID: sess.clientID, Reason: reason, DurationS: time.Since(sess.stats.started).Seconds(), Time: time.Now()})
 	}
+	go sess.statsLoop(ctx.Done())
+	go sendReports(ctx, pc, sess.videoClock, sess.audioClock)
+	go m.watch(ctx, sess)
 
+	started = true
 	m.mu.Lock()
 	m.active = sess
 	m.mu.Unlock()
+	metrics.ActiveSessions.Inc()
+	m.emit(lifecycleEvent{Event: "session.started", SessionID: sess.id, Codec: req.Codec, Profile: sess.profile,
+		ClientID: sess.clientID, Time: time.Now()})
 
-	resp := Answer{SDP: pc.LocalDescription().SDP, Type: pc.LocalDescription().Type.String()}
+	resp := Answer{SDP: pc.LocalDescription().SDP, Type: pc.LocalDescription().Type.String(), SessionID: sess.id,
+		Codec: req.Codec, BitDepth: req.BitDepth, HDR: hdr, Chroma: req.Chroma, Latency: req.Latency,
+		IntraRefresh: video.intraRefresh}
 
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		log.Printf("error encoding answer: %v", err)
+		log.Error("encoding answer", "err", err)
 	}
 }
 
-func forwardRTP(ctx context.Context, conn *net.UDPConn, track *webrtc.TrackLocalStaticRTP, wantPT uint8) {
-	buf := make([]byte, 1700)
+// pumpAnnexBToTrack reads H.264 or H.265 in MPEG-TS from r and writes one
+// sample per access unit, with the parameter sets repeated in front of
+// every keyframe and, for intra refresh, every recovery point, as those are
+// the only places a decoder can join. Access units are delimited by the slice headers, so the
+// stream needs no AUDs; the end of a PES packet always ends one.
+func pumpAnnexBToTrack(ctx context.Context, r io.Reader, out sampleWriter, ms *metrics.Stream, codec bitstream.Codec) {
+	dmx := newTSDemuxer(bufio.NewReaderSize(r, 1<<20))
+	aus := bitstream.NewAUSplitter(codec)
+	f := &auFramer{codec: codec, ms: ms}
+	var nals [][]byte
 	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
-		n, _, err := conn.ReadFrom(buf)
-		if err != nil {
-			return
-		}
-		if n <= 0 {
+		pes, pts, start, err := dmx.next()
+		if errors.Is(err, errTSSync) {
+			ms.ParseErrors.Inc()
 			continue
 		}
-		pkt := &rtp.Packet{}
-		if err := pkt.Unmarshal(buf[:n]); err == nil {
-			pkt.PayloadType = wantPT
-			if err := track.WriteRTP(pkt); err != nil {
-				log.Printf("error writing RTP packet: %v", err)
-			}
-		} else {
-			_, _ = track.Write(buf[:n])
-		}
-	}
-}
-
-func pumpH264AnnexBToTrack(ctx context.Context, r io.Reader, t *webrtc.TrackLocalStaticSample, fps int) {
-	br := bufio.NewReaderSize(r, 1<<20)
-	var (
-		sps []byte
-		pps []byte
-	)
-	frameDur := time.Second / time.Duration(max(1, fps))
-	var au [][]byte
-
-	writeAU := func(nalus [][]byte) {
-		if len(nalus) == 0 {
-			return
-		}
-		if hasH264IDR(nalus) && (sps != nil && pps != nil) {
-			nalus = append([][]byte{sps, pps}, nalus...)
-		}
-		payload := joinAnnexB(nalus)
-		_ = t.WriteSample(wmedia.Sample{Data: payload, Duration: frameDur})
-	}
-
-	for {
-		nal, err := nextAnnexBNAL(br)
 		if err != nil {
 			return
 		}
-		nt := h264Type(nal)
-		switch nt {
-		case 7:
-			sps = append([]byte{}, nal...)
-		case 8:
-			pps = append([]byte{}, nal...)
-		case 9:
-			if len(au) > 0 {
-				writeAU(au)
-				au = au[:0]
-			}
-		default:
-			au = append(au, nal)
-			if len(au) > 50 {
-				writeAU(au)
-				au = au[:0]
+		nals = bitstream.Split(pes, nals)
+		for _, nal := range nals {
+			if au := aus.Push(nal); au != nil {
+				f.write(out, au, pts, start)
+				pts = -1 // only the first access unit in a PES has a PTS
 			}
 		}
-	}
-}
-
-func h264Type(nal []byte) byte {
-	if len(nal) == 0 {
-		return 0
-	}
-	return nal[0] & 0x1F
-}
-func hasH264IDR(nals [][]byte) bool {
-	for _, n := range nals {
-		if h264Type(n) == 5 {
-			return true
+		if au := aus.Flush(); au != nil {
+			f.write(out, au, pts, start)
 		}
 	}
-	return false
 }
 
-func pumpH265AnnexBToTrack(ctx context.Context, r io.Reader, t *webrtc.TrackLocalStaticSample, fps int) {
-	br := bufio.NewReaderSize(r, 1<<20)
-	var (
-		vps []byte
-		sps []byte
-		pps []byte
-	)
-	frameDur := time.Second / time.Duration(max(1, fps))
-	var au [][]byte
-
-	writeAU := func(nalus [][]byte) {
-		if len(nalus) == 0 {
-			return
-		}
-		if hasH265IDR(nalus) && (vps != nil && sps != nil && pps != nil) {
-			nalus = append([][]byte{vps, sps, pps}, nalus...)
-		}
-		payload := joinAnnexB(nalus)
-		_ = t.WriteSample(wmedia.Sample{Data: payload, Duration: frameDur})
-	}
+// auFramer turns access units into samples: parameter sets are kept aside
+// and put back in front of keyframes and recovery points, AUDs are dropped. Samples are built
+// in one buffer that is reused for every frame.
+type auFramer struct {
+	codec    bitstream.Codec
+	ms       *metrics.Stream
+	params   [3][]byte // by bitstream.ParamVPS (H.265 only), ParamSPS, ParamPPS
+	sps      bitstream.SPS
+	frame    [][]byte
+	keyframe bool // or recovery point
+	buf      []byte
+}
 
-	for {
-		nal, err := nextAnnexBNAL(br)
-		if err != nil {
-			return
+func (f *auFramer) write(out sampleWriter, au [][]byte, pts int64, start time.Time) {
+	f.frame, f.keyframe = f.frame[:0], false
+	for _, nal := range au {
+		if f.codec.NALType(nal) < 0 {
+			f.ms.ParseErrors.Inc()
+			continue
 		}
-		nt := h265Type(nal)
-		switch nt {
-		case 32:
-			vps = append([]byte{}, nal...)
-		case 33:
-			sps = append([]byte{}, nal...)
-		case 34:
-			pps = append([]byte{}, nal...)
-		case 35:
-			if len(au) > 0 {
-				writeAU(au)
-				au = au[:0]
-			}
+		switch ps := f.codec.ParamSet(nal); {
+		case ps == bitstream.ParamSPS:
+			f.setSPS(nal)
+		case ps >= 0:
+			f.params[ps] = append(f.params[ps][:0], nal...)
+		case f.codec.IsAUD(nal):
 		default:
-			au = append(au, nal)
-			if len(au) > 50 {
-				writeAU(au)
-				au = au[:0]
-			}
+			f.keyframe = f.keyframe || f.codec.IsKeyframe(nal) || f.codec.IsRecoveryPoint(nal)
+			f.frame = append(f.frame, nal)
 		}
 	}
-}
-
-func h265Type(nal []byte) int {
-	if len(nal) < 2 {
-		return -1
-	}
-	return int((nal[0] >> 1) & 0x3F)
-}
-
-func hasH265IDR(nals [][]byte) bool {
-	for _, n := range nals {
-		t := h265Type(n)
-		if t == 19 || t == 20 {
-			return true
-		}
-	}
-	return false
-}
-
-func pumpAV1IVFToTrack(ctx context.Context, r io.Reader, t *webrtc.TrackLocalStaticSample, fps int) {
-	br := bufio.NewReaderSize(r, 1<<20)
-	h := make([]byte, 32)
-	if _, err := io.ReadFull(br, h); err != nil {
+	if len(f.frame) == 0 {
 		return
 	}
-	frameDur := time.Second / time.Duration(max(1, fps))
-
-	for {
-		hdr := make([]byte, 12)
-		if _, err := io.ReadFull(br, hdr); err != nil {
-			return
+	buf := f.buf[:0]
+	if f.keyframe {
+		ps := f.params[bitstream.ParamSPS:]
+		if f.codec == bitstream.H265 {
+			ps = f.params[:]
 		}
-		sz := binary.LittleEndian.Uint32(hdr[:4])
-		if sz == 0 || sz > 50*1024*1024 {
-			return
+		complete := true
+		for _, p := range ps {
+			complete = complete && p != nil
 		}
-		frame := make([]byte, sz)
-		if _, err := io.ReadFull(br, frame); err != nil {
-			return
+		if complete {
+			buf = appendAnnexB(buf, ps)
 		}
-		_ = t.WriteSample(wmedia.Sample{Data: frame, Duration: frameDur})
 	}
+	f.buf = appendAnnexB(buf, f.frame)
+	out.write(f.buf, pts, start)
 }
 
-func nextAnnexBNAL(br *bufio.Reader) ([]byte, error) {
-	if _, err := findStartCode(br); err != nil {
-		return nil, err
-	}
-	var buf bytes.Buffer
-	for {
-		b, err := br.ReadByte()
-		if err != nil {
-			if err == io.EOF && buf.Len() > 0 {
-				return buf.Bytes(), nil
-			}
-			return nil, err
-		}
-		if b == 0x00 {
-			br.UnreadByte()
-			m, sc := peekStartCode(br)
-			if sc {
-				return buf.Bytes(), nil
-			}
-			_, _ = br.ReadByte()
-			buf.WriteByte(0x00)
-			if m > 1 {
-				for i := 1; i < m; i++ {
-					buf.WriteByte(0x00)
-				}
-			}
-			continue
-		}
-		buf.WriteByte(b)
-	}
-}
-
-func findStartCode(br *bufio.Reader) (int, error) {
-	var z int
-	for {
-		b, err := br.ReadByte()
-		if err != nil {
-			return 0, err
-		}
-		if b == 0x00 {
-			z++
-			if z > 4 {
-				z = 4
-			}
-			continue
-		}
-		if b == 0x01 && (z == 2 || z == 3) {
-			return z, nil
-		}
-		z = 0
+func (f *auFramer) setSPS(nal []byte) {
+	if bytes.Equal(f.params[bitstream.ParamSPS], nal) {
+		return
 	}
-}
-
-func peekStartCode(br *bufio.Reader) (zeros int, found bool) {
-	bs, _ := br.Peek(4)
-	if len(bs) >= 3 && bs[0] == 0x00 && bs[1] == 0x00 && bs[2] == 0x01 {
-		return 2, true
+	f.params[bitstream.ParamSPS] = append(f.params[bitstream.ParamSPS][:0], nal...)
+	sps, err := f.codec.ParseSPS(nal)
+	if err != nil {
+		f.ms.ParseErrors.Inc()
+		log.Warn("unparsable SPS", "err", err)
+		return
 	}
-	if len(bs) >= 4 && bs[0] == 0x00 && bs[1] == 0x00 && bs[2] == 0x00 && bs[3] == 0x01 {
-		return 3, true
+	if sps != f.sps {
+		log.Info("video stream parameters", "width", sps.Width, "height", sps.Height,
+			"profile", sps.Profile, "level", sps.Level, "chroma_format", sps.ChromaFormat, "bit_depth", sps.BitDepthLuma,
+			"color", sps.Color.String())
+		f.sps = sps
 	}
-	return 0, false
 }
 
-func joinAnnexB(nals [][]byte) []byte {
-	if len(nals) == 0 {
-		return nil
-	}
-	total := 0
+// appendAnnexB appends nals to dst, each behind a 3-byte start code.
+func appendAnnexB(dst []byte, nals [][]byte) []byte {
+	total := len(dst)
 	for _, n := range nals {
 		total += 3 + len(n)
 	}
-	out := make([]byte, 0, total)
+	dst = slices.Grow(dst, total-len(dst))
 	for _, n := range nals {
-		out = append(out, 0x00, 0x00, 0x01)
-		out = append(out, n...)
+		dst = append(dst, 0x00, 0x00, 0x01)
+		dst = append(dst, n...)
 	}
-	return out
+	return dst
 }
 
 func max(a, b int) int {
@@ -553,52 +660,134 @@ func max(a, b int) int {
 	return b
 }
 
-func buildAPIForCodec(codec string) (*webrtc.API, error) {
+// buildAPIForCodecs builds a pion API that can send every track in tracks
+// and the audio for the channel count. onStats receives the stats
+// interceptor's getter when a PeerConnection is created from it.
+func buildAPIForCodecs(tracks []webrtc.RTPCodecCapability, audioChannels int, onStats stats.NewPeerConnectionCallback) (*webrtc.API, error) {
+	defaults, err := defaultCodecs()
+	if err != nil {
+		return nil, err
+	}
 	me := &webrtc.MediaEngine{}
 	if err := me.RegisterDefaultCodecs(); err != nil {
 		return nil, err
 	}
-
-	switch strings.ToLower(codec) {
-	case "hevc", "h265":
-		if err := addVideoCodecIfMissing(me, webrtc.MimeTypeH265); err != nil {
-			return nil, fmt.Errorf("register hevc: %w", err)
+	registered := maps.Clone(defaults)
+	for _, t := range tracks {
+		if err := addCodecIfMissing(me, registered, t, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, fmt.Errorf("register %s %s: %w", t.MimeType, t.SDPFmtpLine, err)
 		}
-	case "av1":
-		if err := addVideoCodecIfMissing(me, webrtc.MimeTypeAV1); err != nil {
-			return nil, fmt.Errorf("register av1: %w", err)
+	}
+	if audioChannels == 6 {
+		if err := addCodecIfMissing(me, registered, audioCodec(6), webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, fmt.Errorf("register multiopus: %w", err)
 		}
 	}
 
 	ir := &interceptor.Registry{}
-	if err := webrtc.RegisterDefaultInterceptors(me, ir); err != nil {
+	// the default set minus pion's sender reports, see sendReports
+	if err := webrtc.ConfigureNack(me, ir); err != nil {
+		return nil, err
+	}
+	rr, err := report.NewReceiverInterceptor()
+	if err != nil {
 		return nil, err
 	}
+	ir.Add(rr)
+	if err := webrtc.ConfigureSimulcastExtensionHeaders(me); err != nil {
+		return nil, err
+	}
+	if err := webrtc.ConfigureTWCCSender(me, ir); err != nil {
+		return nil, err
+	}
+	sf, err := stats.NewInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	sf.OnNewPeerConnection(onStats)
+	ir.Add(sf)
 	return webrtc.NewAPI(
 		webrtc.WithMediaEngine(me),
 		webrtc.WithInterceptorRegistry(ir),
 	), nil
 }
 
-func addVideoCodecIfMissing(me *webrtc.MediaEngine, mime string) error {
-	for pt := webrtc.PayloadType(96); pt <= 127; pt++ {
-		err := me.RegisterCodec(webrtc.RTPCodecParameters{
-			RTPCodecCapability: webrtc.RTPCodecCapability{
-				MimeType:  mime,
-				ClockRate: 90000,
-			},
-			PayloadType: pt,
-		}, webrtc.RTPCodecTypeVideo)
-		if err == nil {
+// registeredCodec is a codec of a MediaEngine, as its SDP describes it.
+type registeredCodec struct {
+	mime string // e.g. "video/h264", lower case
+	fmtp string
+}
+
+// defaultCodecs returns the codecs RegisterDefaultCodecs registers, by
+// payload type. pion has no way to list them, so they are read once from
+// an offer.
+var defaultCodecs = sync.OnceValues(func() (map[webrtc.PayloadType]registeredCodec, error) {
+	me := &webrtc.MediaEngine{}
+	if err := me.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(me)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if _, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			return nil, err
+		}
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := offer.Unmarshal()
+	if err != nil {
+		return nil, err
+	}
+	codecs := map[webrtc.PayloadType]registeredCodec{}
+	for _, md := range parsed.MediaDescriptions {
+		for _, a := range md.Attributes {
+			pt, rest, _ := strings.Cut(a.Value, " ")
+			n, err := strconv.ParseUint(pt, 10, 7)
+			if err != nil {
+				continue
+			}
+			c := codecs[webrtc.PayloadType(n)]
+			switch a.Key {
+			case "rtpmap":
+				name, _, _ := strings.Cut(rest, "/")
+				c.mime = strings.ToLower(md.MediaName.Media + "/" + name)
+			case "fmtp":
+				c.fmtp = rest
+			default:
+				continue
+			}
+			codecs[webrtc.PayloadType(n)] = c
+		}
+	}
+	return codecs, nil
+})
+
+// addCodecIfMissing registers c with me on the first free dynamic payload
+// type, unless registered already has it. registered must hold every codec
+// of me: RegisterCodec only fails for a payload type taken by another mime
+// type, and quietly ignores a codec whose payload type holds its own.
+func addCodecIfMissing(me *webrtc.MediaEngine, registered map[webrtc.PayloadType]registeredCodec, c webrtc.RTPCodecCapability, typ webrtc.RTPCodecType) error {
+	want := registeredCodec{mime: strings.ToLower(c.MimeType), fmtp: c.SDPFmtpLine}
+	for _, r := range registered {
+		if r == want {
 			return nil
 		}
-		es := strings.ToLower(err.Error())
-		if strings.Contains(es, "payload type") && strings.Contains(es, "already") {
+	}
+	for pt := webrtc.PayloadType(96); pt <= 127; pt++ {
+		if _, ok := registered[pt]; ok {
 			continue
 		}
-		if strings.Contains(es, "codec already registered") {
-			return nil
+		if err := me.RegisterCodec(webrtc.RTPCodecParameters{RTPCodecCapability: c, PayloadType: pt}, typ); err != nil {
+			return err
 		}
+		registered[pt] = want
+		return nil
 	}
-	return fmt.Errorf("no free dynamic payload type for %s", mime)
+	return fmt.Errorf("no free dynamic payload type for %s", c.MimeType)
 }
@@ -0,0 +1,162 @@
+package webrtcx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+
+	"pc_cloud/internal/devices"
+	"pc_cloud/internal/encoder"
+)
+
+const maxMicGain = 4
+
+// MicRequest changes a session's microphone passthrough; absent fields are
+// left as they are.
+type MicRequest struct {
+	Enabled *bool    `json:"enabled,omitempty"`
+	Gain    *float64 `json:"gain,omitempty"` // 1 = unity, up to 4
+}
+
+// micPassthrough plays the client's microphone track into the host's
+// virtual microphone. Disabling it mutes the virtual mic rather than
+// renegotiating, so it can be toggled instantly.
+type micPassthrough struct {
+	vm         *devices.VirtualMic
+	ffmpegPath string
+
+	mu      sync.Mutex
+	enabled bool
+	gain    float64
+}
+
+func newMicPassthrough(ctx context.Context, ffmpegPath string, gain float64) (*micPassthrough, error) {
+	if gain <= 0 {
+		gain = 1
+	}
+	vm, err := devices.NewVirtualMic(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p := &micPassthrough{vm: vm, ffmpegPath: ffmpegPath, enabled: true, gain: min(gain, maxMicGain)}
+	if err := vm.SetGain(p.gain); err != nil {
+		log.Warn("setting microphone gain failed", "err", err)
+	}
+	return p, nil
+}
+
+// run decodes track into the virtual microphone until the track or ctx
+// ends. If FFmpeg dies the rest of the track is drained and dropped.
+func (p *micPassthrough) run(ctx context.Context, track *webrtc.TrackRemote) {
+	if !strings.EqualFold(track.Codec().MimeType, webrtc.MimeTypeOpus) {
+		log.Warn("ignoring client microphone", "codec", track.Codec().MimeType)
+		return
+	}
+	cmd := encoder.BuildMicPlaybackCmd(ctx, p.ffmpegPath, devices.VirtualMicSink)
+	stderr := &tailBuffer{max: 4 << 10}
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		log.Error("microphone playback", "err", err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		log.Error("microphone playback failed to start", "err", err)
+		return
+	}
+	defer func() {
+		_ = stdin.Close()
+		if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+			log.Warn("microphone playback exited", "err", err, "stderr", stderr.lines(5))
+		}
+	}()
+	log.Info("client microphone connected", "ssrc", track.SSRC())
+
+	// browsers send mono voice even though Opus is always signalled as stereo
+	ow, err := oggwriter.NewWith(stdin, opusClockRate, 1)
+	if err != nil {
+		log.Error("microphone playback", "err", err)
+		return
+	}
+	defer ow.Close()
+	writing := true
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		if !writing {
+			continue
+		}
+		if err := ow.WriteRTP(pkt); err != nil {
+			if ctx.Err() == nil {
+				log.Warn("microphone playback stopped", "err", err)
+			}
+			writing = false
+		}
+	}
+}
+
+func (p *micPassthrough) set(req MicRequest) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if req.Gain != nil {
+		if *req.Gain < 0 || *req.Gain > maxMicGain {
+			return errors.New("gain must be between 0 and 4")
+		}
+		if err := p.vm.SetGain(*req.Gain); err != nil {
+			return err
+		}
+		p.gain = *req.Gain
+	}
+	if req.Enabled != nil {
+		if err := p.vm.SetMuted(!*req.Enabled); err != nil {
+			return err
+		}
+		p.enabled = *req.Enabled
+	}
+	return nil
+}
+
+func (p *micPassthrough) state() map[string]any {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return map[string]any{"enabled": p.enabled, "gain": p.gain}
+}
+
+func (p *micPassthrough) close() {
+	if err := p.vm.Close(); err != nil {
+		log.Warn("removing virtual microphone failed", "err", err)
+	}
+}
+
+// HandleMic serves POST /api/session/{id}/mic, which enables, disables or
+// sets the gain of the session's microphone passthrough.
+func (m *Manager) HandleMic(w http.ResponseWriter, r *http.Request) {
+	sess := m.session(r.PathValue("id"))
+	if sess == nil {
+		writeJSONError(w, http.StatusNotFound, "no such session")
+		return
+	}
+	if sess.mic == nil {
+		writeJSONError(w, http.StatusConflict, "session has no microphone passthrough")
+		return
+	}
+	var req MicRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad json: "+err.Error())
+		return
+	}
+	if err := sess.mic.set(req); err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(sess.mic.state())
+}
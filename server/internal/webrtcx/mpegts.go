@@ -0,0 +1,208 @@
+package webrtcx
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+const tsPacketSize = 188
+
+// errTSSync is returned once each time the demuxer lost packet alignment;
+// it resynchronises on its own, so callers may keep reading.
+var errTSSync = errors.New("mpegts: lost sync")
+
+// tsDemuxer pulls the first video elementary stream out of an MPEG-TS
+// byte stream. FFmpeg muxes one access unit per PES packet, so each call to
+// next yields one frame together with its PTS.
+//
+// A PES over 64 KB, usually a keyframe, can't carry its length. FFmpeg
+// pads the last TS packet of every PES with adaptation field stuffing, so
+// such a PES ends at the first packet with stuffing rather than waiting a
+// frame interval for the next one to start. Only a PES that happens to
+// fill its last packet exactly still ends at the next PES.
+type tsDemuxer struct {
+	r   io.Reader
+	pkt [tsPacketSize]byte
+
+	pmtPID   int // -1 until the PAT was seen
+	videoPID int // -1 until the PMT was seen
+
+	pes      []byte    // the PES being assembled, nil between packets
+	bufs     [2][]byte // alternate so a returned payload survives the next PES start
+	cur      int
+	pesLen   int // expected payload bytes, 0 = unbounded (ends at stuffing or the next PES)
+	pesPTS   int64
+	pesStart time.Time
+}
+
+func newTSDemuxer(r io.Reader) *tsDemuxer {
+	return &tsDemuxer{r: r, pmtPID: -1, videoPID: -1}
+}
+
+// next returns the next complete PES payload, its PTS in 90 kHz ticks (-1
+// if the packet carried none) and when its first TS packet was read. The
+// payload is only valid until the following call.
+func (d *tsDemuxer) next() (payload []byte, pts int64, start time.Time, err error) {
+	for {
+		if _, err := io.ReadFull(d.r, d.pkt[:]); err != nil {
+			return nil, 0, time.Time{}, err
+		}
+		if d.pkt[0] != 0x47 {
+			if err := d.resync(); err != nil {
+				return nil, 0, time.Time{}, err
+			}
+			d.pes = nil
+			return nil, 0, time.Time{}, errTSSync
+		}
+		pid := int(d.pkt[1]&0x1F)<<8 | int(d.pkt[2])
+		pusi := d.pkt[1]&0x40 != 0
+		afc := d.pkt[3] >> 4 & 3
+		p := d.pkt[4:]
+		stuffed := false
+		if afc&2 != 0 {
+			if 1+int(p[0]) > len(p) {
+				continue
+			}
+			stuffed = hasStuffing(p[:1+int(p[0])])
+			p = p[1+int(p[0]):]
+		}
+		if afc&1 == 0 || len(p) == 0 {
+			continue
+		}
+
+		switch {
+		case pid == 0 && pusi:
+			d.parsePAT(p)
+		case pid == d.pmtPID && pusi:
+			d.parsePMT(p)
+		case pid == d.videoPID && pusi:
+			prev, prevPTS, prevStart := d.pes, d.pesPTS, d.pesStart
+			if prev != nil {
+				d.bufs[d.cur] = prev
+			}
+			d.startPES(p)
+			if prev != nil {
+				return prev, prevPTS, prevStart, nil
+			}
+		case pid == d.videoPID && d.pes != nil:
+			d.pes = append(d.pes, p...)
+			if d.pesLen == 0 && stuffed {
+				out := d.pes
+				d.bufs[d.cur], d.pes = d.pes, nil
+				return out, d.pesPTS, d.pesStart, nil
+			}
+		default:
+			continue
+		}
+		if d.pes != nil && d.pesLen > 0 && len(d.pes) >= d.pesLen {
+			out := d.pes[:d.pesLen]
+			d.bufs[d.cur], d.pes = d.pes, nil
+			return out, d.pesPTS, d.pesStart, nil
+		}
+	}
+}
+
+// hasStuffing reports whether the adaptation field af, length byte
+// included, ends in stuffing bytes: a zero length is a single stuffing
+// byte, otherwise anything past the fields its flags announce is. Fields
+// FFmpeg never writes make it answer false.
+func hasStuffing(af []byte) bool {
+	if len(af) == 1 {
+		return true
+	}
+	flags := af[1]
+	if flags&0x03 != 0 { // private data, extension
+		return false
+	}
+	need := 2
+	if flags&0x10 != 0 { // PCR
+		need += 6
+	}
+	if flags&0x08 != 0 { // OPCR
+		need += 6
+	}
+	if flags&0x04 != 0 { // splice countdown
+		need++
+	}
+	return len(af) > need
+}
+
+// resync skips bytes until the next sync byte and refills pkt from there.
+func (d *tsDemuxer) resync() error {
+	for {
+		i := 1
+		for i < tsPacketSize && d.pkt[i] != 0x47 {
+			i++
+		}
+		n := copy(d.pkt[:], d.pkt[i:])
+		if _, err := io.ReadFull(d.r, d.pkt[n:]); err != nil {
+			return err
+		}
+		if d.pkt[0] == 0x47 {
+			return nil
+		}
+	}
+}
+
+func (d *tsDemuxer) startPES(p []byte) {
+	d.pes, d.pesLen, d.pesPTS, d.pesStart = nil, 0, -1, time.Now()
+	d.cur ^= 1
+	if len(p) < 9 || p[0] != 0 || p[1] != 0 || p[2] != 1 {
+		return
+	}
+	hdr := 9 + int(p[8])
+	if hdr > len(p) {
+		return
+	}
+	if p[7]&0x80 != 0 && len(p) >= 14 {
+		d.pesPTS = int64(p[9]>>1&7)<<30 | int64(p[10])<<22 | int64(p[11]>>1)<<15 |
+			int64(p[12])<<7 | int64(p[13]>>1)
+	}
+	if n := int(p[4])<<8 | int(p[5]); n > 0 {
+		d.pesLen = n - (hdr - 6)
+	}
+	if d.bufs[d.cur] == nil {
+		d.bufs[d.cur] = make([]byte, 0, 64<<10)
+	}
+	d.pes = append(d.bufs[d.cur][:0], p[hdr:]...)
+}
+
+// section skips the pointer field and returns the PSI section without its
+// CRC, or nil if it doesn't fit in one packet.
+func section(p []byte) []byte {
+	if len(p) < 1 || 1+int(p[0])+3 > len(p) {
+		return nil
+	}
+	s := p[1+int(p[0]):]
+	n := int(s[1]&0x0F)<<8 | int(s[2])
+	if 3+n > len(s) || n < 4 {
+		return nil
+	}
+	return s[:3+n-4]
+}
+
+func (d *tsDemuxer) parsePAT(p []byte) {
+	s := section(p)
+	for i := 8; i+4 <= len(s); i += 4 {
+		if prog := int(s[i])<<8 | int(s[i+1]); prog != 0 {
+			d.pmtPID = int(s[i+2]&0x1F)<<8 | int(s[i+3])
+			return
+		}
+	}
+}
+
+func (d *tsDemuxer) parsePMT(p []byte) {
+	s := section(p)
+	if len(s) < 12 {
+		return
+	}
+	for i := 12 + (int(s[10]&0x0F)<<8 | int(s[11])); i+5 <= len(s); {
+		switch s[i] {
+		case 0x1B, 0x24: // H.264, HEVC
+			d.videoPID = int(s[i+1]&0x1F)<<8 | int(s[i+2])
+			return
+		}
+		i += 5 + (int(s[i+3]&0x0F)<<8 | int(s[i+4]))
+	}
+}
@@ -0,0 +1,68 @@
+package webrtcx
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestTSDemuxerPESEnd(t *testing.T) {
+	// 14 bytes of PES header plus the payload fill whole TS packets
+	exact := bytes.Repeat([]byte{0xaa}, 400*184-14)
+	tests := []struct {
+		name    string
+		es      []byte
+		bounded bool
+		// an unbounded PES without stuffing only ends at the next one
+		waitsForNext bool
+	}{
+		{"bounded", bytes.Repeat([]byte{0x11}, 5000), true, false},
+		{"unbounded with stuffing", bytes.Repeat([]byte{0x22}, 100<<10), false, false},
+		{"unbounded filling its last packet", exact, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := appendTSPES(tsPreamble(), tt.es, 9000)
+			if tt.bounded {
+				// set PES_packet_length: the header after it plus the payload
+				n := 8 + len(tt.es)
+				ts[2*tsPacketSize+4+4], ts[2*tsPacketSize+4+5] = byte(n>>8), byte(n)
+			}
+			d := newTSDemuxer(bytes.NewReader(ts))
+			got, pts, _, err := d.next()
+			if tt.waitsForNext {
+				if !errors.Is(err, io.EOF) {
+					t.Fatalf("err = %v, want EOF before the next PES", err)
+				}
+				d = newTSDemuxer(bytes.NewReader(appendTSPES(ts, []byte{0, 0, 1, 0x09, 0xf0}, 10500)))
+				got, pts, _, err = d.next()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pts != 9000 || !bytes.Equal(got, tt.es) {
+				t.Errorf("got %d bytes at pts %d, want %d at 9000", len(got), pts, len(tt.es))
+			}
+		})
+	}
+}
+
+func TestHasStuffing(t *testing.T) {
+	tests := []struct {
+		af   []byte
+		want bool
+	}{
+		{[]byte{0}, true},
+		{[]byte{1, 0x00}, false},
+		{[]byte{3, 0x00, 0xff, 0xff}, true},
+		{[]byte{7, 0x50, 0, 0, 0, 0, 0, 0}, false},            // random access, PCR
+		{[]byte{9, 0x50, 0, 0, 0, 0, 0, 0, 0xff, 0xff}, true}, // and stuffing
+		{[]byte{3, 0x02, 1, 0xaa}, false},                     // private data
+	}
+	for _, tt := range tests {
+		if got := hasStuffing(tt.af); got != tt.want {
+			t.Errorf("hasStuffing(% x) = %v, want %v", tt.af, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package webrtcx
+
+import (
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// offeredCodec is one video payload type of the client's offer.
+type offeredCodec struct {
+	name string // encoding name, lower case: "h264", "h265", "av1", "vp9", ...
+	fmtp map[string]string
+}
+
+// offeredVideo lists the video codecs of the first video section of offer,
+// in the client's order of preference.
+func offeredVideo(offer webrtc.SessionDescription) ([]offeredCodec, error) {
+	parsed, err := offer.Unmarshal()
+	if err != nil {
+		return nil, err
+	}
+	for _, md := range parsed.MediaDescriptions {
+		if md.MediaName.Media != "video" {
+			continue
+		}
+		names := map[string]string{}
+		fmtps := map[string]map[string]string{}
+		for _, a := range md.Attributes {
+			pt, rest, _ := strings.Cut(a.Value, " ")
+			switch a.Key {
+			case "rtpmap":
+				name, _, _ := strings.Cut(rest, "/")
+				names[pt] = strings.ToLower(name)
+			case "fmtp":
+				params := map[string]string{}
+				for _, kv := range strings.Split(rest, ";") {
+					k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+					params[strings.ToLower(k)] = v
+				}
+				fmtps[pt] = params
+			}
+		}
+		var out []offeredCodec
+		for _, pt := range md.MediaName.Formats {
+			switch names[pt] {
+			case "", "rtx", "red", "ulpfec", "flexfec-03":
+				// not a codec of its own
+			default:
+				out = append(out, offeredCodec{name: names[pt], fmtp: fmtps[pt]})
+			}
+		}
+		return out, nil
+	}
+	return nil, nil
+}
+
+// codecChoice is the outcome of negotiation: what the encoder produces and
+// the track capability that matches the client's payload type.
+type codecChoice struct {
+	codec    string // h264|hevc|av1|vp9|vp8
+	bitDepth int
+	chroma   string // 420|444
+	profile  string // encoder profile, "" = the codec's default
+	track    webrtc.RTPCodecCapability
+}
+
+// h264Profiles are the H.264 profiles we can encode, best first, by the
+// profile_idc in profile-level-id. Baseline covers constrained baseline,
+// which is what the encoder's baseline output is.
+var h264Profiles = []struct {
+	name string
+	idc  byte
+}{
+	{"high", 0x64},
+	{"main", 0x4d},
+	{"baseline", 0x42},
+}
+
+// negotiateCodec picks the first codec in order that the host can encode
+// and the client offered, with the best profile both support. bitDepth
+// is the one requested; HEVC and VP9 fall back to 8-bit if the client has
+// no Main10 or profile 2, and H.264 and VP8 are always 8-bit. The codecs in
+// full are tried in 4:4:4 first, falling back to 4:2:0 likewise.
+func negotiateCodec(offered []offeredCodec, order, encodable []string, bitDepth int, full []string) (codecChoice, error) {
+	for _, codec := range order {
+		if !slices.Contains(encodable, codec) {
+			continue
+		}
+		if slices.Contains(full, codec) && bitDepth == 8 {
+			if c, ok := match444(offered, codec); ok {
+				return c, nil
+			}
+		}
+		if c, ok := matchOffered(offered, codec, bitDepth); ok {
+			return c, nil
+		}
+	}
+	var names []string
+	for _, o := range offered {
+		if !slices.Contains(names, o.name) {
+			names = append(names, o.name)
+		}
+	}
+	return codecChoice{}, fmt.Errorf("no common video codec: the client offers %s, this host encodes %s",
+		strings.Join(names, ", "), strings.Join(encodable, ", "))
+}
+
+func matchOffered(offered []offeredCodec, codec string, bitDepth int) (codecChoice, bool) {
+	c := codecChoice{codec: codec, bitDepth: 8, chroma: "420", track: videoCodec(codec, 8)}
+	switch codec {
+	case "h264":
+		for _, p := range h264Profiles {
+			for _, o := range offered {
+				if o.name != "h264" || o.fmtp["packetization-mode"] != "1" {
+					continue
+				}
+				plid, err := hex.DecodeString(o.fmtp["profile-level-id"])
+				if err != nil || len(plid) != 3 || plid[0] != p.idc {
+					continue
+				}
+				c.profile = p.name
+				c.track.SDPFmtpLine = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + o.fmtp["profile-level-id"]
+				return c, true
+			}
+		}
+	case "hevc":
+		if bitDepth == 10 && offers(offered, "h265", "profile-id", "2") {
+			c.bitDepth, c.profile, c.track = 10, "main10", videoCodec(codec, 10)
+			return c, true
+		}
+		return c, offers(offered, "h265", "profile-id", "1")
+	case "av1":
+		// Main profile covers 10-bit, the SDP has nothing more to say
+		c.bitDepth = bitDepth
+		return c, offers(offered, "av1", "profile", "0")
+	case "vp9":
+		if bitDepth == 10 && offers(offered, "vp9", "profile-id", "2") {
+			c.bitDepth, c.track = 10, videoCodec(codec, 10)
+			return c, true
+		}
+		return c, offers(offered, "vp9", "profile-id", "0")
+	case "vp8":
+		return c, offers(offered, "vp8", "", "")
+	}
+	return c, false
+}
+
+// negotiableTracks returns the track of choice and of every codec
+// negotiateCodec could pick for the session, which reconfigure may switch
+// to later. All of them have to be registered with the session's
+// MediaEngine: pion matches a track to the answer by mime type and fmtp.
+func negotiableTracks(choice codecChoice, offered []offeredCodec, encodable []string, bitDepth int, full []string) []webrtc.RTPCodecCapability {
+	tracks := []webrtc.RTPCodecCapability{choice.track}
+	for _, codec := range encodable {
+		if c, err := negotiateCodec(offered, []string{codec}, encodable, bitDepth, full); err == nil {
+			tracks = append(tracks, c.track)
+		}
+	}
+	return tracks
+}
+
+// match444 finds the 4:4:4 profile of codec in offered: H.264 High 4:4:4
+// Predictive, HEVC Range Extensions or VP9 profile 1.
+func match444(offered []offeredCodec, codec string) (codecChoice, bool) {
+	c := codecChoice{codec: codec, bitDepth: 8, chroma: "444", track: videoCodec(codec, 8)}
+	switch codec {
+	case "h264":
+		for _, o := range offered {
+			plid, err := hex.DecodeString(o.fmtp["profile-level-id"])
+			if o.name != "h264" || o.fmtp["packetization-mode"] != "1" || err != nil || len(plid) != 3 || plid[0] != 0xf4 {
+				continue
+			}
+			c.profile = "high444p"
+			c.track.SDPFmtpLine = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + o.fmtp["profile-level-id"]
+			return c, true
+		}
+	case "hevc":
+		c.profile, c.track.SDPFmtpLine = "rext", "profile-id=4"
+		return c, offers(offered, "h265", "profile-id", "4")
+	case "vp9":
+		c.track.SDPFmtpLine = "profile-id=1"
+		return c, offers(offered, "vp9", "profile-id", "1")
+	}
+	return c, false
+}
+
+// fmtpDefaults are the values of the fmtp keys offers looks at when an
+// offer leaves them out.
+var fmtpDefaults = map[string]string{
+	"h265/profile-id": "1",
+	"av1/profile":     "0",
+	"vp9/profile-id":  "0",
+}
+
+// offers reports whether offered has codec name with fmtp key set to want,
+// a missing key counting as its default.
+func offers(offered []offeredCodec, name, key, want string) bool {
+	for _, o := range offered {
+		if o.name != name {
+			continue
+		}
+		v, ok := o.fmtp[key]
+		if !ok {
+			v = fmtpDefaults[name+"/"+key]
+		}
+		if key == "" || v == want {
+			return true
+		}
+	}
+	return false
+}
+
+// codecOrder is the order negotiation tries codecs in: the one the request
+// or its profile asked for, then the server's preference.
+func codecOrder(requested string, preference []string) []string {
+	order := []string{requested}
+	for _, c := range preference {
+		if c != requested {
+			order = append(order, c)
+		}
+	}
+	return order
+}
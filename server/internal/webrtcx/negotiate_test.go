@@ -0,0 +1,223 @@
+package webrtcx
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+
+	"pc_cloud/internal/config"
+)
+
+func h264Offer(plid, mode string) offeredCodec {
+	return offeredCodec{name: "h264", fmtp: map[string]string{"profile-level-id": plid, "packetization-mode": mode}}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	all := []string{"h264", "hevc", "av1", "vp9", "vp8"}
+	tests := []struct {
+		name      string
+		offered   []offeredCodec
+		order     []string
+		encodable []string
+		bitDepth  int
+		full      []string
+		want      codecChoice
+	}{
+		{
+			name:    "best h264 profile, whatever the client's order",
+			offered: []offeredCodec{h264Offer("42e01f", "1"), h264Offer("4d001f", "1"), h264Offer("64001f", "1")},
+			order:   []string{"h264"},
+			want: codecChoice{codec: "h264", bitDepth: 8, chroma: "420", profile: "high",
+				track: h264Track("64001f")},
+		},
+		{
+			name:    "packetization-mode=0 is skipped",
+			offered: []offeredCodec{h264Offer("64001f", "0"), h264Offer("4d001f", "1")},
+			order:   []string{"h264"},
+			want: codecChoice{codec: "h264", bitDepth: 8, chroma: "420", profile: "main",
+				track: h264Track("4d001f")},
+		},
+		{
+			// constrained high; pion matches the first two bytes, so the
+			// track must carry the client's profile-iop, not 00
+			name:    "safari constrained high",
+			offered: []offeredCodec{h264Offer("640c1f", "1"), h264Offer("42e01f", "1")},
+			order:   []string{"h264"},
+			want: codecChoice{codec: "h264", bitDepth: 8, chroma: "420", profile: "high",
+				track: h264Track("640c1f")},
+		},
+		{
+			name:    "codec order",
+			offered: []offeredCodec{h264Offer("42e01f", "1"), {name: "vp8"}, {name: "av1"}},
+			order:   []string{"hevc", "av1", "h264"},
+			want:    codecChoice{codec: "av1", bitDepth: 8, chroma: "420", track: videoCodec("av1", 8)},
+		},
+		{
+			name:      "only what the host encodes",
+			offered:   []offeredCodec{{name: "av1"}, h264Offer("42e01f", "1")},
+			order:     []string{"av1", "h264"},
+			encodable: []string{"h264"},
+			want: codecChoice{codec: "h264", bitDepth: 8, chroma: "420", profile: "baseline",
+				track: h264Track("42e01f")},
+		},
+		{
+			name:     "hevc main10",
+			offered:  []offeredCodec{{name: "h265", fmtp: map[string]string{"profile-id": "1"}}, {name: "h265", fmtp: map[string]string{"profile-id": "2"}}},
+			order:    []string{"hevc"},
+			bitDepth: 10,
+			want:     codecChoice{codec: "hevc", bitDepth: 10, chroma: "420", profile: "main10", track: videoCodec("hevc", 10)},
+		},
+		{
+			name:     "hevc without main10 falls back to 8-bit",
+			offered:  []offeredCodec{{name: "h265", fmtp: map[string]string{"profile-id": "1"}}},
+			order:    []string{"hevc"},
+			bitDepth: 10,
+			want:     codecChoice{codec: "hevc", bitDepth: 8, chroma: "420", track: videoCodec("hevc", 8)},
+		},
+		{
+			name:     "vp9 profile 2",
+			offered:  []offeredCodec{{name: "vp9", fmtp: map[string]string{"profile-id": "2"}}},
+			order:    []string{"vp9"},
+			bitDepth: 10,
+			want:     codecChoice{codec: "vp9", bitDepth: 10, chroma: "420", track: videoCodec("vp9", 10)},
+		},
+		{
+			name:     "vp9 without profile 2 falls back to 8-bit",
+			offered:  []offeredCodec{{name: "vp9", fmtp: map[string]string{"profile-id": "0"}}},
+			order:    []string{"vp9"},
+			bitDepth: 10,
+			want:     codecChoice{codec: "vp9", bitDepth: 8, chroma: "420", track: videoCodec("vp9", 8)},
+		},
+		{
+			name:    "vp9 profile 2 only can't carry 8-bit",
+			offered: []offeredCodec{{name: "vp9", fmtp: map[string]string{"profile-id": "2"}}, {name: "vp8"}},
+			order:   []string{"vp9", "vp8"},
+			want:    codecChoice{codec: "vp8", bitDepth: 8, chroma: "420", track: videoCodec("vp8", 8)},
+		},
+		{
+			name:    "fmtp defaults: hevc without profile-id is main",
+			offered: []offeredCodec{{name: "h265"}},
+			order:   []string{"hevc"},
+			want:    codecChoice{codec: "hevc", bitDepth: 8, chroma: "420", track: videoCodec("hevc", 8)},
+		},
+		{
+			name:    "fmtp defaults: vp9 without profile-id is profile 0",
+			offered: []offeredCodec{{name: "vp9", fmtp: map[string]string{"x-google-start-bitrate": "1000"}}},
+			order:   []string{"vp9"},
+			want:    codecChoice{codec: "vp9", bitDepth: 8, chroma: "420", track: videoCodec("vp9", 8)},
+		},
+		{
+			name:     "fmtp defaults: av1 without profile is main, 10-bit included",
+			offered:  []offeredCodec{{name: "av1"}},
+			order:    []string{"av1"},
+			bitDepth: 10,
+			want:     codecChoice{codec: "av1", bitDepth: 10, chroma: "420", track: videoCodec("av1", 10)},
+		},
+		{
+			name:    "av1 high profile only",
+			offered: []offeredCodec{{name: "av1", fmtp: map[string]string{"profile": "1"}}, h264Offer("42e01f", "1")},
+			order:   []string{"av1", "h264"},
+			want: codecChoice{codec: "h264", bitDepth: 8, chroma: "420", profile: "baseline",
+				track: h264Track("42e01f")},
+		},
+		{
+			name:    "4:4:4",
+			offered: []offeredCodec{h264Offer("64001f", "1"), h264Offer("f4001f", "1")},
+			order:   []string{"h264"},
+			full:    []string{"h264"},
+			want: codecChoice{codec: "h264", bitDepth: 8, chroma: "444", profile: "high444p",
+				track: h264Track("f4001f")},
+		},
+		{
+			name:    "4:4:4 falls back to 4:2:0",
+			offered: []offeredCodec{{name: "vp9", fmtp: map[string]string{"profile-id": "0"}}},
+			order:   []string{"vp9"},
+			full:    []string{"vp9"},
+			want:    codecChoice{codec: "vp9", bitDepth: 8, chroma: "420", track: videoCodec("vp9", 8)},
+		},
+		{
+			name:    "hevc range extensions",
+			offered: []offeredCodec{{name: "h265", fmtp: map[string]string{"profile-id": "4"}}},
+			order:   []string{"hevc"},
+			full:    []string{"hevc"},
+			want: codecChoice{codec: "hevc", bitDepth: 8, chroma: "444", profile: "rext",
+				track: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH265, ClockRate: videoClockRate, SDPFmtpLine: "profile-id=4"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encodable := tt.encodable
+			if encodable == nil {
+				encodable = all
+			}
+			bitDepth := tt.bitDepth
+			if bitDepth == 0 {
+				bitDepth = 8
+			}
+			got, err := negotiateCodec(tt.offered, tt.order, encodable, bitDepth, tt.full)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func h264Track(plid string) webrtc.RTPCodecCapability {
+	c := videoCodec("h264", 8)
+	c.SDPFmtpLine = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + plid
+	return c
+}
+
+func TestNegotiateCodecNoCommon(t *testing.T) {
+	offered := []offeredCodec{h264Offer("42e01f", "0"), {name: "vp8"}, h264Offer("64001f", "0")}
+	_, err := negotiateCodec(offered, []string{"h264", "av1"}, []string{"h264", "av1"}, 8, nil)
+	want := "no common video codec: the client offers h264, vp8, this host encodes h264, av1"
+	if err == nil || err.Error() != want {
+		t.Fatalf("err = %v, want %q", err, want)
+	}
+
+	// and HandleOffer answers it with 406
+	st, err := config.Load([]string{"-config", filepath.Join(t.TempDir(), "config.yaml")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sdp := offerSDP("H264/90000", "a=fmtp:96 packetization-mode=0;profile-level-id=42e01f\r\n")
+	body, _ := json.Marshal(OfferRequest{SDP: sdp})
+	rec := httptest.NewRecorder()
+	New(st).HandleOffer(rec, httptest.NewRequest(http.MethodPost, "/api/session/offer", bytes.NewReader(body)))
+	if rec.Code != http.StatusNotAcceptable || !strings.Contains(rec.Body.String(), "no common video codec") {
+		t.Errorf("HandleOffer: %d %s", rec.Code, rec.Body)
+	}
+}
+
+// offerSDP returns an offer with one video payload type, 96, plus its RTX.
+func offerSDP(rtpmap, fmtp string) string {
+	return "v=0\r\no=- 1 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96 97\r\nc=IN IP4 0.0.0.0\r\na=mid:0\r\na=recvonly\r\n" +
+		"a=rtpmap:96 " + rtpmap + "\r\n" + fmtp +
+		"a=rtpmap:97 rtx/90000\r\na=fmtp:97 apt=96\r\n"
+}
+
+func TestOfferedVideo(t *testing.T) {
+	sdp := offerSDP("H264/90000", "a=fmtp:96 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=640C1F\r\n")
+	got, err := offeredVideo(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []offeredCodec{
+		{name: "h264", fmtp: map[string]string{"level-asymmetry-allowed": "1", "packetization-mode": "1", "profile-level-id": "640C1F"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,97 @@
+package webrtcx
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+)
+
+var errOggCapture = errors.New("ogg: bad capture pattern")
+
+// oggReader splits an Ogg stream into packets, reassembling packets that
+// span pages. It assumes a single logical stream, as FFmpeg writes.
+type oggReader struct {
+	r    io.Reader
+	hdr  [27]byte
+	segs [255]byte
+	page []byte
+
+	// the page being consumed
+	lacing  []byte
+	data    []byte
+	arrival time.Time
+	partial []byte
+}
+
+func newOggReader(r io.Reader) *oggReader { return &oggReader{r: r} }
+
+// next returns the next complete packet and when the page that completed it
+// was read. The packet is only valid until the following call.
+func (o *oggReader) next() ([]byte, time.Time, error) {
+	for {
+		for len(o.lacing) > 0 {
+			n, ended := 0, false
+			for len(o.lacing) > 0 {
+				l := int(o.lacing[0])
+				o.lacing = o.lacing[1:]
+				n += l
+				if l < 255 {
+					ended = true
+					break
+				}
+			}
+			if n > len(o.data) {
+				return nil, time.Time{}, io.ErrUnexpectedEOF
+			}
+			seg := o.data[:n]
+			o.data = o.data[n:]
+			if !ended {
+				// continues on the next page
+				o.partial = append(o.partial, seg...)
+				break
+			}
+			if len(o.partial) > 0 {
+				o.partial = append(o.partial, seg...)
+				pkt := o.partial
+				o.partial = o.partial[:0:0]
+				return pkt, o.arrival, nil
+			}
+			return seg, o.arrival, nil
+		}
+		if err := o.readPage(); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+}
+
+func (o *oggReader) readPage() error {
+	if _, err := io.ReadFull(o.r, o.hdr[:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(o.hdr[:4], []byte("OggS")) {
+		return errOggCapture
+	}
+	o.arrival = time.Now()
+	nsegs := int(o.hdr[26])
+	if _, err := io.ReadFull(o.r, o.segs[:nsegs]); err != nil {
+		return err
+	}
+	size := 0
+	for _, l := range o.segs[:nsegs] {
+		size += int(l)
+	}
+	if cap(o.page) < size {
+		o.page = make([]byte, size)
+	}
+	o.page = o.page[:size]
+	if _, err := io.ReadFull(o.r, o.page); err != nil {
+		return err
+	}
+	if o.hdr[5]&0x01 == 0 && len(o.partial) > 0 {
+		// a continued packet whose tail never came
+		o.partial = o.partial[:0]
+	}
+	o.lacing, o.data = o.segs[:nsegs], o.page
+	return nil
+}
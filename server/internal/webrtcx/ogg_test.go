@@ -0,0 +1,126 @@
+package webrtcx
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// appendOggPage appends a page with packets laced into it. If open, the
+// last packet continues on the next page and its length must be a multiple
+// of 255. The header fields the reader ignores are left zero.
+func appendOggPage(dst []byte, continued, open bool, packets ...[]byte) []byte {
+	var lacing, body []byte
+	for i, p := range packets {
+		for n := len(p); n >= 255; n -= 255 {
+			lacing = append(lacing, 255)
+		}
+		if !open || i < len(packets)-1 {
+			lacing = append(lacing, byte(len(p)%255))
+		}
+		body = append(body, p...)
+	}
+	hdr := make([]byte, 27)
+	copy(hdr, "OggS")
+	if continued {
+		hdr[5] = 0x01
+	}
+	hdr[26] = byte(len(lacing))
+	dst = append(dst, hdr...)
+	dst = append(dst, lacing...)
+	return append(dst, body...)
+}
+
+func fill(b byte, n int) []byte { return bytes.Repeat([]byte{b}, n) }
+
+func TestOggReader(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream []byte
+		want   [][]byte
+	}{
+		{
+			name:   "lacing",
+			stream: appendOggPage(nil, false, false, fill(1, 10), fill(2, 255), fill(3, 0), fill(4, 600)),
+			want:   [][]byte{fill(1, 10), fill(2, 255), fill(3, 0), fill(4, 600)},
+		},
+		{
+			name: "packet continued over pages",
+			stream: appendOggPage(appendOggPage(appendOggPage(nil,
+				false, true, fill(1, 20), fill(2, 510)),
+				true, true, fill(2, 255)),
+				true, false, fill(2, 7), fill(3, 30)),
+			want: [][]byte{fill(1, 20), append(fill(2, 765), fill(2, 7)...), fill(3, 30)},
+		},
+		{
+			name: "continued packet whose tail never came",
+			stream: appendOggPage(appendOggPage(nil,
+				false, true, fill(1, 255)),
+				false, false, fill(2, 40)),
+			want: [][]byte{fill(2, 40)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOggReader(bytes.NewReader(tt.stream))
+			for i, want := range tt.want {
+				got, _, err := o.next()
+				if err != nil {
+					t.Fatalf("packet %d: %v", i, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("packet %d: got %d bytes, want %d", i, len(got), len(want))
+				}
+			}
+			if _, _, err := o.next(); err != io.EOF {
+				t.Errorf("after the last packet: err = %v, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestOggReaderErrors(t *testing.T) {
+	page := appendOggPage(nil, false, false, fill(1, 300))
+	bad := append([]byte(nil), page...)
+	copy(bad, "OggX")
+	if _, _, err := newOggReader(bytes.NewReader(bad)).next(); !errors.Is(err, errOggCapture) {
+		t.Errorf("bad capture pattern: err = %v, want %v", err, errOggCapture)
+	}
+	if _, _, err := newOggReader(bytes.NewReader(page[:len(page)-1])).next(); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated page: err = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestOpusSamples(t *testing.T) {
+	tests := []struct {
+		pkt  []byte
+		want int
+	}{
+		{[]byte{0 << 3}, 480},        // SILK 10 ms
+		{[]byte{3 << 3}, 2880},       // SILK 60 ms
+		{[]byte{13 << 3}, 960},       // hybrid 20 ms
+		{[]byte{16 << 3}, 120},       // CELT 2.5 ms
+		{[]byte{31 << 3}, 960},       // CELT 20 ms, the FFmpeg default
+		{[]byte{31<<3 | 1}, 1920},    // two frames
+		{[]byte{31<<3 | 2}, 1920},    // two frames, different sizes
+		{[]byte{31<<3 | 3, 3}, 2880}, // code 3, three frames
+		{[]byte{3<<3 | 3, 2}, 5760},  // 120 ms, the longest allowed
+		{[]byte{3<<3 | 3, 3}, 0},     // 180 ms
+		{[]byte{31<<3 | 3, 0}, 0},    // no frames
+		{[]byte{31<<3 | 3}, 0},       // truncated
+		{nil, 0},
+	}
+	for _, tt := range tests {
+		got, err := opusSamples(tt.pkt)
+		if tt.want == 0 {
+			if err == nil {
+				t.Errorf("opusSamples(% x) = %d, want an error", tt.pkt, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("opusSamples(% x) = %d, %v, want %d", tt.pkt, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package webrtcx
+
+import (
+	"cmp"
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+
+	"pc_cloud/internal/config"
+	"pc_cloud/internal/encoder"
+	"pc_cloud/internal/input"
+)
+
+// resolveStream fills req from the selected profile and then clamps it to
+// the server caps. Fields the client set explicitly win over the profile;
+// caps win over everything. It returns the name of the profile used ("" for
+// the default_* settings).
+func resolveStream(cfg config.Config, req *OfferRequest) (string, error) {
+	p, name, err := cfg.ProfileFor(strings.TrimSpace(req.Profile), req.ClientID)
+	if err != nil {
+		return "", err
+	}
+
+	req.Codec = strings.ToLower(strings.TrimSpace(req.Codec))
+	if req.Codec == "" {
+		req.Codec = p.Codec
+	}
+	if req.Codec == "h265" {
+		req.Codec = "hevc"
+	}
+	switch req.BitDepth {
+	case 0, 8:
+		req.BitDepth = 8
+	case 10:
+		if req.Codec != "hevc" && req.Codec != "av1" && req.Codec != "vp9" {
+			return "", fmt.Errorf("bit_depth 10 needs codec hevc, av1 or vp9, not %s", req.Codec)
+		}
+	default:
+		return "", fmt.Errorf("bit_depth %d is not 8 or 10", req.BitDepth)
+	}
+	req.Chroma = strings.TrimSpace(req.Chroma)
+	if req.Chroma == "" {
+		req.Chroma = p.Chroma
+	}
+	switch req.Chroma {
+	case "", "420":
+		req.Chroma = "420"
+	case "444":
+		if req.BitDepth == 10 {
+			return "", fmt.Errorf("chroma 444 is 8-bit only")
+		}
+	default:
+		return "", fmt.Errorf("chroma %q is not 420 or 444", req.Chroma)
+	}
+	if req.HDR && hostHDR(cfg) {
+		// negotiation drops to 8-bit, and so to tone-mapped SDR, where the
+		// codec or the client can't do 10-bit. HDR wins over 4:4:4.
+		req.BitDepth, req.Chroma = 10, "420"
+	}
+	if req.FPS <= 0 {
+		req.FPS = p.FPS
+	}
+	if req.Width <= 0 || req.Height <= 0 {
+		req.Width, req.Height = p.Width, p.Height
+	}
+	req.Preset = strings.ToLower(strings.TrimSpace(req.Preset))
+	if req.Preset == "" {
+		req.Preset = p.Preset
+	}
+	if req.Bitrate == "" {
+		req.Bitrate = p.Bitrate
+	}
+	req.Latency = strings.ToLower(strings.TrimSpace(req.Latency))
+	if req.Latency == "" {
+		req.Latency = cmp.Or(p.Latency, cfg.DefaultLatency)
+	}
+	if !slices.Contains(encoder.LatencyModes, req.Latency) {
+		return "", fmt.Errorf("latency %q is not one of %s", req.Latency, strings.Join(encoder.LatencyModes, ", "))
+	}
+	if req.IntraRefresh == nil {
+		req.IntraRefresh = p.IntraRefresh
+	}
+
+	applyCaps(cfg.Caps, req)
+	return name, nil
+}
+
+// hdrCapture is whether capture can deliver an HDR desktop, which only the
+// Windows one can. Tests set it.
+var hdrCapture = runtime.GOOS == "windows"
+
+// hostHDR reports whether the captured desktop is HDR.
+func hostHDR(cfg config.Config) bool {
+	return cfg.HDR && hdrCapture
+}
+
+// hdrTransfer returns the transfer function the stream for the negotiated
+// req is sent with, or "" for SDR: HDR needs an HDR desktop, a client that
+// asked for it and 10-bit HEVC or AV1.
+func hdrTransfer(cfg config.Config, req OfferRequest) string {
+	if !req.HDR || !hostHDR(cfg) || req.BitDepth != 10 || (req.Codec != "hevc" && req.Codec != "av1") {
+		return ""
+	}
+	return cfg.HDRTransfer
+}
+
+func applyCaps(caps config.Caps, req *OfferRequest) {
+	if caps.MaxFPS > 0 && req.FPS > caps.MaxFPS {
+		req.FPS = caps.MaxFPS
+	}
+	if caps.MaxBitrate != "" {
+		limit, _ := config.ParseBitrate(caps.MaxBitrate)
+		if br, err := config.ParseBitrate(req.Bitrate); err != nil || br > limit {
+			req.Bitrate = caps.MaxBitrate
+		}
+	}
+	if caps.MaxWidth <= 0 && caps.MaxHeight <= 0 {
+		return
+	}
+	w, h := req.Width, req.Height
+	if w <= 0 || h <= 0 {
+		// native capture still has to respect the caps
+		w, h = input.ScreenSize()
+	}
+	req.Width, req.Height = fitWithin(w, h, caps.MaxWidth, caps.MaxHeight)
+}
+
+// fitWithin scales w x h down, keeping the aspect ratio, until it fits in
+// maxW x maxH (0 = unbounded). The result is rounded to even dimensions.
+func fitWithin(w, h, maxW, maxH int) (int, int) {
+	if w <= 0 || h <= 0 {
+		return w, h
+	}
+	scale := 1.0
+	if maxW > 0 && w > maxW {
+		scale = float64(maxW) / float64(w)
+	}
+	if maxH > 0 && float64(h)*scale > float64(maxH) {
+		scale = float64(maxH) / float64(h)
+	}
+	if scale == 1.0 {
+		return w, h
+	}
+	return int(float64(w)*scale) &^ 1, int(float64(h)*scale) &^ 1
+}
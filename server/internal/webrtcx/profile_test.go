@@ -0,0 +1,263 @@
+package webrtcx
+
+import (
+	"strings"
+	"testing"
+
+	"pc_cloud/internal/config"
+	"pc_cloud/internal/encoder"
+)
+
+func testConfig() config.Config {
+	cfg := config.Defaults()
+	cfg.ClientProfiles = map[string]string{"tv": "lan-4k60", "stale": "gone"}
+	return cfg
+}
+
+func TestResolveStreamProfile(t *testing.T) {
+	tests := []struct {
+		name        string
+		defProfile  string
+		req         OfferRequest
+		wantProfile string
+		want        OfferRequest // only the stream fields are compared
+	}{
+		{
+			name:        "named profile",
+			req:         OfferRequest{Profile: "mobile-720p"},
+			wantProfile: "mobile-720p",
+			want:        OfferRequest{Codec: "h264", FPS: 30, Width: 1280, Height: 720, Bitrate: "6M"},
+		},
+		{
+			name:        "client default",
+			req:         OfferRequest{ClientID: "tv"},
+			wantProfile: "lan-4k60",
+			want:        OfferRequest{Codec: "hevc", FPS: 60, Width: 3840, Height: 2160, Bitrate: "80M"},
+		},
+		{
+			name:        "named profile wins over the client's",
+			req:         OfferRequest{Profile: "wifi-1080p", ClientID: "tv"},
+			wantProfile: "wifi-1080p",
+			want:        OfferRequest{Codec: "h264", FPS: 60, Width: 1920, Height: 1080, Bitrate: encoder.DefaultBitrate},
+		},
+		{
+			name:        "client profile that no longer exists falls back to default_profile",
+			defProfile:  "mobile-720p",
+			req:         OfferRequest{ClientID: "stale"},
+			wantProfile: "mobile-720p",
+			want:        OfferRequest{Codec: "h264", FPS: 30, Width: 1280, Height: 720, Bitrate: "6M"},
+		},
+		{
+			name: "default stream",
+			req:  OfferRequest{ClientID: "unknown"},
+			want: OfferRequest{Codec: "h264", FPS: encoder.DefaultFPS, Bitrate: encoder.DefaultBitrate},
+		},
+		{
+			name:        "explicit fields win over the profile",
+			req:         OfferRequest{Profile: "lan-4k60", Codec: "H265", FPS: 120, Width: 2560, Height: 1440, Bitrate: "50M"},
+			wantProfile: "lan-4k60",
+			want:        OfferRequest{Codec: "hevc", FPS: 120, Width: 2560, Height: 1440, Bitrate: "50M"},
+		},
+		{
+			name:        "half a resolution takes the profile's",
+			req:         OfferRequest{Profile: "mobile-720p", Width: 1920},
+			wantProfile: "mobile-720p",
+			want:        OfferRequest{Codec: "h264", FPS: 30, Width: 1280, Height: 720, Bitrate: "6M"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DefaultProfile = tt.defProfile
+			req := tt.req
+			name, err := resolveStream(cfg, &req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != tt.wantProfile {
+				t.Errorf("profile = %q, want %q", name, tt.wantProfile)
+			}
+			got := OfferRequest{Codec: req.Codec, FPS: req.FPS, Width: req.Width, Height: req.Height, Bitrate: req.Bitrate}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveIntraRefresh(t *testing.T) {
+	on, off := true, false
+	tests := []struct {
+		name    string
+		profile *bool
+		req     *bool
+		want    *bool
+	}{
+		{"unset", nil, nil, nil},
+		{"from the profile", &off, nil, &off},
+		{"request wins", &off, &on, &on},
+		{"request opts out", &on, &off, &off},
+	}
+	for _, tt := range tests {
+		cfg := testConfig()
+		p := cfg.Profiles["wifi-1080p"]
+		p.IntraRefresh = tt.profile
+		cfg.Profiles["wifi-1080p"] = p
+		req := OfferRequest{Profile: "wifi-1080p", IntraRefresh: tt.req}
+		if _, err := resolveStream(cfg, &req); err != nil {
+			t.Fatal(err)
+		}
+		if (req.IntraRefresh == nil) != (tt.want == nil) || (tt.want != nil && *req.IntraRefresh != *tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, req.IntraRefresh, tt.want)
+		}
+	}
+}
+
+func TestResolveStreamErrors(t *testing.T) {
+	tests := []struct {
+		req  OfferRequest
+		want string
+	}{
+		{OfferRequest{Profile: "nope"}, "unknown profile"},
+		{OfferRequest{Codec: "h264", BitDepth: 10}, "bit_depth 10 needs"},
+		{OfferRequest{Codec: "hevc", BitDepth: 12}, "is not 8 or 10"},
+		{OfferRequest{Codec: "hevc", BitDepth: 10, Chroma: "444"}, "8-bit only"},
+		{OfferRequest{Chroma: "422"}, "is not 420 or 444"},
+		{OfferRequest{Latency: "instant"}, "latency"},
+	}
+	for _, tt := range tests {
+		req := tt.req
+		if _, err := resolveStream(testConfig(), &req); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%+v: err = %v, want %q", tt.req, err, tt.want)
+		}
+	}
+}
+
+func TestApplyCaps(t *testing.T) {
+	tests := []struct {
+		name string
+		caps config.Caps
+		req  OfferRequest
+		want OfferRequest
+	}{
+		{"no caps", config.Caps{},
+			OfferRequest{FPS: 144, Width: 3840, Height: 2160, Bitrate: "100M"},
+			OfferRequest{FPS: 144, Width: 3840, Height: 2160, Bitrate: "100M"}},
+		{"fps", config.Caps{MaxFPS: 60},
+			OfferRequest{FPS: 144, Width: 1920, Height: 1080, Bitrate: "20M"},
+			OfferRequest{FPS: 60, Width: 1920, Height: 1080, Bitrate: "20M"}},
+		{"bitrate above the cap", config.Caps{MaxBitrate: "30M"},
+			OfferRequest{FPS: 60, Width: 1920, Height: 1080, Bitrate: "50M"},
+			OfferRequest{FPS: 60, Width: 1920, Height: 1080, Bitrate: "30M"}},
+		{"bitrate below the cap", config.Caps{MaxBitrate: "30M"},
+			OfferRequest{FPS: 60, Width: 1920, Height: 1080, Bitrate: "8000k"},
+			OfferRequest{FPS: 60, Width: 1920, Height: 1080, Bitrate: "8000k"}},
+		{"unparsable bitrate takes the cap", config.Caps{MaxBitrate: "30M"},
+			OfferRequest{FPS: 60, Width: 1920, Height: 1080, Bitrate: "fast"},
+			OfferRequest{FPS: 60, Width: 1920, Height: 1080, Bitrate: "30M"}},
+		{"resolution", config.Caps{MaxWidth: 1920, MaxHeight: 1080},
+			OfferRequest{FPS: 60, Width: 3840, Height: 2160, Bitrate: "20M"},
+			OfferRequest{FPS: 60, Width: 1920, Height: 1080, Bitrate: "20M"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			applyCaps(tt.caps, &req)
+			if req != tt.want {
+				t.Errorf("got %+v, want %+v", req, tt.want)
+			}
+		})
+	}
+}
+
+func TestFitWithin(t *testing.T) {
+	tests := []struct {
+		w, h, maxW, maxH int
+		wantW, wantH     int
+	}{
+		{1920, 1080, 0, 0, 1920, 1080},
+		{1920, 1080, 3840, 2160, 1920, 1080},
+		{3840, 2160, 1920, 0, 1920, 1080},
+		{3840, 2160, 0, 720, 1280, 720},
+		// ultrawide: the width limit is the tighter one
+		{3440, 1440, 1920, 1080, 1920, 802},
+		// portrait: the height limit is
+		{1080, 1920, 1920, 1080, 606, 1080},
+		// odd sizes are rounded down to even
+		{1001, 1001, 500, 0, 500, 500},
+		{1366, 768, 1365, 0, 1364, 766},
+		{0, 0, 1920, 1080, 0, 0},
+	}
+	for _, tt := range tests {
+		w, h := fitWithin(tt.w, tt.h, tt.maxW, tt.maxH)
+		if w != tt.wantW || h != tt.wantH {
+			t.Errorf("fitWithin(%d, %d, %d, %d) = %dx%d, want %dx%d", tt.w, tt.h, tt.maxW, tt.maxH, w, h, tt.wantW, tt.wantH)
+		}
+	}
+}
+
+func TestHDRStream(t *testing.T) {
+	defer func(v bool) { hdrCapture = v }(hdrCapture)
+	hevc := []offeredCodec{{name: "h265", fmtp: map[string]string{"profile-id": "1"}}, {name: "h265", fmtp: map[string]string{"profile-id": "2"}}}
+	hevcMain := hevc[:1]
+	h264 := []offeredCodec{h264Offer("64001f", "1")}
+	tests := []struct {
+		name         string
+		capture      bool // HDR desktop on a host that can capture it
+		transfer     string
+		req          OfferRequest
+		offered      []offeredCodec
+		wantDepth    int
+		wantProfile  string
+		wantHDR      string
+		wantChroma   string
+		resolveDepth int // after resolveStream
+	}{
+		{"hevc main10 pq", true, "pq", OfferRequest{Codec: "hevc", HDR: true}, hevc, 10, "main10", "pq", "420", 10},
+		{"hlg", true, "hlg", OfferRequest{Codec: "hevc", HDR: true}, hevc, 10, "main10", "hlg", "420", 10},
+		{"hdr wins over 4:4:4", true, "pq", OfferRequest{Codec: "hevc", HDR: true, Chroma: "444"}, hevc, 10, "main10", "pq", "420", 10},
+		{"client without main10 gets tone-mapped sdr", true, "pq", OfferRequest{Codec: "hevc", HDR: true}, hevcMain, 8, "", "", "420", 10},
+		{"h264 can't carry it", true, "pq", OfferRequest{Codec: "h264", HDR: true}, h264, 8, "high", "", "420", 10},
+		{"sdr desktop", false, "pq", OfferRequest{Codec: "hevc", HDR: true}, hevc, 8, "", "", "420", 8},
+		{"client did not ask", true, "pq", OfferRequest{Codec: "hevc"}, hevc, 8, "", "", "420", 8},
+		{"10-bit sdr", true, "pq", OfferRequest{Codec: "hevc", BitDepth: 10}, hevc, 10, "main10", "", "420", 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hdrCapture = true
+			cfg := testConfig()
+			cfg.HDR, cfg.HDRTransfer = tt.capture, tt.transfer
+			req := tt.req
+			if _, err := resolveStream(cfg, &req); err != nil {
+				t.Fatal(err)
+			}
+			if req.BitDepth != tt.resolveDepth {
+				t.Errorf("resolved bit depth = %d, want %d", req.BitDepth, tt.resolveDepth)
+			}
+			choice, err := negotiateCodec(tt.offered, []string{req.Codec}, []string{"h264", "hevc"}, req.BitDepth, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.BitDepth, req.Chroma = choice.bitDepth, choice.chroma
+			if choice.bitDepth != tt.wantDepth || choice.profile != tt.wantProfile || choice.chroma != tt.wantChroma {
+				t.Errorf("negotiated %d-bit %q %s, want %d-bit %q %s", choice.bitDepth, choice.profile, choice.chroma,
+					tt.wantDepth, tt.wantProfile, tt.wantChroma)
+			}
+			if hdr := hdrTransfer(cfg, req); hdr != tt.wantHDR {
+				t.Errorf("hdrTransfer = %q, want %q", hdr, tt.wantHDR)
+			}
+		})
+	}
+
+	// HDR needs a host that can capture it, whatever the config says
+	hdrCapture = false
+	cfg := testConfig()
+	cfg.HDR = true
+	req := OfferRequest{Codec: "hevc", HDR: true}
+	if _, err := resolveStream(cfg, &req); err != nil || req.BitDepth != 8 {
+		t.Errorf("without HDR capture: bit depth %d, err %v", req.BitDepth, err)
+	}
+	if hdr := hdrTransfer(cfg, OfferRequest{Codec: "hevc", HDR: true, BitDepth: 10}); hdr != "" {
+		t.Errorf("without HDR capture: hdrTransfer = %q", hdr)
+	}
+}
@@ -0,0 +1,198 @@
+package webrtcx
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+
+	"pc_cloud/internal/bitstream"
+	"pc_cloud/internal/metrics"
+)
+
+// The pump benchmarks count one op per frame written, so allocs/op is
+// allocations per frame. Frames go through a live videoSink, so the RTP
+// packetization is included; the track has no peer bound, so SRTP and the
+// socket are not. p99-ns is the time from a frame's first byte being read
+// to its write call returning.
+
+const benchGOP = 60
+
+func BenchmarkPumpH264(b *testing.B) {
+	sps, _ := hex.DecodeString("6764002aacd940780227e5c044000003000400000300f03c60c658")
+	pps := []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+	rng := rand.New(rand.NewSource(1))
+	var ts []byte
+	for i := 0; i < benchGOP; i++ {
+		var au []byte
+		if i == 0 {
+			au = appendAnnexB(au, [][]byte{{0x09, 0xf0}, sps, pps, benchNAL(rng, 0x65, 60<<10)})
+		} else {
+			au = appendAnnexB(au, [][]byte{{0x09, 0xf0}, benchNAL(rng, 0x41, 8<<10)})
+		}
+		ts = appendTSPES(ts, au, int64(i)*1500)
+	}
+	ms := metrics.NewStream("bench", "h264")
+	defer ms.Close()
+	runPumpBench(b, "h264", tsPreamble(), ts, func(r io.Reader, w sampleWriter) {
+		pumpAnnexBToTrack(context.Background(), r, w, ms, bitstream.H264)
+	})
+}
+
+func BenchmarkPumpAV1(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	var ivf []byte
+	for i := 0; i < benchGOP; i++ {
+		frame := benchOBU(rng, 0x30, 8<<10) // shown inter frame
+		if i == 0 {
+			frame = benchOBU(rng, 0x10, 60<<10) // shown key frame
+		}
+		tu := append([]byte{0x12, 0x00}, frame...) // after a temporal delimiter
+		ivf = binary.LittleEndian.AppendUint32(ivf, uint32(len(tu)))
+		ivf = binary.LittleEndian.AppendUint64(ivf, uint64(i))
+		ivf = append(ivf, tu...)
+	}
+	hdr := make([]byte, 32)
+	copy(hdr, "DKIF")
+	binary.LittleEndian.PutUint16(hdr[6:], 32)
+	copy(hdr[8:], "AV01")
+	binary.LittleEndian.PutUint32(hdr[16:], 60)
+	binary.LittleEndian.PutUint32(hdr[20:], 1)
+	ms := metrics.NewStream("bench", "av1")
+	defer ms.Close()
+	runPumpBench(b, "av1", hdr, ivf, func(r io.Reader, w sampleWriter) {
+		pumpAV1IVFToTrack(context.Background(), r, w, ms)
+	})
+}
+
+// runPumpBench feeds head followed by body repeated until b.N frames were
+// written to a sink for codec.
+func runPumpBench(b *testing.B, codec string, head, body []byte, pump func(io.Reader, sampleWriter)) {
+	ms := metrics.NewStream("bench-sink", codec)
+	defer ms.Close()
+	out := newVideoOutput(newMediaClock().track(videoClockRate), ms, &frameCounters{}, nil)
+	w := &benchWriter{sink: out.sink(testTrack(b, codec), codec), lat: make([]time.Duration, 0, b.N)}
+	r := &loopReader{head: head, body: body, done: func() bool { return len(w.lat) >= b.N }}
+	b.SetBytes(int64(len(body) / benchGOP))
+	b.ReportAllocs()
+	b.ResetTimer()
+	pump(r, w)
+	b.StopTimer()
+	slices.Sort(w.lat)
+	if len(w.lat) > 0 {
+		b.ReportMetric(float64(w.lat[len(w.lat)*99/100]), "p99-ns")
+	}
+}
+
+// benchWriter passes frames on to sink and records how long each took.
+type benchWriter struct {
+	sink *videoSink
+	lat  []time.Duration
+}
+
+func (w *benchWriter) write(payload []byte, pts int64, start time.Time) {
+	w.sink.write(payload, pts, start)
+	if len(w.lat) < cap(w.lat) {
+		w.lat = append(w.lat, time.Since(start))
+	}
+}
+
+type loopReader struct {
+	head, body []byte
+	off        int
+	done       func() bool
+}
+
+func (r *loopReader) Read(p []byte) (int, error) {
+	if len(r.head) > 0 {
+		n := copy(p, r.head)
+		r.head = r.head[n:]
+		return n, nil
+	}
+	if r.done() {
+		return 0, io.EOF
+	}
+	n := copy(p, r.body[r.off:])
+	r.off = (r.off + n) % len(r.body)
+	return n, nil
+}
+
+// benchNAL returns a NAL unit of size bytes with header hdr and a payload
+// that contains no start codes.
+func benchNAL(rng *rand.Rand, hdr byte, size int) []byte {
+	nal := make([]byte, size)
+	rng.Read(nal)
+	nal[0], nal[1] = hdr, 0x88 // first_mb_in_slice = 0
+	for i := 2; i < size; i++ {
+		nal[i] |= 1
+	}
+	return nal
+}
+
+// benchOBU returns an OBU_FRAME with a size field whose payload of size
+// bytes starts with hdr.
+func benchOBU(rng *rand.Rand, hdr byte, size int) []byte {
+	payload := make([]byte, size)
+	rng.Read(payload)
+	payload[0] = hdr
+	o := bitstream.OBU{OBUHeader: bitstream.OBUHeader{Type: bitstream.OBUFrame, Len: 1, Size: -1},
+		Raw: append([]byte{0x30}, payload...), Payload: payload}
+	return bitstream.AppendOBU(nil, o)
+}
+
+const (
+	benchPMTPID   = 0x1000
+	benchVideoPID = 0x100
+)
+
+// tsPreamble returns a PAT and a PMT with one H.264 stream. The demuxer
+// ignores CRCs, so they are left zero.
+func tsPreamble() []byte {
+	pat := []byte{0x00, 0x00, 0xb0, 0x0d, 0x00, 0x01, 0xc1, 0x00, 0x00,
+		0x00, 0x01, 0xe0 | benchPMTPID>>8, benchPMTPID & 0xff, 0, 0, 0, 0}
+	pmt := []byte{0x00, 0x02, 0xb0, 0x12, 0x00, 0x01, 0xc1, 0x00, 0x00,
+		0xe0 | benchVideoPID>>8, benchVideoPID & 0xff, 0xf0, 0x00,
+		0x1b, 0xe0 | benchVideoPID>>8, benchVideoPID & 0xff, 0xf0, 0x00, 0, 0, 0, 0}
+	out := appendTSPackets(nil, 0, pat)
+	return appendTSPackets(out, benchPMTPID, pmt)
+}
+
+// appendTSPES appends es as one unbounded PES packet with a PTS, the way
+// FFmpeg muxes video.
+func appendTSPES(dst, es []byte, pts int64) []byte {
+	pes := []byte{0x00, 0x00, 0x01, 0xe0, 0x00, 0x00, 0x80, 0x80, 0x05,
+		0x21 | byte(pts>>29)&0x0e, byte(pts >> 22), 0x01 | byte(pts>>14),
+		byte(pts >> 7), 0x01 | byte(pts<<1)}
+	return appendTSPackets(dst, benchVideoPID, append(pes, es...))
+}
+
+// appendTSPackets splits payload into TS packets on pid, padding the last
+// one with an adaptation field.
+func appendTSPackets(dst []byte, pid int, payload []byte) []byte {
+	for first := true; len(payload) > 0; first = false {
+		var pkt [tsPacketSize]byte
+		pkt[0], pkt[1], pkt[2], pkt[3] = 0x47, byte(pid>>8), byte(pid), 0x10
+		if first {
+			pkt[1] |= 0x40
+		}
+		body := pkt[4:]
+		if n := len(payload); n < len(body) {
+			pkt[3] |= 0x20
+			stuff := len(body) - n - 1
+			body[0] = byte(stuff)
+			if stuff > 0 {
+				body[1] = 0x00
+				copy(body[2:], bytes.Repeat([]byte{0xff}, stuff-1))
+			}
+			body = body[1+stuff:]
+		}
+		payload = payload[copy(body, payload):]
+		dst = append(dst, pkt[:]...)
+	}
+	return dst
+}
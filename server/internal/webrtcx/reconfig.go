@@ -0,0 +1,285 @@
+package webrtcx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+
+	"pc_cloud/internal/config"
+	"pc_cloud/internal/encoder"
+)
+
+// how long a reconfiguration waits for the new encoder's first keyframe
+// before it gives up and keeps the old one; a var for the tests
+var switchTimeout = 10 * time.Second
+
+var (
+	errBadChange = errors.New("invalid change")
+	// the host can't encode the codec or the client did not offer it; the
+	// session's MediaEngine is fixed, so no renegotiation can add it
+	errCodecUnavailable = errors.New("codec not available in this session")
+)
+
+// StreamChange is a request to change a running session's video. Zero
+// values leave a setting as it is. Any change, bitrate and frame rate
+// included, runs a second capture and encode process next to the first
+// until the switch, so it costs a new encoder's start-up (usually well
+// under a second, up to switchTimeout) and, for that long, twice the
+// capture and encode load on the host and a second NVENC session. There
+// is never more than one extra: the host streams one session at a time
+// and its changes are made one after another.
+//
+// Bitrate and frame rate are not changed in place. NVENC could take a new
+// bitrate without a restart, but only through its own API on a live
+// encoder session; the FFmpeg command line has no way to reach a running
+// encoder, and frame rate is fixed by the capture.
+type StreamChange struct {
+	Codec   string `json:"codec,omitempty"`   // h264|hevc|av1|vp9|vp8, from those the client offered
+	FPS     int    `json:"fps,omitempty"`     // e.g. 60
+	Width   int    `json:"width,omitempty"`   // with height
+	Height  int    `json:"height,omitempty"`  // with width
+	Native  bool   `json:"native,omitempty"`  // back to the desktop resolution
+	Bitrate string `json:"bitrate,omitempty"` // e.g. "25M"
+}
+
+// StreamState is the video a session sends.
+type StreamState struct {
+	Codec        string `json:"codec"`
+	BitDepth     int    `json:"bit_depth"`
+	Chroma       string `json:"chroma"`
+	HDR          string `json:"hdr,omitempty"`
+	FPS          int    `json:"fps"`
+	Width        int    `json:"width,omitempty"`  // 0 = native
+	Height       int    `json:"height,omitempty"` // 0 = native
+	Bitrate      string `json:"bitrate"`
+	IntraRefresh bool   `json:"intra_refresh,omitempty"`
+}
+
+// configureMsg is a StreamChange sent by the client on the "control"
+// DataChannel; the answer is a "configured" controlMsg with the same id.
+type configureMsg struct {
+	Type string `json:"type"` // "configure"
+	ID   int    `json:"id"`
+	StreamChange
+}
+
+// videoEncoder is one generation of a session's video: the encoder, its
+// settings and the sink it writes to. A reconfiguration replaces it.
+type videoEncoder struct {
+	params       encoder.Params
+	intraRefresh bool // keyframes only on request, see requestKeyframe
+	sup          *encoderSupervisor
+	sink         *videoSink
+	cancel       context.CancelFunc
+}
+
+// stop ends the encoder without waiting for it.
+func (v *videoEncoder) stop() {
+	v.cancel()
+	go v.sup.wait()
+}
+
+func (s *Session) currentVideo() *videoEncoder {
+	s.videoMu.Lock()
+	defer s.videoMu.Unlock()
+	return s.video
+}
+
+// startVideo starts an encoder for p that writes to track through the
+// session's video output. Only the current generation may end the session
+// or tell the client about restarts.
+func (m *Manager) startVideo(sess *Session, cfg config.Config, p encoder.Params, track *webrtc.TrackLocalStaticRTP) (*videoEncoder, error) {
+	ctx, cancel := context.WithCancel(sess.ctx)
+	v := &videoEncoder{
+		params:       p,
+		intraRefresh: encoder.UsesIntraRefresh(sess.caps, p),
+		sink:         sess.videoOut.sink(track, p.Codec),
+		cancel:       cancel,
+	}
+	v.sup = &encoderSupervisor{
+		track: "video",
+		build: func(ctx context.Context) (*exec.Cmd, string) {
+			return encoder.BuildFFmpegPipeCmd(ctx, p)
+		},
+		pump:        v.sink.pump,
+		ms:          sess.metrics,
+		maxRestarts: cfg.EncoderMaxRestarts,
+		log:         encoderLog.With("codec", p.Codec, "session", sess.id),
+		notify: func(msg controlMsg) {
+			if sess.currentVideo() == v {
+				sess.control.send(msg)
+			}
+		},
+		onGiveUp: func() {
+			if sess.currentVideo() == v {
+				m.endSession(sess, reasonEncoderFailed)
+			}
+		},
+	}
+	if err := v.sup.start(ctx); err != nil {
+		cancel()
+		sess.videoOut.drop(v.sink)
+		return nil, err
+	}
+	return v, nil
+}
+
+// reconfigure applies c to the running session. FFmpeg can't change any
+// setting of a running encoder, so every change, bitrate and frame rate
+// included, starts a second encoder with the new settings next to the old
+// one and switches to it with its first keyframe: the client sees no gap,
+// and audio and input are not touched. A codec change switches the
+// sender's track too, to another codec the answer already negotiated. If
+// the new encoder fails or sends no keyframe in time, the old one carries
+// on and the error is returned.
+func (m *Manager) reconfigure(sess *Session, c StreamChange) (StreamState, error) {
+	sess.reconfig.Lock()
+	defer sess.reconfig.Unlock()
+	cfg := m.cfg.Get()
+
+	want := sess.want
+	if c.Codec != "" {
+		want.Codec = strings.ToLower(strings.TrimSpace(c.Codec))
+		if want.Codec == "h265" {
+			want.Codec = "hevc"
+		}
+	}
+	if c.FPS < 0 {
+		return StreamState{}, fmt.Errorf("%w: fps %d", errBadChange, c.FPS)
+	}
+	if c.FPS > 0 {
+		want.FPS = c.FPS
+	}
+	switch {
+	case c.Native:
+		want.Width, want.Height = 0, 0
+	case c.Width > 0 && c.Height > 0:
+		want.Width, want.Height = c.Width&^1, c.Height&^1
+	case c.Width != 0 || c.Height != 0:
+		return StreamState{}, fmt.Errorf("%w: width and height are set together", errBadChange)
+	}
+	if c.Bitrate != "" {
+		if _, err := encoder.ParseBitrate(c.Bitrate); err != nil {
+			return StreamState{}, fmt.Errorf("%w: %v", errBadChange, err)
+		}
+		want.Bitrate = c.Bitrate
+	}
+	applyCaps(cfg.Caps, &want)
+
+	cur := sess.currentVideo()
+	p := cur.params
+	p.FPS, p.Width, p.Height, p.Bitrate = want.FPS, want.Width, want.Height, want.Bitrate
+	track := cur.sink.track
+	if want.Codec != cur.params.Codec {
+		var full []string
+		if want.Chroma == "444" && encoder.Chroma444(sess.caps, want.Codec) {
+			full = []string{want.Codec}
+		}
+		choice, err := negotiateCodec(sess.offered, []string{want.Codec}, sess.caps.Codecs, want.BitDepth, full)
+		if err != nil {
+			return StreamState{}, fmt.Errorf("%w: %s", errCodecUnavailable, want.Codec)
+		}
+		neg := want
+		neg.BitDepth, neg.Chroma = choice.bitDepth, choice.chroma
+		p.Codec, p.BitDepth, p.Chroma, p.Profile, p.HDR = choice.codec, choice.bitDepth, choice.chroma, choice.profile, hdrTransfer(cfg, neg)
+		if track, err = webrtc.NewTrackLocalStaticRTP(choice.track, "video", "pccloud"); err != nil {
+			return StreamState{}, err
+		}
+	}
+	if p == cur.params {
+		sess.want = want
+		return sess.streamState(), nil
+	}
+
+	started := time.Now()
+	next, err := m.startVideo(sess, cfg, p, track)
+	if err != nil {
+		return StreamState{}, fmt.Errorf("starting encoder: %w", err)
+	}
+	select {
+	case err = <-next.sink.live:
+	case <-time.After(switchTimeout):
+		err = fmt.Errorf("no keyframe from the new encoder within %s", switchTimeout)
+	case <-sess.ctx.Done():
+		err = sess.ctx.Err()
+	}
+	if err != nil && sess.videoOut.drop(next.sink) {
+		next.stop()
+		encoderLog.Warn("reconfiguration failed, keeping the running encoder", "session", sess.id, "err", err)
+		return StreamState{}, err
+	}
+
+	sess.videoMu.Lock()
+	sess.video = next
+	sess.videoMu.Unlock()
+	cur.stop()
+	sess.metrics.SetCodec(p.Codec)
+	sess.want = want
+	encoderLog.Info("stream reconfigured", "session", sess.id, "codec", p.Codec, "bit_depth", p.BitDepth, "chroma", p.Chroma,
+		"fps", p.FPS, "width", p.Width, "height", p.Height, "bitrate", p.Bitrate, "switch_ms", time.Since(started).Milliseconds())
+	state := sess.streamState()
+	sess.control.send(controlMsg{Type: "stream", Stream: &state})
+	return state, nil
+}
+
+func (s *Session) streamState() StreamState {
+	v := s.currentVideo()
+	p := v.params
+	return StreamState{Codec: p.Codec, BitDepth: p.BitDepth, Chroma: p.Chroma, HDR: p.HDR, FPS: p.FPS,
+		Width: p.Width, Height: p.Height, Bitrate: p.Bitrate, IntraRefresh: v.intraRefresh}
+}
+
+// HandleConfig serves POST /api/session/{id}/config, which changes the
+// video of a running session (see reconfigure) and returns what it sends
+// now. It answers once the new encoder has taken over, as each change
+// starts a second capture and encode process (see StreamChange). The
+// client also gets the new state on its "control" DataChannel.
+func (m *Manager) HandleConfig(w http.ResponseWriter, r *http.Request) {
+	sess := m.session(r.PathValue("id"))
+	if sess == nil {
+		writeJSONError(w, http.StatusNotFound, "no such session")
+		return
+	}
+	var req StreamChange
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad json: "+err.Error())
+		return
+	}
+	state, err := m.reconfigure(sess, req)
+	switch {
+	case errors.Is(err, errBadChange):
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	case errors.Is(err, errCodecUnavailable):
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(state)
+}
+
+// handleControl handles a message from the client on the "control"
+// DataChannel.
+func (m *Manager) handleControl(sess *Session, data []byte) {
+	var msg configureMsg
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "configure" {
+		return
+	}
+	reply := controlMsg{Type: "configured", ID: msg.ID}
+	if state, err := m.reconfigure(sess, msg.StreamChange); err != nil {
+		reply.Error = err.Error()
+	} else {
+		reply.Stream = &state
+	}
+	sess.control.send(reply)
+}
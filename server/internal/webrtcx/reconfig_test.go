@@ -0,0 +1,89 @@
+package webrtcx
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"pc_cloud/internal/config"
+	"pc_cloud/internal/encoder"
+	"pc_cloud/internal/metrics"
+)
+
+// testSession returns a session sending h264 at 10M through an encoder
+// that is never started, and a Manager to reconfigure it. New encoders
+// are copies of the test binary that send nothing.
+func testSession(t *testing.T) (*Manager, *Session) {
+	st, err := config.Load([]string{"-config", filepath.Join(t.TempDir(), "config.yaml")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// probed before FFmpeg is faked: with none on PATH every codec counts
+	caps := encoder.ProbeCapabilities("")
+	t.Setenv("FAKE_FFMPEG", "1")
+
+	ms := metrics.NewStream("test", "h264")
+	t.Cleanup(ms.Close)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	sess := &Session{
+		id:      "test",
+		metrics: ms,
+		ctx:     ctx,
+		cancel:  cancel,
+		caps:    caps,
+		want:    OfferRequest{Codec: "h264", FPS: 60, Bitrate: "10M"},
+	}
+	sess.videoOut = newVideoOutput(newMediaClock().track(videoClockRate), ms, &sess.stats.counts, nil)
+	sess.video = &videoEncoder{
+		params: encoder.Params{Codec: "h264", FPS: 60, Bitrate: "10M", FFmpegPath: os.Args[0]},
+		sink:   sess.videoOut.sink(testTrack(t, "h264"), "h264"),
+		cancel: func() {},
+	}
+	return New(st), sess
+}
+
+func TestReconfigureUnchanged(t *testing.T) {
+	m, sess := testSession(t)
+	cur := sess.video
+	state, err := m.reconfigure(sess, StreamChange{Bitrate: "10M", FPS: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.currentVideo() != cur || state.Bitrate != "10M" || state.FPS != 60 {
+		t.Errorf("got %+v, want the running encoder kept", state)
+	}
+	sess.videoOut.mu.Lock()
+	defer sess.videoOut.mu.Unlock()
+	if sess.videoOut.pending != nil {
+		t.Error("an encoder was started for no change")
+	}
+}
+
+// TestReconfigureTimeout has the new encoder send no keyframe: the
+// running one carries on as if nothing was asked.
+func TestReconfigureTimeout(t *testing.T) {
+	m, sess := testSession(t)
+	defer func(d time.Duration) { switchTimeout = d }(switchTimeout)
+	switchTimeout = 200 * time.Millisecond
+	cur := sess.video
+
+	_, err := m.reconfigure(sess, StreamChange{Bitrate: "5M"})
+	if err == nil || !strings.Contains(err.Error(), "no keyframe") {
+		t.Fatalf("got %v, want the switch to time out", err)
+	}
+	if sess.currentVideo() != cur {
+		t.Error("the running encoder was replaced")
+	}
+	if sess.want.Bitrate != "10M" {
+		t.Errorf("want.Bitrate = %q, want it unchanged", sess.want.Bitrate)
+	}
+	sess.videoOut.mu.Lock()
+	defer sess.videoOut.mu.Unlock()
+	if sess.videoOut.live != cur.sink || sess.videoOut.pending != nil {
+		t.Error("the new encoder's sink is still pending or went live")
+	}
+}
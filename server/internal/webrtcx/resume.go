@@ -0,0 +1,60 @@
+package webrtcx
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// ResumeRequest is an ICE-restart offer for a PeerConnection the client
+// already has.
+type ResumeRequest struct {
+	SDP  string `json:"sdp"`
+	Type string `json:"type"`
+}
+
+// HandleResume serves POST /api/session/{id}/resume. After a network
+// change the client re-offers with ICE restart and the running session is
+// renegotiated in place, so the encoder and input state survive. 410 Gone
+// tells the client the session has ended and it should send a fresh offer.
+func (m *Manager) HandleResume(w http.ResponseWriter, r *http.Request) {
+	sess := m.session(r.PathValue("id"))
+	if sess == nil || sess.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		writeJSONError(w, http.StatusGone, "session is gone, start a new one")
+		return
+	}
+	var req ResumeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad json: "+err.Error())
+		return
+	}
+
+	sess.negotiate.Lock()
+	defer sess.negotiate.Unlock()
+	pc := sess.pc
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: req.SDP}
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "set remote: "+err.Error())
+		return
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	g := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	<-g
+	sess.touch()
+	log.Info("session resumed", "session", sess.id, "state", pc.ConnectionState())
+
+	resp := Answer{SDP: pc.LocalDescription().SDP, Type: pc.LocalDescription().Type.String(), SessionID: sess.id}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Error("encoding answer", "err", err)
+	}
+}
@@ -0,0 +1,59 @@
+package webrtcx
+
+import (
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+
+	"pc_cloud/internal/metrics"
+)
+
+// readRTCP drains RTCP from a sender (the interceptors only see packets
+// that are read) and records receiver reports. onPacket runs for every
+// compound packet, as a liveness signal, and onKeyframe (if not nil) for
+// every PLI or FIR. It returns when the PeerConnection closes.
+func readRTCP(sender *webrtc.RTPSender, track string, clockRate uint32, ms *metrics.Stream, onPacket, onKeyframe func()) {
+	for {
+		pkts, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		onPacket()
+		now := time.Now()
+		for _, p := range pkts {
+			switch p := p.(type) {
+			case *rtcp.ReceiverReport:
+				for _, rep := range p.Reports {
+					ms.ReceiverReport(track,
+						float64(rep.FractionLost)/256,
+						float64(rep.Jitter)/float64(clockRate),
+						reportRTT(now, rep.LastSenderReport, rep.Delay).Seconds())
+				}
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				if onKeyframe != nil {
+					onKeyframe()
+				}
+			}
+		}
+	}
+}
+
+// reportRTT derives the round-trip time from a report block (RFC 3550
+// 6.4.1): arrival - LSR - DLSR, all in 1/65536 s. It returns -1 when the
+// client hasn't seen a sender report yet.
+func reportRTT(arrival time.Time, lsr, dlsr uint32) time.Duration {
+	if lsr == 0 {
+		return -1
+	}
+	rtt := ntpCompact(arrival) - lsr - dlsr
+	if int32(rtt) < 0 {
+		return -1
+	}
+	return time.Duration(uint64(rtt) * uint64(time.Second) >> 16)
+}
+
+// ntpCompact is the middle 32 bits of the NTP timestamp of t.
+func ntpCompact(t time.Time) uint32 {
+	return uint32(ntpTime(t) >> 16)
+}
@@ -0,0 +1,257 @@
+package webrtcx
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/webrtc/v4"
+)
+
+const statsInterval = time.Second
+
+// SessionStats is the host's view of a session, mirroring what the
+// client's StatsOverlay computes from getStats.
+type SessionStats struct {
+	SessionID string       `json:"session_id"`
+	Codec     string       `json:"codec"`
+	UptimeS   float64      `json:"uptime_s"`
+	Encoder   EncoderStats `json:"encoder"`
+	Video     RTPStats     `json:"video"`
+	Audio     *RTPStats    `json:"audio,omitempty"`
+	// AVOffsetMs is how much longer video currently takes than audio from
+	// capture to the wire, relative to when the session started; positive
+	// means video lags.
+	AVOffsetMs   *float64           `json:"av_offset_ms,omitempty"`
+	Latency      *LatencyStats      `json:"latency,omitempty"` // once the client echoed frames
+	ICE          ICEStats           `json:"ice"`
+	DataChannels []DataChannelStats `json:"data_channels"`
+}
+
+// EncoderStats are measured on the encoder output, over the last interval.
+type EncoderStats struct {
+	Frames        uint64  `json:"frames"`
+	FPS           float64 `json:"fps"`
+	BitrateKbps   float64 `json:"bitrate_kbps"`
+	AvgFrameBytes float64 `json:"avg_frame_bytes"`
+	// SendLatencyMs is the mean time from a frame's first byte arriving on
+	// FFmpeg's stdout until it was handed to the track.
+	SendLatencyMs float64 `json:"send_latency_ms"`
+}
+
+// RTPStats combines outbound counters with the client's RTCP reports.
+type RTPStats struct {
+	PacketsSent  uint64  `json:"packets_sent"`
+	BytesSent    uint64  `json:"bytes_sent"`
+	NACKCount    uint32  `json:"nack_count"`
+	PLICount     uint32  `json:"pli_count"`
+	PacketsLost  int64   `json:"packets_lost"`
+	FractionLost float64 `json:"fraction_lost"`
+	JitterMs     float64 `json:"jitter_ms"`
+	RTTMs        float64 `json:"rtt_ms"`
+}
+
+type ICEStats struct {
+	State         string  `json:"state"`
+	RTTMs         float64 `json:"rtt_ms"` // selected candidate pair, from STUN
+	BytesSent     uint64  `json:"bytes_sent"`
+	BytesReceived uint64  `json:"bytes_received"`
+}
+
+type DataChannelStats struct {
+	Label            string `json:"label"`
+	State            string `json:"state"`
+	MessagesSent     uint32 `json:"messages_sent"`
+	MessagesReceived uint32 `json:"messages_received"`
+	BytesSent        uint64 `json:"bytes_sent"`
+	BytesReceived    uint64 `json:"bytes_received"`
+}
+
+// frameCounters are bumped by the video pump for every frame written.
+type frameCounters struct {
+	frames    atomic.Uint64
+	bytes     atomic.Uint64
+	latencyNs atomic.Int64
+}
+
+func (c *frameCounters) add(size int, latency time.Duration) {
+	c.frames.Add(1)
+	c.bytes.Add(uint64(size))
+	c.latencyNs.Add(int64(latency))
+}
+
+// statsState is the per-session bookkeeping behind Stats.
+type statsState struct {
+	started time.Time
+	getter  stats.Getter // from the stats interceptor, nil if unavailable
+	vSSRC   uint32
+	aSSRC   uint32
+	counts  frameCounters
+
+	mu      sync.Mutex
+	encoder EncoderStats
+	prev    struct {
+		frames, bytes uint64
+		latencyNs     int64
+		at            time.Time
+	}
+	dcs     []*webrtc.DataChannel
+	statsDC *webrtc.DataChannel
+}
+
+// sample turns the counters into per-interval rates.
+func (st *statsState) sample(now time.Time) {
+	frames, bytes, lat := st.counts.frames.Load(), st.counts.bytes.Load(), st.counts.latencyNs.Load()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if dt := now.Sub(st.prev.at).Seconds(); !st.prev.at.IsZero() && dt > 0 {
+		df := frames - st.prev.frames
+		db := bytes - st.prev.bytes
+		st.encoder.FPS = float64(df) / dt
+		st.encoder.BitrateKbps = float64(db) * 8 / 1000 / dt
+		if df > 0 {
+			st.encoder.AvgFrameBytes = float64(db) / float64(df)
+			st.encoder.SendLatencyMs = float64(lat-st.prev.latencyNs) / float64(df) / 1e6
+		}
+	}
+	st.encoder.Frames = frames
+	st.prev.frames, st.prev.bytes, st.prev.latencyNs, st.prev.at = frames, bytes, lat, now
+}
+
+func (st *statsState) addDataChannel(d *webrtc.DataChannel) {
+	st.mu.Lock()
+	st.dcs = append(st.dcs, d)
+	if d.Label() == "stats" {
+		st.statsDC = d
+	}
+	st.mu.Unlock()
+}
+
+// Stats collects a snapshot from pion and the encoder counters.
+func (s *Session) Stats() SessionStats {
+	st := &s.stats
+	out := SessionStats{
+		SessionID: s.id,
+		Codec:     s.currentVideo().params.Codec,
+		UptimeS:   time.Since(st.started).Seconds(),
+	}
+	st.mu.Lock()
+	out.Encoder = st.encoder
+	dcs := append([]*webrtc.DataChannel{}, st.dcs...)
+	st.mu.Unlock()
+
+	out.Video = st.rtpStats(st.vSSRC)
+	if st.aSSRC != 0 {
+		a := st.rtpStats(st.aSSRC)
+		out.Audio = &a
+	}
+	if s.audioClock != nil && s.audioClock.packets.Load() > 0 && s.videoClock.packets.Load() > 0 {
+		off := float64(s.videoClock.smoothedLag()-s.audioClock.smoothedLag()) / float64(time.Millisecond)
+		out.AVOffsetMs = &off
+	}
+
+	out.Latency = s.latency.snapshot()
+
+	report := s.pc.GetStats()
+	out.ICE.State = s.pc.ICEConnectionState().String()
+	for _, v := range report {
+		if cp, ok := v.(webrtc.ICECandidatePairStats); ok && cp.Nominated {
+			out.ICE.RTTMs = cp.CurrentRoundTripTime * 1000
+			out.ICE.BytesSent = cp.BytesSent
+			out.ICE.BytesReceived = cp.BytesReceived
+		}
+	}
+	for _, d := range dcs {
+		ds := DataChannelStats{Label: d.Label(), State: d.ReadyState().String()}
+		if r, ok := report.GetDataChannelStats(d); ok {
+			ds.MessagesSent, ds.MessagesReceived = r.MessagesSent, r.MessagesReceived
+			ds.BytesSent, ds.BytesReceived = r.BytesSent, r.BytesReceived
+		}
+		out.DataChannels = append(out.DataChannels, ds)
+	}
+	return out
+}
+
+func (st *statsState) rtpStats(ssrc uint32) RTPStats {
+	if st.getter == nil || ssrc == 0 {
+		return RTPStats{}
+	}
+	s := st.getter.Get(ssrc)
+	if s == nil {
+		return RTPStats{}
+	}
+	return RTPStats{
+		PacketsSent:  s.OutboundRTPStreamStats.PacketsSent,
+		BytesSent:    s.OutboundRTPStreamStats.BytesSent,
+		NACKCount:    s.OutboundRTPStreamStats.NACKCount,
+		PLICount:     s.OutboundRTPStreamStats.PLICount,
+		PacketsLost:  s.RemoteInboundRTPStreamStats.PacketsLost,
+		FractionLost: s.RemoteInboundRTPStreamStats.FractionLost,
+		JitterMs:     s.RemoteInboundRTPStreamStats.Jitter * 1000,
+		RTTMs:        float64(s.RemoteInboundRTPStreamStats.RoundTripTime) / float64(time.Millisecond),
+	}
+}
+
+// videoRTT is the round-trip time from the client's last RTCP report on
+// the video track.
+func (st *statsState) videoRTT() time.Duration {
+	return time.Duration(st.rtpStats(st.vSSRC).RTTMs * float64(time.Millisecond))
+}
+
+// statsLoop samples the encoder counters every statsInterval and pushes a
+// snapshot to the client's "stats" DataChannel when it has opened one.
+func (s *Session) statsLoop(done <-chan struct{}) {
+	t := time.NewTicker(statsInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-t.C:
+			s.stats.sample(now)
+			s.stats.mu.Lock()
+			dc := s.stats.statsDC
+			s.stats.mu.Unlock()
+			if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+				continue
+			}
+			b, _ := json.Marshal(s.Stats())
+			if err := dc.SendText(string(b)); err != nil {
+				log.Debug("stats push failed", "session", s.id, "err", err)
+			}
+		}
+	}
+}
+
+// HandleStats serves GET /api/session/{id}/stats.
+func (m *Manager) HandleStats(w http.ResponseWriter, r *http.Request) {
+	sess := m.session(r.PathValue("id"))
+	if sess == nil {
+		writeJSONError(w, http.StatusNotFound, "no such session")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(sess.Stats())
+}
+
+func (m *Manager) session(id string) *Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active != nil && m.active.id == id {
+		return m.active
+	}
+	return nil
+}
+
+func senderSSRC(s *webrtc.RTPSender) uint32 {
+	if s == nil {
+		return 0
+	}
+	if enc := s.GetParameters().Encodings; len(enc) > 0 {
+		return uint32(enc[0].SSRC)
+	}
+	return 0
+}
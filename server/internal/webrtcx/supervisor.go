@@ -0,0 +1,225 @@
+package webrtcx
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"pc_cloud/internal/logging"
+	"pc_cloud/internal/metrics"
+)
+
+const (
+	restartBackoffMin = 500 * time.Millisecond
+	restartBackoffMax = 10 * time.Second
+	// a run at least this long counts as healthy and resets the failure count
+	stableRun = 30 * time.Second
+	// how long Close waits for FFmpeg to exit after cancelling it
+	encoderStopWait = 5 * time.Second
+	stderrTailLines = 10
+	// clients repeat keyframe requests until one arrives; a new process
+	// starts with one, so requests this soon after a start are dropped
+	keyframeMinInterval = time.Second
+)
+
+// encoderSupervisor runs one FFmpeg process of a session (video or audio)
+// and restarts it with backoff when it exits on its own (driver reset,
+// display mode change, UAC desktop switch), feeding the same sink so the
+// tracks survive the restart.
+type encoderSupervisor struct {
+	track       string // "video"|"audio", for notifications
+	build       func(ctx context.Context) (cmd *exec.Cmd, format string)
+	pump        func(ctx context.Context, r io.Reader, format string)
+	ms          *metrics.Stream
+	maxRestarts int
+	log         *slog.Logger
+	notify      func(controlMsg)
+	onGiveUp    func()
+
+	done chan struct{}
+
+	mu  sync.Mutex
+	cur *encoderRun
+}
+
+type encoderRun struct {
+	cmd      *exec.Cmd
+	stdout   io.ReadCloser
+	format   string
+	stderr   *tailBuffer
+	started  time.Time
+	keyframe bool // stopped by keyframe, guarded by encoderSupervisor.mu
+}
+
+// start launches the first process synchronously, so a missing binary is
+// still reported to the offer, then supervises it in the background.
+func (e *encoderSupervisor) start(ctx context.Context) error {
+	e.done = make(chan struct{})
+	run, err := e.spawn(ctx)
+	if err != nil {
+		close(e.done)
+		return err
+	}
+	go e.supervise(ctx, run)
+	return nil
+}
+
+// wait blocks until the supervisor has stopped and FFmpeg has been reaped,
+// or encoderStopWait passes.
+func (e *encoderSupervisor) wait() {
+	if e.done == nil {
+		return
+	}
+	select {
+	case <-e.done:
+	case <-time.After(encoderStopWait):
+		e.log.Warn("ffmpeg did not exit in time")
+	}
+}
+
+func (e *encoderSupervisor) spawn(ctx context.Context) (*encoderRun, error) {
+	cmd, format := e.build(ctx)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	tail := &tailBuffer{max: 8 << 10}
+	cmd.Stderr = io.MultiWriter(logging.LineWriter(e.log, slog.LevelError), tail)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	run := &encoderRun{cmd: cmd, stdout: stdout, format: format, stderr: tail, started: time.Now()}
+	e.mu.Lock()
+	e.cur = run
+	e.mu.Unlock()
+	return run, nil
+}
+
+// keyframe restarts FFmpeg so the stream continues from a keyframe, for
+// streams that have none after the first (intra refresh) when the client
+// lost a frame it can't do without. FFmpeg can't be asked for a keyframe
+// while it runs; the track clock re-anchors on the new process' timestamps.
+func (e *encoderSupervisor) keyframe() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.cur == nil || e.cur.keyframe || time.Since(e.cur.started) < keyframeMinInterval {
+		return
+	}
+	e.cur.keyframe = true
+	e.log.Debug("restarting ffmpeg for a keyframe")
+	_ = e.cur.cmd.Process.Kill()
+}
+
+// stoppedForKeyframe reports whether run was ended by keyframe.
+func (e *encoderSupervisor) stoppedForKeyframe(run *encoderRun) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return run.keyframe
+}
+
+func (e *encoderSupervisor) supervise(ctx context.Context, run *encoderRun) {
+	defer close(e.done)
+	failures := 0
+	for {
+		err := e.run(ctx, run)
+		if ctx.Err() != nil {
+			return
+		}
+		if e.stoppedForKeyframe(run) {
+			next, serr := e.spawn(ctx)
+			if serr == nil {
+				e.ms.KeyframeRestarts.Inc()
+				run = next
+				continue
+			}
+			err = serr
+		}
+		if time.Since(run.started) >= stableRun {
+			failures = 0
+		}
+		for {
+			failures++
+			e.log.Error("ffmpeg exited", "err", err, "failures", failures,
+				"stderr", strings.Join(run.stderr.lines(stderrTailLines), "\n"))
+			if failures > e.maxRestarts {
+				e.notify(controlMsg{Type: "encoder", Track: e.track, State: "failed", Error: err.Error()})
+				go e.onGiveUp()
+				return
+			}
+			e.notify(controlMsg{Type: "encoder", Track: e.track, State: "restarting", Attempt: failures, Error: err.Error()})
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff(failures)):
+			}
+			e.ms.FFmpegRestarts.Inc()
+			next, serr := e.spawn(ctx)
+			if serr == nil {
+				run = next
+				break
+			}
+			err = serr
+		}
+		e.log.Info("ffmpeg restarted", "failures", failures)
+		e.notify(controlMsg{Type: "encoder", Track: e.track, State: "restarted", Attempt: failures})
+	}
+}
+
+// run feeds the sink until FFmpeg's stdout ends, then reaps the process
+// and describes how it exited.
+func (e *encoderSupervisor) run(ctx context.Context, run *encoderRun) error {
+	e.pump(ctx, run.stdout, run.format)
+	// the pump also stops on bitstream errors while FFmpeg is still running
+	_ = run.cmd.Process.Kill()
+	err := run.cmd.Wait()
+	if err == nil {
+		err = fmt.Errorf("ffmpeg exited after %s", time.Since(run.started).Round(time.Second))
+	}
+	return err
+}
+
+func backoff(failures int) time.Duration {
+	d := restartBackoffMin << (failures - 1)
+	if d <= 0 || d > restartBackoffMax {
+		return restartBackoffMax
+	}
+	return d
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	mu  sync.Mutex
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-t.max:]...)
+	}
+	return len(p), nil
+}
+
+// lines returns up to n of the last non-empty lines.
+func (t *tailBuffer) lines(n int) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []string
+	for _, ln := range strings.FieldsFunc(string(t.buf), func(r rune) bool { return r == '\n' || r == '\r' }) {
+		if ln = strings.TrimSpace(ln); ln != "" {
+			out = append(out, ln)
+		}
+	}
+	if len(out) > n {
+		out = out[len(out)-n:]
+	}
+	return out
+}
@@ -0,0 +1,123 @@
+package webrtcx
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"pc_cloud/internal/metrics"
+)
+
+// TestMain lets the test binary stand in for FFmpeg: run with
+// FAKE_FFMPEG set, it lists no encoders when probed and otherwise blocks
+// until killed.
+func TestMain(m *testing.M) {
+	if os.Getenv("FAKE_FFMPEG") != "" {
+		if !slices.Contains(os.Args, "-encoders") {
+			time.Sleep(time.Minute)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeSupervisor supervises copies of the test binary, blocked until
+// killed.
+func fakeSupervisor(t *testing.T, ms *metrics.Stream) *encoderSupervisor {
+	return &encoderSupervisor{
+		track: "video",
+		build: func(ctx context.Context) (*exec.Cmd, string) {
+			cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^$")
+			cmd.Env = append(os.Environ(), "FAKE_FFMPEG=1")
+			return cmd, "h264"
+		},
+		pump: func(ctx context.Context, r io.Reader, format string) {
+			_, _ = io.Copy(io.Discard, r)
+		},
+		ms:          ms,
+		maxRestarts: 3,
+		log:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+		notify:      func(m controlMsg) { t.Errorf("unexpected notification %+v", m) },
+		onGiveUp:    func() {},
+	}
+}
+
+func (e *encoderSupervisor) current() *encoderRun {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.cur
+}
+
+func counterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	_ = c.Write(&m)
+	return m.GetCounter().GetValue()
+}
+
+// backdate makes run look older than keyframeMinInterval.
+func (e *encoderSupervisor) backdate(run *encoderRun) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	run.started = run.started.Add(-2 * keyframeMinInterval)
+}
+
+func TestEncoderSupervisorKeyframe(t *testing.T) {
+	ms := metrics.NewStream("test", "h264")
+	defer ms.Close()
+	e := fakeSupervisor(t, ms)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := e.start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer e.wait()
+	defer cancel()
+
+	first := e.current()
+	e.keyframe()
+	if e.stoppedForKeyframe(first) {
+		t.Fatal("keyframe restarted a process that had only just started")
+	}
+
+	e.backdate(first)
+	e.keyframe()
+	e.keyframe() // a repeated request before the restart is the same one
+	if !e.stoppedForKeyframe(first) {
+		t.Fatal("keyframe did not stop the process")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for e.current() == first {
+		if time.Now().After(deadline) {
+			t.Fatal("no new process after the keyframe request")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	second := e.current()
+	if e.stoppedForKeyframe(second) {
+		t.Error("the new process is marked stopped for a keyframe")
+	}
+	if got := counterValue(ms.KeyframeRestarts); got != 1 {
+		t.Errorf("KeyframeRestarts = %v, want 1", got)
+	}
+	if got := counterValue(ms.FFmpegRestarts); got != 0 {
+		t.Errorf("FFmpegRestarts = %v, want 0", got)
+	}
+
+	// the new process has just started too
+	e.keyframe()
+	if e.stoppedForKeyframe(second) {
+		t.Error("keyframe restarted the new process within keyframeMinInterval")
+	}
+}
+
+func TestEncoderSupervisorKeyframeBeforeStart(t *testing.T) {
+	e := &encoderSupervisor{log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	e.keyframe() // no process yet: nothing to restart, and no panic
+}
@@ -0,0 +1,229 @@
+package webrtcx
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+
+	"pc_cloud/internal/bitstream"
+	"pc_cloud/internal/metrics"
+)
+
+const (
+	videoClockRate = 90000
+	rtpOutboundMTU = 1200 // same as pion's TrackLocalStaticSample
+)
+
+// videoCodec returns the track capability for codec. HEVC and VP9 are
+// pinned to the profile the encoder produces, as browsers offer their 8 and
+// 10-bit profiles as separate payload types.
+func videoCodec(codec string, bitDepth int) webrtc.RTPCodecCapability {
+	c := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: videoClockRate}
+	switch strings.ToLower(codec) {
+	case "hevc", "h265":
+		c.MimeType, c.SDPFmtpLine = webrtc.MimeTypeH265, "profile-id=1"
+		if bitDepth == 10 {
+			c.SDPFmtpLine = "profile-id=2"
+		}
+	case "av1":
+		c.MimeType = webrtc.MimeTypeAV1
+	case "vp9":
+		c.MimeType, c.SDPFmtpLine = webrtc.MimeTypeVP9, "profile-id=0"
+		if bitDepth == 10 {
+			c.SDPFmtpLine = "profile-id=2"
+		}
+	case "vp8":
+		c.MimeType = webrtc.MimeTypeVP8
+	}
+	return c
+}
+
+// sampleWriter takes the frames a pump produces. The payload is only
+// borrowed for the call: the pumps reuse their buffers for the next frame,
+// which is safe for videoSink because pion's payloaders copy.
+type sampleWriter interface {
+	write(payload []byte, pts int64, start time.Time)
+}
+
+// videoOutput is the session's video as the client sees it: one RTP
+// stream, whose frames come from a different encoder (and after a codec
+// change through a different track) once the session is reconfigured. Each
+// encoder writes to its own videoSink; a new one goes live with its first
+// keyframe, so the client never gets frames it can't decode, and the one
+// it replaces is dropped from then on. Sequence numbers and the track clock
+// carry on across the switch.
+type videoOutput struct {
+	clock   *trackClock
+	ms      *metrics.Stream
+	counts  *frameCounters
+	seq     rtp.Sequencer
+	replace func(webrtc.TrackLocal) error // the sender's ReplaceTrack
+
+	mu      sync.Mutex // also serializes the sinks' writes
+	live    *videoSink
+	pending *videoSink
+}
+
+func newVideoOutput(clock *trackClock, ms *metrics.Stream, counts *frameCounters, replace func(webrtc.TrackLocal) error) *videoOutput {
+	return &videoOutput{clock: clock, ms: ms, counts: counts, seq: rtp.NewRandomSequencer(), replace: replace}
+}
+
+// sink returns a sink for an encoder producing codec, sent on track. The
+// first sink is live at once; later ones replace any sink still pending
+// and go live when their first keyframe arrives, which they report on
+// their live channel.
+func (o *videoOutput) sink(track *webrtc.TrackLocalStaticRTP, codec string) *videoSink {
+	var p rtp.Payloader = &codecs.H264Payloader{}
+	switch strings.ToLower(codec) {
+	case "hevc", "h265":
+		p = &codecs.H265Payloader{}
+	case "av1":
+		p = &codecs.AV1Payloader{}
+	case "vp9":
+		p = &codecs.VP9Payloader{}
+	case "vp8":
+		p = &codecs.VP8Payloader{EnablePictureID: true}
+	}
+	v := &videoSink{
+		out:   o,
+		track: track,
+		codec: strings.ToLower(codec),
+		pk:    rtp.NewPacketizer(rtpOutboundMTU, 0, 0, p, o.seq, videoClockRate),
+		live:  make(chan error, 1),
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.live == nil {
+		o.live = v
+	} else {
+		o.pending = v
+	}
+	return v
+}
+
+// drop gives up on v if it is still pending. It reports false if v went
+// live in the meantime.
+func (o *videoOutput) drop(v *videoSink) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.pending == v {
+		o.pending = nil
+	}
+	return o.live != v
+}
+
+// promote makes v live if it is pending and payload is a keyframe,
+// switching the sender to its track if that is a different one. It is
+// called with o.mu held.
+func (o *videoOutput) promote(v *videoSink, payload []byte) bool {
+	if o.pending != v || !isKeyframe(v.codec, payload) {
+		return false
+	}
+	o.pending = nil
+	if v.track != o.live.track {
+		if err := o.replace(v.track); err != nil {
+			v.live <- fmt.Errorf("switching track: %w", err)
+			return false
+		}
+	}
+	o.live = v
+	v.live <- nil
+	return true
+}
+
+// isKeyframe reports whether a decoder can start at payload, a sample as
+// the pumps write it. Recovery points don't count: joining at one shows a
+// partly refreshed picture for a while.
+func isKeyframe(codec string, payload []byte) bool {
+	switch codec {
+	case "hevc", "h265":
+		return annexBKeyframe(bitstream.H265, payload)
+	case "av1":
+		// the framers put the sequence header in front of every key frame
+		h, err := bitstream.ParseOBUHeader(payload)
+		return err == nil && h.Type == bitstream.OBUSequenceHeader
+	case "vp9":
+		f, err := bitstream.ParseVP9Frame(payload)
+		return err == nil && f.Key
+	case "vp8":
+		return len(payload) > 0 && payload[0]&0x01 == 0 // frame tag: key frame when clear
+	}
+	return annexBKeyframe(bitstream.H264, payload)
+}
+
+func annexBKeyframe(c bitstream.Codec, payload []byte) bool {
+	for _, nal := range bitstream.Split(payload, nil) {
+		if c.IsKeyframe(nal) {
+			return true
+		}
+	}
+	return false
+}
+
+// videoSink packetizes the frames the pumps of one encoder deliver and
+// stamps them with RTP timestamps derived from the encoder's PTS, so
+// dropped or duplicated capture frames show up on the wire instead of
+// being smoothed over.
+type videoSink struct {
+	out   *videoOutput
+	track *webrtc.TrackLocalStaticRTP
+	codec string
+	pk    rtp.Packetizer
+	live  chan error // receives once when the sink goes live or fails to
+}
+
+// pump feeds the sink from FFmpeg's stdout in the given format, as
+// returned by encoder.BuildFFmpegPipeCmd.
+func (v *videoSink) pump(ctx context.Context, r io.Reader, format string) {
+	ms := v.out.ms
+	switch format {
+	case "hevc":
+		pumpAnnexBToTrack(ctx, r, v, ms, bitstream.H265)
+	case "ivf":
+		pumpAV1IVFToTrack(ctx, r, v, ms)
+	case "obu":
+		pumpAV1OBUToTrack(ctx, r, v, ms)
+	case "vp9":
+		pumpVPXIVFToTrack(ctx, r, v, ms, "VP90")
+	case "vp8":
+		pumpVPXIVFToTrack(ctx, r, v, ms, "VP80")
+	default:
+		pumpAnnexBToTrack(ctx, r, v, ms, bitstream.H264)
+	}
+}
+
+// write sends one frame, unless the sink is not live. pts is in 90 kHz
+// ticks, or -1 if unknown; start is when its first byte was read, so the
+// session stats can report how long frames spend inside the host. The
+// pumps call write from one goroutine per sink.
+func (v *videoSink) write(payload []byte, pts int64, start time.Time) {
+	o := v.out
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.live != v && !o.promote(v, payload) {
+		return
+	}
+	o.ms.Frames.Inc()
+	o.ms.FrameBytes.Observe(float64(len(payload)))
+	ts := o.clock.stamp(pts, videoClockRate, start)
+	var failed bool
+	for _, p := range v.pk.Packetize(payload, 0) {
+		p.Timestamp = ts
+		if err := v.track.WriteRTP(p); err != nil {
+			failed = true
+			continue
+		}
+		o.clock.sent(len(p.Payload))
+	}
+	if !failed {
+		o.ms.SampleWritten("video")
+	}
+	o.counts.add(len(payload), time.Since(start))
+}
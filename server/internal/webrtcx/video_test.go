@@ -0,0 +1,194 @@
+package webrtcx
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+
+	"pc_cloud/internal/metrics"
+)
+
+var (
+	h264Key   = appendAnnexB(nil, [][]byte{{0x09, 0xf0}, {0x65, 0x88, 0x80}})
+	h264Delta = appendAnnexB(nil, [][]byte{{0x09, 0xf0}, {0x41, 0x9a, 0x80}})
+	hevcKey   = appendAnnexB(nil, [][]byte{{0x26, 0x01, 0xaf, 0x80}}) // IDR_W_RADL
+)
+
+// testOutput is a videoOutput whose sender only records the tracks it is
+// switched to, or fails with replaceErr.
+type testOutput struct {
+	*videoOutput
+	replaced   []webrtc.TrackLocal
+	replaceErr error
+}
+
+func newTestOutput(t *testing.T) *testOutput {
+	ms := metrics.NewStream("test", "h264")
+	t.Cleanup(ms.Close)
+	o := &testOutput{}
+	o.videoOutput = newVideoOutput(newMediaClock().track(videoClockRate), ms, &frameCounters{}, func(tl webrtc.TrackLocal) error {
+		o.replaced = append(o.replaced, tl)
+		return o.replaceErr
+	})
+	return o
+}
+
+func (o *testOutput) written() uint64 { return o.counts.frames.Load() }
+
+func (o *testOutput) state() (live, pending *videoSink) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.live, o.pending
+}
+
+func testTrack(t testing.TB, codec string) *webrtc.TrackLocalStaticRTP {
+	track, err := webrtc.NewTrackLocalStaticRTP(videoCodec(codec, 8), "video", "pccloud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return track
+}
+
+// liveResult reports whether v reported on its live channel, and what.
+func liveResult(v *videoSink) (bool, error) {
+	select {
+	case err := <-v.live:
+		return true, err
+	default:
+		return false, nil
+	}
+}
+
+func TestVideoOutputPromote(t *testing.T) {
+	o := newTestOutput(t)
+	track := testTrack(t, "h264")
+	old := o.sink(track, "h264")
+	if live, _ := o.state(); live != old {
+		t.Fatal("the first sink is not live at once")
+	}
+	old.write(h264Delta, 0, time.Now())
+
+	next := o.sink(track, "h264")
+	next.write(h264Delta, 0, time.Now()) // a decoder can't start here
+	old.write(h264Delta, 3000, time.Now())
+	if live, pending := o.state(); live != old || pending != next {
+		t.Fatal("the new sink went live without a keyframe")
+	}
+	if ok, _ := liveResult(next); ok {
+		t.Fatal("the new sink reported before its keyframe")
+	}
+	if got := o.written(); got != 2 {
+		t.Fatalf("%d frames written, want the old sink's 2", got)
+	}
+
+	next.write(h264Key, 0, time.Now())
+	if ok, err := liveResult(next); !ok || err != nil {
+		t.Fatalf("live reported %v, %v, want nil", err, ok)
+	}
+	old.write(h264Delta, 6000, time.Now())
+	if live, pending := o.state(); live != next || pending != nil {
+		t.Error("the new sink is not live after its keyframe")
+	}
+	if got := o.written(); got != 3 {
+		t.Errorf("%d frames written, want 3: the old sink is dropped once the new one is live", got)
+	}
+	if len(o.replaced) != 0 {
+		t.Error("the sender's track was replaced without a codec change")
+	}
+	if o.drop(next) {
+		t.Error("drop gave up on a live sink")
+	}
+}
+
+func TestVideoOutputCodecChange(t *testing.T) {
+	o := newTestOutput(t)
+	o.sink(testTrack(t, "h264"), "h264")
+	hevc := testTrack(t, "hevc")
+	next := o.sink(hevc, "hevc")
+
+	next.write(h264Key, 0, time.Now()) // not a keyframe to an HEVC decoder
+	if len(o.replaced) != 0 {
+		t.Fatal("switched tracks before the first HEVC keyframe")
+	}
+	next.write(hevcKey, 0, time.Now())
+	if ok, err := liveResult(next); !ok || err != nil {
+		t.Fatalf("live reported %v, %v, want nil", err, ok)
+	}
+	if len(o.replaced) != 1 || o.replaced[0] != hevc {
+		t.Errorf("replaced %v, want the HEVC track", o.replaced)
+	}
+	if live, _ := o.state(); live != next {
+		t.Error("the HEVC sink is not live")
+	}
+}
+
+func TestVideoOutputReplaceFails(t *testing.T) {
+	o := newTestOutput(t)
+	old := o.sink(testTrack(t, "h264"), "h264")
+	next := o.sink(testTrack(t, "hevc"), "hevc")
+	o.replaceErr = errors.New("sender closed")
+
+	next.write(hevcKey, 0, time.Now())
+	if ok, err := liveResult(next); !ok || !errors.Is(err, o.replaceErr) {
+		t.Fatalf("live reported %v, %v, want %v", err, ok, o.replaceErr)
+	}
+	if live, pending := o.state(); live != old || pending != nil {
+		t.Error("the old sink is not live after the switch failed")
+	}
+	if got := o.written(); got != 0 {
+		t.Errorf("%d frames written, want none", got)
+	}
+	if !o.drop(next) {
+		t.Error("drop reports a failed sink as live")
+	}
+}
+
+func TestVideoOutputDrop(t *testing.T) {
+	o := newTestOutput(t)
+	old := o.sink(testTrack(t, "h264"), "h264")
+	next := o.sink(testTrack(t, "h264"), "h264")
+	if !o.drop(next) {
+		t.Fatal("drop reports a pending sink as live")
+	}
+	next.write(h264Key, 0, time.Now())
+	if live, pending := o.state(); live != old || pending != nil {
+		t.Error("a dropped sink went live")
+	}
+	if ok, _ := liveResult(next); ok {
+		t.Error("a dropped sink reported on its live channel")
+	}
+}
+
+// TestVideoOutputDropRace has a reconfiguration give up on the new sink
+// while its first keyframe arrives: either the sink went live and drop
+// says so, or it was dropped and never goes live.
+func TestVideoOutputDropRace(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		o := newTestOutput(t)
+		old := o.sink(testTrack(t, "h264"), "h264")
+		next := o.sink(testTrack(t, "h264"), "h264")
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			next.write(h264Key, 0, time.Now())
+		}()
+		dropped := o.drop(next)
+		wg.Wait()
+
+		live, pending := o.state()
+		reported, err := liveResult(next)
+		switch {
+		case pending != nil:
+			t.Fatal("the sink is still pending")
+		case dropped && (live != old || reported):
+			t.Fatal("drop gave up on a sink that went live")
+		case !dropped && (live != next || !reported || err != nil):
+			t.Fatal("drop reported a sink live that is not")
+		}
+	}
+}
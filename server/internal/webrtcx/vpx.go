@@ -0,0 +1,59 @@
+package webrtcx
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"pc_cloud/internal/bitstream"
+	"pc_cloud/internal/metrics"
+)
+
+// pumpVPXIVFToTrack reads VP8 or VP9 in IVF from r; fourcc is the one the
+// stream must carry ("VP80" or "VP90"). VP9 superframes are split so each
+// frame goes out as its own sample, with the superframe's PTS.
+func pumpVPXIVFToTrack(ctx context.Context, r io.Reader, out sampleWriter, ms *metrics.Stream, fourcc string) {
+	iv, err := newIVFReader(r)
+	if err != nil {
+		if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			ms.ParseErrors.Inc()
+			log.Warn("unusable IVF stream", "err", err)
+		}
+		return
+	}
+	if iv.fourcc != fourcc {
+		ms.ParseErrors.Inc()
+		log.Warn("unexpected IVF codec", "fourcc", iv.fourcc, "want", fourcc)
+		return
+	}
+	var frames [][]byte
+	var params bitstream.SPS
+	for {
+		frame, pts, start, err := iv.next()
+		if errors.Is(err, errIVFFrame) {
+			ms.ParseErrors.Inc()
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if fourcc != "VP90" {
+			out.write(frame, pts, start)
+			continue
+		}
+		frames = bitstream.SplitVP9Superframe(frame, frames)
+		for _, f := range frames {
+			h, err := bitstream.ParseVP9Frame(f)
+			switch {
+			case err != nil:
+				ms.ParseErrors.Inc()
+			case h.Key && h.SPS != params:
+				log.Info("video stream parameters", "width", h.Width, "height", h.Height,
+					"profile", h.Profile, "chroma_format", h.ChromaFormat, "bit_depth", h.BitDepthLuma,
+					"color", h.Color.String())
+				params = h.SPS
+			}
+			out.write(f, pts, start)
+		}
+	}
+}
@@ -52,6 +52,9 @@ export default function StatsOverlay() {
     { key: 'jitter', label: 'Jitter', unit: 'ms' },
     { key: 'loss', label: 'Packet Loss', unit: '%' },
     { key: 'dropped', label: 'Frames Dropped' },
+    { key: 'send', label: 'Host Send', unit: 'ms' },
+    { key: 'srv_rtt', label: 'Host RTT', unit: 'ms' },
+    { key: 'av', label: 'A/V Offset', unit: 'ms' },
   ];
 
   return (
@@ -6,13 +6,15 @@ const defaultSettings = {
     res: "1920x1080",
     fps: 60,
     bitrate: 25,
+    chroma: "420" as "420" | "444",
   },
   audio: {
     codec: "opus",
     stereo: true,
   },
   network: {
-    qos: "low-latency",
+    qos: "balanced" as "ultra-low" | "balanced" | "quality",
+    intraRefresh: "auto" as "auto" | "on" | "off",
   },
 };
 
@@ -1,11 +1,23 @@
 export interface StreamConfig {
   codec: string;
+  bitDepth?: 8 | 10; // 10 = HEVC Main10, 10-bit AV1 or VP9 profile 2
+  hdr?: boolean; // ask for HDR video; default: whether the display is HDR
+  chroma?: "420" | "444"; // 444 = full chroma for sharp text, if the codec has it
   fps: number;
   width: number;
   height: number;
   bitrate: string;
   preset: string;
+  latency?: "ultra-low" | "balanced" | "quality"; // encoder latency mode; default: the host's
+  intraRefresh?: boolean; // gradual refresh instead of keyframe bursts; default: on for ultra-low latency
   audio: boolean;
+  audioChannels?: 1 | 2 | 6;
+  audioBitrate?: string;
+  audioFec?: boolean;
+  audioDtx?: boolean;
+  audioApp?: string; // process name or PID from /api/devices/audio/apps
+  mic?: boolean;
+  micGain?: number;
 }
 
 export function startSession(
@@ -16,4 +28,33 @@ export function startSession(
 ): Promise<void>;
 
 export function endSession(server: string): Promise<void>;
+export function setMic(
+  server: string,
+  opts: { enabled?: boolean; gain?: number }
+): Promise<{ enabled: boolean; gain: number } | undefined>;
+export interface StreamChange {
+  codec?: string;
+  fps?: number;
+  width?: number; // with height
+  height?: number;
+  native?: boolean; // back to the desktop resolution
+  bitrate?: string;
+}
+
+export interface StreamState {
+  codec: string;
+  bit_depth: number;
+  chroma: string;
+  hdr?: string;
+  fps: number;
+  width?: number; // absent = native
+  height?: number;
+  bitrate: string;
+  intra_refresh?: boolean;
+}
+
+export function reconfigure(
+  server: string,
+  change: StreamChange
+): Promise<StreamState | undefined>;
 export function onStats(callback: (stats: string) => void): void;
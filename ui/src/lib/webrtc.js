@@ -2,6 +2,13 @@ let pc = null;
 let videoEl = null;
 let statsCb = null;
 let inputDC = null;
+let serverStats = null; // latest push from the host's "stats" DataChannel
+let sessionId = null;
+let resuming = false;
+let micStream = null; // client microphone sent to the host's virtual mic
+let controlDC = null;
+let configureSeq = 0;
+const configuring = new Map(); // "configure" request id -> { resolve, reject }
 
 // ---- public API ------------------------------------------------------------
 
@@ -17,7 +24,19 @@ export async function startSession(server, cfg, status, el) {
 
   pc = new RTCPeerConnection({ iceServers: [] });
   pc.addTransceiver('video', { direction: 'recvonly' });
-  pc.addTransceiver('audio', { direction: 'recvonly' });
+  micStream = null;
+  if (cfg.mic) {
+    try {
+      micStream = await navigator.mediaDevices.getUserMedia({
+        audio: { echoCancellation: true, noiseSuppression: true, autoGainControl: true }
+      });
+    } catch (e) {
+      status?.(`Microphone unavailable: ${e.message}`);
+    }
+  }
+  const micTrack = micStream?.getAudioTracks()[0];
+  if (micTrack) pc.addTransceiver(micTrack, { direction: 'sendrecv' });
+  else pc.addTransceiver('audio', { direction: 'recvonly' });
 
   pc.ontrack = ev => {
     if (ev.track.kind === 'video' && videoEl) {
@@ -44,11 +63,60 @@ export async function startSession(server, cfg, status, el) {
     status?.(`Input channel error: ${e.message}`);
   };
 
+  // DataChannel the host sends notifications on (encoder restarts, ...)
+  controlDC = pc.createDataChannel('control', { ordered: true });
+  controlDC.onmessage = ev => {
+    let msg;
+    try { msg = JSON.parse(ev.data); } catch (_) { return; }
+    if (msg.type === 'encoder') {
+      const what = msg.track === 'audio' ? 'Audio encoder' : 'Encoder';
+      if (msg.state === 'restarting') status?.(`${what} crashed, restarting (attempt ${msg.attempt})...`);
+      else if (msg.state === 'restarted') status?.(`${what} restarted`);
+      else if (msg.state === 'failed') status?.(`${what} failed: ${msg.error || 'unknown error'}`);
+    } else if (msg.type === 'configured') {
+      const p = configuring.get(msg.id);
+      configuring.delete(msg.id);
+      if (msg.error) p?.reject(new Error(msg.error));
+      else p?.resolve(msg.stream);
+    } else if (msg.type === 'stream') {
+      const s = msg.stream;
+      status?.(`Video now ${s.codec} ${s.width ? `${s.width}x${s.height}` : 'native'} @ ${s.fps} fps, ${s.bitrate}`);
+    }
+  };
+
+  // DataChannel the host pushes its own stats on (encode time, RTT)
+  serverStats = null;
+  const statsDC = pc.createDataChannel('stats', { ordered: false, maxRetransmits: 0 });
+  statsDC.onmessage = ev => {
+    try { serverStats = JSON.parse(ev.data); } catch (_) { /* empty */ }
+  };
+
+  // DataChannel the presented frames are echoed on, so the host can measure
+  // the latency from its encoder to this screen (in serverStats.latency)
+  const latencyDC = pc.createDataChannel('latency', { ordered: false, maxRetransmits: 0 });
+  latencyDC.onopen = () => echoFrames(latencyDC);
+
+  // ask for HDR when this display can show it, unless the config says
+  const hdr = cfg.hdr ?? !!window.matchMedia?.('(dynamic-range: high)').matches;
+
   // Prefer codec (best-effort)
   try {
     const tx = pc.getTransceivers().find(t => t.receiver?.track?.kind === 'video');
     const caps = RTCRtpReceiver.getCapabilities('video');
-    const wanted = caps?.codecs?.filter(c => (c.mimeType || '').toLowerCase().includes(cfg.codec)) || [];
+    // RTP calls HEVC H265
+    const mime = cfg.codec === 'hevc' ? 'h265' : cfg.codec;
+    let wanted = caps?.codecs?.filter(c => (c.mimeType || '').toLowerCase().includes(mime)) || [];
+    // 10-bit and 4:4:4 profiles are payload types of their own
+    const tenBit = cfg.bitDepth === 10 || hdr;
+    const profile = {
+      vp9: tenBit ? 'profile-id=2' : cfg.chroma === '444' ? 'profile-id=1' : 'profile-id=0',
+      h265: tenBit ? 'profile-id=2' : cfg.chroma === '444' ? 'profile-id=4' : 'profile-id=1',
+      h264: cfg.chroma === '444' ? 'profile-level-id=f4' : null,
+    }[mime];
+    if (profile) {
+      wanted = [...wanted.filter(c => (c.sdpFmtpLine || '').includes(profile)),
+        ...wanted.filter(c => !(c.sdpFmtpLine || '').includes(profile))];
+    }
     const rest = caps?.codecs?.filter(c => !wanted.includes(c)) || [];
     if (wanted.length) await tx.setCodecPreferences([...wanted, ...rest]);
   } catch (_) { /* empty */ }
@@ -61,15 +129,32 @@ export async function startSession(server, cfg, status, el) {
     headers: { 'Content-Type': 'application/json' },
     body: JSON.stringify({
       sdp: offer.sdp, type: offer.type,
-      codec: cfg.codec, audio: !!cfg.audio,
+      codec: cfg.codec, bit_depth: cfg.bitDepth, hdr, chroma: cfg.chroma, audio: !!cfg.audio,
       fps: cfg.fps, width: cfg.width, height: cfg.height,
-      preset: cfg.preset, bitrate: cfg.bitrate,
-      capture: cfg.capture
+      preset: cfg.preset, bitrate: cfg.bitrate, latency: cfg.latency,
+      intra_refresh: cfg.intraRefresh,
+      capture: cfg.capture,
+      audio_channels: cfg.audioChannels, audio_bitrate: cfg.audioBitrate,
+      audio_fec: cfg.audioFec, audio_dtx: cfg.audioDtx, audio_app: cfg.audioApp,
+      mic: !!micTrack, mic_gain: cfg.micGain
     })
   });
   if (!res.ok) throw new Error(`offer failed ${res.status}: ${await res.text().catch(() => '')}`);
   const ans = await res.json();
   await pc.setRemoteDescription(ans);
+  sessionId = ans.session_id;
+  // the host may pick another codec than asked for if this browser can't decode it
+  if (ans.codec && ans.codec !== cfg.codec) status?.(`Using ${ans.codec} video (${cfg.codec} not available)`);
+  if (hdr && !ans.hdr) status?.('Host sends SDR video');
+  if (cfg.chroma === '444' && ans.chroma !== '444') status?.('Using 4:2:0 video (4:4:4 not available)');
+
+  // After a network change, renegotiate with an ICE restart so the host keeps
+  // the running encoder, instead of starting over.
+  pc.onconnectionstatechange = () => {
+    if (pc && (pc.connectionState === 'failed' || pc.connectionState === 'disconnected')) {
+      resumeSession(server, cfg, status, el);
+    }
+  };
 
   attachInputsRD(); // absolute mouse + keys + wheel + gamepad
   status?.('Connected to ' + server);
@@ -138,15 +223,104 @@ export async function startSession(server, cfg, status, el) {
     // --- Format Output String ---
     const jitter = Math.round((videoReport.jitter || 0) * 1000);
     const pl = packetLossPercentage.toFixed(2);
-    const out = `fps: ${fps} | br: ${br} Mbps | jitter: ${jitter}ms | loss: ${pl}% | dropped: ${deltaFramesDropped}`;
+    let out = `fps: ${fps} | br: ${br} Mbps | jitter: ${jitter}ms | loss: ${pl}% | dropped: ${deltaFramesDropped}`;
+    if (serverStats) {
+      const send = (serverStats.encoder?.send_latency_ms || 0).toFixed(1);
+      const rtt = (serverStats.ice?.rtt_ms || serverStats.video?.rtt_ms || 0).toFixed(1);
+      out += ` | send: ${send} ms | srv_rtt: ${rtt} ms`;
+      if (serverStats.av_offset_ms != null) out += ` | av: ${serverStats.av_offset_ms.toFixed(1)} ms`;
+      if (serverStats.latency) out += ` | enc→screen: ${serverStats.latency.encoder_to_screen_ms.toFixed(1)} ms`;
+    }
     statsCb?.(out);
   }, 1000);
 }
 
+// echoFrames sends the RTP timestamp of a presented frame back to the host
+// a few times a second, with how long it took to decode and how soon it
+// will be on screen. Needs requestVideoFrameCallback; without it the host
+// just gets no latency figure.
+const echoInterval = 250; // ms
+function echoFrames(dc) {
+  if (!videoEl?.requestVideoFrameCallback) return;
+  let last = 0;
+  const onFrame = (now, meta) => {
+    if (dc.readyState !== 'open') return;
+    if (meta.rtpTimestamp !== undefined && now - last >= echoInterval) {
+      last = now;
+      dc.send(JSON.stringify({
+        rtp: meta.rtpTimestamp,
+        decode_ms: (meta.processingDuration || 0) * 1000,
+        display_in_ms: Math.max(0, meta.expectedDisplayTime - performance.now()),
+      }));
+    }
+    videoEl?.requestVideoFrameCallback(onFrame);
+  };
+  videoEl.requestVideoFrameCallback(onFrame);
+}
+
+async function resumeSession(server, cfg, status, el) {
+  if (!pc || !sessionId || resuming) return;
+  resuming = true;
+  try {
+    status?.('Connection lost, resuming...');
+    const offer = await pc.createOffer({ iceRestart: true });
+    await pc.setLocalDescription(offer);
+    const res = await fetch(`${server}/api/session/${sessionId}/resume`, {
+      method: 'POST', mode: 'cors',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ sdp: offer.sdp, type: offer.type })
+    });
+    if (res.status === 410) {
+      // the host already ended it: fall back to a fresh session
+      resuming = false;
+      return startSession(server, cfg, status, el);
+    }
+    if (!res.ok) throw new Error(`resume failed ${res.status}: ${await res.text().catch(() => '')}`);
+    await pc.setRemoteDescription(await res.json());
+    status?.('Resumed ' + server);
+  } catch (e) {
+    status?.(`Resume failed: ${e.message}`);
+  } finally {
+    resuming = false;
+  }
+}
+
+// reconfigure changes the running stream's codec, fps, resolution
+// ({ width, height } or { native: true }) or bitrate; fields left out stay
+// as they are. The host switches to a new encoder on its first keyframe,
+// so the picture doesn't stop. That encoder is a second capture and encode
+// process, started for every change, bitrate and fps included, so the
+// switch takes a fraction of a second and doubles the host's load until
+// then. Goes over the control DataChannel when it is open, else over
+// HTTP; resolves to the stream the host now sends.
+export async function reconfigure(server, change) {
+  if (!sessionId) return;
+  if (controlDC?.readyState === 'open') {
+    const id = ++configureSeq;
+    return new Promise((resolve, reject) => {
+      configuring.set(id, { resolve, reject });
+      controlDC.send(JSON.stringify({ type: 'configure', id, ...change }));
+    });
+  }
+  const res = await fetch(`${server}/api/session/${sessionId}/config`, {
+    method: 'POST', mode: 'cors',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify(change)
+  });
+  if (!res.ok) throw new Error(`reconfigure failed ${res.status}: ${await res.text().catch(() => '')}`);
+  return res.json();
+}
+
 export async function endSession(server) {
   try { await fetch(server + '/api/session/end', { method: 'POST', mode: 'cors' }); } catch (_) { /* empty */ }
   try { pc && pc.close(); } catch (_) { /* empty */ }
   pc = null;
+  sessionId = null;
+  controlDC = null;
+  configuring.forEach(p => p.reject(new Error('session ended')));
+  configuring.clear();
+  micStream?.getTracks().forEach(t => t.stop());
+  micStream = null;
   if (videoEl?.srcObject) {
     console.log("Stopping video tracks");
 
@@ -155,6 +329,20 @@ export async function endSession(server) {
   }
 }
 
+// setMic enables/disables the microphone passthrough or changes its gain
+// (1 = unity) without renegotiating.
+export async function setMic(server, { enabled, gain } = {}) {
+  if (!sessionId) return;
+  micStream?.getAudioTracks().forEach(t => { if (enabled !== undefined) t.enabled = enabled; });
+  const res = await fetch(`${server}/api/session/${sessionId}/mic`, {
+    method: 'POST', mode: 'cors',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ enabled, gain })
+  });
+  if (!res.ok) throw new Error(`mic failed ${res.status}: ${await res.text().catch(() => '')}`);
+  return res.json();
+}
+
 // ---- inputs (remote-desktop absolute) -------------------------------------
 
 function send(type, payload) {
@@ -1,7 +1,7 @@
 import { useEffect, useRef, useState } from "react";
 import StreamPlayer from "../components/StreamPlayer";
 import StatsOverlay from "../components/StatsOverlay";
-import { startSession } from "../lib/webrtc.js";
+import { reconfigure, startSession, type StreamChange } from "../lib/webrtc.js";
 import { useSettings } from "../context/SettingsContext";
 import useGamepad from "../hooks/useGamepad.js"; 
 
@@ -29,6 +29,8 @@ export default function Player({ session, onExit }: PlayerProps) {
   const { settings, showStats, setShowSidebar } = useSettings();
   const videoRef = useRef<HTMLVideoElement>(null);
   const [started, setStarted] = useState(false);
+  // the video settings the stream was started with or last asked to change to
+  const applied = useRef({ codec: "", fps: 0, res: "", bitrate: 0 });
 
   // --- Hold Escape Logic ---
   const escTimer = useRef<NodeJS.Timeout | null>(null);
@@ -47,17 +49,25 @@ export default function Player({ session, onExit }: PlayerProps) {
       width,
       height,
       bitrate: `${settings.video.bitrate}M`,
+      chroma: settings.video.chroma,
+      // settings saved before the modes existed say "low-latency"
+      latency: (settings.network.qos as string) === "low-latency" ? "ultra-low" : settings.network.qos,
+      // settings saved before "auto" existed have false, which meant the default
+      intraRefresh: settings.network.intraRefresh === "on" || (settings.network.intraRefresh as unknown) === true ? true
+        : settings.network.intraRefresh === "off" ? false : undefined,
       preset: "p1",
       audio: true,
     };
 
-    const server = session.server?.address ? `http://${session.server.address}:8080` : "http://localhost:8080";
+    const server = serverURL(session);
 
     const start = async () => {
       try {
         console.log("▶️ Starting session...");
         await startSession(server, config, console.log, videoRef.current!);
         console.log("✅ Stream started");
+        const { codec, fps, res, bitrate } = settings.video;
+        applied.current = { codec, fps, res, bitrate };
         setStarted(true); // ✅ prevent re-run
       } catch (err) {
         console.error("❌ Failed to start session", err);
@@ -67,6 +77,38 @@ export default function Player({ session, onExit }: PlayerProps) {
     start();
   }, [session, started, settings]);
 
+  // Video settings changed while streaming apply to the running session;
+  // the host swaps encoders without interrupting the picture. Each change
+  // starts a second encoder on the host (see reconfigure), so the debounce
+  // keeps typing in the resolution field from starting one per keystroke.
+  useEffect(() => {
+    if (!started) return;
+    const { codec, fps, res, bitrate } = settings.video;
+    const last = applied.current;
+    const change: StreamChange = {};
+    if (codec !== last.codec) change.codec = codec;
+    if (fps !== last.fps) change.fps = fps;
+    if (bitrate !== last.bitrate) change.bitrate = `${bitrate}M`;
+    if (res !== last.res && /^\d+x\d+$/.test(res)) {
+      const [width, height] = res.split("x").map(Number);
+      if (width > 0 && height > 0) Object.assign(change, { width, height });
+      else change.native = true;
+    }
+    if (Object.keys(change).length === 0) return;
+
+    const t = setTimeout(async () => {
+      try {
+        const state = await reconfigure(serverURL(session), change);
+        console.log("🔁 Stream reconfigured", state);
+      } catch (err) {
+        // the host keeps the old settings; don't ask again until they change
+        console.error("❌ Failed to reconfigure stream", err);
+      }
+      applied.current = { codec, fps, res, bitrate };
+    }, 500);
+    return () => clearTimeout(t);
+  }, [session, started, settings.video]);
+
   useEffect(() => {
     const handleKeyDown = (e: { key: string; }) => {
       if (e.key === "Escape" && !escTimer.current) {
@@ -129,3 +171,7 @@ export default function Player({ session, onExit }: PlayerProps) {
     </div>
   );
 }
+
+function serverURL(session: PlayerProps["session"]) {
+  return session.server?.address ? `http://${session.server.address}:8080` : "http://localhost:8080";
+}
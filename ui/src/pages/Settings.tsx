@@ -80,6 +80,8 @@ export default function Settings() {
                 <option value="av1">AV1</option>
                 <option value="h264">H.264</option>
                 <option value="hevc">HEVC (H.265)</option>
+                <option value="vp9">VP9</option>
+                <option value="vp8">VP8</option>
               </StyledSelect>
             </SettingItem>
             <SettingItem label="Resolution">
@@ -91,6 +93,12 @@ export default function Settings() {
             <SettingItem label="Bitrate (Mbps)">
               <StyledInput type="number" value={settings.video.bitrate} onChange={(e) => updateVideo("bitrate", Number(e.target.value))} />
             </SettingItem>
+            <SettingItem label="Chroma">
+              <StyledSelect value={settings.video.chroma} onChange={(e) => updateVideo("chroma", e.target.value as "420" | "444")}>
+                <option value="420">4:2:0</option>
+                <option value="444">4:4:4 (sharp text)</option>
+              </StyledSelect>
+            </SettingItem>
           </div>
         )}
 
@@ -113,13 +121,20 @@ export default function Settings() {
         {activeCategory === 'network' && (
           <div>
             <h2 className="text-3xl font-bold text-white mb-6">Network Settings</h2>
-            <SettingItem label="LAN QoS Profile">
-              <StyledSelect value={settings.network.qos} onChange={(e) => updateNetwork("qos", e.target.value)}>
-                <option value="low-latency">Low Latency</option>
+            <SettingItem label="Latency Mode">
+              <StyledSelect value={settings.network.qos} onChange={(e) => updateNetwork("qos", e.target.value as "ultra-low" | "balanced" | "quality")}>
+                <option value="ultra-low">Ultra-low Latency</option>
                 <option value="balanced">Balanced</option>
                 <option value="quality">Quality</option>
               </StyledSelect>
             </SettingItem>
+            <SettingItem label="Intra Refresh (no keyframe spikes)">
+              <StyledSelect value={typeof settings.network.intraRefresh === "string" ? settings.network.intraRefresh : "auto"} onChange={(e) => updateNetwork("intraRefresh", e.target.value as "auto" | "on" | "off")}>
+                <option value="auto">Auto (on for ultra-low latency)</option>
+                <option value="on">On</option>
+                <option value="off">Off</option>
+              </StyledSelect>
+            </SettingItem>
           </div>
         )}
       </div>